@@ -0,0 +1,123 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// AccessEntry records a site's private key being decrypted and returned, for
+// key-access auditing, see EnvNameAccessAudit.
+type AccessEntry struct {
+	Domain   string // stored as its key segment, see nameSegment
+	Instance string
+	CA       string
+	Reason   string
+	Created  time.Time
+	Labels   []string
+}
+
+type accessReasonKey struct{}
+
+// WithAccessReason returns a context whose loads of site private keys are
+// recorded with reason by EnvNameAccessAudit, eg `export`. Loads are recorded
+// with AccessReasonLoad if it isn't set.
+func WithAccessReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, accessReasonKey{}, reason)
+}
+
+func accessReason(ctx context.Context) string {
+	if reason, ok := ctx.Value(accessReasonKey{}).(string); ok && reason != "" {
+		return reason
+	}
+	return AccessReasonLoad
+}
+
+// isPrivateKeyKey reports whether key is a site private key CertMagic stores,
+// ie certificates/<issuer>/<domain>/<domain>.key.
+func isPrivateKeyKey(key string) bool {
+	parts := strings.Split(cleanKVKey(key), "/")
+	return len(parts) == 4 && parts[0] == "certificates" && parts[3] == parts[2]+".key"
+}
+
+// recordKeyAccess records the private key of domain being returned, as set by
+// EnvNameAccessAudit. Failing to record it doesn't fail the load, it's only
+// logged.
+func (cds *CloudDsStorage) recordKeyAccess(ctx context.Context, domain string) {
+	if cds.accessAudit == "" {
+		return
+	}
+	e := &AccessEntry{
+		Domain:   cds.nameSegment(domain),
+		Instance: cds.instanceID,
+		CA:       cds.caNamespace,
+		Reason:   accessReason(ctx),
+		Created:  cds.clock.Now(),
+		Labels:   cds.labels,
+	}
+
+	if cds.accessAudit == AccessAuditLog {
+		// a JSON line is a structured entry in Cloud Logging
+		line, err := json.Marshal(map[string]interface{}{
+			"severity": "NOTICE",
+			"message":  "Site private key accessed",
+			"domain":   e.Domain,
+			"instance": e.Instance,
+			"ca":       e.CA,
+			"reason":   e.Reason,
+			"labels":   e.Labels,
+			"time":     e.Created.Format(time.RFC3339Nano),
+		})
+		if err == nil {
+			_, err = cds.accessLog.Write(append(line, '\n'))
+		}
+		if err != nil {
+			log.Printf("[WARNING] Unable to log key access for %v: %v", domain, err)
+		}
+		return
+	}
+
+	k := datastore.IncompleteKey(ACCESS_RECORD, nil)
+	k.Namespace = cds.namespace
+	if _, err := cds.siteClient(domain).Put(ctx, k, e); err != nil {
+		log.Printf("[WARNING] Unable to store key access entry for %v: %v", domain, err)
+	}
+}
+
+// SiteKeyAccesses returns the key access entries stored for domain with
+// AccessAuditDatastore, oldest first.
+func (cds *CloudDsStorage) SiteKeyAccesses(ctx context.Context, domain string) ([]AccessEntry, error) {
+	var entries []AccessEntry
+	for _, segment := range cds.nameSegments(domain) {
+		q := datastore.NewQuery(ACCESS_RECORD).
+			Namespace(cds.namespace).
+			FilterField("Domain", "=", segment).
+			FilterField("CA", "=", cds.caNamespace)
+
+		for it := cds.siteClient(domain).Run(ctx, q); ; {
+			var e AccessEntry
+			_, err := it.Next(&e)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to obtain key access entries for %v: %w", domain, err)
+			}
+			e.Domain = domain
+			entries = append(entries, e)
+		}
+	}
+
+	// sorted here rather than in the query so no composite index is needed
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
@@ -0,0 +1,72 @@
+package tlsclouddatastore
+
+import (
+	"github.com/caddyserver/caddy/caddytls"
+)
+
+// The caddytls.Storage interface has no contexts, these methods adapt it to
+// the context aware methods using the storage's base context and timeout.
+
+// SiteExists checks if a cert for a specific domain already exists
+func (cds *CloudDsStorage) SiteExists(domain string) (bool, error) {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.SiteExistsContext(ctx, domain)
+}
+
+// LoadSite loads the site data for a domain from Cloud Datastore
+func (cds *CloudDsStorage) LoadSite(domain string) (*caddytls.SiteData, error) {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.LoadSiteContext(ctx, domain)
+}
+
+// StoreSite stores the site data for a given domain in Cloud Datastore
+func (cds *CloudDsStorage) StoreSite(domain string, data *caddytls.SiteData) error {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.StoreSiteContext(ctx, domain, data)
+}
+
+// DeleteSite deletes site data for a given domain
+func (cds *CloudDsStorage) DeleteSite(domain string) error {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.DeleteSiteContext(ctx, domain)
+}
+
+// TryLock attempts to set a global lock for a given domain. If a lock is
+// already set it will return a `caddytls.Waiter` that will resolve when the lock is free.
+func (cds *CloudDsStorage) TryLock(domain string) (caddytls.Waiter, error) {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.TryLockContext(ctx, domain)
+}
+
+// Unlock releases an existing lock
+func (cds *CloudDsStorage) Unlock(domain string) error {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.UnlockContext(ctx, domain)
+}
+
+// LoadUser loads user data for a given email address
+func (cds *CloudDsStorage) LoadUser(email string) (*caddytls.UserData, error) {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.LoadUserContext(ctx, email)
+}
+
+// StoreUser stores user data for a given email address in KV store
+func (cds *CloudDsStorage) StoreUser(email string, data *caddytls.UserData) error {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.StoreUserContext(ctx, email, data)
+}
+
+// MostRecentUserEmail returns the last modified Email address from cloud datastore.
+func (cds *CloudDsStorage) MostRecentUserEmail() string {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.MostRecentUserEmailContext(ctx)
+}
@@ -0,0 +1,110 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// maxAnnotations is the most annotations a site can have.
+	maxAnnotations = 64
+
+	// maxAnnotationSize bounds the length of an annotation's key and value.
+	maxAnnotationSize = 1024
+)
+
+// annotationKey is separate from the site's key so annotations outlive the
+// site record being replaced on renewal.
+func (cds *CloudDsStorage) annotationKey(domain string) *datastore.Key {
+	return cds.dsKey(ANNOTATION_RECORD, path.Join("annotations", cds.nameSegment(escapeWildcard(domain))))
+}
+
+// SetSiteAnnotation sets the annotation key of domain to value, or removes it
+// if value is empty. Annotations are small operator-defined metadata, eg the
+// owning team or a ticket reference, kept encrypted alongside the site,
+// whether it's a Caddy v1 site or a CertMagic certificate, and returned by
+// LoadSiteMeta and CertMagicStorage.Sites.
+func (cds *CloudDsStorage) SetSiteAnnotation(ctx context.Context, domain, key, value string) error {
+	if key == "" || len(key) > maxAnnotationSize || len(value) > maxAnnotationSize {
+		return fmt.Errorf("Invalid annotation %q, keys must be set and keys and values at most %d bytes", key, maxAnnotationSize)
+	}
+	k := cds.annotationKey(domain)
+	err := cds.siteClient(domain).RunInTransaction(ctx, func(tx dsTransaction) error {
+		r := new(cdsEncryptedRecord)
+		annotations := make(map[string]string)
+		if err := tx.Get(k, r); err == nil {
+			if annotations, err = cds.decodeAnnotations(domain, r); err != nil {
+				return err
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		if value == "" {
+			delete(annotations, key)
+		} else {
+			annotations[key] = value
+		}
+		if len(annotations) > maxAnnotations {
+			return fmt.Errorf("Too many annotations, at most %d", maxAnnotations)
+		}
+		if len(annotations) == 0 {
+			return tx.Delete(k)
+		}
+
+		r = new(cdsEncryptedRecord)
+		var err error
+		if r.Value, err = cds.toBytes(annotations); err != nil {
+			return err
+		}
+		cds.stamp(r)
+		cds.sign(r, ANNOTATION_RECORD, domain, nil)
+		_, err = tx.Put(k, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to store annotation %v of %v: %w", key, domain, err)
+	}
+	return nil
+}
+
+// GetSiteAnnotation returns the annotation key of domain, the error is
+// ErrNotExist if it isn't set.
+func (cds *CloudDsStorage) GetSiteAnnotation(ctx context.Context, domain, key string) (string, error) {
+	annotations, err := cds.SiteAnnotations(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	value, ok := annotations[key]
+	if !ok {
+		return "", fmt.Errorf("Unable to obtain annotation %v of %v: %w", key, domain, ErrNotExist)
+	}
+	return value, nil
+}
+
+// SiteAnnotations returns all the annotations of domain, none if it has none.
+func (cds *CloudDsStorage) SiteAnnotations(ctx context.Context, domain string) (map[string]string, error) {
+	r := new(cdsEncryptedRecord)
+	err := cds.siteClient(domain).Get(ctx, cds.annotationKey(domain), r)
+	if err == datastore.ErrNoSuchEntity {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to obtain annotations of %v: %w", domain, err)
+	}
+	return cds.decodeAnnotations(domain, r)
+}
+
+func (cds *CloudDsStorage) decodeAnnotations(domain string, r *cdsEncryptedRecord) (map[string]string, error) {
+	if err := cds.verify(r, ANNOTATION_RECORD, domain, nil); err != nil {
+		return nil, err
+	}
+	annotations := make(map[string]string)
+	if err := cds.fromBytes(r.Value, &annotations); err != nil {
+		return nil, fmt.Errorf("Unable to decode annotations of %v: %w", domain, err)
+	}
+	return annotations, nil
+}
@@ -0,0 +1,137 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/caddyserver/caddy/caddytls"
+	"google.golang.org/api/iterator"
+)
+
+// AuditEntry records a single StoreSite, so operators can reconstruct which
+// instance renewed a certificate and when.
+type AuditEntry struct {
+	Domain   string // stored as its key segment, see nameSegment
+	Instance string
+	CA       string
+	// PreviousNotAfter is the expiry of the certificate that was replaced,
+	// zero if there wasn't one or it couldn't be parsed.
+	PreviousNotAfter time.Time
+	NotAfter         time.Time
+	Created          time.Time
+	Labels           []string
+}
+
+// DefaultSiteAuditHistory is how many audit entries are kept per site by
+// default, see EnvNameSiteAuditHistory.
+const DefaultSiteAuditHistory = 100
+
+// recordStoreSite adds an audit entry for data being stored for domain,
+// replacing prev (nil if there wasn't a site), and deletes the oldest beyond
+// the site's history. Failing to write the audit entry doesn't fail storing
+// the site, it's only logged.
+func (cds *CloudDsStorage) recordStoreSite(ctx context.Context, domain string, prev *cdsEncryptedRecordWithLock, data *caddytls.SiteData) {
+	if cds.auditHistory == 0 {
+		return
+	}
+	client := cds.siteClient(domain)
+	e := cds.auditEntry(domain, cds.previousNotAfter(prev), data)
+	if _, err := client.Put(ctx, cds.auditKey(e), e); err != nil {
+		log.Printf("[WARNING] Unable to store audit entry for %v: %v", domain, err)
+		return
+	}
+
+	// listing keys works on every backend, unlike queries
+	keys, err := cds.namesUnder(ctx, client, AUDIT_RECORD, path.Join("audit", e.Domain))
+	if err == nil && len(keys) > cds.auditHistory {
+		// oldest first
+		err = deleteMulti(ctx, client, keys[:len(keys)-cds.auditHistory])
+	}
+	if err != nil {
+		log.Printf("[WARNING] Unable to delete old audit entries for %v: %v", domain, err)
+	}
+}
+
+// previousNotAfter returns the expiry of the certificate of prev, zero if
+// there wasn't one or it can't be read.
+func (cds *CloudDsStorage) previousNotAfter(prev *cdsEncryptedRecordWithLock) time.Time {
+	if prev == nil {
+		return time.Time{}
+	}
+	if !prev.NotAfter.IsZero() {
+		// stored in plaintext with EnvNameFieldEncryption
+		return prev.NotAfter
+	}
+	data, err := cds.decodeSite(prev)
+	if err != nil {
+		return time.Time{}
+	}
+	cert, err := leafCertificate(data.Cert)
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter
+}
+
+// auditKey returns a new key for the audit entry e. Names sort by when the
+// entry was created, so the oldest of a site are listed first.
+func (cds *CloudDsStorage) auditKey(e *AuditEntry) *datastore.Key {
+	b := make([]byte, 4)
+	rand.Read(b) // only tells apart entries created at the same instant
+	return cds.dsKey(AUDIT_RECORD, path.Join("audit", e.Domain, fmt.Sprintf("%020d-%s", e.Created.UnixNano(), hex.EncodeToString(b))))
+}
+
+// auditEntry returns the audit entry of data being stored for domain,
+// replacing a certificate expiring at prevNotAfter.
+func (cds *CloudDsStorage) auditEntry(domain string, prevNotAfter time.Time, data *caddytls.SiteData) *AuditEntry {
+	e := &AuditEntry{
+		Domain:           cds.nameSegment(domain),
+		Instance:         cds.instanceID,
+		CA:               cds.caNamespace,
+		PreviousNotAfter: prevNotAfter,
+		Created:          cds.clock.Now(),
+		Labels:           cds.labels,
+	}
+	if cert, err := leafCertificate(data.Cert); err == nil {
+		e.NotAfter = cert.NotAfter
+	}
+	return e
+}
+
+// SiteAudit returns the audit entries for domain, oldest first.
+func (cds *CloudDsStorage) SiteAudit(ctx context.Context, domain string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	for _, segment := range cds.nameSegments(domain) {
+		q := datastore.NewQuery(AUDIT_RECORD).
+			Namespace(cds.namespace).
+			FilterField("Domain", "=", segment).
+			FilterField("CA", "=", cds.caNamespace)
+
+		for it := cds.siteClient(domain).Run(ctx, q); ; {
+			var e AuditEntry
+			_, err := it.Next(&e)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to obtain audit entries for %v: %w", domain, err)
+			}
+			// hashed or encrypted with EnvNameHashKey or EnvNameNameKey
+			e.Domain = domain
+			entries = append(entries, e)
+		}
+	}
+
+	// sorted here rather than in the query so no composite index is needed
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
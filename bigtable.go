@@ -0,0 +1,52 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/kv"
+)
+
+// DefaultBigtableTable is the Cloud Bigtable table records are stored in.
+const DefaultBigtableTable = "caddytls"
+
+// NewBigtableStorage returns a storage for caURL keeping records in the Cloud
+// Bigtable instance cfg.BigtableInstance of cfg.ProjectID rather than Cloud
+// Datastore, for millions of domains or read rates Datastore doesn't serve
+// comfortably. Bigtable only has single row transactions, so transactions
+// are optimistic and retried on conflicts, see kvClient.
+func NewBigtableStorage(caURL *url.URL, cfg *Config) (*CloudDsStorage, error) {
+	if cfg.ProjectID == "" {
+		return nil, fmt.Errorf("Unable read project id from env var: %s", EnvNameProjectId)
+	}
+	if cfg.BigtableInstance == "" {
+		return nil, fmt.Errorf("Unable read Bigtable instance from env var: %s", EnvNameBigtableInstance)
+	}
+	if err := checkKVConfig(cfg, "Cloud Bigtable"); err != nil {
+		return nil, err
+	}
+
+	o, err := backendClientOptions(cfg, "BIGTABLE_EMULATOR_HOST")
+	if err != nil {
+		return nil, err
+	}
+	client, err := bigtable.NewClient(context.Background(), cfg.ProjectID, cfg.BigtableInstance, o...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create Cloud Bigtable client: %w", err)
+	}
+	table := cfg.BigtableTable
+	if table == "" {
+		table = DefaultBigtableTable
+	}
+
+	cs, err := newCloudDsStorage(caURL, cfg, newKVClient(kv.NewBigtable(client, table)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.start(cfg, "Cloud Bigtable "+cfg.BigtableInstance+"/"+table); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
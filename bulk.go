@@ -0,0 +1,136 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/caddyserver/caddy/caddytls"
+)
+
+const (
+	// maxPutBatch is the most entities a single PutMulti call can write.
+	maxPutBatch = 500
+
+	// maxPutBatchBytes bounds the size of the records in a PutMulti call,
+	// well under the 10 MiB a single commit can carry.
+	maxPutBatchBytes = 4 << 20
+)
+
+// siteBatch is the site records waiting to be written to one project.
+type siteBatch struct {
+	client  dsClient
+	keys    []*datastore.Key
+	records []*cdsEncryptedRecordWithLock
+	audit   []*AuditEntry
+	size    int
+}
+
+// StoreSites stores many sites at once, keyed by domain, encoded like
+// StoreSite but written with PutMulti in batches of up to 500, eg to import
+// or migrate hundreds of certificates per RPC. Unlike StoreSite it doesn't
+// check for locks held by other instances, and the audit entries don't have
+// the expiry of the certificates replaced and aren't trimmed to the site's
+// history until it's next stored with StoreSite. If it fails, the batches before
+// the failure are stored; storing the same sites again is safe.
+func (cds *CloudDsStorage) StoreSites(ctx context.Context, sites map[string]*caddytls.SiteData) error {
+	domains := make([]string, 0, len(sites))
+	for domain := range sites {
+		// all checked before the first batch is stored
+		if err := validDomain(domain); err != nil {
+			return err
+		}
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	// a batch per project, with project routes
+	batches := make(map[dsClient]*siteBatch)
+	for _, domain := range domains {
+		data := sites[domain]
+		r := new(cdsEncryptedRecordWithLock)
+		if err := cds.encodeSite(r, data); err != nil {
+			return fmt.Errorf("Unable to encode site data for %v: %w", domain, err)
+		}
+		cds.sign(&r.cdsEncryptedRecord, SITE_RECORD, domain, r.Cert)
+		cds.stamp(&r.cdsEncryptedRecord)
+		if err := cds.stampName(&r.cdsEncryptedRecord, domain); err != nil {
+			return fmt.Errorf("Unable to encode site data for %v: %w", domain, err)
+		}
+
+		client := cds.siteClient(domain)
+		b := batches[client]
+		if b == nil {
+			b = &siteBatch{client: client}
+			batches[client] = b
+		}
+		size := len(r.Value) + len(r.Cert) + len(r.KeyName) + len(r.Sig)
+		if len(b.keys) == maxPutBatch || (len(b.keys) > 0 && b.size+size > maxPutBatchBytes) {
+			if err := cds.putSites(ctx, b); err != nil {
+				return err
+			}
+		}
+		b.keys = append(b.keys, cds.siteKey(domain))
+		b.records = append(b.records, r)
+		if cds.auditHistory > 0 {
+			b.audit = append(b.audit, cds.auditEntry(domain, time.Time{}, data))
+		}
+		b.size += size
+	}
+
+	for _, client := range cds.clients() {
+		if b := batches[client]; b != nil && len(b.keys) > 0 {
+			if err := cds.putSites(ctx, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putSites writes the records of b and their audit entries, emptying it.
+func (cds *CloudDsStorage) putSites(ctx context.Context, b *siteBatch) error {
+	if _, err := b.client.PutMulti(ctx, b.keys, b.records); err != nil {
+		return fmt.Errorf("Unable to store site data for %d sites from %v: %w", len(b.keys), b.keys[0].Name, err)
+	}
+
+	if len(b.audit) > 0 {
+		keys := make([]*datastore.Key, len(b.audit))
+		for i, e := range b.audit {
+			keys[i] = cds.auditKey(e)
+		}
+		if _, err := b.client.PutMulti(ctx, keys, b.audit); err != nil {
+			log.Printf("[WARNING] Unable to store audit entries for %d sites: %v", len(keys), err)
+		}
+	}
+
+	b.keys, b.records, b.audit, b.size = b.keys[:0], b.records[:0], b.audit[:0], 0
+	return nil
+}
+
+// DeleteSites deletes many sites at once, with their locks, like
+// DeleteSite but with as few DeleteMulti calls as possible, eg for cleanup
+// tooling. Domains without a site are skipped rather than an error, so
+// deleting the same sites again is safe.
+func (cds *CloudDsStorage) DeleteSites(ctx context.Context, domains []string) error {
+	for _, domain := range domains {
+		if err := validDomain(domain); err != nil {
+			return err
+		}
+	}
+	keys := make(map[dsClient][]*datastore.Key)
+	for _, domain := range domains {
+		client := cds.siteClient(domain)
+		keys[client] = append(keys[client], cds.siteKeys(domain)...)
+		keys[client] = append(keys[client], cds.siteLockKey(domain))
+	}
+	for _, client := range cds.clients() {
+		if err := deleteMulti(ctx, client, keys[client]); err != nil {
+			return fmt.Errorf("Unable to delete site data for %d sites: %w", len(domains), err)
+		}
+	}
+	return nil
+}
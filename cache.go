@@ -0,0 +1,213 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultCacheTTL is how long a record stays in the Redis cache, which
+// bounds how stale a read can be if an invalidation is lost or races a read.
+const DefaultCacheTTL = 5 * time.Minute
+
+// cachedKinds are the kinds the cache holds, the ones loaded on handshakes:
+// Caddy v1 sites and CertMagic certificates, keys and metadata.
+var cachedKinds = map[string]bool{
+	SITE_RECORD: true,
+	KV_RECORD:   true,
+}
+
+// recordCache stores encoded records by key with a time to live.
+type recordCache interface {
+	// Get returns the value of key, false if it isn't cached
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	Close() error
+}
+
+// redisCache is a recordCache on Redis, eg Memorystore.
+type redisCache struct {
+	client *redis.Client
+}
+
+// newRedisCache connects to the Redis server of rawURL, eg
+// `rediss://:password@10.0.0.3:6378/0`.
+func newRedisCache(rawURL string) (*redisCache, error) {
+	o, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse Redis URL from %s: %w", EnvNameRedisURL, err)
+	}
+	return &redisCache{client: redis.NewClient(o)}, nil
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *redisCache) Delete(ctx context.Context, keys ...string) error {
+	return c.client.Del(ctx, keys...).Err()
+}
+
+func (c *redisCache) Close() error {
+	return c.client.Close()
+}
+
+// cachingClient is a dsClient reading cachedKinds through a recordCache.
+// Records are cached as stored, so encrypted, and every write of a record,
+// by any instance sharing the cache, removes it from the cache. Errors of
+// the cache are logged and the record read from the client instead.
+type cachingClient struct {
+	dsClient
+	cache  recordCache
+	ttl    time.Duration
+	prefix string // keeps projects sharing a cache apart
+}
+
+func newCachingClient(client dsClient, cache recordCache, ttl time.Duration, project string) *cachingClient {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &cachingClient{dsClient: client, cache: cache, ttl: ttl, prefix: "caddytls:" + project + ":"}
+}
+
+func (c *cachingClient) cacheKey(key *datastore.Key) string {
+	return c.prefix + kvKeyOf(key)
+}
+
+func (c *cachingClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if !cachedKinds[key.Kind] {
+		return c.dsClient.Get(ctx, key, dst)
+	}
+	k := c.cacheKey(key)
+	value, ok, err := c.cache.Get(ctx, k)
+	if err != nil {
+		log.Printf("[WARNING] Unable to read %v from cache: %v", key.Name, err)
+	}
+	if ok {
+		if err := decodeEntity(value, dst); err == nil {
+			return nil
+		}
+		// written by an incompatible version, read it again
+	}
+
+	if err := c.dsClient.Get(ctx, key, dst); err != nil {
+		return err
+	}
+	if value, err = encodeEntity(dst); err == nil {
+		err = c.cache.Set(ctx, k, value, c.ttl)
+	}
+	if err != nil {
+		log.Printf("[WARNING] Unable to cache %v: %v", key.Name, err)
+	}
+	return nil
+}
+
+// invalidate removes keys from the cache.
+func (c *cachingClient) invalidate(ctx context.Context, keys ...*datastore.Key) {
+	var cached []string
+	for _, k := range keys {
+		if k != nil && cachedKinds[k.Kind] {
+			cached = append(cached, c.cacheKey(k))
+		}
+	}
+	if len(cached) == 0 {
+		return
+	}
+	if err := c.cache.Delete(ctx, cached...); err != nil {
+		log.Printf("[WARNING] Unable to remove %d records from cache: %v", len(cached), err)
+	}
+}
+
+// Put invalidates key both before and after writing, which narrows the
+// window but doesn't close it: a read that got the previous record from the
+// client before the write, and fills the cache after the second
+// invalidation, leaves the previous record cached until the TTL runs out,
+// DefaultCacheTTL unless configured. The other writes are the same.
+func (c *cachingClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	c.invalidate(ctx, key)
+	defer c.invalidate(ctx, key)
+	return c.dsClient.Put(ctx, key, src)
+}
+
+func (c *cachingClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	c.invalidate(ctx, keys...)
+	defer c.invalidate(ctx, keys...)
+	return c.dsClient.PutMulti(ctx, keys, src)
+}
+
+func (c *cachingClient) Delete(ctx context.Context, key *datastore.Key) error {
+	c.invalidate(ctx, key)
+	defer c.invalidate(ctx, key)
+	return c.dsClient.Delete(ctx, key)
+}
+
+func (c *cachingClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	c.invalidate(ctx, keys...)
+	defer c.invalidate(ctx, keys...)
+	return c.dsClient.DeleteMulti(ctx, keys)
+}
+
+// RunInTransaction reads from the client, and invalidates the records the
+// transaction wrote once it's done, committed or not.
+func (c *cachingClient) RunInTransaction(ctx context.Context, f func(tx dsTransaction) error) error {
+	tx := &cachingTransaction{}
+	defer func() { c.invalidate(ctx, tx.written()...) }()
+	return c.dsClient.RunInTransaction(ctx, func(t dsTransaction) error {
+		tx.dsTransaction = t
+		return f(tx)
+	})
+}
+
+func (c *cachingClient) Close() error {
+	if err := c.cache.Close(); err != nil {
+		log.Printf("[WARNING] Unable to close cache: %v", err)
+	}
+	return c.dsClient.Close()
+}
+
+// cachingTransaction records the keys a transaction writes, over every
+// attempt if it's retried.
+type cachingTransaction struct {
+	dsTransaction
+	mu   sync.Mutex
+	keys []*datastore.Key
+}
+
+func (tx *cachingTransaction) write(key *datastore.Key) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.keys = append(tx.keys, key)
+}
+
+func (tx *cachingTransaction) written() []*datastore.Key {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.keys
+}
+
+func (tx *cachingTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	tx.write(key)
+	return tx.dsTransaction.Put(key, src)
+}
+
+func (tx *cachingTransaction) Delete(key *datastore.Key) error {
+	tx.write(key)
+	return tx.dsTransaction.Delete(key)
+}
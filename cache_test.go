@@ -0,0 +1,92 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddytls"
+)
+
+// mapCache is a recordCache in a map, ignoring the TTL.
+type mapCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (c *mapCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	return value, ok, nil
+}
+
+func (c *mapCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func (c *mapCache) Delete(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		delete(c.values, k)
+	}
+	return nil
+}
+
+func (c *mapCache) Close() error {
+	return nil
+}
+
+func TestMemCache(t *testing.T) {
+	client, cache := newMemClient(), &mapCache{values: make(map[string][]byte)}
+	a, b := newMemStorageOn(t, client, "a"), newMemStorageOn(t, client, "b")
+	for _, cds := range []*CloudDsStorage{a, b} {
+		cds.cloudDsClient = cds.ops.wrap(newCachingClient(client, cache, 0, "project"))
+	}
+	ctx := context.Background()
+	siteReads := func() int64 {
+		var n int64
+		for _, o := range a.OpStatsByKind()[SITE_RECORD] {
+			n += o.Reads
+		}
+		return n
+	}
+
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte("meta")}
+	if err := b.StoreSiteContext(ctx, "example.com", site); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if _, err := a.LoadSiteContext(ctx, "example.com"); err != nil {
+		t.Fatalf("Error loading site: %v", err)
+	}
+	reads := siteReads()
+	loaded, err := a.LoadSiteContext(ctx, "example.com")
+	if err != nil || !reflect.DeepEqual(loaded, site) {
+		t.Fatalf("Expected %+v from the cache, got %+v, %v", site, loaded, err)
+	}
+	if n := siteReads(); n != reads {
+		t.Errorf("Expected the second load to hit the cache, got %d reads after %d", n, reads)
+	}
+
+	renewed := &caddytls.SiteData{Cert: []byte("cert2"), Key: []byte("key2"), Meta: []byte("meta2")}
+	if err := b.StoreSiteContext(ctx, "example.com", renewed); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if loaded, err := a.LoadSiteContext(ctx, "example.com"); err != nil || !reflect.DeepEqual(loaded, renewed) {
+		t.Errorf("Expected the write of another instance to invalidate the cache, got %+v, %v", loaded, err)
+	}
+
+	if err := b.DeleteSiteContext(ctx, "example.com"); err != nil {
+		t.Fatalf("Error deleting site: %v", err)
+	}
+	if _, err := a.LoadSiteContext(ctx, "example.com"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected ErrNotExist after deleting, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package caddyv2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+
+	tlsclouddatastore "github.com/j0hnsmith/caddy-tlsclouddatastore"
+)
+
+func init() {
+	caddy.RegisterModule(new(AdminAPI))
+}
+
+// AdminAPI adds `/storage/cloud-datastore/sites` to Caddy's admin API, listing
+// the stored certificates with their expiry and lock status,
+// `/storage/cloud-datastore/health`, `/storage/cloud-datastore/security`,
+// `/storage/cloud-datastore/ops` and `/storage/cloud-datastore/pause`. It
+// requires cloud_datastore to be the configured storage.
+type AdminAPI struct {
+	ctx caddy.Context
+}
+
+// CaddyModule returns the Caddy module information.
+func (*AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.cloud_datastore",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Provision keeps the context the configured storage is obtained from.
+func (a *AdminAPI) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	return nil
+}
+
+// Routes returns the admin routes.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/storage/cloud-datastore/sites",
+			Handler: caddy.AdminHandlerFunc(a.handleSites),
+		},
+		{
+			Pattern: "/storage/cloud-datastore/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/storage/cloud-datastore/security",
+			Handler: caddy.AdminHandlerFunc(a.handleSecurity),
+		},
+		{
+			Pattern: "/storage/cloud-datastore/ops",
+			Handler: caddy.AdminHandlerFunc(a.handleOps),
+		},
+		{
+			Pattern: "/storage/cloud-datastore/pause",
+			Handler: caddy.AdminHandlerFunc(a.handlePause),
+		},
+	}
+}
+
+func (a *AdminAPI) handleSites(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	storage, err := a.storage()
+	if err != nil {
+		return err
+	}
+
+	sites, err := storage.Sites(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	if sites == nil {
+		sites = []tlsclouddatastore.SiteInfo{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(sites)
+}
+
+func (a *AdminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	storage, err := a.storage()
+	if err != nil {
+		return err
+	}
+	storage.CloudDsStorage().HealthHandler().ServeHTTP(w, r)
+	return nil
+}
+
+func (a *AdminAPI) handleSecurity(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	storage, err := a.storage()
+	if err != nil {
+		return err
+	}
+
+	findings, err := storage.CloudDsStorage().SecurityAudit(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	if findings == nil {
+		findings = []tlsclouddatastore.SecurityFinding{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(findings)
+}
+
+func (a *AdminAPI) handleOps(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	storage, err := a.storage()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(storage.CloudDsStorage().OpStats())
+}
+
+// handlePause returns the pause of issuance on GET, null if it isn't paused,
+// pauses it on POST with the JSON body `{"reason": "..."}` and resumes it on
+// DELETE.
+func (a *AdminAPI) handlePause(w http.ResponseWriter, r *http.Request) error {
+	storage, err := a.storage()
+	if err != nil {
+		return err
+	}
+	cds := storage.CloudDsStorage()
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := cds.PauseState(r.Context())
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        err,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(state)
+	case http.MethodPost:
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %v", err),
+			}
+		}
+		err = cds.Pause(r.Context(), body.Reason)
+	case http.MethodDelete:
+		err = cds.Resume(r.Context())
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// contextStorage returns the storage configured in ctx. A variable so tests
+// can replace it, a context only has a storage once a config is loaded.
+var contextStorage = func(ctx caddy.Context) certmagic.Storage {
+	return ctx.Storage()
+}
+
+// storage returns the configured storage, if it's cloud_datastore.
+func (a *AdminAPI) storage() (*tlsclouddatastore.CertMagicStorage, error) {
+	storage, ok := contextStorage(a.ctx).(*tlsclouddatastore.CertMagicStorage)
+	if !ok {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("storage is not cloud_datastore"),
+		}
+	}
+	return storage, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner = (*AdminAPI)(nil)
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
@@ -0,0 +1,169 @@
+package caddyv2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+
+	tlsclouddatastore "github.com/j0hnsmith/caddy-tlsclouddatastore"
+)
+
+// newTestAdmin returns an AdminAPI whose context has storage configured.
+func newTestAdmin(t *testing.T, storage certmagic.Storage) *AdminAPI {
+	prev := contextStorage
+	contextStorage = func(caddy.Context) certmagic.Storage { return storage }
+	t.Cleanup(func() { contextStorage = prev })
+	return new(AdminAPI)
+}
+
+// newMemoryAdmin returns an AdminAPI with a storage keeping records in memory.
+func newMemoryAdmin(t *testing.T) (*AdminAPI, *tlsclouddatastore.CertMagicStorage) {
+	storage, err := tlsclouddatastore.NewMemoryCertMagicStorage(nil)
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	t.Cleanup(func() { storage.CloudDsStorage().Close() })
+	return newTestAdmin(t, storage), storage
+}
+
+// serveAdmin serves a request to the route of path, returning the response
+// and the status of the error returned, if any.
+func serveAdmin(t *testing.T, a *AdminAPI, method, path, body string) (*httptest.ResponseRecorder, int) {
+	t.Helper()
+	for _, route := range a.Routes() {
+		if route.Pattern != path {
+			continue
+		}
+		w := httptest.NewRecorder()
+		err := route.Handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if err == nil {
+			return w, 0
+		}
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("Expected an APIError from %s %s, got %v", method, path, err)
+		}
+		return w, apiErr.HTTPStatus
+	}
+	t.Fatalf("No admin route %s", path)
+	return nil, 0
+}
+
+func TestAdminNotCloudDatastore(t *testing.T) {
+	a := newTestAdmin(t, &certmagic.FileStorage{Path: t.TempDir()})
+
+	for _, route := range a.Routes() {
+		if _, status := serveAdmin(t, a, "GET", route.Pattern, ""); status != http.StatusNotFound {
+			t.Errorf("Expected status 404 from %s with another storage, got %d", route.Pattern, status)
+		}
+	}
+}
+
+func TestAdminSites(t *testing.T) {
+	a, storage := newMemoryAdmin(t)
+
+	w, status := serveAdmin(t, a, "GET", "/storage/cloud-datastore/sites", "")
+	if status != 0 || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("Expected an empty list, got %d %s", status, w.Body.String())
+	}
+
+	key := "certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt"
+	if err := storage.Store(context.Background(), key, []byte("cert")); err != nil {
+		t.Fatalf("Error storing certificate: %v", err)
+	}
+	w, status = serveAdmin(t, a, "GET", "/storage/cloud-datastore/sites", "")
+	if status != 0 {
+		t.Fatalf("Expected the sites listed, got status %d", status)
+	}
+	var sites []tlsclouddatastore.SiteInfo
+	if err := json.NewDecoder(w.Body).Decode(&sites); err != nil {
+		t.Fatalf("Error decoding sites: %v", err)
+	}
+	if len(sites) != 1 || sites[0].Domain != "example.com" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected example.com listed, got %+v", sites)
+	}
+
+	if _, status := serveAdmin(t, a, "POST", "/storage/cloud-datastore/sites", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", status)
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	a, _ := newMemoryAdmin(t)
+
+	w, status := serveAdmin(t, a, "GET", "/storage/cloud-datastore/health", "")
+	if status != 0 || w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d %d", status, w.Code)
+	}
+}
+
+func TestAdminSecurity(t *testing.T) {
+	a, _ := newMemoryAdmin(t)
+
+	// the audit's record scan queries, which memory storages don't support
+	if _, status := serveAdmin(t, a, "GET", "/storage/cloud-datastore/security", ""); status != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 when the audit fails, got %d", status)
+	}
+	if _, status := serveAdmin(t, a, "DELETE", "/storage/cloud-datastore/security", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", status)
+	}
+}
+
+func TestAdminOps(t *testing.T) {
+	a, _ := newMemoryAdmin(t)
+
+	w, status := serveAdmin(t, a, "GET", "/storage/cloud-datastore/ops", "")
+	if status != 0 {
+		t.Fatalf("Expected the operation stats, got status %d", status)
+	}
+	var days []tlsclouddatastore.DayOps
+	if err := json.NewDecoder(w.Body).Decode(&days); err != nil {
+		t.Fatalf("Error decoding operation stats: %v", err)
+	}
+
+	if _, status := serveAdmin(t, a, "POST", "/storage/cloud-datastore/ops", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", status)
+	}
+}
+
+func TestAdminPause(t *testing.T) {
+	a, _ := newMemoryAdmin(t)
+	path := "/storage/cloud-datastore/pause"
+
+	w, status := serveAdmin(t, a, "GET", path, "")
+	if status != 0 || strings.TrimSpace(w.Body.String()) != "null" {
+		t.Fatalf("Expected null while not paused, got %d %s", status, w.Body.String())
+	}
+
+	if _, status := serveAdmin(t, a, "POST", path, "{"); status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid body, got %d", status)
+	}
+	w, status = serveAdmin(t, a, "POST", path, `{"reason": "CA outage"}`)
+	if status != 0 || w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204 pausing, got %d %d", status, w.Code)
+	}
+	w, _ = serveAdmin(t, a, "GET", path, "")
+	var state tlsclouddatastore.PauseState
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil || state.Reason != "CA outage" {
+		t.Fatalf("Expected the pause returned, got %+v: %v", state, err)
+	}
+
+	w, status = serveAdmin(t, a, "DELETE", path, "")
+	if status != 0 || w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204 resuming, got %d %d", status, w.Code)
+	}
+	if w, _ := serveAdmin(t, a, "GET", path, ""); strings.TrimSpace(w.Body.String()) != "null" {
+		t.Errorf("Expected null once resumed, got %s", w.Body.String())
+	}
+
+	if _, status := serveAdmin(t, a, "PUT", path, ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", status)
+	}
+}
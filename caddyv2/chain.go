@@ -0,0 +1,116 @@
+package caddyv2
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+
+	tlsclouddatastore "github.com/j0hnsmith/caddy-tlsclouddatastore"
+)
+
+func init() {
+	caddy.RegisterModule(new(ChainStorage))
+}
+
+// ChainStorage chains two storage modules, eg cloud_datastore and the storage
+// being migrated from. Reads try the primary first and fall back to the
+// secondary, writes go to both, locks are only taken in the primary.
+type ChainStorage struct {
+	PrimaryRaw   json.RawMessage `json:"primary,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	SecondaryRaw json.RawMessage `json:"secondary,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	primary   caddy.StorageConverter
+	secondary caddy.StorageConverter
+}
+
+// CaddyModule returns the Caddy module information.
+func (*ChainStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.cloud_datastore_chain",
+		New: func() caddy.Module { return new(ChainStorage) },
+	}
+}
+
+// Provision loads the chained storage modules.
+func (s *ChainStorage) Provision(ctx caddy.Context) error {
+	if s.PrimaryRaw == nil || s.SecondaryRaw == nil {
+		return fmt.Errorf("cloud_datastore_chain storage requires primary and secondary storage")
+	}
+
+	val, err := ctx.LoadModule(s, "PrimaryRaw")
+	if err != nil {
+		return fmt.Errorf("loading primary storage module: %v", err)
+	}
+	s.primary = val.(caddy.StorageConverter)
+
+	val, err = ctx.LoadModule(s, "SecondaryRaw")
+	if err != nil {
+		return fmt.Errorf("loading secondary storage module: %v", err)
+	}
+	s.secondary = val.(caddy.StorageConverter)
+	return nil
+}
+
+// CertMagicStorage returns the chained storage.
+func (s *ChainStorage) CertMagicStorage() (certmagic.Storage, error) {
+	primary, err := s.primary.CertMagicStorage()
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := s.secondary.CertMagicStorage()
+	if err != nil {
+		return nil, err
+	}
+	return tlsclouddatastore.NewChainStorage(primary, secondary), nil
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens. Syntax:
+//
+//	storage cloud_datastore_chain {
+//	    primary   <storage module> [<args...>] { ... }
+//	    secondary <storage module> [<args...>] { ... }
+//	}
+func (s *ChainStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for d.NextBlock(0) {
+			which := d.Val()
+			if which != "primary" && which != "secondary" {
+				return d.Errf("unrecognized subdirective %q", which)
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			modID := "caddy.storage." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return err
+			}
+			if _, ok := unm.(caddy.StorageConverter); !ok {
+				return d.Errf("module %s is not a caddy.StorageConverter", modID)
+			}
+			raw := caddyconfig.JSONModuleObject(unm, "module", name, nil)
+			if which == "primary" {
+				s.PrimaryRaw = raw
+			} else {
+				s.SecondaryRaw = raw
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*ChainStorage)(nil)
+	_ caddy.StorageConverter = (*ChainStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*ChainStorage)(nil)
+)
@@ -0,0 +1,11 @@
+package caddyv2
+
+import (
+	tlsclouddatastore "github.com/j0hnsmith/caddy-tlsclouddatastore"
+)
+
+// ProvisionedConfig returns the config Provision built, for the tests of
+// package caddyv2_test.
+func (s *CaddyStorage) ProvisionedConfig() *tlsclouddatastore.Config {
+	return s.cfg
+}
@@ -0,0 +1,768 @@
+// Package caddyv2 registers the Cloud Datastore storage as the Caddy v2 module
+// `caddy.storage.cloud_datastore`.
+package caddyv2
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/certmagic"
+
+	tlsclouddatastore "github.com/j0hnsmith/caddy-tlsclouddatastore"
+)
+
+func init() {
+	caddy.RegisterModule(new(CaddyStorage))
+}
+
+// ProjectRoute keeps site records for domains matching Pattern in another GCP project.
+type ProjectRoute struct {
+	Pattern  string `json:"pattern"`
+	Project  string `json:"project"`
+	Database string `json:"database,omitempty"`
+}
+
+// SigningKey is an HMAC key records are signed with, identified by ID.
+type SigningKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// CaddyStorage configures the storage. Env vars are read first so fields only
+// need setting to override them.
+type CaddyStorage struct {
+	Profile            string            `json:"profile,omitempty"`
+	ProjectID          string            `json:"project_id,omitempty"`
+	ServiceAccountFile string            `json:"service_account_file,omitempty"`
+	AESKey             string            `json:"aes_key,omitempty"`
+	UserAESKey         string            `json:"user_aes_key,omitempty"`
+	AllowPlaintext     bool              `json:"i_understand_plaintext_storage,omitempty"`
+	HashKey            string            `json:"hash_key,omitempty"`
+	NameKey            string            `json:"name_key,omitempty"`
+	Prefix             string            `json:"prefix,omitempty"`
+	Timeout            caddy.Duration    `json:"timeout,omitempty"`
+	LockSkew           caddy.Duration    `json:"lock_skew,omitempty"`
+	DriftThreshold     string            `json:"drift_threshold,omitempty"`
+	DriftWidenSkew     bool              `json:"drift_widen_skew,omitempty"`
+	ExpiryMonitor      caddy.Duration    `json:"expiry_monitor,omitempty"`
+	IntegrityScan      caddy.Duration    `json:"integrity_scan,omitempty"`
+	RenewalWebhook     string            `json:"renewal_webhook,omitempty"`
+	RenewalFailures    int               `json:"renewal_failures,omitempty"`
+	RenewalJitter      caddy.Duration    `json:"renewal_jitter,omitempty"`
+	IssuanceRate       string            `json:"issuance_rate,omitempty"`
+	DomainIssuanceRate string            `json:"domain_issuance_rate,omitempty"`
+	NotifyWebhook      string            `json:"notify_webhook,omitempty"`
+	NotifySlack        string            `json:"notify_slack,omitempty"`
+	NotifyEvents       []string          `json:"notify_events,omitempty"`
+	ProjectRoutes      []ProjectRoute    `json:"project_routes,omitempty"`
+	AllowedProjects    []string          `json:"allowed_projects,omitempty"`
+	KMSKey             string            `json:"kms_key,omitempty"`
+	SigningKeys        []SigningKey      `json:"signing_keys,omitempty"`
+	AcceptUnsigned     bool              `json:"accept_unsigned,omitempty"`
+	Shards             int               `json:"shards,omitempty"`
+	NamespacePerCA     *bool             `json:"namespace_per_ca,omitempty"`
+	FieldEncryption    bool              `json:"field_encryption,omitempty"`
+	Namespace          string            `json:"namespace,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	InstanceID         string            `json:"instance_id,omitempty"`
+	UserAgent          string            `json:"user_agent,omitempty"`
+	Endpoint           string            `json:"endpoint,omitempty"`
+	BigtableInstance   string            `json:"bigtable_instance,omitempty"`
+	BigtableTable      string            `json:"bigtable_table,omitempty"`
+	GCSBucket          string            `json:"gcs_bucket,omitempty"`
+	SpannerDatabase    string            `json:"spanner_database,omitempty"`
+	SpannerTable       string            `json:"spanner_table,omitempty"`
+	RedisURL           string            `json:"redis_url,omitempty"`
+	CacheTTL           caddy.Duration    `json:"cache_ttl,omitempty"`
+	Proxy              string            `json:"proxy,omitempty"`
+	CAFile             string            `json:"ca_file,omitempty"`
+	Preflight          string            `json:"preflight,omitempty"`
+	SiteAuditHistory   int               `json:"site_audit_history,omitempty"`
+	AccessAudit        string            `json:"access_audit,omitempty"`
+	NonceMode          string            `json:"nonce_mode,omitempty"`
+	Compression        string            `json:"compression,omitempty"`
+	CompressionDict    string            `json:"compression_dict,omitempty"`
+
+	cfg    *tlsclouddatastore.Config
+	ctx    caddy.Context
+	events *caddyevents.App
+
+	mu      sync.Mutex
+	storage *tlsclouddatastore.CertMagicStorage
+}
+
+// CaddyModule returns the Caddy module information.
+func (*CaddyStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.cloud_datastore",
+		New: func() caddy.Module { return new(CaddyStorage) },
+	}
+}
+
+// Provision builds the storage config from env vars and the module's fields.
+func (s *CaddyStorage) Provision(ctx caddy.Context) error {
+	var cfg *tlsclouddatastore.Config
+	var err error
+	if s.Profile != "" {
+		cfg, err = tlsclouddatastore.ConfigFromEnvProfile(s.Profile)
+	} else {
+		cfg, err = tlsclouddatastore.ConfigFromEnv()
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.ProjectID != "" {
+		cfg.ProjectID = s.ProjectID
+	}
+	if s.ServiceAccountFile != "" {
+		cfg.ServiceAccountFile = s.ServiceAccountFile
+	}
+	if s.AESKey != "" {
+		cfg.AESKeyB64 = s.AESKey
+	}
+	if s.UserAESKey != "" {
+		cfg.UserAESKeyB64 = s.UserAESKey
+	}
+	if s.AllowPlaintext {
+		cfg.AllowPlaintext = true
+	}
+	if s.HashKey != "" {
+		cfg.HashKeyB64 = s.HashKey
+	}
+	if s.NameKey != "" {
+		cfg.NameKeyB64 = s.NameKey
+	}
+	if s.Prefix != "" {
+		cfg.Prefix = s.Prefix
+	}
+	if s.Timeout != 0 {
+		cfg.Timeout = time.Duration(s.Timeout)
+	}
+	if s.LockSkew != 0 {
+		cfg.LockSkew = time.Duration(s.LockSkew)
+	}
+	if s.DriftThreshold == "off" {
+		cfg.DriftThreshold = -1
+	} else if s.DriftThreshold != "" {
+		threshold, err := caddy.ParseDuration(s.DriftThreshold)
+		if err != nil {
+			return fmt.Errorf("invalid cloud_datastore drift_threshold %q: %v", s.DriftThreshold, err)
+		}
+		cfg.DriftThreshold = threshold
+	}
+	if s.DriftWidenSkew {
+		cfg.DriftWidenSkew = true
+	}
+	if s.ExpiryMonitor != 0 {
+		cfg.ExpiryMonitor = time.Duration(s.ExpiryMonitor)
+	}
+	if s.IntegrityScan != 0 {
+		cfg.IntegrityScan = time.Duration(s.IntegrityScan)
+	}
+	if s.RenewalWebhook != "" {
+		cfg.RenewalWebhook = s.RenewalWebhook
+	}
+	if s.RenewalFailures != 0 {
+		cfg.RenewalFailures = s.RenewalFailures
+	}
+	if s.RenewalJitter != 0 {
+		cfg.RenewalJitter = time.Duration(s.RenewalJitter)
+	}
+	if s.IssuanceRate != "" {
+		rate, err := tlsclouddatastore.ParseRate(s.IssuanceRate)
+		if err != nil {
+			return fmt.Errorf("invalid cloud_datastore issuance_rate %q: %v", s.IssuanceRate, err)
+		}
+		cfg.IssuanceRate = rate
+	}
+	if s.DomainIssuanceRate != "" {
+		rate, err := tlsclouddatastore.ParseRate(s.DomainIssuanceRate)
+		if err != nil {
+			return fmt.Errorf("invalid cloud_datastore domain_issuance_rate %q: %v", s.DomainIssuanceRate, err)
+		}
+		cfg.DomainIssuanceRate = rate
+	}
+	if s.NotifyWebhook != "" {
+		cfg.NotifyWebhook = s.NotifyWebhook
+	}
+	if s.NotifySlack != "" {
+		cfg.NotifySlack = s.NotifySlack
+	}
+	if len(s.NotifyEvents) > 0 {
+		cfg.NotifyEvents = s.NotifyEvents
+	}
+	if len(s.ProjectRoutes) > 0 {
+		// replacing the env's routes, like the other settings
+		cfg.ProjectRoutes = nil
+		for _, r := range s.ProjectRoutes {
+			cfg.ProjectRoutes = append(cfg.ProjectRoutes, tlsclouddatastore.ProjectRoute{
+				Pattern:  r.Pattern,
+				Project:  r.Project,
+				Database: r.Database,
+			})
+		}
+	}
+	if len(s.AllowedProjects) > 0 {
+		cfg.AllowedProjects = s.AllowedProjects
+	}
+	if s.KMSKey != "" {
+		cfg.KMSKeyName = s.KMSKey
+	}
+	if len(s.SigningKeys) > 0 {
+		cfg.SigningKeys = nil
+		for _, k := range s.SigningKeys {
+			cfg.SigningKeys = append(cfg.SigningKeys, tlsclouddatastore.SigningKey{ID: k.ID, KeyB64: k.Key})
+		}
+	}
+	if s.AcceptUnsigned {
+		cfg.AcceptUnsigned = true
+	}
+	if s.Shards != 0 {
+		cfg.Shards = s.Shards
+	}
+	if s.NamespacePerCA != nil {
+		// false turns off EnvNameNamespacePerCA
+		cfg.NamespacePerCA = *s.NamespacePerCA
+	}
+	if s.FieldEncryption {
+		cfg.FieldEncryption = true
+	}
+	if s.Namespace != "" {
+		cfg.Namespace = s.Namespace
+	}
+	if len(s.Labels) > 0 {
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		for k, v := range s.Labels {
+			cfg.Labels[k] = v
+		}
+	}
+	if s.InstanceID != "" {
+		cfg.InstanceID = s.InstanceID
+	}
+	if s.UserAgent != "" {
+		cfg.UserAgent = s.UserAgent
+	}
+	if s.Endpoint != "" {
+		cfg.Endpoint = s.Endpoint
+	}
+	if s.BigtableInstance != "" {
+		cfg.BigtableInstance = s.BigtableInstance
+	}
+	if s.BigtableTable != "" {
+		cfg.BigtableTable = s.BigtableTable
+	}
+	if s.GCSBucket != "" {
+		cfg.GCSBucket = s.GCSBucket
+	}
+	if s.SpannerDatabase != "" {
+		cfg.SpannerDatabase = s.SpannerDatabase
+	}
+	if s.SpannerTable != "" {
+		cfg.SpannerTable = s.SpannerTable
+	}
+	if s.RedisURL != "" {
+		cfg.RedisURL = s.RedisURL
+	}
+	if s.CacheTTL != 0 {
+		cfg.CacheTTL = time.Duration(s.CacheTTL)
+	}
+	if s.Proxy != "" {
+		cfg.Proxy = s.Proxy
+	}
+	if s.CAFile != "" {
+		cfg.CAFile = s.CAFile
+	}
+	if s.Preflight != "" {
+		cfg.Preflight = s.Preflight
+	}
+	if s.SiteAuditHistory != 0 {
+		// negative turns it off
+		cfg.SiteAuditHistory = s.SiteAuditHistory
+	}
+	if s.AccessAudit != "" {
+		cfg.AccessAudit = s.AccessAudit
+	}
+	if s.NonceMode != "" {
+		cfg.NonceMode = s.NonceMode
+	}
+	if s.Compression != "" {
+		cfg.Compression = s.Compression
+	}
+	if s.CompressionDict != "" {
+		cfg.CompressionDict = s.CompressionDict
+	}
+
+	s.cfg = cfg
+	s.ctx = ctx
+	return nil
+}
+
+// Validate checks the provisioned config, the connection is only made by CertMagicStorage.
+func (s *CaddyStorage) Validate() error {
+	if s.cfg == nil {
+		return fmt.Errorf("cloud_datastore storage not provisioned")
+	}
+	if s.cfg.ProjectID == "" {
+		return fmt.Errorf("cloud_datastore storage requires project_id or env var %s", tlsclouddatastore.EnvNameProjectId)
+	}
+	if s.cfg.Timeout < 0 {
+		return fmt.Errorf("cloud_datastore timeout must not be negative: %s", s.cfg.Timeout)
+	}
+	if s.cfg.LockSkew < 0 {
+		return fmt.Errorf("cloud_datastore lock_skew must not be negative: %s", s.cfg.LockSkew)
+	}
+	if s.cfg.ExpiryMonitor < 0 {
+		return fmt.Errorf("cloud_datastore expiry_monitor must not be negative: %s", s.cfg.ExpiryMonitor)
+	}
+	if s.cfg.IntegrityScan < 0 {
+		return fmt.Errorf("cloud_datastore integrity_scan must not be negative: %s", s.cfg.IntegrityScan)
+	}
+	if s.cfg.RenewalJitter < 0 {
+		return fmt.Errorf("cloud_datastore renewal_jitter must not be negative: %s", s.cfg.RenewalJitter)
+	}
+	if s.cfg.CacheTTL < 0 {
+		return fmt.Errorf("cloud_datastore cache_ttl must not be negative: %s", s.cfg.CacheTTL)
+	}
+	if s.cfg.RenewalFailures < 0 {
+		return fmt.Errorf("cloud_datastore renewal_failures must not be negative: %d", s.cfg.RenewalFailures)
+	}
+	if s.cfg.Shards < 0 {
+		return fmt.Errorf("cloud_datastore shards must not be negative: %d", s.cfg.Shards)
+	}
+	for _, r := range s.cfg.ProjectRoutes {
+		if r.Pattern == "" || r.Project == "" {
+			return fmt.Errorf("cloud_datastore project route requires pattern and project: %+v", r)
+		}
+	}
+	return nil
+}
+
+// CertMagicStorage connects to Cloud Datastore, the storage is shared by every call.
+func (s *CaddyStorage) CertMagicStorage() (certmagic.Storage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storage == nil {
+		storage, err := tlsclouddatastore.NewCertMagicStorageWithConfig(s.cfg)
+		if err != nil {
+			return nil, err
+		}
+		// emitted on the event bus, if the events app is available
+		if app, err := s.ctx.App("events"); err == nil {
+			if s.events, _ = app.(*caddyevents.App); s.events != nil {
+				storage.OnEvent(s.emit)
+				if err := s.events.On("cert_failed", rateLimitHandler{storage.CloudDsStorage()}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		s.storage = storage
+	}
+	return s.storage, nil
+}
+
+// emit passes storage events to Caddy's event bus.
+func (s *CaddyStorage) emit(name string, data map[string]interface{}) {
+	s.events.Emit(s.ctx, name, data)
+}
+
+// rateLimitHandler records the rate limit errors of CertMagic's cert_failed
+// events, so every instance backs off rather than only the one limited.
+type rateLimitHandler struct {
+	storage *tlsclouddatastore.CloudDsStorage
+}
+
+func (h rateLimitHandler) Handle(ctx context.Context, e caddy.Event) error {
+	err, _ := e.Data["error"].(error)
+	domain, _ := e.Data["identifier"].(string)
+	_, err = h.storage.RecordCAError(ctx, domain, err)
+	return err
+}
+
+// Cleanup closes the storage's connections.
+func (s *CaddyStorage) Cleanup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storage == nil {
+		return nil
+	}
+	err := s.storage.Close()
+	s.storage = nil
+	return err
+}
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens. Syntax:
+//
+//	storage cloud_datastore [<project_id>] {
+//	    profile              <profile>
+//	    project_id           <project_id>
+//	    service_account_file <path>
+//	    aes_key              <base64 key>
+//	    user_aes_key         <base64 key>
+//	    i_understand_plaintext_storage
+//	    hash_key             <base64 key>
+//	    name_key             <base64 key>
+//	    prefix               <prefix>
+//	    timeout              <duration>
+//	    lock_skew            <duration>
+//	    drift_threshold      <duration>|off
+//	    drift_widen_skew     [true|false]
+//	    expiry_monitor       <interval>
+//	    integrity_scan       <interval>
+//	    renewal_webhook      <url>
+//	    renewal_failures     <count>
+//	    renewal_jitter       <duration>
+//	    issuance_rate        <limit>/<window>
+//	    domain_issuance_rate <limit>/<window>
+//	    notify_webhook       <url>
+//	    notify_slack         <url>
+//	    notify_events        <event...>
+//	    shards               <n>
+//	    namespace            <namespace>
+//	    namespace_per_ca     [true|false]
+//	    field_encryption     [true|false]
+//	    label                <key> <value>
+//	    project_route        <pattern> <project> [<database>]
+//	    allowed_projects     <project...>
+//	    kms_key              <key name>
+//	    signing_key          <id> <base64 key>
+//	    accept_unsigned      [true|false]
+//	    instance_id          <id>
+//	    user_agent           <user agent>
+//	    endpoint             <host[:port]>
+//	    bigtable_instance    <instance>
+//	    bigtable_table       <table>
+//	    gcs_bucket           <bucket>
+//	    spanner_database     <instance>/<database>
+//	    spanner_table        <table>
+//	    redis_url            <url>
+//	    cache_ttl            <duration>
+//	    proxy                <url>
+//	    ca_file              <path>
+//	    preflight            require|warn|background|skip
+//	    site_audit_history   <count>|off
+//	    access_audit         datastore|log
+//	    nonce_mode           random|counter
+//	    compression          off|zstd
+//	    compression_dict     <path>
+//	}
+func (s *CaddyStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.ProjectID = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "profile":
+				if !d.Args(&s.Profile) {
+					return d.ArgErr()
+				}
+			case "project_id":
+				if !d.Args(&s.ProjectID) {
+					return d.ArgErr()
+				}
+			case "service_account_file":
+				if !d.Args(&s.ServiceAccountFile) {
+					return d.ArgErr()
+				}
+			case "aes_key":
+				if !d.Args(&s.AESKey) {
+					return d.ArgErr()
+				}
+			case "user_aes_key":
+				if !d.Args(&s.UserAESKey) {
+					return d.ArgErr()
+				}
+			case "i_understand_plaintext_storage":
+				s.AllowPlaintext = true
+			case "hash_key":
+				if !d.Args(&s.HashKey) {
+					return d.ArgErr()
+				}
+			case "name_key":
+				if !d.Args(&s.NameKey) {
+					return d.ArgErr()
+				}
+			case "prefix":
+				if !d.Args(&s.Prefix) {
+					return d.ArgErr()
+				}
+			case "namespace":
+				if !d.Args(&s.Namespace) {
+					return d.ArgErr()
+				}
+			case "instance_id":
+				if !d.Args(&s.InstanceID) {
+					return d.ArgErr()
+				}
+			case "user_agent":
+				if !d.Args(&s.UserAgent) {
+					return d.ArgErr()
+				}
+			case "endpoint":
+				if !d.Args(&s.Endpoint) {
+					return d.ArgErr()
+				}
+			case "bigtable_instance":
+				if !d.Args(&s.BigtableInstance) {
+					return d.ArgErr()
+				}
+			case "bigtable_table":
+				if !d.Args(&s.BigtableTable) {
+					return d.ArgErr()
+				}
+			case "gcs_bucket":
+				if !d.Args(&s.GCSBucket) {
+					return d.ArgErr()
+				}
+			case "spanner_database":
+				if !d.Args(&s.SpannerDatabase) {
+					return d.ArgErr()
+				}
+			case "spanner_table":
+				if !d.Args(&s.SpannerTable) {
+					return d.ArgErr()
+				}
+			case "redis_url":
+				if !d.Args(&s.RedisURL) {
+					return d.ArgErr()
+				}
+			case "cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid cache_ttl %q: %v", d.Val(), err)
+				}
+				s.CacheTTL = caddy.Duration(ttl)
+			case "proxy":
+				if !d.Args(&s.Proxy) {
+					return d.ArgErr()
+				}
+			case "ca_file":
+				if !d.Args(&s.CAFile) {
+					return d.ArgErr()
+				}
+			case "preflight":
+				if !d.Args(&s.Preflight) {
+					return d.ArgErr()
+				}
+			case "site_audit_history":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				history := -1
+				if d.Val() != "off" {
+					var err error
+					if history, err = strconv.Atoi(d.Val()); err != nil || history <= 0 {
+						return d.Errf("invalid site_audit_history %q", d.Val())
+					}
+				}
+				s.SiteAuditHistory = history
+			case "access_audit":
+				if !d.Args(&s.AccessAudit) {
+					return d.ArgErr()
+				}
+			case "nonce_mode":
+				if !d.Args(&s.NonceMode) {
+					return d.ArgErr()
+				}
+			case "compression":
+				if !d.Args(&s.Compression) {
+					return d.ArgErr()
+				}
+			case "compression_dict":
+				if !d.Args(&s.CompressionDict) {
+					return d.ArgErr()
+				}
+			case "timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid timeout %q: %v", d.Val(), err)
+				}
+				s.Timeout = caddy.Duration(timeout)
+			case "lock_skew":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				skew, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid lock_skew %q: %v", d.Val(), err)
+				}
+				s.LockSkew = caddy.Duration(skew)
+			case "drift_threshold":
+				if !d.Args(&s.DriftThreshold) {
+					return d.ArgErr()
+				}
+			case "drift_widen_skew":
+				s.DriftWidenSkew = true
+				if d.NextArg() {
+					enabled, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid drift_widen_skew %q: %v", d.Val(), err)
+					}
+					s.DriftWidenSkew = enabled
+				}
+			case "expiry_monitor":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid expiry_monitor %q: %v", d.Val(), err)
+				}
+				s.ExpiryMonitor = caddy.Duration(interval)
+			case "integrity_scan":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid integrity_scan %q: %v", d.Val(), err)
+				}
+				s.IntegrityScan = caddy.Duration(interval)
+			case "renewal_webhook":
+				if !d.Args(&s.RenewalWebhook) {
+					return d.ArgErr()
+				}
+			case "renewal_failures":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				failures, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid renewal_failures %q: %v", d.Val(), err)
+				}
+				s.RenewalFailures = failures
+			case "renewal_jitter":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				jitter, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid renewal_jitter %q: %v", d.Val(), err)
+				}
+				s.RenewalJitter = caddy.Duration(jitter)
+			case "issuance_rate":
+				if !d.Args(&s.IssuanceRate) {
+					return d.ArgErr()
+				}
+			case "domain_issuance_rate":
+				if !d.Args(&s.DomainIssuanceRate) {
+					return d.ArgErr()
+				}
+			case "notify_webhook":
+				if !d.Args(&s.NotifyWebhook) {
+					return d.ArgErr()
+				}
+			case "notify_slack":
+				if !d.Args(&s.NotifySlack) {
+					return d.ArgErr()
+				}
+			case "notify_events":
+				s.NotifyEvents = append(s.NotifyEvents, d.RemainingArgs()...)
+				if len(s.NotifyEvents) == 0 {
+					return d.ArgErr()
+				}
+			case "shards":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				shards, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid shards %q: %v", d.Val(), err)
+				}
+				s.Shards = shards
+			case "namespace_per_ca":
+				enabled := true
+				if d.NextArg() {
+					var err error
+					if enabled, err = strconv.ParseBool(d.Val()); err != nil {
+						return d.Errf("invalid namespace_per_ca %q: %v", d.Val(), err)
+					}
+				}
+				s.NamespacePerCA = &enabled
+			case "field_encryption":
+				s.FieldEncryption = true
+				if d.NextArg() {
+					enabled, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid field_encryption %q: %v", d.Val(), err)
+					}
+					s.FieldEncryption = enabled
+				}
+			case "label":
+				var k, v string
+				if !d.Args(&k, &v) {
+					return d.ArgErr()
+				}
+				if s.Labels == nil {
+					s.Labels = make(map[string]string)
+				}
+				s.Labels[k] = v
+			case "allowed_projects":
+				s.AllowedProjects = append(s.AllowedProjects, d.RemainingArgs()...)
+				if len(s.AllowedProjects) == 0 {
+					return d.ArgErr()
+				}
+			case "kms_key":
+				if !d.Args(&s.KMSKey) {
+					return d.ArgErr()
+				}
+			case "signing_key":
+				var k SigningKey
+				if !d.Args(&k.ID, &k.Key) {
+					return d.ArgErr()
+				}
+				s.SigningKeys = append(s.SigningKeys, k)
+			case "accept_unsigned":
+				s.AcceptUnsigned = true
+				if d.NextArg() {
+					enabled, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid accept_unsigned %q: %v", d.Val(), err)
+					}
+					s.AcceptUnsigned = enabled
+				}
+			case "project_route":
+				args := d.RemainingArgs()
+				if len(args) < 2 || len(args) > 3 {
+					return d.ArgErr()
+				}
+				r := ProjectRoute{Pattern: args[0], Project: args[1]}
+				if len(args) == 3 {
+					r.Database = args[2]
+				}
+				s.ProjectRoutes = append(s.ProjectRoutes, r)
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*CaddyStorage)(nil)
+	_ caddy.Validator        = (*CaddyStorage)(nil)
+	_ caddy.CleanerUpper     = (*CaddyStorage)(nil)
+	_ caddy.StorageConverter = (*CaddyStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*CaddyStorage)(nil)
+)
@@ -0,0 +1,126 @@
+package caddyv2_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	tlsclouddatastore "github.com/j0hnsmith/caddy-tlsclouddatastore"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/caddyv2"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	cloud_datastore my-project {
+		prefix mytls
+		timeout 5s
+		shards 4
+		namespace_per_ca
+		label env prod
+		project_route *.customer.com customer-project customer-db
+		user_agent caddy-web
+	}`)
+
+	var s caddyv2.CaddyStorage
+	if err := s.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Error unmarshalling Caddyfile: %v", err)
+	}
+
+	if s.ProjectID != "my-project" {
+		t.Errorf("Expected project id my-project, got %s", s.ProjectID)
+	}
+	if s.Prefix != "mytls" {
+		t.Errorf("Expected prefix mytls, got %s", s.Prefix)
+	}
+	if time.Duration(s.Timeout) != 5*time.Second {
+		t.Errorf("Expected timeout 5s, got %s", time.Duration(s.Timeout))
+	}
+	if s.Shards != 4 || s.NamespacePerCA == nil || !*s.NamespacePerCA {
+		t.Errorf("Expected 4 shards namespaced per CA, got %d %v", s.Shards, s.NamespacePerCA)
+	}
+	if s.Labels["env"] != "prod" {
+		t.Errorf("Expected label env=prod, got %v", s.Labels)
+	}
+	if s.UserAgent != "caddy-web" {
+		t.Errorf("Expected user agent caddy-web, got %s", s.UserAgent)
+	}
+	want := caddyv2.ProjectRoute{Pattern: "*.customer.com", Project: "customer-project", Database: "customer-db"}
+	if len(s.ProjectRoutes) != 1 || s.ProjectRoutes[0] != want {
+		t.Errorf("Expected project route %+v, got %+v", want, s.ProjectRoutes)
+	}
+}
+
+func TestUnmarshalCaddyfileUnknownDirective(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	cloud_datastore {
+		bucket foo
+	}`)
+
+	var s caddyv2.CaddyStorage
+	if err := s.UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected error for unknown subdirective")
+	}
+}
+
+func TestUnmarshalCaddyfileNamespacePerCAOff(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	cloud_datastore my-project {
+		namespace_per_ca false
+	}`)
+
+	var s caddyv2.CaddyStorage
+	if err := s.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Error unmarshalling Caddyfile: %v", err)
+	}
+	// set, so it overrides the env var
+	if s.NamespacePerCA == nil || *s.NamespacePerCA {
+		t.Errorf("Expected namespace_per_ca explicitly off, got %v", s.NamespacePerCA)
+	}
+}
+
+func TestProvisionValidate(t *testing.T) {
+	t.Setenv(tlsclouddatastore.EnvNameProjectId, "")
+
+	s := caddyv2.CaddyStorage{}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Error provisioning: %v", err)
+	}
+	if err := s.Validate(); err == nil {
+		t.Error("Expected error validating without a project id")
+	}
+
+	s = caddyv2.CaddyStorage{ProjectID: "my-project", Shards: -1}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Error provisioning: %v", err)
+	}
+	if err := s.Validate(); err == nil {
+		t.Error("Expected error validating negative shards")
+	}
+}
+
+func TestProvisionProjectRoutes(t *testing.T) {
+	t.Setenv(tlsclouddatastore.EnvNameProjectId, "my-project")
+	t.Setenv(tlsclouddatastore.EnvNameProjectRoutes, "*.env.com=env-project")
+
+	s := caddyv2.CaddyStorage{}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Error provisioning: %v", err)
+	}
+	env := []tlsclouddatastore.ProjectRoute{{Pattern: "*.env.com", Project: "env-project"}}
+	if routes := s.ProvisionedConfig().ProjectRoutes; !reflect.DeepEqual(routes, env) {
+		t.Errorf("Expected the env's routes, got %+v", routes)
+	}
+
+	// the module's routes replace the env's rather than being added to them
+	s = caddyv2.CaddyStorage{ProjectRoutes: []caddyv2.ProjectRoute{{Pattern: "*.customer.com", Project: "customer-project", Database: "customer-db"}}}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Error provisioning: %v", err)
+	}
+	want := []tlsclouddatastore.ProjectRoute{{Pattern: "*.customer.com", Project: "customer-project", Database: "customer-db"}}
+	if routes := s.ProvisionedConfig().ProjectRoutes; !reflect.DeepEqual(routes, want) {
+		t.Errorf("Expected only the module's routes, got %+v", routes)
+	}
+}
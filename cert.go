@@ -0,0 +1,70 @@
+package tlsclouddatastore
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// leafCertificate parses the first certificate of a PEM bundle, which is the
+// leaf in the bundles Caddy stores.
+func leafCertificate(bundle []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return nil, fmt.Errorf("No certificate found in PEM data")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// CertDetails are the details of a stored certificate, parsed from its leaf
+// when it's read so consumers of SiteInfo and SiteMeta don't parse PEM.
+type CertDetails struct {
+	Serial     string    `json:"serial"` // in hex
+	SANs       []string  `json:"sans"`   // DNS names and IP addresses
+	IssuerName string    `json:"issuer_name"`
+	KeyType    string    `json:"key_type"` // eg `ECDSA P-256`, `RSA 2048` or `Ed25519`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// parseCertDetails returns the details of the leaf of a PEM bundle.
+func parseCertDetails(bundle []byte) (CertDetails, error) {
+	cert, err := leafCertificate(bundle)
+	if err != nil {
+		return CertDetails{}, err
+	}
+	d := CertDetails{
+		Serial:     fmt.Sprintf("%x", cert.SerialNumber),
+		SANs:       cert.DNSNames,
+		IssuerName: cert.Issuer.CommonName,
+		KeyType:    keyType(cert.PublicKey),
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		d.SANs = append(d.SANs, ip.String())
+	}
+	return d, nil
+}
+
+// keyType describes the type and size of a certificate's public key.
+func keyType(pub interface{}) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
@@ -0,0 +1,235 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/caddyserver/certmagic"
+)
+
+const (
+	// certMagicLockTTL is how long a CertMagic lock lasts without being refreshed, so the lock of an
+	// instance that dies is taken over
+	certMagicLockTTL = time.Minute
+
+	// certMagicLockPoll is how often a lock held elsewhere is checked
+	certMagicLockPoll = time.Second
+)
+
+// CertMagicStorage implements certmagic.Storage on Cloud Datastore for Caddy
+// v2 and standalone CertMagic. It shares the connection, encryption and
+// locking of CloudDsStorage, which implements the Caddy v1 interface.
+type CertMagicStorage struct {
+	cds     *CloudDsStorage
+	locks   map[string]*certMagicLock
+	locksMu sync.Mutex
+	onEvent EventHandler
+}
+
+// certMagicLock is a held lock, refreshed until stop is closed.
+type certMagicLock struct {
+	lock *Leadership
+	stop chan struct{}
+}
+
+var _ certmagic.Storage = (*CertMagicStorage)(nil)
+
+// NewCertMagicStorage connects to Cloud Datastore, configured with the same
+// env vars as NewCloudDatastoreStorage, and returns a certmagic.Storage.
+// CertMagic keys include the issuer so, unlike Caddy v1 records, they aren't
+// namespaced by CA.
+func NewCertMagicStorage() (*CertMagicStorage, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewCertMagicStorageWithConfig(cfg)
+}
+
+// NewCertMagicStorageWithConfig is NewCertMagicStorage configured by cfg rather than env vars.
+func NewCertMagicStorageWithConfig(cfg *Config) (*CertMagicStorage, error) {
+	cds, err := NewCloudDatastoreStorageWithConfig(&url.URL{}, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &CertMagicStorage{cds: cds, locks: make(map[string]*certMagicLock)}, nil
+}
+
+// CloudDsStorage returns the underlying storage.
+func (s *CertMagicStorage) CloudDsStorage() *CloudDsStorage {
+	return s.cds
+}
+
+// Close releases the storage's resources.
+func (s *CertMagicStorage) Close() error {
+	return s.cds.Close()
+}
+
+// Store puts value at key.
+func (s *CertMagicStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := s.cds.kvStore(ctx, key, value); err != nil {
+		return s.degraded("store", key, err)
+	}
+	if isCertKey(key) {
+		s.cds.renewalStored(ctx, certKeyDomain(key))
+		s.cds.countIssued(ctx, certKeyDomain(key))
+		s.emit(EventCertStored, map[string]interface{}{"key": cleanKVKey(key)})
+	}
+	return nil
+}
+
+// Load retrieves the value at key.
+func (s *CertMagicStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.cds.kvLoad(withOpCategory(ctx, OpCategoryHandshake), key)
+	return value, s.degraded("load", key, err)
+}
+
+// Delete deletes key and, if it's a directory, everything under it.
+func (s *CertMagicStorage) Delete(ctx context.Context, key string) error {
+	if err := s.cds.kvDelete(ctx, key); err != nil {
+		return s.degraded("delete", key, err)
+	}
+	if isCertKey(key) {
+		s.emit(EventCertDeleted, map[string]interface{}{"key": cleanKVKey(key)})
+	}
+	return nil
+}
+
+// Exists returns true if key exists, as a value or a directory.
+func (s *CertMagicStorage) Exists(ctx context.Context, key string) bool {
+	_, err := s.cds.kvStat(ctx, key)
+	return err == nil
+}
+
+// List returns all keys under prefix, or only its immediate children if not recursive.
+func (s *CertMagicStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	list, err := s.cds.kvList(ctx, prefix, recursive)
+	return list, s.degraded("list", prefix, err)
+}
+
+// Stat returns information about key.
+func (s *CertMagicStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info, err := s.cds.kvStat(ctx, key)
+	if err != nil {
+		return certmagic.KeyInfo{}, s.degraded("stat", key, err)
+	}
+	return certmagic.KeyInfo{
+		Key:        info.Key,
+		Modified:   info.Modified,
+		Size:       info.Size,
+		IsTerminal: info.IsTerminal,
+	}, nil
+}
+
+func (cds *CloudDsStorage) certMagicLockKey(name string) *datastore.Key {
+	return cds.dsKey(LOCK_RECORD, path.Join("certmagic", cds.nameSegment(name)))
+}
+
+// Lock obtains the cluster-wide lock name, blocking until it's available or
+// ctx is done, when it returns ErrLockTimeout. The lock is refreshed until Unlock, if this instance dies it's
+// taken over once it expires.
+func (s *CertMagicStorage) Lock(ctx context.Context, name string) error {
+	// unique per call, so goroutines of the same instance exclude each other too
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("Unable to generate lock owner: %w", err)
+	}
+	owner := s.cds.instanceID + "/" + hex.EncodeToString(b)
+	domain, issue := issueLockDomain(name)
+	if issue {
+		if err := s.cds.checkPaused(ctx); err != nil {
+			return err
+		}
+		if err := s.cds.checkRateLimited(ctx, domain); err != nil {
+			return err
+		}
+		if err := s.cds.renewalDue(ctx, domain, false); err != nil {
+			return err
+		}
+	}
+
+	attempt := ctx
+	for {
+		l, err := s.cds.acquireLock(attempt, s.cds.certMagicLockKey(name), name, owner, certMagicLockTTL)
+		if err == nil {
+			if issue {
+				// only once the lock is held, waiting on another instance's issuance takes no token
+				if err := s.cds.takeIssuance(ctx, domain); err != nil {
+					if err := l.Release(ctx); err != nil {
+						log.Printf("[ERROR] Unable to release lock %v: %v", name, err)
+					}
+					return err
+				}
+			}
+			held := &certMagicLock{lock: l, stop: make(chan struct{})}
+			s.locksMu.Lock()
+			s.locks[name] = held
+			s.locksMu.Unlock()
+			go s.refresh(held)
+			if issue {
+				s.cds.renewalStarted(domain)
+			}
+			s.emit(EventLockAcquired, map[string]interface{}{"name": name, "owner": owner})
+			return nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return s.degraded("lock", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrLockTimeout, ctx.Err())
+		case <-s.cds.clock.After(certMagicLockPoll):
+		}
+		// retries wait on the lock of another instance
+		attempt = withOpCategory(ctx, OpCategoryLockPolling)
+	}
+}
+
+// refresh renews held until it's unlocked.
+func (s *CertMagicStorage) refresh(held *certMagicLock) {
+	for {
+		select {
+		case <-held.stop:
+			return
+		case <-s.cds.ctx.Done():
+			return
+		case <-s.cds.clock.After(certMagicLockTTL / 3):
+			ctx, cancel := s.cds.opContext()
+			err := held.lock.Renew(ctx)
+			cancel()
+			if errors.Is(err, ErrConflict) {
+				// lost it, nothing more to refresh
+				s.emit(EventLockLost, map[string]interface{}{"name": held.lock.Name()})
+				return
+			}
+			s.degraded("renew lock", held.lock.Name(), err)
+		}
+	}
+}
+
+// Unlock releases the lock name, which must have been obtained with Lock.
+func (s *CertMagicStorage) Unlock(ctx context.Context, name string) error {
+	s.locksMu.Lock()
+	held, ok := s.locks[name]
+	delete(s.locks, name)
+	s.locksMu.Unlock()
+	if !ok {
+		return fmt.Errorf("No lock to release for %s", name)
+	}
+
+	close(held.stop)
+	if domain, ok := issueLockDomain(name); ok {
+		s.cds.renewalEnded(ctx, domain)
+	}
+	return held.lock.Release(ctx)
+}
@@ -0,0 +1,140 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// certMagicSafe makes s safe for use in a CertMagic key the way CertMagic
+// does, so migrated records are found where it looks for them.
+func certMagicSafe(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.NewReplacer(" ", "_", "+", "_plus_", "*", "wildcard_", ":", "-", "..", "").Replace(s)
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// certMagicIssuerKey returns the issuer segment CertMagic uses in keys for
+// this storage's CA, its host and path joined by `-`.
+func (cds *CloudDsStorage) certMagicIssuerKey() string {
+	return strings.ReplaceAll(cds.caNamespace, "/", "-")
+}
+
+// certMagicAccount converts a Caddy v1 (lego) registration, the account
+// wrapped with its URI, to the ACME account CertMagic stores.
+func certMagicAccount(reg []byte) ([]byte, error) {
+	var v1 struct {
+		Body map[string]interface{} `json:"body"`
+		URI  string                 `json:"uri"`
+	}
+	if err := json.Unmarshal(reg, &v1); err != nil {
+		return nil, err
+	}
+	if v1.Body == nil {
+		// not wrapped, assume it's already an account
+		return reg, nil
+	}
+	v1.Body["location"] = v1.URI
+	return json.Marshal(v1.Body)
+}
+
+// MigrateToCertMagic copies this CA's site and user records, stored by Caddy
+// v1, to dst in CertMagic's key layout, so Caddy v2 reuses the certificates
+// and accounts rather than issuing new ones. Usually dst is a
+// CertMagicStorage on the same project. Certificates and keys are copied
+// as-is, certificate metadata too as it only holds informational fields, and
+// registrations are converted to CertMagic's account format. Existing keys
+// in dst are overwritten, so it's safe to run again.
+func (cds *CloudDsStorage) MigrateToCertMagic(ctx context.Context, dst certmagic.Storage) (sites, users int, err error) {
+	if cds.caNamespace == "" {
+		return 0, 0, fmt.Errorf("Unable to migrate to CertMagic layout without a CA URL")
+	}
+	issuer := cds.certMagicIssuerKey()
+	ctx = WithAccessReason(ctx, "migrate")
+
+	seenSites := make(map[string]bool)
+	for _, client := range cds.clients() {
+		keys, err := cds.namesUnder(ctx, client, SITE_RECORD, "sites")
+		if err != nil {
+			return sites, users, err
+		}
+		for _, k := range keys {
+			domain, err := cds.siteDomainOf(ctx, client, k)
+			if err != nil {
+				return sites, users, err
+			}
+			if seenSites[domain] {
+				// a site may also be under its plain or hashed name
+				continue
+			}
+			seenSites[domain] = true
+			if cds.siteClient(domain) != client {
+				// left over from before a project route was added
+				continue
+			}
+			site, err := cds.LoadSiteContext(ctx, domain)
+			if err != nil {
+				return sites, users, err
+			}
+
+			safe := certMagicSafe(domain)
+			dir := path.Join("certificates", issuer, safe)
+			for ext, value := range map[string][]byte{".crt": site.Cert, ".key": site.Key, ".json": site.Meta} {
+				if err := dst.Store(ctx, path.Join(dir, safe+ext), value); err != nil {
+					return sites, users, fmt.Errorf("Unable to migrate site data for %v: %w", domain, err)
+				}
+			}
+			sites++
+		}
+	}
+
+	seenUsers := make(map[string]bool)
+	keys, err := cds.namesUnder(ctx, cds.cloudDsClient, USER_RECORD, "users")
+	if err != nil {
+		return sites, users, err
+	}
+	for _, k := range keys {
+		email, err := cds.userEmailOf(ctx, k)
+		if err != nil {
+			return sites, users, err
+		}
+		if seenUsers[email] {
+			continue
+		}
+		seenUsers[email] = true
+		user, err := cds.LoadUserContext(ctx, email)
+		if err != nil {
+			return sites, users, err
+		}
+		account, err := certMagicAccount(user.Reg)
+		if err != nil {
+			return sites, users, fmt.Errorf("Unable to convert registration for %v: %w", email, err)
+		}
+
+		username := email
+		if i := strings.Index(email, "@"); i >= 0 {
+			username = email[:i]
+		}
+		if username == "" {
+			username = "default"
+		}
+		dir := path.Join("acme", issuer, "users", certMagicSafe(email))
+		if err := dst.Store(ctx, path.Join(dir, certMagicSafe(username)+".json"), account); err != nil {
+			return sites, users, fmt.Errorf("Unable to migrate user data for %v: %w", email, err)
+		}
+		if err := dst.Store(ctx, path.Join(dir, certMagicSafe(username)+".key"), user.Key); err != nil {
+			return sites, users, fmt.Errorf("Unable to migrate user data for %v: %w", email, err)
+		}
+		users++
+	}
+	return sites, users, nil
+}
@@ -0,0 +1,384 @@
+package tlsclouddatastore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddytls"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/dstest"
+)
+
+func setupCertMagicStorage(t *testing.T) *tlsclouddatastore.CertMagicStorage {
+	dstest.Truncate(t)
+
+	s, err := tlsclouddatastore.NewCertMagicStorage()
+	if err != nil {
+		t.Fatalf("Error creating CertMagic storage: %v", err)
+	}
+	return s
+}
+
+func TestCertMagicStoreLoadDelete(t *testing.T) {
+	s := setupCertMagicStorage(t)
+	ctx := context.Background()
+	key := "certificates/acme/example.com/example.com.crt"
+
+	if _, err := s.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist loading missing key, got: %v", err)
+	}
+
+	if err := s.Store(ctx, key, []byte("cert")); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	value, err := s.Load(ctx, key)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if string(value) != "cert" {
+		t.Fatalf("Loaded value is not the same like the saved one")
+	}
+
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Error getting key info: %v", err)
+	}
+	if !info.IsTerminal || info.Size != 4 || info.Key != key || info.Modified.IsZero() {
+		t.Fatalf("Unexpected key info: %+v", info)
+	}
+	info, err = s.Stat(ctx, "certificates/acme")
+	if err != nil {
+		t.Fatalf("Error getting directory info: %v", err)
+	}
+	if info.IsTerminal {
+		t.Fatal("Directory shouldn't be terminal")
+	}
+
+	// deleting a directory deletes everything under it
+	if err := s.Delete(ctx, "certificates/acme"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	if s.Exists(ctx, key) {
+		t.Fatal("Key should be deleted")
+	}
+}
+
+func TestCertMagicList(t *testing.T) {
+	s := setupCertMagicStorage(t)
+	ctx := context.Background()
+
+	keys := []string{
+		"certificates/acme/a.com/a.com.crt",
+		"certificates/acme/a.com/a.com.key",
+		"certificates/acme/b.com/b.com.crt",
+		"certificates/acmefoo/c.com/c.com.crt",
+	}
+	for _, k := range keys {
+		if err := s.Store(ctx, k, []byte("x")); err != nil {
+			t.Fatalf("Error storing: %v", err)
+		}
+	}
+
+	list, err := s.List(ctx, "certificates/acme", false)
+	if err != nil {
+		t.Fatalf("Error listing: %v", err)
+	}
+	sort.Strings(list)
+	if expected := []string{"certificates/acme/a.com", "certificates/acme/b.com"}; !reflect.DeepEqual(list, expected) {
+		t.Fatalf("Expected %v, got %v", expected, list)
+	}
+
+	list, err = s.List(ctx, "certificates/acme", true)
+	if err != nil {
+		t.Fatalf("Error listing: %v", err)
+	}
+	sort.Strings(list)
+	if !reflect.DeepEqual(list, keys[:3]) {
+		t.Fatalf("Expected %v, got %v", keys[:3], list)
+	}
+}
+
+func TestCertMagicLock(t *testing.T) {
+	s1 := setupCertMagicStorage(t)
+	s2, err := tlsclouddatastore.NewCertMagicStorage()
+	if err != nil {
+		t.Fatalf("Error creating CertMagic storage: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := s1.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, time.Millisecond*1500)
+	defer cancel()
+	if err := s2.Lock(timeout, "issue_cert_example.com"); !errors.Is(err, tlsclouddatastore.ErrLockTimeout) {
+		t.Fatalf("Expected ErrLockTimeout for a lock held by another instance, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(time.Second)
+		s1.Unlock(ctx, "issue_cert_example.com")
+	}()
+	if err := s2.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Error locking after release: %v", err)
+	}
+	if err := s2.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Error unlocking: %v", err)
+	}
+}
+
+func TestCertMagicSites(t *testing.T) {
+	s := setupCertMagicStorage(t)
+	ctx := context.Background()
+	notAfter := time.Now().Add(time.Hour * 24 * 30).Truncate(time.Second)
+
+	for _, domain := range []string{"example.com", "*.example.com"} {
+		key := "certificates/acme/" + strings.Replace(domain, "*", "wildcard_", 1)
+		if err := s.Store(ctx, key+"/"+path.Base(key)+".crt", getSiteWithCert(t, domain, notAfter).Cert); err != nil {
+			t.Fatalf("Error storing: %v", err)
+		}
+		if err := s.Store(ctx, key+"/"+path.Base(key)+".key", []byte("key")); err != nil {
+			t.Fatalf("Error storing: %v", err)
+		}
+	}
+	if err := s.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	defer s.Unlock(ctx, "issue_cert_example.com")
+
+	sites, err := s.Sites(ctx)
+	if err != nil {
+		t.Fatalf("Error listing sites: %v", err)
+	}
+	if len(sites) != 2 {
+		t.Fatalf("Expected 2 sites, got %+v", sites)
+	}
+	for _, site := range sites {
+		if site.Issuer != "acme" || !site.NotAfter.Equal(notAfter) || site.Serial != strconv.FormatInt(notAfter.Unix(), 16) || site.KeyType != "ECDSA P-256" || len(site.SANs) != 1 {
+			t.Errorf("Unexpected site: %+v", site)
+		}
+		if site.Locked != (site.Domain == "example.com") {
+			t.Errorf("Unexpected lock status: %+v", site)
+		}
+	}
+}
+
+func TestCertMagicEvents(t *testing.T) {
+	s := setupCertMagicStorage(t)
+	ctx := context.Background()
+
+	var events []string
+	s.OnEvent(func(name string, data map[string]interface{}) {
+		events = append(events, name)
+	})
+
+	key := "certificates/acme/example.com/example.com.crt"
+	if err := s.Store(ctx, key, []byte("cert")); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	if err := s.Store(ctx, "certificates/acme/example.com/example.com.json", []byte("{}")); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	if err := s.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	if err := s.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Error unlocking: %v", err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+
+	expected := []string{
+		tlsclouddatastore.EventCertStored,
+		tlsclouddatastore.EventLockAcquired,
+		tlsclouddatastore.EventCertDeleted,
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestChainStorage(t *testing.T) {
+	primary := setupCertMagicStorage(t)
+	t.Setenv(tlsclouddatastore.EnvNamePrefix, "secondary")
+	secondary, err := tlsclouddatastore.NewCertMagicStorage()
+	if err != nil {
+		t.Fatalf("Error creating CertMagic storage: %v", err)
+	}
+	s := tlsclouddatastore.NewChainStorage(primary, secondary)
+	ctx := context.Background()
+
+	// only in the secondary, eg not migrated yet
+	if err := secondary.Store(ctx, "old", []byte("old")); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	value, err := s.Load(ctx, "old")
+	if err != nil || string(value) != "old" {
+		t.Fatalf("Expected value from secondary, got %q: %v", value, err)
+	}
+
+	if err := s.Store(ctx, "new", []byte("new")); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	for _, storage := range []*tlsclouddatastore.CertMagicStorage{primary, secondary} {
+		if value, err := storage.Load(ctx, "new"); err != nil || string(value) != "new" {
+			t.Fatalf("Expected value written to both storages, got %q: %v", value, err)
+		}
+	}
+
+	keys, err := s.List(ctx, "", true)
+	if err != nil {
+		t.Fatalf("Error listing: %v", err)
+	}
+	if expected := []string{"new", "old"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected keys %v, got %v", expected, keys)
+	}
+
+	if err := s.Delete(ctx, "old"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	if s.Exists(ctx, "old") {
+		t.Fatal("Expected key deleted from both storages")
+	}
+}
+
+func TestMigrateToCertMagic(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+
+	if err := gds.StoreSite("*.example.com", getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	user := &caddytls.UserData{
+		Reg: []byte(`{"body":{"status":"valid","contact":["mailto:me@example.com"]},"uri":"https://acme.example.com/acct/1"}`),
+		Key: []byte("key"),
+	}
+	if err := gds.StoreUser("me@example.com", user); err != nil {
+		t.Fatalf("Error storing user: %v", err)
+	}
+
+	s, err := tlsclouddatastore.NewCertMagicStorage()
+	if err != nil {
+		t.Fatalf("Error creating CertMagic storage: %v", err)
+	}
+	sites, users, err := gds.MigrateToCertMagic(ctx, s)
+	if err != nil {
+		t.Fatalf("Error migrating: %v", err)
+	}
+	if sites != 1 || users != 1 {
+		t.Fatalf("Expected 1 site and 1 user migrated, got %d and %d", sites, users)
+	}
+
+	issuer := "acme-staging.api.letsencrypt.org-directory"
+	cert, err := s.Load(ctx, "certificates/"+issuer+"/wildcard_.example.com/wildcard_.example.com.crt")
+	if err != nil || string(cert) != "cert" {
+		t.Fatalf("Expected migrated certificate, got %q: %v", cert, err)
+	}
+
+	reg, err := s.Load(ctx, "acme/"+issuer+"/users/me@example.com/me.json")
+	if err != nil {
+		t.Fatalf("Error loading migrated account: %v", err)
+	}
+	var account map[string]interface{}
+	if err := json.Unmarshal(reg, &account); err != nil {
+		t.Fatalf("Error decoding migrated account: %v", err)
+	}
+	if account["location"] != "https://acme.example.com/acct/1" || account["status"] != "valid" {
+		t.Fatalf("Unexpected migrated account: %s", reg)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	src := setupCertMagicStorage(t)
+	t.Setenv(tlsclouddatastore.EnvNamePrefix, "dst")
+	dst, err := tlsclouddatastore.NewCertMagicStorage()
+	if err != nil {
+		t.Fatalf("Error creating CertMagic storage: %v", err)
+	}
+	ctx := context.Background()
+
+	store := func(s *tlsclouddatastore.CertMagicStorage, key, value string) {
+		if err := s.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatalf("Error storing: %v", err)
+		}
+	}
+	store(src, "certificates/acme/missing.com/missing.com.crt", "missing")
+	store(src, "certificates/acme/same.com/same.com.crt", "same")
+	store(dst, "certificates/acme/same.com/same.com.crt", "same")
+	store(src, "certificates/acme/conflict.com/conflict.com.crt", "old")
+	store(dst, "certificates/acme/conflict.com/conflict.com.crt", "edited")
+	store(dst, "certificates/acme/newer.com/newer.com.crt", "old")
+	store(src, "certificates/acme/newer.com/newer.com.crt", "new")
+
+	report, err := tlsclouddatastore.Reconcile(ctx, src, dst, true)
+	if err != nil {
+		t.Fatalf("Error reconciling: %v", err)
+	}
+	if len(report.Missing) != 1 || len(report.Newer) != 1 || len(report.Conflicts) != 1 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if dst.Exists(ctx, "certificates/acme/missing.com/missing.com.crt") {
+		t.Fatal("Expected nothing copied in a dry run")
+	}
+
+	if _, err := tlsclouddatastore.Reconcile(ctx, src, dst, false); err != nil {
+		t.Fatalf("Error reconciling: %v", err)
+	}
+	for key, expected := range map[string]string{
+		"certificates/acme/missing.com/missing.com.crt":   "missing",
+		"certificates/acme/newer.com/newer.com.crt":       "new",
+		"certificates/acme/conflict.com/conflict.com.crt": "edited",
+	} {
+		if value, err := dst.Load(ctx, key); err != nil || string(value) != expected {
+			t.Fatalf("Expected %s in destination to be %q, got %q: %v", key, expected, value, err)
+		}
+	}
+}
+
+func TestSubscribeRenewals(t *testing.T) {
+	s := setupCertMagicStorage(t)
+	cds := s.CloudDsStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notAfter := time.Now().Add(time.Hour * 24 * 30).Truncate(time.Second)
+
+	events, err := cds.SubscribeRenewals(ctx, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	next := func() tlsclouddatastore.RenewalEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("Expected a renewal")
+		}
+		return tlsclouddatastore.RenewalEvent{}
+	}
+
+	site := getSiteWithCert(t, "example.com", notAfter)
+	if err := s.Store(ctx, "certificates/acme/example.com/example.com.crt", site.Cert); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	if e := next(); e.Domain != "example.com" || e.Issuer != "acme" || e.Stored.IsZero() {
+		t.Fatalf("Unexpected CertMagic renewal: %+v", e)
+	}
+
+	if err := cds.StoreSiteContext(ctx, "v1.example.com", getSiteWithCert(t, "v1.example.com", notAfter)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if e := next(); e.Domain != "v1.example.com" || e.Instance != cds.InstanceID() || !e.NotAfter.Equal(notAfter) {
+		t.Fatalf("Unexpected site renewal: %+v", e)
+	}
+}
@@ -0,0 +1,118 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// ChainStorage chains two CertMagic storages, eg Cloud Datastore and the
+// storage being migrated from. Reads try the primary first and fall back to
+// the secondary, writes go to both. Locks are only taken in the primary, so
+// every instance must use the same primary.
+type ChainStorage struct {
+	primary   certmagic.Storage
+	secondary certmagic.Storage
+}
+
+var _ certmagic.Storage = (*ChainStorage)(nil)
+
+// NewChainStorage returns a storage reading from primary, falling back to
+// secondary, and writing to both.
+func NewChainStorage(primary, secondary certmagic.Storage) *ChainStorage {
+	return &ChainStorage{primary: primary, secondary: secondary}
+}
+
+// Store puts value at key in both storages.
+func (s *ChainStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := s.primary.Store(ctx, key, value); err != nil {
+		return fmt.Errorf("Unable to store %v in primary storage: %w", key, err)
+	}
+	if err := s.secondary.Store(ctx, key, value); err != nil {
+		return fmt.Errorf("Unable to store %v in secondary storage: %w", key, err)
+	}
+	return nil
+}
+
+// Load retrieves the value at key from the primary or, if it's missing or
+// failing, the secondary.
+func (s *ChainStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.primary.Load(ctx, key)
+	if err == nil {
+		return value, nil
+	}
+	if value, err2 := s.secondary.Load(ctx, key); err2 == nil {
+		return value, nil
+	}
+	return nil, err
+}
+
+// Delete deletes key from both storages, it's not an error for either not
+// to have it.
+func (s *ChainStorage) Delete(ctx context.Context, key string) error {
+	if err := s.primary.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Unable to delete %v from primary storage: %w", key, err)
+	}
+	if err := s.secondary.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Unable to delete %v from secondary storage: %w", key, err)
+	}
+	return nil
+}
+
+// Exists returns true if key exists in either storage.
+func (s *ChainStorage) Exists(ctx context.Context, key string) bool {
+	return s.primary.Exists(ctx, key) || s.secondary.Exists(ctx, key)
+}
+
+// List returns the keys under prefix in either storage.
+func (s *ChainStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	primary, err := s.primary.List(ctx, prefix, recursive)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	secondary, err2 := s.secondary.List(ctx, prefix, recursive)
+	if err2 != nil && !errors.Is(err2, fs.ErrNotExist) {
+		return nil, err2
+	}
+	if err != nil && err2 != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var list []string
+	for _, k := range append(primary, secondary...) {
+		if !seen[k] {
+			seen[k] = true
+			list = append(list, k)
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// Stat returns information about key from the primary or, if it's missing or
+// failing, the secondary.
+func (s *ChainStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info, err := s.primary.Stat(ctx, key)
+	if err == nil {
+		return info, nil
+	}
+	if info, err2 := s.secondary.Stat(ctx, key); err2 == nil {
+		return info, nil
+	}
+	return certmagic.KeyInfo{}, err
+}
+
+// Lock obtains the lock name in the primary storage.
+func (s *ChainStorage) Lock(ctx context.Context, name string) error {
+	return s.primary.Lock(ctx, name)
+}
+
+// Unlock releases the lock name in the primary storage.
+func (s *ChainStorage) Unlock(ctx context.Context, name string) error {
+	return s.primary.Unlock(ctx, name)
+}
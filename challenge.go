@@ -0,0 +1,144 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// ACME challenge types
+const (
+	ChallengeDNS01     = "dns-01"
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// Challenge is the state of an in-flight ACME challenge, shared so any
+// instance of a cluster can work on it.
+type Challenge struct {
+	Type    string
+	Domain  string
+	Token   string
+	KeyAuth string
+	Expires time.Time
+}
+
+// cdsChallengeRecord is a challenge, Token and KeyAuth are encrypted in Value.
+type cdsChallengeRecord struct {
+	cdsEncryptedRecord
+	Expires time.Time
+}
+
+// challengeSecrets is the encrypted part of a cdsChallengeRecord.
+type challengeSecrets struct {
+	Token   string
+	KeyAuth string
+}
+
+func (cds *CloudDsStorage) challengeKey(typ, domain string) *datastore.Key {
+	return cds.dsKey(CHALLENGE_RECORD, path.Join("challenges", typ, cds.nameSegment(escapeWildcard(domain))))
+}
+
+// StoreChallenge stores c, replacing any challenge of the same type for the
+// domain, so any instance can answer the CA's validation request.
+func (cds *CloudDsStorage) StoreChallenge(ctx context.Context, c *Challenge) error {
+	r := &cdsChallengeRecord{Expires: c.Expires}
+	var err error
+	if r.Value, err = cds.toBytes(&challengeSecrets{Token: c.Token, KeyAuth: c.KeyAuth}); err != nil {
+		return fmt.Errorf("Unable to encode %s challenge for %v: %w", c.Type, c.Domain, err)
+	}
+	cds.stamp(&r.cdsEncryptedRecord)
+
+	if _, err := cds.siteClient(c.Domain).Put(ctx, cds.challengeKey(c.Type, c.Domain), r); err != nil {
+		return fmt.Errorf("Unable to store %s challenge for %v: %w", c.Type, c.Domain, err)
+	}
+	return nil
+}
+
+// LoadChallenge returns the challenge of typ for domain, ErrNotExist if
+// there isn't one or it's expired.
+func (cds *CloudDsStorage) LoadChallenge(ctx context.Context, typ, domain string) (*Challenge, error) {
+	r := new(cdsChallengeRecord)
+	if err := cds.siteClient(domain).Get(ctx, cds.challengeKey(typ, domain), r); err != nil {
+		return nil, fmt.Errorf("Unable to obtain %s challenge for %v: %w", typ, domain, notExist(err))
+	}
+	if cds.clock.Now().After(r.Expires) {
+		return nil, fmt.Errorf("%s challenge for %v expired: %w", typ, domain, ErrNotExist)
+	}
+
+	secrets := new(challengeSecrets)
+	if err := cds.fromBytes(r.Value, secrets); err != nil {
+		return nil, fmt.Errorf("Unable to decode %s challenge for %v: %w", typ, domain, err)
+	}
+	return &Challenge{
+		Type:    typ,
+		Domain:  domain,
+		Token:   secrets.Token,
+		KeyAuth: secrets.KeyAuth,
+		Expires: r.Expires,
+	}, nil
+}
+
+// DeleteChallenge deletes the challenge of typ for domain.
+func (cds *CloudDsStorage) DeleteChallenge(ctx context.Context, typ, domain string) error {
+	if err := cds.siteClient(domain).Delete(ctx, cds.challengeKey(typ, domain)); err != nil {
+		return fmt.Errorf("Unable to delete %s challenge for %v: %w", typ, domain, err)
+	}
+	return nil
+}
+
+// StoreDNSChallenge stores the DNS-01 challenge state for domain for ttl, so
+// other instances can present or clean up the TXT record.
+func (cds *CloudDsStorage) StoreDNSChallenge(ctx context.Context, domain, token, keyAuth string, ttl time.Duration) error {
+	return cds.StoreChallenge(ctx, &Challenge{
+		Type:    ChallengeDNS01,
+		Domain:  domain,
+		Token:   token,
+		KeyAuth: keyAuth,
+		Expires: cds.clock.Now().Add(ttl),
+	})
+}
+
+// LoadDNSChallenge returns the DNS-01 challenge state for domain, or
+// ErrNotExist if there isn't one or it's expired.
+func (cds *CloudDsStorage) LoadDNSChallenge(ctx context.Context, domain string) (*Challenge, error) {
+	return cds.LoadChallenge(ctx, ChallengeDNS01, domain)
+}
+
+// DeleteDNSChallenge deletes the DNS-01 challenge state for domain.
+func (cds *CloudDsStorage) DeleteDNSChallenge(ctx context.Context, domain string) error {
+	return cds.DeleteChallenge(ctx, ChallengeDNS01, domain)
+}
+
+// PruneChallenges deletes expired challenges of every type and returns how
+// many were deleted. Challenges are short lived so call it periodically, eg
+// from the instance holding a leadership.
+func (cds *CloudDsStorage) PruneChallenges(ctx context.Context) (int, error) {
+	var n int
+	for _, client := range cds.clients() {
+		q := datastore.NewQuery(CHALLENGE_RECORD).
+			Namespace(cds.namespace).
+			FilterField("Expires", "<", cds.clock.Now()).
+			KeysOnly()
+		var keys []*datastore.Key
+		for it := client.Run(ctx, q); ; {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return n, fmt.Errorf("Unable to query expired challenges: %w", err)
+			}
+			keys = append(keys, k)
+		}
+		if err := deleteMulti(ctx, client, keys); err != nil {
+			return n, fmt.Errorf("Unable to delete expired challenges: %w", err)
+		}
+		n += len(keys)
+	}
+	return n, nil
+}
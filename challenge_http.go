@@ -0,0 +1,42 @@
+package tlsclouddatastore
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// httpChallengeBasePath is where the CA requests HTTP-01 challenge responses.
+const httpChallengeBasePath = "/.well-known/acme-challenge/"
+
+// HTTPChallengeHandler answers HTTP-01 validation requests for challenges
+// stored by any instance, passing all other requests to next. Use it when a
+// load balancer may send the CA's request to a different instance than the
+// one that started issuance.
+func (cds *CloudDsStorage) HTTPChallengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, httpChallengeBasePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		domain := r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			domain = host
+		}
+		token := strings.TrimPrefix(r.URL.Path, httpChallengeBasePath)
+
+		c, err := cds.LoadChallenge(r.Context(), ChallengeHTTP01, domain)
+		if err != nil || c.Token != token {
+			if err != nil {
+				log.Printf("[INFO] No shared HTTP-01 challenge for %v: %v", domain, err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(c.KeyAuth))
+	})
+}
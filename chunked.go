@@ -0,0 +1,282 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/seal"
+)
+
+const (
+	// chunkSize is the plaintext size of each chunk of a chunked value.
+	chunkSize = 64 << 10
+
+	// chunkThreshold is the size above which values are stored chunked.
+	chunkThreshold = chunkSize
+
+	// chunkSaltSize is the size of the random salt a chunked value's key is
+	// derived with.
+	chunkSaltSize = 16
+)
+
+// Chunked values are encrypted in chunks of chunkSize, so neither the whole
+// plaintext nor the whole ciphertext has to be held to encrypt or decrypt
+// them. Each value has its own key, an HMAC of a random salt with the AES
+// key, and is laid out as the salt followed by each sealed chunk. A chunk's
+// nonce is its index, with the last byte set on the final chunk so
+// truncation at a chunk boundary is detected. The final chunk is never a
+// full one, it's empty if the plaintext fills every other chunk.
+
+// chunkAEAD returns the cipher of a chunked value with salt.
+func chunkAEAD(key, salt []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("chunked-value"))
+	m.Write(salt)
+	return seal.New(m.Sum(nil))
+}
+
+// chunkNonce returns the nonce of chunk i.
+func chunkNonce(i uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:11], i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// chunkWriter encrypts what's written to it into dst, a chunk at a time.
+type chunkWriter struct {
+	dst   io.Writer
+	gcm   cipher.AEAD
+	buf   []byte
+	index uint32
+	out   []byte
+}
+
+// newChunkWriter returns a writer encrypting a chunked value with key into
+// dst. The value is only complete once it's closed.
+func (cds *CloudDsStorage) newChunkWriter(key []byte, dst io.Writer) (io.WriteCloser, error) {
+	salt := make([]byte, chunkSaltSize)
+	if _, err := io.ReadFull(cds.nonceSource(), salt); err != nil {
+		return nil, fmt.Errorf("Unable to generate salt: %v", err)
+	}
+	gcm, err := chunkAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(salt); err != nil {
+		return nil, err
+	}
+	w := &chunkWriter{dst: dst, gcm: gcm, buf: make([]byte, 0, chunkSize)}
+	// checked on read like unchunked values
+	_, err = w.Write([]byte(valuePrefix))
+	return w, err
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == chunkSize {
+			// only sealed once more follows, the final chunk is never full
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *chunkWriter) seal(last bool) error {
+	if !last && w.index == ^uint32(0) {
+		return errors.New("Chunked value too large")
+	}
+	w.out = w.gcm.Seal(w.out[:0], chunkNonce(w.index, last), w.buf, nil)
+	w.index++
+	for i := range w.buf {
+		w.buf[i] = 0
+	}
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(w.out)
+	return err
+}
+
+// Close writes the final chunk.
+func (w *chunkWriter) Close() error {
+	if len(w.buf) == chunkSize {
+		if err := w.seal(false); err != nil {
+			return err
+		}
+	}
+	return w.seal(true)
+}
+
+// chunkReader decrypts a chunked value from src, a chunk at a time.
+type chunkReader struct {
+	src   io.Reader
+	key   []byte
+	gcm   cipher.AEAD
+	in    []byte
+	buf   []byte
+	plain []byte // the rest of the current chunk
+	index uint32
+	done  bool
+}
+
+// newChunkReader returns a reader of the chunked value with key in src.
+// Errors are ErrDecryption if the value was altered, truncated or encrypted
+// with another key.
+func newChunkReader(key []byte, src io.Reader) io.Reader {
+	return &chunkReader{src: src, key: key, in: make([]byte, chunkSize+16)}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		first := r.gcm == nil
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+		if first {
+			// the first chunk always holds the whole prefix
+			if !bytes.HasPrefix(r.plain, []byte(valuePrefix)) {
+				return 0, fmt.Errorf("%w: invalid data format", ErrDecryption)
+			}
+			r.plain = r.plain[len(valuePrefix):]
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into plain.
+func (r *chunkReader) next() error {
+	if r.gcm == nil {
+		salt := make([]byte, chunkSaltSize)
+		if _, err := io.ReadFull(r.src, salt); err != nil {
+			return fmt.Errorf("%w: invalid contents", ErrDecryption)
+		}
+		var err error
+		if r.gcm, err = chunkAEAD(r.key, salt); err != nil {
+			return err
+		}
+	}
+
+	n, err := io.ReadFull(r.src, r.in)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		// shorter than a full chunk, so it's the final one. Nothing after a
+		// full chunk is a truncated value, which fails to open
+		last = true
+	case err != nil:
+		return err
+	}
+	plain, err := r.gcm.Open(r.buf[:0], chunkNonce(r.index, last), r.in[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	r.buf, r.plain = plain, plain
+	r.index++
+	r.done = last
+	return nil
+}
+
+// chunkedToBytes encrypts value as a chunked value with key.
+func (cds *CloudDsStorage) chunkedToBytes(key, value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	chunks := (len(valuePrefix)+len(value))/chunkSize + 1
+	buf.Grow(chunkSaltSize + len(valuePrefix) + len(value) + chunks*16)
+	w, err := cds.newChunkWriter(key, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// StoreFrom stores the value read from src at key, encrypting it a chunk at
+// a time so the whole plaintext isn't held in memory, eg to import large
+// values in bulk. The encrypted value is still limited by Cloud Datastore's
+// entity size of 1 MiB.
+func (s *CertMagicStorage) StoreFrom(ctx context.Context, key string, src io.Reader) error {
+	cds := s.cds
+	if len(cds.kvAESKey(key)) == 0 || (cds.fieldEnc && isCertKey(key)) {
+		// stored as-is, so read whole
+		value, err := io.ReadAll(src)
+		if err != nil {
+			return fmt.Errorf("Unable to read %v: %w", key, err)
+		}
+		return s.Store(ctx, key, value)
+	}
+
+	var buf bytes.Buffer
+	w, err := cds.newChunkWriter(cds.kvAESKey(key), &buf)
+	if err != nil {
+		return fmt.Errorf("Unable to encode %v: %w", key, err)
+	}
+	size, err := io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to encode %v: %w", key, err)
+	}
+
+	r := &cdsKVRecord{Size: size, Chunked: true}
+	r.Value = buf.Bytes()
+	if err := cds.kvPut(ctx, key, r); err != nil {
+		return s.degraded("store", key, err)
+	}
+	if isCertKey(key) {
+		s.emit(EventCertStored, map[string]interface{}{"key": cleanKVKey(key)})
+	}
+	return nil
+}
+
+// LoadTo writes the value at key to dst, decrypting chunked values a chunk at
+// a time so the whole plaintext isn't held in memory alongside the record,
+// eg to export large values in bulk.
+func (s *CertMagicStorage) LoadTo(ctx context.Context, key string, dst io.Writer) error {
+	ctx = withOpCategory(ctx, OpCategoryHandshake)
+	r, err := s.cds.kvGet(ctx, key)
+	if err != nil {
+		return s.degraded("load", key, err)
+	}
+	if !r.Chunked || r.Cert != nil {
+		value, err := s.cds.kvDecode(ctx, key, r)
+		if err != nil {
+			return s.degraded("load", key, err)
+		}
+		_, err = dst.Write(value)
+		return err
+	}
+
+	if _, err := io.Copy(dst, newChunkReader(s.cds.kvAESKey(key), bytes.NewReader(r.Value))); err != nil {
+		return s.degraded("load", key, s.cds.decryptFailed(key, fmt.Errorf("Unable to decode %v: %w", key, err)))
+	}
+	if isPrivateKeyKey(key) {
+		s.cds.recordKeyAccess(ctx, certMagicDomain(strings.Split(cleanKVKey(key), "/")[2]))
+	}
+	return nil
+}
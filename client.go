@@ -0,0 +1,164 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// dsClient is the subset of *datastore.Client the storage uses, so unit tests
+// can substitute a fake for the emulator.
+type dsClient interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	Run(ctx context.Context, q *datastore.Query) dsIterator
+	KeysInRange(ctx context.Context, kind, namespace, start, end string) ([]*datastore.Key, error)
+	GetProjection(ctx context.Context, key *datastore.Key, props ...string) (datastore.PropertyList, error)
+	RunInTransaction(ctx context.Context, f func(tx dsTransaction) error) error
+	Close() error
+}
+
+// maxDeleteBatch is the most keys a single DeleteMulti call can delete.
+const maxDeleteBatch = 500
+
+// deleteMulti deletes keys with as few DeleteMulti calls as possible, rather
+// than a Delete call for each.
+func deleteMulti(ctx context.Context, client dsClient, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteBatch {
+			n = maxDeleteBatch
+		}
+		if err := client.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// dsIterator is the result of a query.
+type dsIterator interface {
+	Next(dst interface{}) (*datastore.Key, error)
+	Cursor() (datastore.Cursor, error)
+}
+
+// errIterator is the result of a query that fails with err.
+type errIterator struct {
+	err error
+}
+
+func (it errIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return nil, it.err
+}
+
+func (it errIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.Cursor{}, it.err
+}
+
+// dsTransaction is the subset of *datastore.Transaction the storage uses.
+type dsTransaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
+	Delete(key *datastore.Key) error
+}
+
+// cloudClient adapts *datastore.Client to dsClient.
+type cloudClient struct {
+	*datastore.Client
+}
+
+func (c cloudClient) Run(ctx context.Context, q *datastore.Query) dsIterator {
+	return c.Client.Run(ctx, q)
+}
+
+// KeysInRange returns the keys of kind in namespace with names from start up
+// to but excluding end, in order.
+func (c cloudClient) KeysInRange(ctx context.Context, kind, namespace, start, end string) ([]*datastore.Key, error) {
+	startKey := datastore.NameKey(kind, start, nil)
+	startKey.Namespace = namespace
+	endKey := datastore.NameKey(kind, end, nil)
+	endKey.Namespace = namespace
+
+	q := datastore.NewQuery(kind).
+		Namespace(namespace).
+		FilterField("__key__", ">=", startKey).
+		FilterField("__key__", "<", endKey).
+		KeysOnly()
+
+	var keys []*datastore.Key
+	for it := c.Client.Run(ctx, q); ; {
+		k, err := it.Next(nil)
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+}
+
+// GetProjection returns only props of the entity at key, with a projection
+// query so its encrypted value isn't transferred, or checks it exists with a
+// keys-only query if props is empty. Only indexed properties can be projected,
+// datastore.ErrNoSuchEntity is returned if the entity doesn't have them all.
+func (c cloudClient) GetProjection(ctx context.Context, key *datastore.Key, props ...string) (datastore.PropertyList, error) {
+	q := datastore.NewQuery(key.Kind).
+		Namespace(key.Namespace).
+		FilterField("__key__", "=", key).
+		Limit(1)
+	var dst interface{}
+	var list datastore.PropertyList
+	if len(props) == 0 {
+		q = q.KeysOnly()
+	} else {
+		q = q.Project(props...)
+		dst = &list
+	}
+
+	_, err := c.Client.Run(ctx, q).Next(dst)
+	if err == iterator.Done {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return list, err
+}
+
+// propTime returns the time property name of props, which projection queries
+// return as microseconds since the epoch.
+func propTime(props datastore.PropertyList, name string) time.Time {
+	for _, p := range props {
+		if p.Name != name {
+			continue
+		}
+		switch v := p.Value.(type) {
+		case time.Time:
+			return v
+		case int64:
+			return time.UnixMicro(v)
+		}
+	}
+	return time.Time{}
+}
+
+// propInt returns the integer property name of props.
+func propInt(props datastore.PropertyList, name string) int64 {
+	for _, p := range props {
+		if v, ok := p.Value.(int64); ok && p.Name == name {
+			return v
+		}
+	}
+	return 0
+}
+
+func (c cloudClient) RunInTransaction(ctx context.Context, f func(tx dsTransaction) error) error {
+	_, err := c.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(tx)
+	})
+	return err
+}
@@ -0,0 +1,57 @@
+package tlsclouddatastore
+
+import "time"
+
+// Clock tells the time for lock expiry, renewal and other record expiry.
+// Tests can set Config.Clock to control time instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// lockTime returns t as lock expiries are stored: in UTC, to the microsecond
+// Cloud Datastore keeps and without the monotonic reading storing drops, so
+// an expiry reads back as it was written whatever the instance's timezone.
+func lockTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// lockLive returns whether a lock expiring at expires, as stored, is still
+// held, allowing for the holder's clock being behind by up to EnvNameLockSkew.
+// Instants are compared, so timezones don't matter.
+func (cds *CloudDsStorage) lockLive(expires time.Time) bool {
+	return !expires.IsZero() && cds.clock.Now().UTC().Before(expires.Add(cds.skew()))
+}
+
+// lockRemaining returns how long a lock expiring at expires, as stored, has
+// left with the skew allowance, at most siteLockTTL plus the allowance, so a
+// holder whose clock is ahead of this instance's can't make it wait longer
+// than the lock could last.
+func (cds *CloudDsStorage) lockRemaining(expires time.Time) time.Duration {
+	skew := cds.skew()
+	d := expires.Add(skew).Sub(cds.clock.Now())
+	if limit := siteLockTTL + skew; d > limit {
+		d = limit
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// skew returns the allowance for other instances' clocks, from
+// EnvNameLockSkew or widened by drift checks.
+func (cds *CloudDsStorage) skew() time.Duration {
+	return time.Duration(cds.lockSkew.Load())
+}
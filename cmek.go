@@ -0,0 +1,77 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	firestoreadmin "google.golang.org/api/firestore/v1"
+	"google.golang.org/api/option"
+)
+
+// defaultDatabase is the ID of the database clients use unless a project
+// route names another.
+const defaultDatabase = "(default)"
+
+// databaseKMSKey returns the KMS key the database name, as
+// `projects/<project>/databases/<database>`, is encrypted with, empty if it
+// uses Google-managed encryption. A variable so tests can replace the Admin
+// API.
+var databaseKMSKey = func(ctx context.Context, name string, o []option.ClientOption) (string, error) {
+	svc, err := firestoreadmin.NewService(ctx, o...)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create Firestore Admin client: %w", err)
+	}
+	db, err := svc.Projects.Databases.Get(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Unable to obtain database %s: %w", name, err)
+	}
+	if db.CmekConfig == nil {
+		return "", nil
+	}
+	return db.CmekConfig.KmsKeyName, nil
+}
+
+// checkCMEK returns an error unless every database cfg uses, the project's
+// default one and those of project routes, is encrypted with cfg.KMSKeyName,
+// when that's set.
+func checkCMEK(ctx context.Context, cfg *Config) error {
+	if cfg.KMSKeyName == "" {
+		return nil
+	}
+	if os.Getenv("DATASTORE_EMULATOR_HOST") != "" {
+		log.Printf("[WARNING] Not checking %s against the Datastore emulator", EnvNameKMSKey)
+		return nil
+	}
+
+	o := append(baseClientOptions(cfg), option.WithCredentialsFile(cfg.ServiceAccountFile))
+
+	names := []string{fmt.Sprintf("projects/%s/databases/%s", cfg.ProjectID, defaultDatabase)}
+	for _, r := range cfg.ProjectRoutes {
+		database := r.Database
+		if database == "" {
+			database = defaultDatabase
+		}
+		names = append(names, fmt.Sprintf("projects/%s/databases/%s", r.Project, database))
+	}
+
+	checked := make(map[string]bool)
+	for _, name := range names {
+		if checked[name] {
+			continue
+		}
+		checked[name] = true
+		key, err := databaseKMSKey(ctx, name, o)
+		if err != nil {
+			return err
+		}
+		if key != cfg.KMSKeyName {
+			if key == "" {
+				key = "Google-managed encryption"
+			}
+			return fmt.Errorf("Database %s is protected by %s, not %s required by %s", name, key, cfg.KMSKeyName, EnvNameKMSKey)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedPrefix starts values compressed with EnvNameCompression in place
+// of valuePrefix, which is compressed along with the rest of the value.
+const compressedPrefix = "caddy-tlszstd"
+
+// maxDecompressedSize bounds decompressed values, well over Cloud Datastore's
+// entity size so only a corrupted or malicious value reaches it.
+const maxDecompressedSize = 16 << 20
+
+// pemDict is the embedded zstd dictionary, trained with `zstd --train
+// --maxdict=8192` on generated ECDSA and RSA certificates and keys in PEM,
+// their CertMagic and Caddy v1 metadata and the site and user JSON records
+// holding them. Values compressed with it can only be read with it, so it
+// mustn't change; a new one would be embedded alongside it.
+//
+//go:embed pem.dict
+var pemDict []byte
+
+// zstdCodec compresses values with a dictionary and decompresses values
+// compressed with it or the embedded one. Both are safe for concurrent use.
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCodec(dict []byte) (*zstdCodec, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create zstd encoder: %w", err)
+	}
+	dicts := [][]byte{pemDict}
+	if !bytes.Equal(dict, pemDict) {
+		dicts = append(dicts, dict)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...), zstd.WithDecoderMaxMemory(maxDecompressedSize), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		enc.Close()
+		return nil, fmt.Errorf("Unable to create zstd decoder: %w", err)
+	}
+	return &zstdCodec{enc: enc, dec: dec}, nil
+}
+
+// loadZstdCodec creates the codec of the dictionary in path, see
+// EnvNameCompressionDict.
+func loadZstdCodec(path string) (*zstdCodec, error) {
+	dict, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read compression dictionary %s: %w", path, err)
+	}
+	c, err := newZstdCodec(dict)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid compression dictionary %s: %w", path, err)
+	}
+	return c, nil
+}
+
+var (
+	pemCodecOnce sync.Once
+	pemCodec     *zstdCodec
+	pemCodecErr  error
+)
+
+// zstd returns the codec of the storage's dictionary, the embedded one's
+// unless EnvNameCompressionDict is set. It's only created once a value is
+// compressed or decompressed, as most storages never do either.
+func (cds *CloudDsStorage) zstd() (*zstdCodec, error) {
+	if cds.codec != nil {
+		return cds.codec, nil
+	}
+	pemCodecOnce.Do(func() {
+		pemCodec, pemCodecErr = newZstdCodec(pemDict)
+	})
+	return pemCodec, pemCodecErr
+}
+
+// compress returns plain, which starts with valuePrefix, compressed into dst,
+// or plain itself if compressing doesn't make it smaller.
+func (cds *CloudDsStorage) compress(dst *[]byte, plain []byte) ([]byte, error) {
+	c, err := cds.zstd()
+	if err != nil {
+		return nil, err
+	}
+	*dst = c.enc.EncodeAll(plain, append((*dst)[:0], compressedPrefix...))
+	if len(*dst) >= len(plain) {
+		return plain, nil
+	}
+	return *dst, nil
+}
+
+// decompress reverses compress, returning plain as is if it isn't
+// compressed.
+func (cds *CloudDsStorage) decompress(plain []byte) ([]byte, error) {
+	if !bytes.HasPrefix(plain, []byte(compressedPrefix)) {
+		return plain, nil
+	}
+	c, err := cds.zstd()
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.dec.DecodeAll(plain[len(compressedPrefix):], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid compressed value: %v", ErrDecryption, err)
+	}
+	return out, nil
+}
+
+// Close releases the codec's encoder and decoder.
+func (c *zstdCodec) Close() {
+	c.enc.Close()
+	c.dec.Close()
+}
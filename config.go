@@ -0,0 +1,458 @@
+package tlsclouddatastore
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Config holds the storage settings. ConfigFromEnv reads them from env vars,
+// zero values mean the defaults.
+type Config struct {
+	// Profile the config was read for, empty for the usual env vars
+	Profile string
+
+	ProjectID string
+
+	// ServiceAccountFile is the path to a service account json key file, not
+	// needed when DATASTORE_EMULATOR_HOST is set
+	ServiceAccountFile string
+
+	// AESKeyB64 is the base64 encoded AES key, without one storing fails
+	// with ErrPlaintext unless AllowPlaintext is set
+	AESKeyB64 string
+
+	// AllowPlaintext acknowledges that records are stored unencrypted if
+	// there's no AES key, see EnvNameAllowPlaintext
+	AllowPlaintext bool
+
+	// UserAESKeyB64 is the base64 encoded AES key of user records and
+	// CertMagic account keys, they use AESKeyB64 if it's empty
+	UserAESKeyB64 string
+
+	// HashKeyB64 is the base64 encoded key domains and emails in key names
+	// are hashed with, they're stored as-is if it's empty
+	HashKeyB64 string
+
+	// NameKeyB64 is the base64 encoded key domains and emails in key names
+	// are deterministically encrypted with, it takes precedence over
+	// HashKeyB64 for new records
+	NameKeyB64 string
+
+	// Prefix of all keys, defaults to DefaultPrefix
+	Prefix string
+
+	// Timeout of operations made through the caddytls.Storage interface, defaults to DefaultTimeout
+	Timeout time.Duration
+
+	// LockSkew is how far other instances' clocks may be off, see EnvNameLockSkew
+	LockSkew time.Duration
+
+	// DriftThreshold is how far the clock may be from Cloud Datastore's
+	// before a warning is logged, defaults to DefaultDriftThreshold, negative
+	// disables the check
+	DriftThreshold time.Duration
+
+	// DriftWidenSkew widens LockSkew to the drift measured, when it's over
+	// DriftThreshold
+	DriftWidenSkew bool
+
+	// ExpiryMonitor is how often the expiry of stored certificates is
+	// scanned, see EnvNameExpiryMonitor, disabled if 0
+	ExpiryMonitor time.Duration
+
+	// IntegrityScan is how often every record is checked by IntegrityScan,
+	// see EnvNameIntegrityScan, disabled if 0
+	IntegrityScan time.Duration
+
+	// IssuanceRate limits how many certificates the cluster obtains or
+	// renews, see EnvNameIssuanceRate, unlimited if zero
+	IssuanceRate Rate
+
+	// DomainIssuanceRate limits how many certificates the cluster obtains or
+	// renews per registered domain, unlimited if zero
+	DomainIssuanceRate Rate
+
+	// RenewalJitter staggers renewals across the cluster, see
+	// EnvNameRenewalJitter, disabled if 0
+	RenewalJitter time.Duration
+
+	// RenewalWebhook is the URL a RenewalFailure is posted to, see
+	// EnvNameRenewalWebhook
+	RenewalWebhook string
+
+	// RenewalFailures is how many renewals in a row may fail before the
+	// webhook is called, defaults to DefaultRenewalFailures
+	RenewalFailures int
+
+	// NotifyWebhook is a URL Notifications are posted to as JSON, see
+	// EnvNameNotifyWebhook
+	NotifyWebhook string
+
+	// NotifySlack is a Slack incoming webhook Notifications are posted to
+	NotifySlack string
+
+	// NotifyEvents are the events notifiers are sent, all of them if empty
+	NotifyEvents []string
+
+	// Notifiers are sent events as well as the webhooks
+	Notifiers []Notifier
+
+	ProjectRoutes  []ProjectRoute
+	Shards         int
+	NamespacePerCA bool
+	Namespace      string
+	Labels         map[string]string
+
+	// FieldEncryption encrypts only the private key and meta of sites,
+	// keeping the certificate and its details queryable
+	FieldEncryption bool
+
+	// SiteAuditHistory is how many audit entries are kept per site,
+	// defaults to DefaultSiteAuditHistory, negative records none
+	SiteAuditHistory int
+
+	// AccessAudit is where site private key accesses are recorded, one of
+	// the AccessAudit constants, nothing is recorded if it's empty
+	AccessAudit string
+
+	// AllowedProjects, if set, are the only projects the storage starts with
+	AllowedProjects []string
+
+	// KMSKeyName, if set, is the customer-managed key every database must be
+	// protected by for the storage to start
+	KMSKeyName string
+
+	// SigningKeys are the HMAC keys records are signed with, the first signs
+	// new records, see EnvNameSigningKeys
+	SigningKeys []SigningKey
+
+	// AcceptUnsigned accepts unsigned records with SigningKeys
+	AcceptUnsigned bool
+
+	// UserAgent of Cloud Datastore requests, defaults to DefaultUserAgent
+	UserAgent string
+
+	// Endpoint is a regional or Private Service Connect endpoint to connect
+	// to instead of the global default, see EnvNameEndpoint
+	Endpoint string
+
+	// Proxy is the URL of an HTTP(S) proxy to tunnel Cloud Datastore
+	// connections through, see EnvNameProxy
+	Proxy string
+
+	// CAFile is a PEM bundle of CA certificates trusted as well as the system
+	// roots, see EnvNameCAFile
+	CAFile string
+
+	// TLSConfig of Cloud Datastore connections, defaults to the system's
+	TLSConfig *tls.Config
+
+	// Preflight is one of the Preflight constants, defaults to PreflightRequire
+	Preflight string
+
+	// BigtableInstance keeps records in Cloud Bigtable rather than Cloud
+	// Datastore, see NewBigtableStorage
+	BigtableInstance string
+
+	// BigtableTable is the Cloud Bigtable table, defaults to DefaultBigtableTable
+	BigtableTable string
+
+	// GCSBucket keeps records in Cloud Storage rather than Cloud Datastore,
+	// see NewGCSStorage
+	GCSBucket string
+
+	// SpannerDatabase keeps records in Cloud Spanner rather than Cloud
+	// Datastore, `<instance>/<database>`, see NewSpannerStorage
+	SpannerDatabase string
+
+	// SpannerTable is the Cloud Spanner table, defaults to DefaultSpannerTable
+	SpannerTable string
+
+	// RedisURL caches site and certificate reads in Redis, see EnvNameRedisURL
+	RedisURL string
+
+	// CacheTTL is how long records stay in the cache, defaults to DefaultCacheTTL
+	CacheTTL time.Duration
+
+	// UnaryInterceptors and StreamInterceptors are applied in order to every
+	// Cloud Datastore connection, eg for auth proxies, request logging or tracing
+	UnaryInterceptors  []grpc.UnaryClientInterceptor
+	StreamInterceptors []grpc.StreamClientInterceptor
+
+	// InstanceID defaults to the hostname with a random suffix
+	InstanceID string
+
+	// Clock defaults to the system clock
+	Clock Clock
+
+	// Rand is the source of encryption nonces, defaults to crypto/rand. Only
+	// set it to produce deterministic test vectors, reusing nonces breaks
+	// the encryption
+	Rand io.Reader
+
+	// NonceMode is one of the Nonce constants, defaults to NonceRandom
+	NonceMode string
+
+	// Compression is one of the Compression constants, defaults to CompressionOff
+	Compression string
+
+	// CompressionDict is the path to a zstd dictionary to compress with in
+	// place of the embedded one, see EnvNameCompressionDict
+	CompressionDict string
+}
+
+// ConfigFromEnv reads the config from the env vars documented on the EnvName constants,
+// for the profile selected by EnvNameProfile if it's set.
+func ConfigFromEnv() (*Config, error) {
+	return ConfigFromEnvProfile(os.Getenv(EnvNameProfile))
+}
+
+// ConfigFromEnvProfile reads the config for profile from env vars. Each var is
+// read from its name suffixed with `_<PROFILE>` if that's set, eg
+// `CADDY_CLOUDDATASTORETLS_PREFIX_STAGING`, otherwise from its usual name.
+// With EnvNameMetadata, vars that aren't set are read from GCE metadata, other
+// than keys and URLs that may carry credentials.
+func ConfigFromEnvProfile(profile string) (*Config, error) {
+	env := &envSource{profile: profile}
+	if useMetadata := os.Getenv(EnvNameMetadata); useMetadata != "" {
+		var err error
+		if env.metadata, err = strconv.ParseBool(useMetadata); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameMetadata, err)
+		}
+	}
+
+	cfg := &Config{
+		Profile:            profile,
+		ProjectID:          env.get(EnvNameProjectId),
+		ServiceAccountFile: env.get(EnvNameServiceAccountPath),
+		AESKeyB64:          env.get(EnvNameAESKey),
+		UserAESKeyB64:      env.get(EnvNameUserAESKey),
+		HashKeyB64:         env.get(EnvNameHashKey),
+		NameKeyB64:         env.get(EnvNameNameKey),
+		Prefix:             env.get(EnvNamePrefix),
+		InstanceID:         env.get(EnvNameInstanceID),
+		Namespace:          env.get(EnvNameNamespace),
+		UserAgent:          env.get(EnvNameUserAgent),
+		Endpoint:           env.get(EnvNameEndpoint),
+		Proxy:              env.get(EnvNameProxy),
+		CAFile:             env.get(EnvNameCAFile),
+		Preflight:          env.get(EnvNamePreflight),
+		BigtableInstance:   env.get(EnvNameBigtableInstance),
+		BigtableTable:      env.get(EnvNameBigtableTable),
+		GCSBucket:          env.get(EnvNameGCSBucket),
+		SpannerDatabase:    env.get(EnvNameSpannerDatabase),
+		SpannerTable:       env.get(EnvNameSpannerTable),
+		RedisURL:           env.get(EnvNameRedisURL),
+		AccessAudit:        env.get(EnvNameAccessAudit),
+		KMSKeyName:         env.get(EnvNameKMSKey),
+		NonceMode:          env.get(EnvNameNonceMode),
+		Compression:        env.get(EnvNameCompression),
+		CompressionDict:    env.get(EnvNameCompressionDict),
+		RenewalWebhook:     env.get(EnvNameRenewalWebhook),
+		NotifyWebhook:      env.get(EnvNameNotifyWebhook),
+		NotifySlack:        env.get(EnvNameNotifySlack),
+	}
+
+	var err error
+	if timeout := env.get(EnvNameTimeout); timeout != "" {
+		if cfg.Timeout, err = time.ParseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("Unable to parse timeout from env var %s: %w", EnvNameTimeout, err)
+		}
+	}
+
+	if skew := env.get(EnvNameLockSkew); skew != "" {
+		if cfg.LockSkew, err = time.ParseDuration(skew); err != nil {
+			return nil, fmt.Errorf("Unable to parse lock skew from env var %s: %w", EnvNameLockSkew, err)
+		}
+	}
+
+	if threshold := env.get(EnvNameDriftThreshold); threshold == "off" {
+		cfg.DriftThreshold = -1
+	} else if threshold != "" {
+		if cfg.DriftThreshold, err = time.ParseDuration(threshold); err != nil {
+			return nil, fmt.Errorf("Unable to parse drift threshold from env var %s: %w", EnvNameDriftThreshold, err)
+		}
+	}
+
+	if widen := env.get(EnvNameDriftWidenSkew); widen != "" {
+		if cfg.DriftWidenSkew, err = strconv.ParseBool(widen); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameDriftWidenSkew, err)
+		}
+	}
+
+	if interval := env.get(EnvNameExpiryMonitor); interval != "" {
+		if cfg.ExpiryMonitor, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("Unable to parse expiry monitor interval from env var %s: %w", EnvNameExpiryMonitor, err)
+		}
+	}
+
+	if interval := env.get(EnvNameIntegrityScan); interval != "" {
+		if cfg.IntegrityScan, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("Unable to parse integrity scan interval from env var %s: %w", EnvNameIntegrityScan, err)
+		}
+	}
+
+	if perCA := env.get(EnvNameNamespacePerCA); perCA != "" {
+		if cfg.NamespacePerCA, err = strconv.ParseBool(perCA); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameNamespacePerCA, err)
+		}
+	}
+
+	if plaintext := env.get(EnvNameAllowPlaintext); plaintext != "" {
+		if cfg.AllowPlaintext, err = strconv.ParseBool(plaintext); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameAllowPlaintext, err)
+		}
+	}
+
+	if fieldEnc := env.get(EnvNameFieldEncryption); fieldEnc != "" {
+		if cfg.FieldEncryption, err = strconv.ParseBool(fieldEnc); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameFieldEncryption, err)
+		}
+	}
+
+	if labels := env.get(EnvNameLabels); labels != "" {
+		if cfg.Labels, err = parseLabels(labels); err != nil {
+			return nil, err
+		}
+	}
+
+	if shards := env.get(EnvNameShards); shards != "" {
+		if cfg.Shards, err = strconv.Atoi(shards); err != nil || cfg.Shards < 0 {
+			return nil, fmt.Errorf("Unable to parse number of shards from env var %s: %s", EnvNameShards, shards)
+		}
+	}
+
+	if history := env.get(EnvNameSiteAuditHistory); history == "off" {
+		cfg.SiteAuditHistory = -1
+	} else if history != "" {
+		if cfg.SiteAuditHistory, err = strconv.Atoi(history); err != nil || cfg.SiteAuditHistory < 0 {
+			return nil, fmt.Errorf("Unable to parse site audit history from env var %s: %s", EnvNameSiteAuditHistory, history)
+		}
+	}
+
+	if failures := env.get(EnvNameRenewalFailures); failures != "" {
+		if cfg.RenewalFailures, err = strconv.Atoi(failures); err != nil || cfg.RenewalFailures < 0 {
+			return nil, fmt.Errorf("Unable to parse renewal failures from env var %s: %s", EnvNameRenewalFailures, failures)
+		}
+	}
+
+	if jitter := env.get(EnvNameRenewalJitter); jitter != "" {
+		if cfg.RenewalJitter, err = time.ParseDuration(jitter); err != nil {
+			return nil, fmt.Errorf("Unable to parse renewal jitter from env var %s: %w", EnvNameRenewalJitter, err)
+		}
+	}
+
+	if ttl := env.get(EnvNameCacheTTL); ttl != "" {
+		if cfg.CacheTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("Unable to parse cache TTL from env var %s: %w", EnvNameCacheTTL, err)
+		}
+	}
+
+	if rate := env.get(EnvNameIssuanceRate); rate != "" {
+		if cfg.IssuanceRate, err = ParseRate(rate); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameIssuanceRate, err)
+		}
+	}
+
+	if rate := env.get(EnvNameDomainIssuanceRate); rate != "" {
+		if cfg.DomainIssuanceRate, err = ParseRate(rate); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameDomainIssuanceRate, err)
+		}
+	}
+
+	if events := env.get(EnvNameNotifyEvents); events != "" {
+		for _, e := range strings.Split(events, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				cfg.NotifyEvents = append(cfg.NotifyEvents, e)
+			}
+		}
+	}
+
+	if allowed := env.get(EnvNameAllowedProjects); allowed != "" {
+		for _, p := range strings.Split(allowed, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				cfg.AllowedProjects = append(cfg.AllowedProjects, p)
+			}
+		}
+	}
+
+	if keys := env.get(EnvNameSigningKeys); keys != "" {
+		if cfg.SigningKeys, err = parseSigningKeys(keys); err != nil {
+			return nil, err
+		}
+	}
+
+	if unsigned := env.get(EnvNameAcceptUnsigned); unsigned != "" {
+		if cfg.AcceptUnsigned, err = strconv.ParseBool(unsigned); err != nil {
+			return nil, fmt.Errorf("Unable to parse env var %s: %w", EnvNameAcceptUnsigned, err)
+		}
+	}
+
+	if routes := env.get(EnvNameProjectRoutes); routes != "" {
+		if cfg.ProjectRoutes, err = parseProjectRoutes(routes); err != nil {
+			return nil, err
+		}
+	}
+
+	if env.err != nil {
+		return nil, env.err
+	}
+	if cfg.ProjectID == "" && env.metadata {
+		if cfg.ProjectID, err = metadataProjectID(); err != nil {
+			return nil, fmt.Errorf("Unable to read project id from metadata: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// envSource reads the env vars of a profile, the usual ones if it's empty,
+// falling back to GCE metadata attributes when metadata is set.
+type envSource struct {
+	profile  string
+	metadata bool
+	err      error // first error reading metadata
+}
+
+func (e *envSource) get(name string) string {
+	names := []string{name}
+	if e.profile != "" {
+		names = []string{name + "_" + e.suffix(), name}
+	}
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	if !e.metadata || e.err != nil || secretEnvNames[name] {
+		return ""
+	}
+	for _, n := range names {
+		v, ok, err := metadataAttribute(attributeName(n))
+		if err != nil {
+			e.err = err
+			return ""
+		}
+		if ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// suffix returns the profile's env var name suffix, eg `STAGING`.
+func (e *envSource) suffix() string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, strings.ToUpper(e.profile))
+}
@@ -0,0 +1,168 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddytls"
+	"google.golang.org/api/option"
+)
+
+func TestConfigFromEnvProfile(t *testing.T) {
+	t.Setenv(EnvNameProjectId, "shared-project")
+	t.Setenv(EnvNamePrefix, "caddytls")
+	t.Setenv(EnvNamePrefix+"_STAGING", "staging")
+	t.Setenv(EnvNameAESKey+"_STAGING", "c3RhZ2luZw==")
+	t.Setenv(EnvNameProjectId+"_EU_PRODUCTION", "eu-project")
+
+	cfg, err := ConfigFromEnvProfile("staging")
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if cfg.Profile != "staging" || cfg.ProjectID != "shared-project" || cfg.Prefix != "staging" || cfg.AESKeyB64 != "c3RhZ2luZw==" {
+		t.Errorf("Expected the staging profile's prefix and key with the shared project, got %+v", cfg)
+	}
+
+	t.Setenv(EnvNameProfile, "eu-production")
+	cfg, err = ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if cfg.ProjectID != "eu-project" || cfg.Prefix != "caddytls" || cfg.AESKeyB64 != "" {
+		t.Errorf("Expected the eu-production profile's project with the usual prefix, got %+v", cfg)
+	}
+}
+
+func TestCheckAllowedProjects(t *testing.T) {
+	cfg := &Config{
+		ProjectID:     "staging",
+		ProjectRoutes: []ProjectRoute{{Pattern: "*.customer.com", Project: "customer-staging"}},
+	}
+	if err := checkAllowedProjects(cfg); err != nil {
+		t.Errorf("Expected any project allowed without an allowlist, got: %v", err)
+	}
+
+	cfg.AllowedProjects = []string{"staging", "customer-staging"}
+	if err := checkAllowedProjects(cfg); err != nil {
+		t.Errorf("Expected allowed projects to start, got: %v", err)
+	}
+
+	cfg.ProjectID = "production"
+	if err := checkAllowedProjects(cfg); err == nil {
+		t.Error("Expected error for a project that isn't allowed")
+	}
+
+	cfg.ProjectID = "staging"
+	cfg.ProjectRoutes[0].Project = "customer-production"
+	if err := checkAllowedProjects(cfg); err == nil {
+		t.Error("Expected error for a routed project that isn't allowed")
+	}
+}
+
+func TestConfigFromMetadata(t *testing.T) {
+	attrs := map[string]string{
+		"caddy-clouddatastoretls-prefix":         "fleet",
+		"caddy-clouddatastoretls-b64-aeskey":     "bWV0YWRhdGE=",
+		"caddy-clouddatastoretls-b64-hashkey":    "bWV0YWRhdGE=",
+		"caddy-clouddatastoretls-prefix-staging": "fleet-staging",
+	}
+	defer func(a func(string) (string, bool, error), p func() (string, error)) {
+		metadataAttribute, metadataProjectID = a, p
+	}(metadataAttribute, metadataProjectID)
+	metadataAttribute = func(name string) (string, bool, error) {
+		v, ok := attrs[name]
+		return v, ok, nil
+	}
+	metadataProjectID = func() (string, error) { return "instance-project", nil }
+
+	t.Setenv(EnvNameProjectId, "")
+	t.Setenv(EnvNameAESKey, "ZW52")
+	t.Setenv(EnvNameHashKey, "")
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if cfg.Prefix != "" || cfg.ProjectID != "" {
+		t.Errorf("Expected metadata ignored unless enabled, got %+v", cfg)
+	}
+
+	t.Setenv(EnvNameMetadata, "true")
+	cfg, err = ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if cfg.Prefix != "fleet" || cfg.ProjectID != "instance-project" || cfg.AESKeyB64 != "ZW52" {
+		t.Errorf("Expected prefix and project from metadata and env vars preferred, got %+v", cfg)
+	}
+	if cfg.HashKeyB64 != "" {
+		t.Errorf("Expected keys never read from metadata, got %s", cfg.HashKeyB64)
+	}
+
+	cfg, err = ConfigFromEnvProfile("staging")
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if cfg.Prefix != "fleet-staging" {
+		t.Errorf("Expected the profile's metadata attribute, got %s", cfg.Prefix)
+	}
+}
+
+func TestCheckCMEK(t *testing.T) {
+	t.Setenv("DATASTORE_EMULATOR_HOST", "")
+	keys := map[string]string{
+		"projects/prod/databases/(default)":     "projects/kms/locations/eu/keyRings/r/cryptoKeys/tls",
+		"projects/customer/databases/(default)": "",
+	}
+	orig := databaseKMSKey
+	defer func() { databaseKMSKey = orig }()
+	databaseKMSKey = func(ctx context.Context, name string, o []option.ClientOption) (string, error) {
+		return keys[name], nil
+	}
+
+	cfg := &Config{ProjectID: "prod"}
+	if err := checkCMEK(context.Background(), cfg); err != nil {
+		t.Errorf("Expected no check without a key, got %v", err)
+	}
+
+	cfg.KMSKeyName = "projects/kms/locations/eu/keyRings/r/cryptoKeys/tls"
+	if err := checkCMEK(context.Background(), cfg); err != nil {
+		t.Errorf("Expected the database protected by the key, got %v", err)
+	}
+
+	cfg.ProjectRoutes = []ProjectRoute{{Pattern: "*.customer.com", Project: "customer"}}
+	if err := checkCMEK(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "Google-managed") {
+		t.Errorf("Expected error for a route's database without the key, got %v", err)
+	}
+}
+
+func TestRegisterProviderNames(t *testing.T) {
+	var registered []string
+	orig := registerStorageProvider
+	defer func() { registerStorageProvider = orig }()
+	registerStorageProvider = func(name string, provider caddytls.StorageConstructor) {
+		registered = append(registered, name)
+	}
+
+	registerProviderNames(" gcds, ,gcp," + ProviderName)
+	if want := []string{"gcds", "gcp"}; !reflect.DeepEqual(registered, want) {
+		t.Errorf("Expected %v registered, got %v", want, registered)
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	keys, err := parseSigningKeys("new=bmV3, old=b2xk")
+	if err != nil {
+		t.Fatalf("Error parsing signing keys: %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "new" || keys[1].KeyB64 != "b2xk" {
+		t.Errorf("Unexpected signing keys %v", keys)
+	}
+	if _, err := parseSigningKeys("bmV3"); err == nil || strings.Contains(err.Error(), "bmV3") {
+		t.Errorf("Expected error without the key, got %v", err)
+	}
+	if _, err := decodeSigningKeys([]SigningKey{{ID: "a", KeyB64: "bmV3"}, {ID: "a", KeyB64: "b2xk"}}); err == nil {
+		t.Error("Expected error for duplicate key ids")
+	}
+}
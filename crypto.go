@@ -1,93 +1,335 @@
 package tlsclouddatastore
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sync"
+
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/seal"
 )
 
 const valuePrefix = "caddy-tlsconsul"
 
 func (cds *CloudDsStorage) encrypt(bytes []byte) ([]byte, error) {
-	// No key? No encrypt
-	if len(cds.aesKey) == 0 {
-		return bytes, nil
-	}
+	return cds.encryptWith(cds.aesKey, bytes)
+}
 
-	c, err := aes.NewCipher(cds.aesKey)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to create AES cipher: %v", err)
+// encryptWith is encrypt with key rather than the AES key.
+func (cds *CloudDsStorage) encryptWith(key, bytes []byte) ([]byte, error) {
+	// No key? No encrypt, but only if that's been acknowledged. Copied as
+	// bytes may be a scratch buffer
+	if len(key) == 0 {
+		if !cds.plaintextOK {
+			return nil, ErrPlaintext
+		}
+		return append([]byte(nil), bytes...), nil
 	}
 
-	gcm, err := cipher.NewGCM(c)
+	gcm, err := seal.For(key)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create GCM cipher: %v", err)
+		return nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	// sized for the nonce, ciphertext and tag so Seal doesn't reallocate
+	out := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(bytes)+gcm.Overhead())
+	nonce := out[:gcm.NonceSize()]
+	if cds.nonces != nil {
+		err = cds.nonces.next(nonce)
+	} else {
+		_, err = io.ReadFull(cds.nonceSource(), nonce)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Unable to generate nonce: %v", err)
 	}
 
-	return gcm.Seal(nonce, nonce, bytes, nil), nil
+	return gcm.Seal(out, nonce, bytes, nil), nil
+}
+
+// maxScratchSize is the largest scratch buffer kept for reuse, larger ones
+// are left to the garbage collector rather than pinned in the pool.
+const maxScratchSize = 64 << 10
+
+// scratchPool holds buffers for JSON encoding and decrypted values, which only
+// live for a single call.
+var scratchPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func getScratch() *[]byte {
+	buf := scratchPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// putScratch returns buf to the pool, zeroed first as it may have held a
+// private key.
+func putScratch(buf *[]byte) {
+	if cap(*buf) > maxScratchSize {
+		return
+	}
+	b := (*buf)[:cap(*buf)]
+	for i := range b {
+		b[i] = 0
+	}
+	scratchPool.Put(buf)
+}
+
+// scratchWriter appends to a scratch buffer.
+type scratchWriter struct {
+	buf *[]byte
+}
+
+func (w scratchWriter) Write(p []byte) (int, error) {
+	*w.buf = append(*w.buf, p...)
+	return len(p), nil
+}
+
+// nonceSource returns the source of nonces, crypto/rand unless replaced for
+// deterministic test vectors.
+func (cds *CloudDsStorage) nonceSource() io.Reader {
+	if cds.rand != nil {
+		return cds.rand
+	}
+	return rand.Reader
+}
+
+// counterNonces generates nonces from a random per-instance prefix and a
+// counter starting at a random value, see NonceCounter. Unlike random nonces
+// an instance doesn't repeat one until the counter wraps around, however many
+// values it encrypts, and as both the prefix and the start are random,
+// instances only repeat each other's if they share the prefix and their
+// counters overlap.
+type counterNonces struct {
+	mu      sync.Mutex
+	prefix  [4]byte
+	counter uint64
+	used    uint64
+}
+
+func newCounterNonces(rand io.Reader) (*counterNonces, error) {
+	var b [12]byte
+	if _, err := io.ReadFull(rand, b[:]); err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce prefix: %v", err)
+	}
+	n := new(counterNonces)
+	copy(n.prefix[:], b[:4])
+	n.counter = binary.BigEndian.Uint64(b[4:])
+	return n, nil
+}
+
+// next fills nonce, which must be 12 bytes, with the prefix followed by the
+// next counter value.
+func (n *counterNonces) next(nonce []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.used == math.MaxUint64 {
+		return fmt.Errorf("nonce counter exhausted, restart to pick a new prefix")
+	}
+	n.used++
+	n.counter++ // wraps around
+	copy(nonce, n.prefix[:])
+	binary.BigEndian.PutUint64(nonce[len(n.prefix):], n.counter)
+	return nil
 }
 
 func (cds *CloudDsStorage) toBytes(iface interface{}) ([]byte, error) {
-	// JSON marshal, then encrypt if key is there
-	bytes, err := json.Marshal(iface)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to marshal: %v", err)
+	return cds.toBytesWith(cds.aesKey, iface)
+}
+
+// toBytesWith is toBytes with key rather than the AES key.
+func (cds *CloudDsStorage) toBytesWith(key []byte, iface interface{}) ([]byte, error) {
+	// Prefix with simple prefix, JSON marshal after it, then encrypt if key is
+	// there. Encoded into a scratch buffer, only the result is allocated
+	buf := getScratch()
+	defer putScratch(buf)
+	*buf = append(*buf, valuePrefix...)
+	if err := json.NewEncoder(scratchWriter{buf}).Encode(iface); err != nil {
+		return nil, fmt.Errorf("Unable to marshal: %w", err)
 	}
+	// Encode ends with a newline that json.Marshal doesn't
+	*buf = (*buf)[:len(*buf)-1]
+	return cds.compressAndEncrypt(key, *buf)
+}
+
+// rawToBytes is toBytes for values that are already bytes, skipping JSON.
+func (cds *CloudDsStorage) rawToBytes(value []byte) ([]byte, error) {
+	return cds.rawToBytesWith(cds.aesKey, value)
+}
+
+// rawToBytesWith is rawToBytes with key rather than the AES key.
+func (cds *CloudDsStorage) rawToBytesWith(key, value []byte) ([]byte, error) {
+	buf := getScratch()
+	defer putScratch(buf)
+	*buf = append(append(*buf, valuePrefix...), value...)
+	return cds.compressAndEncrypt(key, *buf)
+}
 
-	// Prefix with simple prefix and then encrypt
-	bytes = append([]byte(valuePrefix), bytes...)
-	return cds.encrypt(bytes)
+// compressAndEncrypt encrypts plain with key, compressed first with
+// EnvNameCompression.
+func (cds *CloudDsStorage) compressAndEncrypt(key, plain []byte) ([]byte, error) {
+	if !cds.compression {
+		return cds.encryptWith(key, plain)
+	}
+	buf := getScratch()
+	defer putScratch(buf)
+	plain, err := cds.compress(buf, plain)
+	if err != nil {
+		return nil, err
+	}
+	return cds.encryptWith(key, plain)
 }
 
 func (cds *CloudDsStorage) decrypt(bytes []byte) ([]byte, error) {
+	return decryptWith(cds.aesKey, bytes)
+}
+
+// decryptWith is decrypt with key rather than the AES key.
+func decryptWith(key, bytes []byte) ([]byte, error) {
+	return openWith(nil, key, bytes)
+}
+
+// openWith is decryptWith appending the decrypted value to dst, which
+// mustn't overlap bytes. bytes itself is returned if there's no key.
+func openWith(dst, key, bytes []byte) ([]byte, error) {
 	// No key? No decrypt
-	if len(cds.aesKey) == 0 {
+	if len(key) == 0 {
 		return bytes, nil
 	}
-	if len(bytes) < aes.BlockSize {
-		return nil, fmt.Errorf("Invalid contents")
-	}
-
-	block, err := aes.NewCipher(cds.aesKey)
+	gcm, err := seal.For(key)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create AES cipher: %v", err)
+		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to create GCM cipher: %v", err)
+	if len(bytes) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: invalid contents", ErrDecryption)
 	}
 
-	out, err := gcm.Open(nil, bytes[:gcm.NonceSize()], bytes[gcm.NonceSize():], nil)
+	out, err := gcm.Open(dst, bytes[:gcm.NonceSize()], bytes[gcm.NonceSize():], nil)
 	if err != nil {
-		return nil, fmt.Errorf("Decryption failure: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrDecryption, err)
 	}
 
 	return out, nil
 }
 
 func (cds *CloudDsStorage) fromBytes(bytes []byte, iface interface{}) error {
-	// We have to decrypt if there is an AES key and then JSON unmarshal
-	bytes, err := cds.decrypt(bytes)
+	return cds.fromBytesWith(cds.aesKey, bytes, iface)
+}
+
+// defaultAESKey is DefaultAESKeyB64 decoded.
+var defaultAESKey, _ = base64.StdEncoding.DecodeString(DefaultAESKeyB64)
+
+// readDefault reports whether a value key failed to decode with, err, is
+// to be read with defaultAESKey instead, as older versions stored it
+// without an AES key.
+func readDefault(key []byte, err error) bool {
+	return errors.Is(err, ErrDecryption) && !bytes.Equal(key, defaultAESKey)
+}
+
+// fromBytesWith is fromBytes with key rather than the AES key, falling back
+// to the default key.
+func (cds *CloudDsStorage) fromBytesWith(key, value []byte, iface interface{}) error {
+	err := cds.decodeWith(key, value, iface)
+	if readDefault(key, err) {
+		if cds.decodeWith(defaultAESKey, value, iface) == nil {
+			cds.defaultReads.Add(1)
+			return nil
+		}
+	}
+	return err
+}
+
+// decodeWith is fromBytesWith without the fallback.
+func (cds *CloudDsStorage) decodeWith(key, bytes []byte, iface interface{}) error {
+	// We have to decrypt if there is an AES key and then JSON unmarshal,
+	// decrypted into a scratch buffer as unmarshalling copies what it keeps
+	buf := getScratch()
+	defer putScratch(buf)
+	bytes, err := openWith(*buf, key, bytes)
 	if err != nil {
 		return err
 	}
+	if len(key) > 0 {
+		// keep the buffer Open grew to zero and reuse it
+		*buf = bytes
+	}
+	if bytes, err = cds.decompress(bytes); err != nil {
+		return err
+	}
 	// Simple sanity check of the beginning of the byte array just to check
 	if len(bytes) < len(valuePrefix) || string(bytes[:len(valuePrefix)]) != valuePrefix {
-		return fmt.Errorf("Invalid data format")
+		return fmt.Errorf("%w: invalid data format", ErrDecryption)
 	}
 	// Now just json unmarshal
 	if err := json.Unmarshal(bytes[len(valuePrefix):], iface); err != nil {
-		return fmt.Errorf("Unable to unmarshal result: %v", err)
+		return fmt.Errorf("Unable to unmarshal result: %w", err)
 	}
 	return nil
 }
+
+// rawFromBytes reverses rawToBytes.
+func (cds *CloudDsStorage) rawFromBytes(bytes []byte) ([]byte, error) {
+	return cds.rawFromBytesWith(cds.aesKey, bytes)
+}
+
+// rawFromBytesWith is rawFromBytes with key rather than the AES key, falling
+// back to the default key.
+func (cds *CloudDsStorage) rawFromBytesWith(key, bytes []byte) ([]byte, error) {
+	value, err := cds.rawDecodeWith(key, bytes)
+	if readDefault(key, err) {
+		if v, derr := cds.rawDecodeWith(defaultAESKey, bytes); derr == nil {
+			cds.defaultReads.Add(1)
+			return v, nil
+		}
+	}
+	return value, err
+}
+
+// rawDecodeWith is rawFromBytesWith without the fallback.
+func (cds *CloudDsStorage) rawDecodeWith(key, bytes []byte) ([]byte, error) {
+	bytes, err := decryptWith(key, bytes)
+	if err != nil {
+		return nil, err
+	}
+	if bytes, err = cds.decompress(bytes); err != nil {
+		return nil, err
+	}
+	if len(bytes) < len(valuePrefix) || string(bytes[:len(valuePrefix)]) != valuePrefix {
+		return nil, fmt.Errorf("%w: invalid data format", ErrDecryption)
+	}
+	return bytes[len(valuePrefix):], nil
+}
+
+// accountKey returns the AES key user records, which hold ACME account
+// private keys, are encrypted with: EnvNameUserAESKey if set, otherwise the
+// AES key.
+func (cds *CloudDsStorage) accountKey() []byte {
+	if cds.userAESKey != nil {
+		return cds.userAESKey
+	}
+	return cds.aesKey
+}
+
+// accountFromBytes is fromBytes for user records, falling back to the AES key
+// for ones stored before EnvNameUserAESKey was set.
+func (cds *CloudDsStorage) accountFromBytes(bytes []byte, iface interface{}) error {
+	err := cds.fromBytesWith(cds.accountKey(), bytes, iface)
+	if errors.Is(err, ErrDecryption) && cds.userAESKey != nil {
+		return cds.fromBytes(bytes, iface)
+	}
+	return err
+}
+
+// rawAccountFromBytes is accountFromBytes for values that are already bytes.
+func (cds *CloudDsStorage) rawAccountFromBytes(bytes []byte) ([]byte, error) {
+	value, err := cds.rawFromBytesWith(cds.accountKey(), bytes)
+	if errors.Is(err, ErrDecryption) && cds.userAESKey != nil {
+		return cds.rawFromBytes(bytes)
+	}
+	return value, err
+}
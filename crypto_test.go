@@ -0,0 +1,312 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddytls"
+)
+
+func fuzzStorage(key string) *CloudDsStorage {
+	return &CloudDsStorage{aesKey: []byte(key)}
+}
+
+// FuzzDecrypt checks that arbitrary contents, including truncated or
+// corrupted ciphertexts and ones encrypted with another key, are rejected
+// with an error rather than a panic.
+func FuzzDecrypt(f *testing.F) {
+	cds := fuzzStorage("0123456789abcdef0123456789abcdef")
+	other := fuzzStorage("fedcba9876543210fedcba9876543210")
+
+	valid, err := cds.toBytes(&caddytls.SiteData{Cert: []byte("cert")})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add(valid[:len(valid)-1])
+	f.Add(valid[:12])
+	f.Add([]byte{})
+	if wrongKey, err := other.toBytes(&caddytls.SiteData{}); err == nil {
+		f.Add(wrongKey)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cds.decrypt(data)
+		var site caddytls.SiteData
+		cds.fromBytes(data, &site)
+		cds.rawFromBytes(data)
+	})
+}
+
+// FuzzFromBytes encrypts arbitrary plaintexts, including hostile JSON and
+// ones with a corrupted prefix, and checks decoding them into each record
+// type doesn't panic.
+func FuzzFromBytes(f *testing.F) {
+	cds := fuzzStorage("0123456789abcdef0123456789abcdef")
+
+	f.Add([]byte(valuePrefix + `{"Cert":"Y2VydA==","Key":null,"Meta":[]}`))
+	f.Add([]byte(valuePrefix + `{"Reg":{"Reg":{"Reg":1}}}`))
+	f.Add([]byte(valuePrefix + `{"Keys":[[1,2,3]]}`))
+	f.Add([]byte(valuePrefix + `[` + string(bytes.Repeat([]byte("["), 10000))))
+	f.Add([]byte(valuePrefix[:len(valuePrefix)-1] + `{}`))
+	f.Add([]byte(valuePrefix + "\xff\xfe"))
+
+	f.Fuzz(func(t *testing.T, plaintext []byte) {
+		data, err := cds.encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dst := range []interface{}{
+			new(caddytls.SiteData),
+			new(caddytls.UserData),
+			new(stekState),
+			new(challengeSecrets),
+		} {
+			cds.fromBytes(data, dst)
+		}
+
+		value, err := cds.rawFromBytes(data)
+		if err == nil && !bytes.Equal(value, plaintext[len(valuePrefix):]) {
+			t.Fatalf("Raw value %q doesn't match plaintext %q", value, plaintext)
+		}
+	})
+}
+
+// zeroReader is a deterministic nonce source for test vectors.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestDeterministicNonce(t *testing.T) {
+	cds, err := NewMemoryStorage(&url.URL{}, &Config{Rand: zeroReader{}})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte("meta")}
+
+	first, err := cds.toBytes(site)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	second, err := cds.toBytes(site)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("Expected the same ciphertext from the same nonce source")
+	}
+	if !bytes.HasPrefix(first, make([]byte, 12)) {
+		t.Fatalf("Expected the nonce from the nonce source, got %x", first[:12])
+	}
+
+	decoded := new(caddytls.SiteData)
+	if err := cds.fromBytes(first, decoded); err != nil || string(decoded.Meta) != "meta" {
+		t.Fatalf("Error decrypting test vector: %v", err)
+	}
+}
+
+func TestCounterNonces(t *testing.T) {
+	cds, err := NewMemoryStorage(&url.URL{}, &Config{NonceMode: NonceCounter})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	site := &caddytls.SiteData{Cert: []byte("cert")}
+
+	first, err := cds.toBytes(site)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	second, err := cds.toBytes(site)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if !bytes.Equal(first[:4], second[:4]) {
+		t.Errorf("Expected the same prefix, got %x and %x", first[:4], second[:4])
+	}
+	if binary.BigEndian.Uint64(second[4:12]) != binary.BigEndian.Uint64(first[4:12])+1 {
+		t.Errorf("Expected consecutive counters, got %x and %x", first[4:12], second[4:12])
+	}
+
+	// restarts start the counter somewhere else
+	n, err := newCounterNonces(bytes.NewReader(append([]byte{1, 2, 3, 4}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)))
+	if err != nil {
+		t.Fatalf("Error creating nonces: %v", err)
+	}
+	nonce := make([]byte, 12)
+	if err := n.next(nonce); err != nil || !bytes.Equal(nonce, []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Expected the counter to wrap around, got %x, %v", nonce, err)
+	}
+
+	decoded := new(caddytls.SiteData)
+	if err := cds.fromBytes(second, decoded); err != nil || string(decoded.Cert) != "cert" {
+		t.Fatalf("Error decrypting: %v", err)
+	}
+
+	if _, err := NewMemoryStorage(&url.URL{}, &Config{NonceMode: "sequential"}); err == nil {
+		t.Error("Expected error for an invalid nonce mode")
+	}
+}
+
+func TestPlaintextRefused(t *testing.T) {
+	ctx := context.Background()
+	site := &caddytls.SiteData{Key: []byte("key")}
+	cds, err := newCloudDsStorage(&url.URL{}, &Config{}, newMemClient())
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	defer cds.Close()
+	if err := cds.StoreSiteContext(ctx, "example.com", site); !errors.Is(err, ErrPlaintext) {
+		t.Fatalf("Expected ErrPlaintext without an AES key, got %v", err)
+	}
+
+	cds, err = newCloudDsStorage(&url.URL{}, &Config{AllowPlaintext: true}, newMemClient())
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	defer cds.Close()
+	if err := cds.StoreSiteContext(ctx, "example.com", site); err != nil {
+		t.Fatalf("Error storing acknowledged plaintext: %v", err)
+	}
+	loaded, err := cds.LoadSiteContext(ctx, "example.com")
+	if err != nil || string(loaded.Key) != "key" {
+		t.Fatalf("Error loading plaintext: %v", err)
+	}
+
+	// the default key is only read with, so storing fails as without a key
+	cds, err = newCloudDsStorage(&url.URL{}, &Config{AESKeyB64: DefaultAESKeyB64}, newMemClient())
+	if err != nil {
+		t.Fatalf("Error creating storage with the default key: %v", err)
+	}
+	defer cds.Close()
+	if err := cds.StoreSiteContext(ctx, "example.com", site); !errors.Is(err, ErrPlaintext) {
+		t.Fatalf("Expected ErrPlaintext with the default key, got %v", err)
+	}
+	if findings := cds.configFindings(); len(findings) == 0 || findings[0].Check != "default_key" {
+		t.Errorf("Expected the default key reported first, got %+v", findings)
+	}
+}
+
+// BenchmarkSiteRoundTrip measures encoding and decoding a site with a
+// certificate chain sized PEM payload, run with -benchmem to see allocations.
+func BenchmarkSiteRoundTrip(b *testing.B) {
+	cds := fuzzStorage("0123456789abcdef0123456789abcdef")
+	site := &caddytls.SiteData{
+		Cert: bytes.Repeat([]byte("MIIFazCCA1OgAwIBAgIRAIIQz7DSQONZRGPgu2OCiwAw"), 100),
+		Key:  bytes.Repeat([]byte("MHcCAQEEIBkg4LVWM9nuwNSk3yByxZpYRTBnVJk5oqc"), 6),
+		Meta: []byte("meta"),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		value, err := cds.toBytes(site)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := cds.fromBytes(value, new(caddytls.SiteData)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	cds := fuzzStorage("0123456789abcdef0123456789abcdef")
+	for _, size := range []int{0, 1, chunkSize - len(valuePrefix), chunkSize, 2*chunkSize - len(valuePrefix), 5*chunkSize + 7} {
+		value := bytes.Repeat([]byte{'v'}, size)
+		b, err := cds.chunkedToBytes(cds.aesKey, value)
+		if err != nil {
+			t.Fatalf("Error encrypting %d bytes: %v", size, err)
+		}
+		got, err := io.ReadAll(newChunkReader(cds.aesKey, bytes.NewReader(b)))
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("Expected %d bytes back, got %d: %v", size, len(got), err)
+		}
+
+		// dropping the final chunk, or part of it, is detected
+		for _, truncated := range [][]byte{b[:len(b)-1], b[:chunkSaltSize+chunkSize+16]} {
+			if len(truncated) >= len(b) {
+				continue
+			}
+			if _, err := io.ReadAll(newChunkReader(cds.aesKey, bytes.NewReader(truncated))); !errors.Is(err, ErrDecryption) {
+				t.Fatalf("Expected truncated %d byte value rejected, got %v", size, err)
+			}
+		}
+	}
+
+	b, _ := cds.chunkedToBytes(cds.aesKey, []byte("value"))
+	other := fuzzStorage("fedcba9876543210fedcba9876543210")
+	if _, err := io.ReadAll(newChunkReader(other.aesKey, bytes.NewReader(b))); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("Expected value with another key rejected, got %v", err)
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "example.com"}, DNSNames: []string{"example.com", "www.example.com"}, NotAfter: time.Now().AddDate(0, 0, 90)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	site := &caddytls.SiteData{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		Meta: []byte(`{"domain":"example.com","certUrl":"https://acme-v02.api.letsencrypt.org/acme/cert/1"}`),
+	}
+
+	plain := fuzzStorage("0123456789abcdef0123456789abcdef")
+	cds := fuzzStorage("0123456789abcdef0123456789abcdef")
+	cds.compression = true
+	uncompressed, err := plain.toBytes(site)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	compressed, err := cds.toBytes(site)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if len(compressed) >= len(uncompressed)*3/4 {
+		t.Fatalf("Expected the site compressed, got %d bytes from %d", len(compressed), len(uncompressed))
+	}
+
+	// read whether compression is on or not
+	for _, s := range []*CloudDsStorage{cds, plain} {
+		var got caddytls.SiteData
+		if err := s.fromBytes(compressed, &got); err != nil || !bytes.Equal(got.Key, site.Key) || !bytes.Equal(got.Cert, site.Cert) {
+			t.Fatalf("Expected the site back, got %v", err)
+		}
+	}
+
+	// too small to shrink, kept as is
+	small, err := cds.rawToBytes([]byte("x"))
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if b, _ := cds.decrypt(small); !bytes.HasPrefix(b, []byte(valuePrefix)) {
+		t.Fatalf("Expected small value uncompressed, got %q", b)
+	}
+
+	corrupt, _ := cds.encrypt([]byte(compressedPrefix + "not zstd"))
+	if _, err := cds.rawFromBytes(corrupt); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("Expected corrupt compressed value rejected, got %v", err)
+	}
+}
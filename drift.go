@@ -0,0 +1,120 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	dsadmin "google.golang.org/api/datastore/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	// DefaultDriftThreshold is how far the local clock may be from Cloud
+	// Datastore's before a warning is logged.
+	DefaultDriftThreshold = 2 * time.Second
+
+	// driftCheckInterval is how often the clock is compared again.
+	driftCheckInterval = time.Hour
+)
+
+// datastoreTime returns Cloud Datastore's time, the read time of a lookup of
+// a key that doesn't exist, zero if the server doesn't report one like the
+// emulator. A variable so tests can replace the API.
+var datastoreTime = func(ctx context.Context, project string, o []option.ClientOption) (time.Time, error) {
+	svc, err := dsadmin.NewService(ctx, o...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to create Datastore client: %w", err)
+	}
+	probe := &dsadmin.Key{Path: []*dsadmin.PathElement{{Kind: LOCK_RECORD, Name: "clock"}}}
+	resp, err := svc.Projects.Lookup(project, &dsadmin.LookupRequest{Keys: []*dsadmin.Key{probe}}).Context(ctx).Do()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to read the time of %s: %w", project, err)
+	}
+	if resp.ReadTime == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, resp.ReadTime)
+}
+
+// driftMonitor compares the local clock with Cloud Datastore's, as the
+// locks of instances are only as good as their clocks agree.
+type driftMonitor struct {
+	cds       *CloudDsStorage
+	threshold time.Duration
+	widen     bool                                         // widen the skew allowance to the drift
+	now       func(ctx context.Context) (time.Time, error) // Cloud Datastore's time
+}
+
+// monitorDrift checks the clock against Cloud Datastore's every
+// driftCheckInterval, from now until the storage is closed, unless cfg
+// disables it.
+func (cds *CloudDsStorage) monitorDrift(cfg *Config) {
+	if cfg.DriftThreshold < 0 || os.Getenv("DATASTORE_EMULATOR_HOST") != "" {
+		return
+	}
+	userAgent := DefaultUserAgent
+	if cfg.UserAgent != "" {
+		userAgent = cfg.UserAgent
+	}
+	o := []option.ClientOption{option.WithUserAgent(userAgent), option.WithCredentialsFile(cfg.ServiceAccountFile)}
+	m := &driftMonitor{
+		cds:       cds,
+		threshold: cfg.DriftThreshold,
+		widen:     cfg.DriftWidenSkew,
+		now: func(ctx context.Context) (time.Time, error) {
+			return datastoreTime(ctx, cfg.ProjectID, o)
+		},
+	}
+	if m.threshold == 0 {
+		m.threshold = DefaultDriftThreshold
+	}
+
+	go func() {
+		for {
+			ctx, cancel := cds.opContext()
+			err := m.check(ctx)
+			cancel()
+			if err != nil && cds.ctx.Err() == nil {
+				log.Printf("[INFO] Unable to compare the clock with Cloud Datastore's: %v", err)
+			}
+			select {
+			case <-cds.ctx.Done():
+				return
+			case <-cds.clock.After(driftCheckInterval):
+			}
+		}
+	}()
+}
+
+// check logs a warning if the local clock is further than the threshold from
+// Cloud Datastore's, widening the skew allowance to the drift if set.
+func (m *driftMonitor) check(ctx context.Context) error {
+	before := m.cds.clock.Now()
+	server, err := m.now(ctx)
+	if err != nil {
+		return err
+	}
+	if server.IsZero() {
+		return nil
+	}
+	// the server read its clock somewhere in the round trip
+	half := m.cds.clock.Now().Sub(before) / 2
+	drift := before.Add(half).Sub(server)
+	off := drift
+	if off < 0 {
+		off = -off
+	}
+	if off -= half; off <= m.threshold {
+		return nil
+	}
+
+	log.Printf("[WARNING] The clock is %v off Cloud Datastore's, more than %v; locks depend on the clocks of instances agreeing within %s", drift.Round(time.Millisecond), m.threshold, EnvNameLockSkew)
+	if m.widen && off > m.cds.skew() {
+		m.cds.lockSkew.Store(int64(off))
+		log.Printf("[WARNING] Widened the lock skew allowance to %v", off.Round(time.Millisecond))
+	}
+	return nil
+}
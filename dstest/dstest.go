@@ -0,0 +1,290 @@
+// Package dstest runs tests against the Cloud Datastore emulator, starting it
+// if one isn't already running, or against a real project with
+// `-dstest.project`, where everything is kept in a disposable namespace.
+//
+//	func TestMain(m *testing.M) {
+//		dstest.Main(m)
+//	}
+//
+//	func TestSomething(t *testing.T) {
+//		dstest.Truncate(t)
+//		...
+//	}
+package dstest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/j0hnsmith/caddy-tlsclouddatastore"
+)
+
+const (
+	// DefaultProjectID is the project used if DATASTORE_PROJECT_ID isn't set
+	DefaultProjectID = "caddy-tlsclouddatastore-test"
+
+	// AESKeyB64 is the AES key used if CADDY_CLOUDDATASTORETLS_B64_AESKEY isn't set
+	AESKeyB64 = "ZHN0ZXN0LWtleS0wMTIzNDU2Nzg5YWJjZGVmMDEyMzQ="
+
+	// EnvNameEmulatorHost is the env var the Cloud Datastore client connects to the emulator with
+	EnvNameEmulatorHost = "DATASTORE_EMULATOR_HOST"
+
+	// NamespacePrefix starts the disposable namespaces of runs against a real project
+	NamespacePrefix = "dstest-"
+
+	// startTimeout is how long a started emulator has to become ready
+	startTimeout = time.Minute
+)
+
+var project = flag.String("dstest.project", "", "run against this real project instead of the emulator, "+
+	"in a disposable namespace deleted afterwards, credentials are read from "+tlsclouddatastore.EnvNameServiceAccountPath)
+
+// Emulator is the emulator tests run against.
+type Emulator struct {
+	Host      string // empty when running against a real project
+	ProjectID string
+	Namespace string // disposable namespace when running against a real project
+
+	cmd *exec.Cmd // nil if the emulator was already running
+}
+
+// Real returns whether tests run against a real project rather than the
+// emulator, for skipping tests that need more than a namespace, eg a second
+// project.
+func Real() bool {
+	return *project != ""
+}
+
+// Start connects to the emulator at DATASTORE_EMULATOR_HOST if it's set,
+// otherwise starts one with `gcloud beta emulators datastore start` on a free
+// port and sets DATASTORE_EMULATOR_HOST. DATASTORE_PROJECT_ID is set to
+// DefaultProjectID if it's empty.
+//
+// With `-dstest.project` nothing is started, DATASTORE_EMULATOR_HOST is unset
+// and the storage's namespace is set to a new disposable one, so tests don't
+// touch anything else in the project. Flags must have been parsed.
+func Start() (*Emulator, error) {
+	if Real() {
+		return startReal()
+	}
+
+	e := &Emulator{
+		Host:      os.Getenv(EnvNameEmulatorHost),
+		ProjectID: os.Getenv(tlsclouddatastore.EnvNameProjectId),
+	}
+	if e.ProjectID == "" {
+		e.ProjectID = DefaultProjectID
+		os.Setenv(tlsclouddatastore.EnvNameProjectId, e.ProjectID)
+	}
+	if e.Host != "" {
+		return e, nil
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find a free port for the emulator: %w", err)
+	}
+	e.Host = l.Addr().String()
+	l.Close()
+
+	e.cmd = exec.Command("gcloud", "beta", "emulators", "datastore", "start",
+		"--host-port="+e.Host,
+		"--project="+e.ProjectID,
+		"--no-store-on-disk",
+		"--consistency=1.0",
+	)
+	if err := e.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Unable to start the emulator, is the gcloud SDK installed?: %w", err)
+	}
+
+	if err := e.waitReady(); err != nil {
+		e.Stop()
+		return nil, err
+	}
+	os.Setenv(EnvNameEmulatorHost, e.Host)
+	return e, nil
+}
+
+// startReal points tests at the project set by `-dstest.project`.
+func startReal() (*Emulator, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("Unable to generate a namespace: %w", err)
+	}
+	e := &Emulator{
+		ProjectID: *project,
+		Namespace: NamespacePrefix + hex.EncodeToString(b),
+	}
+	os.Unsetenv(EnvNameEmulatorHost)
+	os.Setenv(tlsclouddatastore.EnvNameProjectId, e.ProjectID)
+	os.Setenv(tlsclouddatastore.EnvNameNamespace, e.Namespace)
+	return e, nil
+}
+
+// waitReady polls the emulator until it responds.
+func (e *Emulator) waitReady() error {
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get("http://" + e.Host + "/")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("Emulator at %s not ready after %s", e.Host, startTimeout)
+}
+
+// Stop shuts down the emulator if Start started it, or deletes the disposable
+// namespace of a real project.
+func (e *Emulator) Stop() error {
+	if e.Namespace != "" {
+		return truncate(context.Background())
+	}
+	if e.cmd == nil {
+		return nil
+	}
+	// the emulator runs in a child of gcloud, which killing gcloud doesn't stop
+	if resp, err := http.Post("http://"+e.Host+"/shutdown", "text/plain", nil); err == nil {
+		resp.Body.Close()
+	}
+	e.cmd.Process.Kill()
+	e.cmd.Wait()
+	return nil
+}
+
+// Main starts the emulator, runs the tests and stops it, for use as TestMain.
+// CADDY_CLOUDDATASTORETLS_B64_AESKEY is set to AESKeyB64 if it's empty, as
+// storages don't store records without a key.
+func Main(m *testing.M) {
+	flag.Parse()
+	if os.Getenv(tlsclouddatastore.EnvNameAESKey) == "" {
+		os.Setenv(tlsclouddatastore.EnvNameAESKey, AESKeyB64)
+	}
+	e, err := Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := e.Stop(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(code)
+}
+
+// Truncate deletes every entity in the emulator's project, in all namespaces.
+// Against a real project only the disposable namespace, and the per CA
+// namespaces derived from it, are deleted.
+func Truncate(t testing.TB) {
+	t.Helper()
+	if err := truncate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func truncate(ctx context.Context) error {
+	client, err := NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	namespaces, err := keyNames(ctx, client, datastore.NewQuery("__namespace__").KeysOnly())
+	if err != nil {
+		return fmt.Errorf("Unable to list namespaces: %w", err)
+	}
+	if !Real() {
+		namespaces = append(namespaces, "")
+	}
+	base := os.Getenv(tlsclouddatastore.EnvNameNamespace)
+	for _, ns := range namespaces {
+		if Real() && !strings.HasPrefix(ns, base) {
+			continue
+		}
+		kinds, err := keyNames(ctx, client, datastore.NewQuery("__kind__").Namespace(ns).KeysOnly())
+		if err != nil {
+			return fmt.Errorf("Unable to list kinds: %w", err)
+		}
+		for _, kind := range kinds {
+			if err := deleteAll(ctx, client, datastore.NewQuery(kind).Namespace(ns).KeysOnly()); err != nil {
+				return fmt.Errorf("Unable to delete %s entities: %w", kind, err)
+			}
+		}
+	}
+	return nil
+}
+
+// NewClient returns a client of the project tests run against, for checking
+// entities directly. Queries must set the storage's namespace.
+func NewClient(ctx context.Context) (*datastore.Client, error) {
+	var opts []option.ClientOption
+	if f := os.Getenv(tlsclouddatastore.EnvNameServiceAccountPath); Real() && f != "" {
+		opts = append(opts, option.WithCredentialsFile(f))
+	}
+	client, err := datastore.NewClient(ctx, os.Getenv(tlsclouddatastore.EnvNameProjectId), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create Cloud Datastore client: %w", err)
+	}
+	return client, nil
+}
+
+// keyNames returns the names of the keys q returns.
+func keyNames(ctx context.Context, client *datastore.Client, q *datastore.Query) ([]string, error) {
+	var names []string
+	for it := client.Run(ctx, q); ; {
+		k, err := it.Next(nil)
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if k.Name != "" {
+			names = append(names, k.Name)
+		}
+	}
+}
+
+// deleteAll deletes the entities q returns, in batches of the most a single
+// call can delete.
+func deleteAll(ctx context.Context, client *datastore.Client, q *datastore.Query) error {
+	var keys []*datastore.Key
+	for it := client.Run(ctx, q); ; {
+		k, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		if err := client.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package tlsclouddatastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// effectiveConfig describes the settings the storage runs with, for
+// operators to confirm which env vars took effect. Secrets are only
+// described by a fingerprint.
+func (cds *CloudDsStorage) effectiveConfig(cfg *Config) string {
+	fields := []string{
+		"project=" + cfg.ProjectID,
+		"prefix=" + cds.prefix,
+	}
+	if cfg.Profile != "" {
+		fields = append(fields, "profile="+cfg.Profile)
+	}
+	if cds.caNamespace != "" {
+		fields = append(fields, "ca="+cds.caNamespace)
+	}
+	if cds.namespace != "" {
+		fields = append(fields, "namespace="+cds.namespace)
+	}
+	if cds.shards > 0 {
+		fields = append(fields, fmt.Sprintf("shards=%d", cds.shards))
+	}
+	for _, r := range cfg.ProjectRoutes {
+		fields = append(fields, "route="+r.Pattern+"->"+r.Project)
+	}
+	if len(cds.labels) > 0 {
+		fields = append(fields, "labels="+strings.Join(cds.labels, ","))
+	}
+	if cds.fieldEnc {
+		fields = append(fields, "fields=plaintext-cert")
+	}
+	if cds.auditHistory != DefaultSiteAuditHistory {
+		fields = append(fields, fmt.Sprintf("site_audit_history=%d", cds.auditHistory))
+	}
+	if cds.accessAudit != "" {
+		fields = append(fields, "access_audit="+cds.accessAudit)
+	}
+	if cds.nameKey != nil {
+		fields = append(fields, "names=encrypted")
+	} else if cds.hashKey != nil {
+		fields = append(fields, "names=hashed")
+	}
+	if cfg.ExpiryMonitor > 0 {
+		fields = append(fields, "expiry_monitor="+cfg.ExpiryMonitor.String())
+	}
+	if cfg.IntegrityScan > 0 {
+		fields = append(fields, "integrity_scan="+cfg.IntegrityScan.String())
+	}
+	if cfg.RedisURL != "" {
+		if u, err := url.Parse(cfg.RedisURL); err == nil {
+			// the user info may hold a password
+			fields = append(fields, "cache="+u.Scheme+"://"+u.Host)
+		}
+	}
+	if cds.renewalJitter > 0 {
+		fields = append(fields, "renewal_jitter="+cds.renewalJitter.String())
+	}
+	if cds.issuanceRate.Limit > 0 {
+		fields = append(fields, "issuance_rate="+cds.issuanceRate.String())
+	}
+	if cds.domainRate.Limit > 0 {
+		fields = append(fields, "domain_issuance_rate="+cds.domainRate.String())
+	}
+	if cds.renewalHook != "" {
+		if u, err := url.Parse(cds.renewalHook); err == nil {
+			// the path and query may hold a token
+			fields = append(fields, fmt.Sprintf("renewal_webhook=%s://%s(after %d)", u.Scheme, u.Host, cds.renewalLimit))
+		}
+	}
+	if n := cds.notifiers; n != nil {
+		var events []string
+		for _, e := range notifyEvents {
+			if n.events[e] {
+				events = append(events, e)
+			}
+		}
+		// only counted, the webhook URLs may hold a token
+		fields = append(fields, fmt.Sprintf("notifiers=%d(%s)", len(n.list), strings.Join(events, ",")))
+	}
+	if cfg.Endpoint != "" {
+		fields = append(fields, "endpoint="+endpointAddr(cfg.Endpoint))
+	}
+	if cfg.Proxy != "" {
+		if u, err := parseProxyURL(cfg.Proxy); err == nil {
+			fields = append(fields, "proxy="+u.Redacted())
+		}
+	}
+	fields = append(fields,
+		"kinds="+strings.Join(recordKinds, ","),
+		"instance="+cds.instanceID,
+		"timeout="+cds.timeout.String(),
+		"lock_skew="+cds.skew().String(),
+		"cipher="+cds.cipherName(),
+		"key="+keyFingerprint(cds.aesKey),
+	)
+	if cds.userAESKey != nil {
+		fields = append(fields, "user_key="+keyFingerprint(cds.userAESKey))
+	}
+	if len(cds.signingKeys) > 0 {
+		fields = append(fields, "signing_key="+cds.signingKeys[0].id)
+	}
+	return strings.Join(fields, " ")
+}
+
+// cipherName returns the cipher records are encrypted with.
+func (cds *CloudDsStorage) cipherName() string {
+	if len(cds.aesKey) == 0 {
+		return "none"
+	}
+	if cds.nonces != nil {
+		return fmt.Sprintf("AES-%d-GCM(counter-nonce)", len(cds.aesKey)*8)
+	}
+	return fmt.Sprintf("AES-%d-GCM", len(cds.aesKey)*8)
+}
+
+// keyFingerprint identifies an AES key without revealing it, the start of
+// its SHA-256 hash.
+func keyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return "none"
+	}
+	sum := sha256.Sum256(key)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,82 @@
+package tlsclouddatastore
+
+import (
+	"errors"
+	"io/fs"
+
+	"cloud.google.com/go/datastore"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/kv"
+)
+
+var (
+	// ErrNotExist is returned when a site, user or other record isn't in Cloud Datastore.
+	// It satisfies caddytls.ErrNotExist and matches fs.ErrNotExist with errors.Is, which
+	// CertMagic checks for, so callers of either interface can tell it from a failure.
+	ErrNotExist error = notExistError{}
+
+	// ErrDecryption is returned when a stored value can't be decrypted or
+	// doesn't have the expected format, usually because of a wrong AES key.
+	ErrDecryption = errors.New("unable to decrypt record")
+
+	// ErrPlaintext is returned when storing a record without an AES key,
+	// unless EnvNameAllowPlaintext acknowledges private keys will be stored
+	// unencrypted.
+	ErrPlaintext = errors.New("refusing to store unencrypted record, no AES key")
+
+	// ErrSignature is returned when a record's signature is missing or
+	// doesn't match, with EnvNameSigningKeys.
+	ErrSignature = errors.New("invalid record signature")
+
+	// ErrConflict is returned when a write loses a race with another instance.
+	ErrConflict = kv.ErrConflict
+
+	// ErrQueryUnsupported is returned by what needs queries, eg SiteAudit or
+	// SecurityAudit, on backends that can't run them.
+	ErrQueryUnsupported = errors.New("queries unsupported by this storage")
+
+	// ErrLockTimeout is returned by CertMagicStorage.Lock when its context is
+	// done before the lock could be obtained.
+	ErrLockTimeout = errors.New("timed out waiting for lock")
+
+	// ErrInvalidName is matched by the ValidationError returned for a domain
+	// or email that can't be used in a key name.
+	ErrInvalidName = errors.New("invalid name")
+
+	// ErrPaused is returned when locking to obtain or renew a certificate
+	// while issuance is paused across the cluster, see Pause.
+	ErrPaused = errors.New("issuance paused")
+
+	// ErrThrottled is returned when locking to obtain or renew a certificate
+	// would exceed EnvNameIssuanceRate or EnvNameDomainIssuanceRate.
+	ErrThrottled = errors.New("issuance throttled")
+
+	// ErrRateLimited is returned when locking to obtain or renew a
+	// certificate while the cluster backs off after the CA rate limited it,
+	// see RecordRateLimit.
+	ErrRateLimited = errors.New("rate limited by CA")
+
+	// ErrRenewalDeferred is returned when locking to renew a certificate
+	// before the attempt EnvNameRenewalJitter scheduled.
+	ErrRenewalDeferred = errors.New("renewal deferred")
+)
+
+// notExistError is ErrNotExist.
+type notExistError struct{}
+
+func (notExistError) Error() string {
+	return "record does not exist"
+}
+
+// Is matches fs.ErrNotExist as well as ErrNotExist itself.
+func (notExistError) Is(target error) bool {
+	return target == fs.ErrNotExist
+}
+
+// notExist translates datastore.ErrNoSuchEntity to ErrNotExist so callers
+// don't need to know about Cloud Datastore errors.
+func notExist(err error) error {
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNotExist
+	}
+	return err
+}
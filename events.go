@@ -0,0 +1,50 @@
+package tlsclouddatastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Names of the events passed to an EventHandler.
+const (
+	EventCertStored      = "cert_stored"
+	EventCertDeleted     = "cert_deleted"
+	EventLockAcquired    = "lock_acquired"
+	EventLockLost        = "lock_lost"
+	EventStorageDegraded = "storage_degraded"
+)
+
+// EventHandler is called with storage lifecycle events, eg to emit them on
+// Caddy's event bus. It's called synchronously so mustn't block.
+type EventHandler func(name string, data map[string]interface{})
+
+// OnEvent sets the handler called for events, it must be set before the
+// storage is used.
+func (s *CertMagicStorage) OnEvent(h EventHandler) {
+	s.onEvent = h
+}
+
+func (s *CertMagicStorage) emit(name string, data map[string]interface{}) {
+	if s.onEvent != nil {
+		s.onEvent(name, data)
+	}
+}
+
+// isCertKey reports whether key is a certificate CertMagic stores, ie
+// certificates/<issuer>/<domain>/<domain>.crt.
+func isCertKey(key string) bool {
+	parts := strings.Split(cleanKVKey(key), "/")
+	return len(parts) == 4 && parts[0] == "certificates" && parts[3] == parts[2]+".crt"
+}
+
+// degraded emits and notifies EventStorageDegraded if err is a failure of
+// Cloud Datastore rather than a missing key, and returns err.
+func (s *CertMagicStorage) degraded(op, key string, err error) error {
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		data := map[string]interface{}{"operation": op, "key": key, "error": err.Error()}
+		s.emit(EventStorageDegraded, data)
+		s.cds.notify(EventStorageDegraded, fmt.Sprintf("Unable to %s %s: %v", op, key, err), data)
+	}
+	return err
+}
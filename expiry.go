@@ -0,0 +1,163 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// expiryHorizon is the furthest ExpiryStats counts certificates expiring
+// within.
+const expiryHorizon = 30 * 24 * time.Hour
+
+// expiryVars are the stats of the storages monitoring expiry, keyed by
+// storage, published by expvar at /debug/vars.
+var expiryVars = expvar.NewMap("caddy_clouddatastoretls_expiry")
+
+// ExpiryStats summarises when the certificates the storage holds expire, to
+// catch renewals that have silently stopped. Only certificates stored with
+// EnvNameFieldEncryption have an indexed expiry and are counted.
+type ExpiryStats struct {
+	Soonest   time.Time // expiry of the certificate expiring first, zero if none
+	Within7d  int       // certificates expiring within 7 days, or expired
+	Within14d int
+	Within30d int
+	Scanned   time.Time
+}
+
+// DaysUntilSoonest returns the days until the soonest expiry, negative if a
+// certificate has expired, 0 if there are none.
+func (st ExpiryStats) DaysUntilSoonest() float64 {
+	if st.Soonest.IsZero() {
+		return 0
+	}
+	return st.Soonest.Sub(st.Scanned).Hours() / 24
+}
+
+// add counts a certificate expiring at notAfter.
+func (st *ExpiryStats) add(notAfter time.Time) {
+	if st.Soonest.IsZero() || notAfter.Before(st.Soonest) {
+		st.Soonest = notAfter
+	}
+	left := notAfter.Sub(st.Scanned)
+	if left < 7*24*time.Hour {
+		st.Within7d++
+	}
+	if left < 14*24*time.Hour {
+		st.Within14d++
+	}
+	if left < expiryHorizon {
+		st.Within30d++
+	}
+}
+
+// ExpiryStats scans the indexed expiry of the Caddy v1 sites and CertMagic
+// certificates the storage holds.
+func (cds *CloudDsStorage) ExpiryStats(ctx context.Context) (ExpiryStats, error) {
+	ctx = withOpCategory(ctx, OpCategoryMaintenance)
+	st := ExpiryStats{Scanned: cds.clock.Now()}
+	for _, client := range cds.clients() {
+		if err := cds.scanExpiry(ctx, client, SITE_RECORD, "sites", &st); err != nil {
+			return ExpiryStats{}, err
+		}
+	}
+	if err := cds.scanExpiry(ctx, cds.cloudDsClient, KV_RECORD, "certificates", &st); err != nil {
+		return ExpiryStats{}, err
+	}
+	return st, nil
+}
+
+// scanExpiry adds the expiry of records of kind under dir to st, until past
+// expiryHorizon once the soonest is known.
+func (cds *CloudDsStorage) scanExpiry(ctx context.Context, client dsClient, kind, dir string, st *ExpiryStats) error {
+	// ordered by a single property, projected from the built-in index
+	base := cds.dsKey(kind, dir).Name + "/"
+	q := datastore.NewQuery(kind).
+		Namespace(cds.namespace).
+		Project("NotAfter").
+		Order("NotAfter")
+
+	for it := client.Run(ctx, q); ; {
+		var f struct{ NotAfter time.Time }
+		k, err := it.Next(&f)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to query expiry of %v: %w", dir, err)
+		}
+		if !strings.HasPrefix(k.Name, base) {
+			continue
+		}
+		if f.NotAfter.Sub(st.Scanned) >= expiryHorizon && !st.Soonest.IsZero() {
+			return nil
+		}
+		st.add(f.NotAfter)
+	}
+}
+
+// expiryVarName is the key of the storage's stats in expiryVars.
+func (cds *CloudDsStorage) expiryVarName() string {
+	if cds.namespace != "" {
+		return cds.namespace + ":" + cds.key("")
+	}
+	return cds.key("")
+}
+
+// publish sets the storage's stats in expiryVars.
+func (st ExpiryStats) publish(name string) {
+	m := new(expvar.Map).Init()
+	days := new(expvar.Float)
+	days.Set(st.DaysUntilSoonest())
+	m.Set("days_until_soonest_expiry", days)
+	for key, n := range map[string]int{"expiring_7d": st.Within7d, "expiring_14d": st.Within14d, "expiring_30d": st.Within30d} {
+		v := new(expvar.Int)
+		v.Set(int64(n))
+		m.Set(key, v)
+	}
+	scanned := new(expvar.String)
+	scanned.Set(st.Scanned.UTC().Format(time.RFC3339))
+	m.Set("scanned", scanned)
+	expiryVars.Set(name, m)
+}
+
+// monitorExpiry scans the expiry of certificates every cfg.ExpiryMonitor,
+// from now until the storage is closed, publishing the stats and warning if
+// any expire within 7 days.
+func (cds *CloudDsStorage) monitorExpiry(cfg *Config) {
+	if cfg.ExpiryMonitor <= 0 {
+		return
+	}
+	if !cds.fieldEnc {
+		log.Printf("[WARNING] The expiry monitor only sees certificates stored with %s", EnvNameFieldEncryption)
+	}
+
+	go func() {
+		for {
+			ctx, cancel := cds.opContext()
+			st, err := cds.ExpiryStats(ctx)
+			cancel()
+			if err != nil && cds.ctx.Err() == nil {
+				log.Printf("[ERROR] Unable to scan certificate expiry: %v", err)
+			} else if err == nil {
+				st.publish(cds.expiryVarName())
+				if st.Within7d > 0 {
+					msg := fmt.Sprintf("%d certificates expire within 7 days, the soonest in %.1f days; renewals may have stopped", st.Within7d, st.DaysUntilSoonest())
+					log.Printf("[WARNING] %s", msg)
+					cds.notify(EventCertsExpiring, msg, map[string]interface{}{"expiring_7d": st.Within7d, "soonest": st.Soonest})
+				}
+			}
+			select {
+			case <-cds.ctx.Done():
+				return
+			case <-cds.clock.After(cfg.ExpiryMonitor):
+			}
+		}
+	}()
+}
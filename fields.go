@@ -0,0 +1,181 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/caddyserver/caddy/caddytls"
+	"google.golang.org/api/iterator"
+)
+
+// siteFields are the plaintext properties of a site record, or a CertMagic
+// certificate, stored with EnvNameFieldEncryption. Only the certificate and
+// details parsed from it are kept in plaintext, the private key and meta stay
+// encrypted in Value.
+type siteFields struct {
+	Cert     []byte    `datastore:",noindex,omitempty"`
+	SANs     []string  `datastore:",omitempty"`
+	NotAfter time.Time `datastore:",omitempty"`
+	Issuer   string    `datastore:",omitempty"`
+}
+
+// certFields returns the plaintext fields of a PEM bundle, only the bundle
+// itself if its leaf can't be parsed.
+func certFields(bundle []byte) siteFields {
+	f := siteFields{Cert: bundle}
+	if d, err := parseCertDetails(bundle); err == nil {
+		f.SANs, f.NotAfter, f.Issuer = d.SANs, d.NotAfter, d.IssuerName
+	}
+	return f
+}
+
+// encodeSite sets r's value to data, with the certificate and its details in
+// plaintext fields when field encryption is enabled.
+func (cds *CloudDsStorage) encodeSite(r *cdsEncryptedRecordWithLock, data *caddytls.SiteData) error {
+	if !cds.fieldEnc {
+		var err error
+		r.Value, err = cds.toBytes(data)
+		return err
+	}
+
+	r.siteFields = certFields(data.Cert)
+	secret := *data
+	secret.Cert = nil
+	var err error
+	r.Value, err = cds.toBytes(&secret)
+	return err
+}
+
+// decodeSite reverses encodeSite, for records stored with or without field
+// encryption.
+func (cds *CloudDsStorage) decodeSite(r *cdsEncryptedRecordWithLock) (*caddytls.SiteData, error) {
+	data := new(caddytls.SiteData)
+	if err := cds.fromBytes(r.Value, data); err != nil {
+		return nil, err
+	}
+	if len(r.Cert) > 0 {
+		data.Cert = r.Cert
+	}
+	return data, nil
+}
+
+// SiteMeta describes the certificate of a site, without its private key.
+type SiteMeta struct {
+	Domain string `json:"domain"`
+	CertDetails
+	Modified    time.Time         `json:"modified"` // when the site was last stored
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// LoadSiteMeta returns the details of domain's certificate, for dashboards
+// and health checks that shouldn't handle key material. With
+// EnvNameFieldEncryption the private key isn't even decrypted, otherwise it's
+// zeroed once the certificate is read, and either way its access isn't
+// recorded. The error is ErrNotExist if there's no site.
+func (cds *CloudDsStorage) LoadSiteMeta(ctx context.Context, domain string) (*SiteMeta, error) {
+	r, err := cds.getSiteEntity(ctx, domain)
+	if err == nil && !r.hasSite() {
+		err = datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to obtain site data for %v: %w", domain, notExist(err))
+	}
+	if err := cds.verify(&r.cdsEncryptedRecord, SITE_RECORD, domain, r.Cert); err != nil {
+		return nil, err
+	}
+
+	bundle := r.Cert
+	if len(bundle) == 0 {
+		data, err := cds.decodeSite(r)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode site data for %v: %w", domain, err)
+		}
+		for i := range data.Key {
+			data.Key[i] = 0
+		}
+		bundle = data.Cert
+	}
+	details, err := parseCertDetails(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse certificate of %v: %w", domain, err)
+	}
+	annotations, err := cds.SiteAnnotations(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := cds.SiteLabels(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	return &SiteMeta{Domain: domain, CertDetails: details, Modified: r.Modified, Labels: labels, Annotations: annotations}, nil
+}
+
+// SitesExpiringBefore returns the domains whose certificate expires before t,
+// using the NotAfter property of sites stored with EnvNameFieldEncryption.
+// Sites stored without it aren't returned.
+func (cds *CloudDsStorage) SitesExpiringBefore(ctx context.Context, t time.Time) ([]string, error) {
+	var domains []string
+	for _, client := range cds.clients() {
+		keys, err := cds.expiringBefore(ctx, client, SITE_RECORD, "sites", t)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			domain, err := cds.siteDomainOf(ctx, client, k)
+			if err != nil {
+				return nil, err
+			}
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+// CertificatesExpiringBefore returns the keys of the certificates CertMagic
+// has stored that expire before t, for those stored with
+// EnvNameFieldEncryption.
+func (s *CertMagicStorage) CertificatesExpiringBefore(ctx context.Context, t time.Time) ([]string, error) {
+	keys, err := s.cds.expiringBefore(ctx, s.cds.cloudDsClient, KV_RECORD, "certificates", t)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, k := range keys {
+		key, err := s.cds.kvKeyOf(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, key)
+	}
+	return list, nil
+}
+
+// expiringBefore returns the keys of records of kind under dir with a
+// NotAfter before t.
+func (cds *CloudDsStorage) expiringBefore(ctx context.Context, client dsClient, kind, dir string, t time.Time) ([]*datastore.Key, error) {
+	// the query has a single inequality so the built-in index serves it, the
+	// key prefix limits the results to this storage's records
+	base := cds.dsKey(kind, dir).Name + "/"
+	q := datastore.NewQuery(kind).
+		Namespace(cds.namespace).
+		FilterField("NotAfter", "<", t).
+		KeysOnly()
+
+	var keys []*datastore.Key
+	for it := client.Run(ctx, q); ; {
+		k, err := it.Next(nil)
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to query expiring %v: %w", dir, err)
+		}
+		if strings.HasPrefix(k.Name, base) {
+			keys = append(keys, k)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultFirestoreBatchSize is the default number of documents written per
+// batch, Firestore's limit.
+const DefaultFirestoreBatchSize = 500
+
+// recordKinds are the kinds of every record the storage writes.
+var recordKinds = []string{
+	SITE_RECORD,
+	USER_RECORD,
+	MOST_RECENT_USER_RECORD,
+	LOCK_RECORD,
+	AUDIT_RECORD,
+	ACCESS_RECORD,
+	STEK_RECORD,
+	OCSP_RECORD,
+	CHALLENGE_RECORD,
+	KV_RECORD,
+	ANNOTATION_RECORD,
+	SITE_LABEL_RECORD,
+	RENEWAL_RECORD,
+	CONTROL_RECORD,
+	THROTTLE_RECORD,
+	RATE_LIMIT_RECORD,
+}
+
+// FirestoreMigrationOptions configures MigrateToFirestore.
+type FirestoreMigrationOptions struct {
+	// BatchSize is the number of documents written per batch, defaults to DefaultFirestoreBatchSize
+	BatchSize int
+
+	// Progress, if set, is called after each batch with the kind being copied
+	// and the number of its entities copied so far
+	Progress func(kind string, copied int)
+}
+
+// firestoreCollection returns the collection entities of kind in namespace
+// are copied to, the kind itself in the default namespace, otherwise
+// `namespaces/<namespace>/<kind>`.
+func firestoreCollection(fs *firestore.Client, namespace, kind string) *firestore.CollectionRef {
+	if namespace == "" {
+		return fs.Collection(kind)
+	}
+	return fs.Collection("namespaces").Doc(namespace).Collection(kind)
+}
+
+// firestoreDocID returns a document ID for k, which can't contain `/` as
+// key names do.
+func firestoreDocID(k *datastore.Key) string {
+	if k.Name == "" {
+		return strconv.FormatInt(k.ID, 10)
+	}
+	return url.PathEscape(k.Name)
+}
+
+// MigrateToFirestore copies every record in the default project, in all
+// namespaces, to a Firestore native mode database. Each kind becomes a
+// collection and each entity a document with the same properties, keyed by
+// its escaped key name. Once copied, the number of documents in each
+// collection is checked against the number of entities. It's safe to run
+// again, documents are overwritten.
+func (cds *CloudDsStorage) MigrateToFirestore(ctx context.Context, fs *firestore.Client, opts FirestoreMigrationOptions) (int, error) {
+	if opts.BatchSize <= 0 || opts.BatchSize > DefaultFirestoreBatchSize {
+		opts.BatchSize = DefaultFirestoreBatchSize
+	}
+
+	namespaces, err := cds.datastoreNamespaces(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, ns := range namespaces {
+		for _, kind := range recordKinds {
+			copied, err := cds.migrateKindToFirestore(ctx, fs, ns, kind, opts)
+			total += copied
+			if err != nil {
+				return total, err
+			}
+
+			docs, err := countFirestoreDocs(ctx, firestoreCollection(fs, ns, kind))
+			if err != nil {
+				return total, err
+			}
+			if docs < copied {
+				return total, fmt.Errorf("Unable to verify %v in namespace %q: %d entities copied but %d documents found", kind, ns, copied, docs)
+			}
+		}
+	}
+	return total, nil
+}
+
+// datastoreNamespaces returns every namespace in the default project,
+// including the default namespace.
+func (cds *CloudDsStorage) datastoreNamespaces(ctx context.Context) ([]string, error) {
+	namespaces := []string{""}
+	q := datastore.NewQuery("__namespace__").KeysOnly()
+	for it := cds.cloudDsClient.Run(ctx, q); ; {
+		k, err := it.Next(nil)
+		if err == iterator.Done {
+			return namespaces, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list namespaces: %w", err)
+		}
+		if k.Name != "" {
+			namespaces = append(namespaces, k.Name)
+		}
+	}
+}
+
+func (cds *CloudDsStorage) migrateKindToFirestore(ctx context.Context, fs *firestore.Client, ns, kind string, opts FirestoreMigrationOptions) (int, error) {
+	coll := firestoreCollection(fs, ns, kind)
+	batch, pending, copied := fs.Batch(), 0, 0
+	commit := func() error {
+		if pending == 0 {
+			return nil
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("Unable to write %v documents to Firestore: %w", kind, err)
+		}
+		copied += pending
+		batch, pending = fs.Batch(), 0
+		if opts.Progress != nil {
+			opts.Progress(kind, copied)
+		}
+		return nil
+	}
+
+	q := datastore.NewQuery(kind).Namespace(ns)
+	for it := cds.cloudDsClient.Run(ctx, q); ; {
+		var props datastore.PropertyList
+		k, err := it.Next(&props)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return copied, fmt.Errorf("Unable to read %v entities: %w", kind, err)
+		}
+
+		data := make(map[string]interface{}, len(props))
+		for _, p := range props {
+			data[p.Name] = p.Value
+		}
+		batch.Set(coll.Doc(firestoreDocID(k)), data)
+		if pending++; pending == opts.BatchSize {
+			if err := commit(); err != nil {
+				return copied, err
+			}
+		}
+	}
+	return copied, commit()
+}
+
+func countFirestoreDocs(ctx context.Context, coll *firestore.CollectionRef) (int, error) {
+	n := 0
+	for it := coll.DocumentRefs(ctx); ; {
+		_, err := it.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("Unable to count Firestore documents in %v: %w", coll.Path, err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,42 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/kv"
+)
+
+// NewGCSStorage returns a storage for caURL keeping records as objects of
+// the Cloud Storage bucket cfg.GCSBucket rather than in Cloud Datastore, for
+// projects that don't enable Datastore and manage lifecycle and replication
+// on the bucket. Objects are written conditionally on their generation, so
+// locks and transactions hold across instances, see kvClient.
+func NewGCSStorage(caURL *url.URL, cfg *Config) (*CloudDsStorage, error) {
+	if cfg.GCSBucket == "" {
+		return nil, fmt.Errorf("Unable read GCS bucket from env var: %s", EnvNameGCSBucket)
+	}
+	if err := checkKVConfig(cfg, "Cloud Storage"); err != nil {
+		return nil, err
+	}
+
+	o, err := backendClientOptions(cfg, "STORAGE_EMULATOR_HOST")
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(context.Background(), o...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create Cloud Storage client: %w", err)
+	}
+
+	cs, err := newCloudDsStorage(caURL, cfg, newKVClient(kv.NewGCS(client, cfg.GCSBucket)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.start(cfg, "Cloud Storage gs://"+cfg.GCSBucket); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
@@ -0,0 +1,102 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddytls"
+)
+
+// Fixtures in testdata/golden were encrypted by released versions with the
+// default AES key and an all zero nonce. Never regenerate existing ones, add
+// fixtures for new formats with -update-golden.
+var updateGolden = flag.Bool("update-golden", false, "write missing golden fixtures")
+
+var goldenSite = &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte("meta")}
+var goldenUser = &caddytls.UserData{Reg: []byte("registration"), Key: []byte("key")}
+var goldenRaw = []byte("raw value")
+
+func goldenStorage(t *testing.T) *CloudDsStorage {
+	cds, err := NewMemoryStorage(&url.URL{}, &Config{Rand: zeroReader{}})
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	// only read with since, set directly
+	cds.aesKey, _ = base64.StdEncoding.DecodeString(DefaultAESKeyB64)
+	return cds
+}
+
+// golden returns the fixture name, writing it from value if it's missing and
+// -update-golden is set.
+func golden(t *testing.T, name string, value func() ([]byte, error)) []byte {
+	path := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			b, err := value()
+			if err != nil {
+				t.Fatalf("Error encrypting %s: %v", name, err)
+			}
+			if err := os.WriteFile(path, b, 0644); err != nil {
+				t.Fatalf("Error writing %s: %v", name, err)
+			}
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading fixture %s: %v", name, err)
+	}
+	return b
+}
+
+func TestGoldenDecrypt(t *testing.T) {
+	cds := goldenStorage(t)
+
+	site := new(caddytls.SiteData)
+	if err := cds.fromBytes(golden(t, "site.v1.bin", func() ([]byte, error) { return cds.toBytes(goldenSite) }), site); err != nil {
+		t.Fatalf("Error decoding site fixture: %v", err)
+	}
+	if !bytes.Equal(site.Cert, goldenSite.Cert) || !bytes.Equal(site.Key, goldenSite.Key) || !bytes.Equal(site.Meta, goldenSite.Meta) {
+		t.Errorf("Site fixture decoded to %+v", site)
+	}
+
+	user := new(caddytls.UserData)
+	if err := cds.fromBytes(golden(t, "user.v1.bin", func() ([]byte, error) { return cds.toBytes(goldenUser) }), user); err != nil {
+		t.Fatalf("Error decoding user fixture: %v", err)
+	}
+	if !bytes.Equal(user.Reg, goldenUser.Reg) || !bytes.Equal(user.Key, goldenUser.Key) {
+		t.Errorf("User fixture decoded to %+v", user)
+	}
+
+	raw, err := cds.rawFromBytes(golden(t, "raw.v1.bin", func() ([]byte, error) { return cds.rawToBytes(goldenRaw) }))
+	if err != nil {
+		t.Fatalf("Error decoding raw fixture: %v", err)
+	}
+	if !bytes.Equal(raw, goldenRaw) {
+		t.Errorf("Raw fixture decoded to %q", raw)
+	}
+}
+
+// TestGoldenEncrypt checks the current version still writes the same
+// prefix/nonce/ciphertext layout, so older versions can read its records.
+func TestGoldenEncrypt(t *testing.T) {
+	cds := goldenStorage(t)
+
+	for name, value := range map[string]func() ([]byte, error){
+		"site.v1.bin": func() ([]byte, error) { return cds.toBytes(goldenSite) },
+		"user.v1.bin": func() ([]byte, error) { return cds.toBytes(goldenUser) },
+		"raw.v1.bin":  func() ([]byte, error) { return cds.rawToBytes(goldenRaw) },
+	} {
+		b, err := value()
+		if err != nil {
+			t.Fatalf("Error encrypting %s: %v", name, err)
+		}
+		if expected := golden(t, name, value); !bytes.Equal(b, expected) {
+			t.Errorf("Encrypted %s differs from fixture:\n%x\n%x", name, b, expected)
+		}
+	}
+}
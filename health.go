@@ -0,0 +1,90 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Healthy returns an error if any project the storage uses can't be read,
+// using a keys-only query for a single record which is cheap however much is
+// stored. It lets orchestration tell Caddy being up from its storage being
+// reachable.
+func (cds *CloudDsStorage) Healthy(ctx context.Context) error {
+	ctx = withOpCategory(ctx, OpCategoryMaintenance)
+	q := datastore.NewQuery(SITE_RECORD).Namespace(cds.namespace).KeysOnly().Limit(1)
+	for _, client := range cds.clients() {
+		_, err := client.Run(ctx, q).Next(nil)
+		if errors.Is(err, ErrQueryUnsupported) {
+			// backends without queries are reached reading a record instead
+			err = client.Get(ctx, cds.dsKey(CONTROL_RECORD, "health"), &datastore.PropertyList{})
+			if err == datastore.ErrNoSuchEntity {
+				err = nil
+			}
+		}
+		if err != nil && err != iterator.Done {
+			return fmt.Errorf("Unable to query Cloud Datastore: %w", err)
+		}
+	}
+	return nil
+}
+
+// preflight checks the storage can reach Cloud Datastore when it's created,
+// as set by mode, one of the Preflight constants. Unless skipped, the query
+// also establishes the connections and fetches an auth token, so the first
+// handshake after a deploy doesn't wait for them.
+func (cds *CloudDsStorage) preflight(mode string) error {
+	switch mode {
+	case "", PreflightRequire, PreflightWarn:
+	case PreflightBackground:
+		go func() {
+			ctx, cancel := cds.opContext()
+			defer cancel()
+			if err := cds.Healthy(ctx); err != nil && cds.ctx.Err() == nil {
+				log.Printf("[WARNING] Storage warm-up failed: %v", err)
+			}
+		}()
+		return nil
+	case PreflightSkip:
+		return nil
+	default:
+		return fmt.Errorf("Invalid preflight mode %q, expected %s, %s, %s or %s", mode, PreflightRequire, PreflightWarn, PreflightBackground, PreflightSkip)
+	}
+
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	err := cds.Healthy(ctx)
+	if err != nil && mode == PreflightWarn {
+		log.Printf("[WARNING] Storage preflight check failed, continuing: %v", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Storage preflight check failed, set %s=%s if Cloud Datastore isn't reachable yet: %w", EnvNamePreflight, PreflightWarn, err)
+	}
+	return nil
+}
+
+// HealthHandler responds 200 if the storage is healthy and 503 if not, for
+// load balancer health checks. Each request is limited to the storage's
+// timeout.
+func (cds *CloudDsStorage) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), cds.timeout)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/plain")
+		if err := cds.Healthy(ctx); err != nil {
+			log.Printf("[WARNING] Storage health check failed: %v", err)
+			cds.notify(EventStorageDegraded, fmt.Sprintf("Storage health check failed: %v", err), map[string]interface{}{"error": err.Error()})
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("unhealthy\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,48 @@
+package tlsclouddatastore
+
+import "cloud.google.com/go/datastore"
+
+// Client returns the Cloud Datastore client of the storage's project, for
+// tooling beyond what the storage offers. It's nil for a storage that isn't
+// backed by Cloud Datastore, eg from NewMemoryStorage. Close closes it.
+func (cds *CloudDsStorage) Client() *datastore.Client {
+	return datastoreClient(cds.cloudDsClient)
+}
+
+// SiteClient returns the Cloud Datastore client of the project the site
+// records of domain are kept in, the storage's own unless a project route
+// matches it, see EnvNameProjectRoutes.
+func (cds *CloudDsStorage) SiteClient(domain string) *datastore.Client {
+	return datastoreClient(cds.siteClient(domain))
+}
+
+// SiteKey returns the key the site record of domain is stored under, in the
+// project of SiteClient, with the prefix, CA, shard and hash or name key
+// applied. Records stored under older layouts are still read from other keys
+// until they're stored again.
+func (cds *CloudDsStorage) SiteKey(domain string) *datastore.Key {
+	return cds.siteKey(domain)
+}
+
+// UserKey returns the key the user record of email is stored under, in the
+// storage's own project.
+func (cds *CloudDsStorage) UserKey(email string) *datastore.Key {
+	return cds.userKey(email)
+}
+
+// KVKey returns the key the value of a key/value or CertMagic key is stored
+// under, eg `certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt`.
+func (cds *CloudDsStorage) KVKey(key string) *datastore.Key {
+	return cds.kvKey(key)
+}
+
+// datastoreClient returns the *datastore.Client behind c, nil if it's a fake.
+func datastoreClient(c dsClient) *datastore.Client {
+	if counting, ok := c.(*countingClient); ok {
+		c = counting.dsClient
+	}
+	if c, ok := c.(cloudClient); ok {
+		return c.Client
+	}
+	return nil
+}
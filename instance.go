@@ -0,0 +1,24 @@
+package tlsclouddatastore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+)
+
+// defaultInstanceID returns the hostname with a random suffix, so processes
+// sharing a hostname (eg containers with host networking) are still distinct.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "caddy"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// InstanceID returns the identity this instance uses in lock records.
+func (cds *CloudDsStorage) InstanceID() string {
+	return cds.instanceID
+}
@@ -0,0 +1,333 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/caddyserver/caddy/caddytls"
+	"google.golang.org/api/iterator"
+)
+
+// Problems of the records IntegrityScan reports.
+const (
+	// IntegritySignature records don't match their signature
+	IntegritySignature = "signature"
+	// IntegrityDecryption records can't be decrypted with the configured keys
+	IntegrityDecryption = "decryption"
+	// IntegrityFormat records are decrypted but aren't in a format the storage reads
+	IntegrityFormat = "format"
+	// IntegrityCertificate records hold a certificate that can't be parsed
+	IntegrityCertificate = "certificate"
+	// IntegrityKeyMismatch records hold a private key that isn't their certificate's
+	IntegrityKeyMismatch = "key_mismatch"
+	// IntegrityFields records have plaintext fields that don't match their certificate
+	IntegrityFields = "fields"
+)
+
+// integrityLeader is the leadership the scheduled scan runs under, so only
+// one instance of a cluster scans.
+const integrityLeader = "integrity-scan"
+
+// integrityLogLimit is the most issues a scheduled scan logs one by one.
+const integrityLogLimit = 20
+
+// IntegrityIssue is a record IntegrityScan found corrupt or unreadable.
+type IntegrityIssue struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key"`     // key name of the record
+	Problem string `json:"problem"` // one of the Integrity constants
+	Detail  string `json:"detail"`
+}
+
+// IntegrityReport is the result of IntegrityScan.
+type IntegrityReport struct {
+	Scanned  int              `json:"scanned"`
+	Issues   []IntegrityIssue `json:"issues,omitempty"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+}
+
+// IntegrityScan reads every site, user and key/value record of the storage's
+// CA, in every project it uses, and checks it's signed, decrypts and decodes,
+// that certificates parse and private keys match them, so corruption, partial
+// migrations or writes with the wrong key are found before they're needed.
+// Nothing is modified and private key accesses aren't recorded. The error is
+// only for records that can't be queried, problems with them are issues.
+func (cds *CloudDsStorage) IntegrityScan(ctx context.Context) (*IntegrityReport, error) {
+	ctx = withOpCategory(ctx, OpCategoryMaintenance)
+	s := &integrityScan{cds: cds, report: &IntegrityReport{Started: cds.clock.Now()}}
+	for _, client := range cds.clients() {
+		if err := s.sites(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.users(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.kv(ctx); err != nil {
+		return nil, err
+	}
+	s.report.Finished = cds.clock.Now()
+	return s.report, nil
+}
+
+// integrityScan collects the issues of the records it's given.
+type integrityScan struct {
+	cds    *CloudDsStorage
+	report *IntegrityReport
+}
+
+func (s *integrityScan) add(kind string, k *datastore.Key, problem string, err error) {
+	s.report.Issues = append(s.report.Issues, IntegrityIssue{Kind: kind, Key: k.Name, Problem: problem, Detail: err.Error()})
+}
+
+// decodeFailed adds the issue of a value that can't be decoded.
+func (s *integrityScan) decodeFailed(kind string, k *datastore.Key, err error) {
+	if errors.Is(err, ErrDecryption) {
+		s.add(kind, k, IntegrityDecryption, err)
+		return
+	}
+	s.add(kind, k, IntegrityFormat, err)
+}
+
+// next returns the next record of kind from it into dst, false once there
+// are none. A record with properties dst doesn't have is an issue but still
+// checked.
+func (s *integrityScan) next(it dsIterator, kind string, dst interface{}) (*datastore.Key, bool, error) {
+	k, err := it.Next(dst)
+	if err == iterator.Done {
+		return nil, false, nil
+	}
+	var mismatch *datastore.ErrFieldMismatch
+	if errors.As(err, &mismatch) {
+		s.add(kind, k, IntegrityFormat, err)
+		err = nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to scan %v: %w", kind, err)
+	}
+	s.report.Scanned++
+	return k, true, nil
+}
+
+// query returns the query of every record of kind under the storage's prefix
+// and CA.
+func (s *integrityScan) query(kind string) (*datastore.Query, string) {
+	return datastore.NewQuery(kind).Namespace(s.cds.namespace), s.cds.dsKey(kind, "").Name + "/"
+}
+
+func (s *integrityScan) sites(ctx context.Context, client dsClient) error {
+	q, base := s.query(SITE_RECORD)
+	for it := client.Run(ctx, q); ; {
+		r := new(cdsEncryptedRecordWithLock)
+		k, ok, err := s.next(it, SITE_RECORD, r)
+		if !ok {
+			return err
+		}
+		if !strings.HasPrefix(k.Name, base) || !r.hasSite() {
+			continue
+		}
+		domain, err := s.cds.recordDomain(k, &r.cdsEncryptedRecord)
+		if err != nil {
+			s.decodeFailed(SITE_RECORD, k, err)
+			continue
+		}
+		if err := s.cds.verify(&r.cdsEncryptedRecord, SITE_RECORD, domain, r.Cert); err != nil {
+			s.add(SITE_RECORD, k, IntegritySignature, err)
+			continue
+		}
+		data, err := s.cds.decodeSite(r)
+		if err != nil {
+			s.decodeFailed(SITE_RECORD, k, err)
+			continue
+		}
+		s.certificate(SITE_RECORD, k, data.Cert, data.Key, r.siteFields)
+	}
+}
+
+// certificate checks cert parses, matches key unless it's empty, and
+// matches fields if they're stored.
+func (s *integrityScan) certificate(kind string, k *datastore.Key, cert, key []byte, fields siteFields) {
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		s.add(kind, k, IntegrityCertificate, err)
+		return
+	}
+	if len(key) > 0 {
+		if _, err := tls.X509KeyPair(cert, key); err != nil {
+			s.add(kind, k, IntegrityKeyMismatch, err)
+			return
+		}
+	}
+	if len(fields.Cert) > 0 && !fields.NotAfter.Equal(leaf.NotAfter) {
+		s.add(kind, k, IntegrityFields, fmt.Errorf("Indexed expiry %s, the certificate's is %s", fields.NotAfter.UTC().Format(time.RFC3339), leaf.NotAfter.UTC().Format(time.RFC3339)))
+	}
+}
+
+func (s *integrityScan) users(ctx context.Context) error {
+	for _, kind := range []string{USER_RECORD, MOST_RECENT_USER_RECORD} {
+		q, base := s.query(kind)
+		for it := s.cds.cloudDsClient.Run(ctx, q); ; {
+			r := new(cdsEncryptedRecord)
+			k, ok, err := s.next(it, kind, r)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if !strings.HasPrefix(k.Name, base) {
+				continue
+			}
+			if kind == MOST_RECENT_USER_RECORD {
+				s.mostRecentUser(k, r)
+				continue
+			}
+			s.user(k, r)
+		}
+	}
+	return nil
+}
+
+func (s *integrityScan) user(k *datastore.Key, r *cdsEncryptedRecord) {
+	email, ok := s.cds.openName(s.cds.emailFromKey(k))
+	if !ok {
+		email = s.cds.emailFromKey(k)
+		if s.cds.hashKey != nil && len(r.KeyName) > 0 {
+			name, err := s.cds.rawFromBytes(r.KeyName)
+			if err != nil {
+				s.decodeFailed(USER_RECORD, k, fmt.Errorf("Unable to decode key name: %w", err))
+				return
+			}
+			email = string(name)
+		}
+	}
+	if err := s.cds.verify(r, USER_RECORD, email, nil); err != nil {
+		s.add(USER_RECORD, k, IntegritySignature, err)
+		return
+	}
+	if err := s.cds.accountFromBytes(r.Value, new(caddytls.UserData)); err != nil {
+		s.decodeFailed(USER_RECORD, k, err)
+	}
+}
+
+func (s *integrityScan) mostRecentUser(k *datastore.Key, r *cdsEncryptedRecord) {
+	if err := s.cds.verify(r, MOST_RECENT_USER_RECORD, "most-recent-user", nil); err != nil {
+		s.add(MOST_RECENT_USER_RECORD, k, IntegritySignature, err)
+		return
+	}
+	if err := s.cds.fromBytes(r.Value, new(mostRecentUser)); err != nil {
+		s.decodeFailed(MOST_RECENT_USER_RECORD, k, err)
+	}
+}
+
+func (s *integrityScan) kv(ctx context.Context) error {
+	q, base := s.query(KV_RECORD)
+	for it := s.cds.cloudDsClient.Run(ctx, q); ; {
+		r := new(cdsKVRecord)
+		k, ok, err := s.next(it, KV_RECORD, r)
+		if !ok {
+			return err
+		}
+		if !strings.HasPrefix(k.Name, base) {
+			continue
+		}
+		key, err := s.cds.kvKeyOf(ctx, k)
+		if err != nil {
+			s.decodeFailed(KV_RECORD, k, err)
+			continue
+		}
+		if err := s.cds.verify(&r.cdsEncryptedRecord, KV_RECORD, cleanKVKey(key), r.Cert); err != nil {
+			s.add(KV_RECORD, k, IntegritySignature, err)
+			continue
+		}
+		value, err := s.cds.kvValue(key, r)
+		if err != nil {
+			s.decodeFailed(KV_RECORD, k, err)
+			continue
+		}
+
+		switch {
+		case isCertKey(key):
+			// the private key is checked on its own as well
+			var private []byte
+			privateKey := strings.TrimSuffix(key, ".crt") + ".key"
+			if kr, err := s.cds.kvGet(ctx, privateKey); err == nil {
+				private, _ = s.cds.kvValue(privateKey, kr)
+			}
+			s.certificate(KV_RECORD, k, value, private, r.siteFields)
+		case strings.HasSuffix(key, ".json") && !json.Valid(value):
+			s.add(KV_RECORD, k, IntegrityFormat, fmt.Errorf("Invalid JSON"))
+		}
+	}
+}
+
+// monitorIntegrity scans the records every cfg.IntegrityScan, from now until
+// the storage is closed, on whichever instance of the cluster holds the
+// leadership of the scan, logging and notifying any issues.
+func (cds *CloudDsStorage) monitorIntegrity(cfg *Config) {
+	if cfg.IntegrityScan <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case <-cds.ctx.Done():
+				return
+			case <-cds.clock.After(cfg.IntegrityScan):
+			}
+
+			// held past the next scan so it's renewed rather than lapsing
+			ctx, cancel := cds.opContext()
+			_, err := cds.AcquireLeadership(ctx, integrityLeader, 2*cfg.IntegrityScan)
+			cancel()
+			if errors.Is(err, ErrConflict) {
+				continue
+			}
+			if err != nil {
+				if cds.ctx.Err() == nil {
+					log.Printf("[ERROR] Unable to start integrity scan: %v", err)
+				}
+				continue
+			}
+
+			ctx, cancel = context.WithTimeout(cds.ctx, cfg.IntegrityScan)
+			report, err := cds.IntegrityScan(ctx)
+			cancel()
+			if err != nil {
+				if cds.ctx.Err() == nil {
+					log.Printf("[ERROR] Unable to scan record integrity: %v", err)
+				}
+				continue
+			}
+			report.log()
+			if len(report.Issues) > 0 {
+				cds.notify(EventIntegrityFailed, fmt.Sprintf("%d of %d records failed the integrity scan", len(report.Issues), report.Scanned), map[string]interface{}{"issues": report.Issues})
+			}
+		}
+	}()
+}
+
+// log logs the issues of the report, up to integrityLogLimit.
+func (r *IntegrityReport) log() {
+	if len(r.Issues) == 0 {
+		log.Printf("[INFO] Integrity scan of %d records found no issues", r.Scanned)
+		return
+	}
+	for i, issue := range r.Issues {
+		if i == integrityLogLimit {
+			log.Printf("[WARNING] Integrity scan: %d more issues", len(r.Issues)-i)
+			break
+		}
+		log.Printf("[WARNING] Integrity scan: %s %s: %s: %s", issue.Kind, issue.Key, issue.Problem, issue.Detail)
+	}
+	log.Printf("[WARNING] Integrity scan of %d records found %d issues", r.Scanned, len(r.Issues))
+}
@@ -0,0 +1,122 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/datastore"
+)
+
+// Column family and columns of the Cloud Bigtable table. The family must
+// keep a single version of each cell.
+const (
+	bigtableFamily  = "e"
+	bigtableValue   = "v" // value
+	bigtableVersion = "n" // decimal version of the row
+)
+
+// bigtableBackend is a Backend on a Cloud Bigtable table, a row per key.
+// Conditional writes check the version cell with a CheckAndMutate.
+type bigtableBackend struct {
+	client *bigtable.Client
+	table  *bigtable.Table
+}
+
+// NewBigtable returns a Backend on table, a table of client with a column
+// family e keeping a single version. Closing it closes client.
+func NewBigtable(client *bigtable.Client, table string) Backend {
+	return &bigtableBackend{client: client, table: client.Open(table)}
+}
+
+// latestCells reads only the latest cell of each column, in case the
+// family keeps more.
+var latestCells = bigtable.RowFilter(bigtable.LatestNFilter(1))
+
+func (b *bigtableBackend) Get(ctx context.Context, key string) ([]byte, int64, error) {
+	row, err := b.table.ReadRow(ctx, key, latestCells)
+	if err != nil {
+		return nil, 0, err
+	}
+	var value []byte
+	var version int64
+	for _, item := range row[bigtableFamily] {
+		switch item.Column {
+		case bigtableFamily + ":" + bigtableValue:
+			value = item.Value
+		case bigtableFamily + ":" + bigtableVersion:
+			if version, err = strconv.ParseInt(string(item.Value), 10, 64); err != nil {
+				return nil, 0, fmt.Errorf("Invalid version of %s: %w", key, err)
+			}
+		}
+	}
+	if value == nil {
+		return nil, 0, datastore.ErrNoSuchEntity
+	}
+	return value, version, nil
+}
+
+// versionFilter matches a row at version, 0 matching any row that exists.
+func versionFilter(version int64) bigtable.Filter {
+	if version == 0 {
+		return bigtable.StripValueFilter()
+	}
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter(bigtableFamily),
+		bigtable.ColumnFilter(bigtableVersion),
+		bigtable.LatestNFilter(1),
+		bigtable.ValueFilter(regexp.QuoteMeta(strconv.FormatInt(version, 10))),
+	)
+}
+
+// apply applies m to key if it's at version, ErrConflict otherwise.
+func (b *bigtableBackend) apply(ctx context.Context, key string, m *bigtable.Mutation, version int64) error {
+	if version == AnyVersion {
+		return b.table.Apply(ctx, key, m)
+	}
+	var cond *bigtable.Mutation
+	if version == 0 {
+		// only if the row doesn't exist
+		cond = bigtable.NewCondMutation(versionFilter(0), nil, m)
+	} else {
+		cond = bigtable.NewCondMutation(versionFilter(version), m, nil)
+	}
+	var matched bool
+	if err := b.table.Apply(ctx, key, cond, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return err
+	}
+	if matched != (version != 0) {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (b *bigtableBackend) Set(ctx context.Context, key string, value []byte, version int64) error {
+	m := bigtable.NewMutation()
+	now := bigtable.Now()
+	m.Set(bigtableFamily, bigtableValue, now, value)
+	// the write time keeps versions unique without reading the row
+	m.Set(bigtableFamily, bigtableVersion, now, []byte(strconv.FormatInt(int64(now), 10)))
+	return b.apply(ctx, key, m, version)
+}
+
+func (b *bigtableBackend) Delete(ctx context.Context, key string, version int64) error {
+	m := bigtable.NewMutation()
+	m.DeleteRow()
+	return b.apply(ctx, key, m, version)
+}
+
+func (b *bigtableBackend) Keys(ctx context.Context, start, end string) ([]string, error) {
+	var keys []string
+	err := b.table.ReadRows(ctx, bigtable.NewRange(start, end), func(row bigtable.Row) bool {
+		keys = append(keys, row.Key())
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(bigtable.CellsRowLimitFilter(1), bigtable.StripValueFilter())))
+	return keys, err
+}
+
+func (b *bigtableBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,140 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// gcsDefaultNamespace names the objects of keys of the default namespace,
+// which start with a slash as object names can't. Datastore reserves
+// namespaces of this form so it can't clash with a real one.
+const gcsDefaultNamespace = "__default__"
+
+// gcsBackend is a Backend on a Cloud Storage bucket, an object per key
+// named by gcsObject. Versions are object generations, so conditional writes
+// are generation preconditions.
+type gcsBackend struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+// NewGCS returns a Backend on bucket, a bucket client can access. Closing it
+// closes client.
+func NewGCS(client *storage.Client, bucket string) Backend {
+	return &gcsBackend{client: client, bucket: client.Bucket(bucket)}
+}
+
+// gcsObject returns the name of the object of key.
+func gcsObject(key string) string {
+	if strings.HasPrefix(key, "/") {
+		return gcsDefaultNamespace + key
+	}
+	return key
+}
+
+// gcsKey reverses gcsObject.
+func gcsKey(object string) string {
+	if strings.HasPrefix(object, gcsDefaultNamespace+"/") {
+		return strings.TrimPrefix(object, gcsDefaultNamespace)
+	}
+	return object
+}
+
+// gcsConditions returns the preconditions of a write of an object at
+// version, none for AnyVersion.
+func gcsConditions(version int64) (storage.Conditions, bool) {
+	switch version {
+	case AnyVersion:
+		return storage.Conditions{}, false
+	case 0:
+		return storage.Conditions{DoesNotExist: true}, true
+	default:
+		return storage.Conditions{GenerationMatch: version}, true
+	}
+}
+
+// gcsConflict returns ErrConflict for a failed precondition, err otherwise.
+func gcsConflict(err error) error {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+		return ErrConflict
+	}
+	return err
+}
+
+func (b *gcsBackend) Get(ctx context.Context, key string) ([]byte, int64, error) {
+	r, err := b.bucket.Object(gcsObject(key)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, 0, datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, r.Attrs.Generation, nil
+}
+
+func (b *gcsBackend) Set(ctx context.Context, key string, value []byte, version int64) error {
+	o := b.bucket.Object(gcsObject(key))
+	if cond, ok := gcsConditions(version); ok {
+		o = o.If(cond)
+	}
+	w := o.NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	if _, err := w.Write(value); err != nil {
+		w.Close()
+		return gcsConflict(err)
+	}
+	return gcsConflict(w.Close())
+}
+
+func (b *gcsBackend) Delete(ctx context.Context, key string, version int64) error {
+	o := b.bucket.Object(gcsObject(key))
+	if cond, ok := gcsConditions(version); ok {
+		o = o.If(cond)
+	}
+	err := o.Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		if version > 0 {
+			// deleted since it was read
+			return ErrConflict
+		}
+		return nil
+	}
+	return gcsConflict(err)
+}
+
+func (b *gcsBackend) Keys(ctx context.Context, start, end string) ([]string, error) {
+	q := &storage.Query{StartOffset: gcsObject(start), EndOffset: gcsObject(end)}
+	if err := q.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+	var keys []string
+	it := b.bucket.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, gcsKey(attrs.Name))
+	}
+}
+
+func (b *gcsBackend) Close() error {
+	return b.client.Close()
+}
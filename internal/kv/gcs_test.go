@@ -0,0 +1,18 @@
+package kv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGCSObjectNames(t *testing.T) {
+	for _, key := range []string{"/caddytlsSiteRecord/caddytls/example.com", "caddytls.acme/caddytlsAuditRecord/@42"} {
+		object := gcsObject(key)
+		if strings.HasPrefix(object, "/") {
+			t.Errorf("Expected %v not to start with a slash", object)
+		}
+		if got := gcsKey(object); got != key {
+			t.Errorf("Expected %v from %v, got %v", key, object, got)
+		}
+	}
+}
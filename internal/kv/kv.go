@@ -0,0 +1,50 @@
+// Package kv has the key/value backends the storage keeps records in other
+// than Cloud Datastore. The storage adapts a Backend to its Datastore client,
+// so encryption, key layout and locking are the same on every backend and
+// each backend only stores bytes by key.
+package kv
+
+import (
+	"context"
+	"errors"
+)
+
+// AnyVersion writes a key whatever its version.
+const AnyVersion = -1
+
+// ErrConflict is returned when a conditional write finds the key at another
+// version.
+var ErrConflict = errors.New("conflicting update")
+
+// Backend stores values by key.
+//
+// Every write of a key changes its version, which is 0 while the key doesn't
+// exist, so writes can be conditional and transactions optimistic.
+type Backend interface {
+	// Get returns the value of key and its version,
+	// datastore.ErrNoSuchEntity if it doesn't exist
+	Get(ctx context.Context, key string) ([]byte, int64, error)
+	// Set writes value to key if it's still at version or version is
+	// AnyVersion, ErrConflict otherwise
+	Set(ctx context.Context, key string, value []byte, version int64) error
+	// Delete deletes key, conditionally like Set
+	Delete(ctx context.Context, key string, version int64) error
+	// Keys returns the keys from start up to but excluding end, in order
+	Keys(ctx context.Context, start, end string) ([]string, error)
+	Close() error
+}
+
+// Write is a write of a transaction, conditional on Version like Set.
+type Write struct {
+	Key     string
+	Value   []byte // nil deletes Key
+	Version int64
+}
+
+// Batcher is a Backend that can apply several writes atomically, so
+// transactions writing several keys are never partly applied.
+type Batcher interface {
+	// Commit applies writes if every key is still at its version,
+	// otherwise none of them and returns ErrConflict
+	Commit(ctx context.Context, writes []Write) error
+}
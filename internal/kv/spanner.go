@@ -0,0 +1,123 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/spanner"
+	"google.golang.org/grpc/codes"
+)
+
+// Columns of the Cloud Spanner table, created with
+//
+//	CREATE TABLE caddytls (
+//	  Key STRING(MAX) NOT NULL,
+//	  Value BYTES(MAX) NOT NULL,
+//	  Version INT64 NOT NULL,
+//	) PRIMARY KEY (Key)
+var spannerColumns = []string{"Key", "Value", "Version"}
+
+// spannerBackend is a Backend and Batcher on a Cloud Spanner table, a row
+// per key. Writes check and bump the version in a read-write
+// transaction, and transactions commit all their writes in one, so they're
+// applied atomically across regions.
+type spannerBackend struct {
+	client *spanner.Client
+	table  string
+}
+
+// NewSpanner returns a Backend on table, a table of the database of client
+// created as above. Closing it closes client.
+func NewSpanner(client *spanner.Client, table string) Backend {
+	return &spannerBackend{client: client, table: table}
+}
+
+func (b *spannerBackend) Get(ctx context.Context, key string) ([]byte, int64, error) {
+	row, err := b.client.Single().ReadRow(ctx, b.table, spanner.Key{key}, spannerColumns[1:])
+	if spanner.ErrCode(err) == codes.NotFound {
+		return nil, 0, datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var value []byte
+	var version int64
+	if err := row.Columns(&value, &version); err != nil {
+		return nil, 0, fmt.Errorf("Invalid row %s: %w", key, err)
+	}
+	return value, version, nil
+}
+
+func (b *spannerBackend) Set(ctx context.Context, key string, value []byte, version int64) error {
+	return b.Commit(ctx, []Write{{Key: key, Value: value, Version: version}})
+}
+
+func (b *spannerBackend) Delete(ctx context.Context, key string, version int64) error {
+	return b.Commit(ctx, []Write{{Key: key, Version: version}})
+}
+
+// Commit applies writes in a read-write transaction, which Spanner retries
+// itself if it aborts.
+func (b *spannerBackend) Commit(ctx context.Context, writes []Write) error {
+	var conflict bool
+	_, err := b.client.ReadWriteTransaction(ctx, func(ctx context.Context, tx *spanner.ReadWriteTransaction) error {
+		conflict = false
+		mutations := make([]*spanner.Mutation, 0, len(writes))
+		for _, w := range writes {
+			var current int64
+			row, err := tx.ReadRow(ctx, b.table, spanner.Key{w.Key}, []string{"Version"})
+			if err == nil {
+				err = row.Columns(&current)
+			} else if spanner.ErrCode(err) == codes.NotFound {
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+			if w.Version != AnyVersion && w.Version != current {
+				conflict = true
+				return nil
+			}
+			if w.Value == nil {
+				mutations = append(mutations, spanner.Delete(b.table, spanner.Key{w.Key}))
+				continue
+			}
+			// the time rather than a count, so a row deleted and written
+			// again doesn't go back to a version read before
+			next := time.Now().UnixNano()
+			if next <= current {
+				next = current + 1
+			}
+			mutations = append(mutations, spanner.InsertOrUpdate(b.table, spannerColumns, []interface{}{w.Key, w.Value, next}))
+		}
+		return tx.BufferWrite(mutations)
+	})
+	if err != nil {
+		return err
+	}
+	if conflict {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (b *spannerBackend) Keys(ctx context.Context, start, end string) ([]string, error) {
+	var keys []string
+	r := spanner.KeyRange{Start: spanner.Key{start}, End: spanner.Key{end}, Kind: spanner.ClosedOpen}
+	err := b.client.Single().Read(ctx, b.table, r, spannerColumns[:1]).Do(func(row *spanner.Row) error {
+		var key string
+		if err := row.Columns(&key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+func (b *spannerBackend) Close() error {
+	b.client.Close()
+	return nil
+}
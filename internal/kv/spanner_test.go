@@ -0,0 +1,147 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
+	"cloud.google.com/go/spanner/admin/instance/apiv1/instancepb"
+	"google.golang.org/grpc/codes"
+)
+
+// newEmulatorSpanner returns a Backend on a new database of the Spanner
+// emulator at SPANNER_EMULATOR_HOST, skipping the test without one.
+func newEmulatorSpanner(t *testing.T) Backend {
+	if os.Getenv("SPANNER_EMULATOR_HOST") == "" {
+		t.Skip("Needs the Spanner emulator, set SPANNER_EMULATOR_HOST")
+	}
+	ctx := context.Background()
+	parent := "projects/kvtest/instances/kvtest"
+
+	ic, err := instance.NewInstanceAdminClient(ctx)
+	if err != nil {
+		t.Fatalf("Error creating instance admin client: %v", err)
+	}
+	defer ic.Close()
+	op, err := ic.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     "projects/kvtest",
+		InstanceId: "kvtest",
+		Instance: &instancepb.Instance{
+			Config:      "projects/kvtest/instanceConfigs/emulator-config",
+			DisplayName: "kvtest",
+			NodeCount:   1,
+		},
+	})
+	if err == nil {
+		_, err = op.Wait(ctx)
+	}
+	if err != nil && spanner.ErrCode(err) != codes.AlreadyExists {
+		t.Fatalf("Error creating instance: %v", err)
+	}
+
+	dc, err := database.NewDatabaseAdminClient(ctx)
+	if err != nil {
+		t.Fatalf("Error creating database admin client: %v", err)
+	}
+	defer dc.Close()
+	// a database per test, so they don't see each other's rows
+	db := fmt.Sprintf("kvtest-%d", time.Now().UnixNano())
+	dop, err := dc.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
+		Parent:          parent,
+		CreateStatement: "CREATE DATABASE `" + db + "`",
+		ExtraStatements: []string{"CREATE TABLE caddytls (Key STRING(MAX) NOT NULL, Value BYTES(MAX) NOT NULL, Version INT64 NOT NULL) PRIMARY KEY (Key)"},
+	})
+	if err == nil {
+		_, err = dop.Wait(ctx)
+	}
+	if err != nil {
+		t.Fatalf("Error creating database: %v", err)
+	}
+
+	client, err := spanner.NewClient(ctx, parent+"/databases/"+db)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	b := NewSpanner(client, "caddytls")
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestSpannerConditionalWrites(t *testing.T) {
+	b := newEmulatorSpanner(t)
+	ctx := context.Background()
+
+	if _, _, err := b.Get(ctx, "a"); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected ErrNoSuchEntity, got %v", err)
+	}
+	// version 0 only writes a key that doesn't exist
+	if err := b.Set(ctx, "a", []byte("one"), 0); err != nil {
+		t.Fatalf("Error creating a: %v", err)
+	}
+	if err := b.Set(ctx, "a", []byte("other"), 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict creating a again, got %v", err)
+	}
+	value, version, err := b.Get(ctx, "a")
+	if err != nil || string(value) != "one" || version <= 0 {
+		t.Fatalf("Expected one at a version, got %q %d: %v", value, version, err)
+	}
+
+	if err := b.Set(ctx, "a", []byte("two"), version); err != nil {
+		t.Fatalf("Error updating a: %v", err)
+	}
+	if err := b.Set(ctx, "a", []byte("stale"), version); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict writing a read version, got %v", err)
+	}
+	if err := b.Delete(ctx, "a", version); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict deleting a read version, got %v", err)
+	}
+	value, next, err := b.Get(ctx, "a")
+	if err != nil || string(value) != "two" || next <= version {
+		t.Fatalf("Expected two at a later version, got %q %d: %v", value, next, err)
+	}
+	if err := b.Delete(ctx, "a", next); err != nil {
+		t.Fatalf("Error deleting a: %v", err)
+	}
+	if _, _, err := b.Get(ctx, "a"); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected a deleted, got %v", err)
+	}
+}
+
+func TestSpannerCommit(t *testing.T) {
+	b := newEmulatorSpanner(t)
+	ctx := context.Background()
+
+	if err := b.Set(ctx, "b", []byte("one"), AnyVersion); err != nil {
+		t.Fatalf("Error writing b: %v", err)
+	}
+	// b conflicting, a isn't written either
+	err := b.(Batcher).Commit(ctx, []Write{{Key: "a", Value: []byte("one"), Version: 0}, {Key: "b", Value: []byte("two"), Version: 0}})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	if _, _, err := b.Get(ctx, "a"); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("Expected a not written, got %v", err)
+	}
+
+	_, version, err := b.Get(ctx, "b")
+	if err != nil {
+		t.Fatalf("Error reading b: %v", err)
+	}
+	err = b.(Batcher).Commit(ctx, []Write{{Key: "a", Value: []byte("one"), Version: 0}, {Key: "b", Value: []byte("two"), Version: version}, {Key: "c", Value: []byte("three"), Version: AnyVersion}})
+	if err != nil {
+		t.Fatalf("Error committing: %v", err)
+	}
+	keys, err := b.Keys(ctx, "a", "c")
+	if err != nil || !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatalf("Expected a and b, got %v: %v", keys, err)
+	}
+}
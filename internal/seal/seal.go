@@ -0,0 +1,133 @@
+// Package seal has the AES-GCM and name encryption the storage seals records
+// and key segments with, independent of the backend they're kept in.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// maxCachedAEADs bounds the ciphers cached on first use, a storage only
+// uses a few keys and builds theirs at startup.
+const maxCachedAEADs = 8
+
+var (
+	aeadsMu sync.Mutex   // held to replace aeads
+	aeads   atomic.Value // map[string]cipher.AEAD by key, copied on write so reads don't lock
+)
+
+// New creates the AES-GCM cipher of key.
+func New(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create GCM cipher: %v", err)
+	}
+	return gcm, nil
+}
+
+// For returns the AES-GCM cipher of key, from the cache if it's been built
+// before, as creating one for every record allocates its key schedule and
+// tables.
+func For(key []byte) (cipher.AEAD, error) {
+	cached, _ := aeads.Load().(map[string]cipher.AEAD)
+	if gcm, ok := cached[string(key)]; ok {
+		return gcm, nil
+	}
+	gcm, err := New(key)
+	if err != nil {
+		return nil, err
+	}
+	store(key, gcm, false)
+	return gcm, nil
+}
+
+// Cache builds the cipher of key, unless it's empty, so it's ready before
+// the first record is encrypted and an invalid key fails at startup.
+func Cache(key []byte) error {
+	if len(key) == 0 {
+		return nil
+	}
+	gcm, err := New(key)
+	if err != nil {
+		return err
+	}
+	store(key, gcm, true)
+	return nil
+}
+
+// store adds gcm to the cache, if there's room or always.
+func store(key []byte, gcm cipher.AEAD, always bool) {
+	aeadsMu.Lock()
+	defer aeadsMu.Unlock()
+	cached, _ := aeads.Load().(map[string]cipher.AEAD)
+	if _, ok := cached[string(key)]; ok || (!always && len(cached) >= maxCachedAEADs) {
+		return
+	}
+	next := make(map[string]cipher.AEAD, len(cached)+1)
+	for k, v := range cached {
+		next[k] = v
+	}
+	next[string(key)] = gcm
+	aeads.Store(next)
+}
+
+// nameSubkey derives the subkey of key used for purpose, so the MAC and
+// cipher of Name don't share a key.
+func nameSubkey(key []byte, purpose string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(purpose))
+	return m.Sum(nil)
+}
+
+// nameIV returns the synthetic IV of name, which doubles as its MAC.
+func nameIV(key []byte, name []byte) []byte {
+	m := hmac.New(sha256.New, nameSubkey(key, "siv-mac"))
+	m.Write(name)
+	return m.Sum(nil)[:aes.BlockSize]
+}
+
+// Name deterministically encrypts name with key, SIV style: the IV is an
+// HMAC of name so the same name always gives the same key segment, which keeps
+// lookups by name possible, and the segment can be decrypted again.
+func Name(key []byte, name string) string {
+	iv := nameIV(key, []byte(name))
+	block, err := aes.NewCipher(nameSubkey(key, "siv-enc"))
+	if err != nil {
+		// a SHA-256 sum is always a valid AES-256 key
+		panic(err)
+	}
+	out := make([]byte, len(iv)+len(name))
+	copy(out, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(out[len(iv):], []byte(name))
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// Unname reverses Name, false if segment wasn't sealed with key, eg
+// for a plain or hashed name stored before encryption was enabled.
+func Unname(key []byte, segment string) (string, bool) {
+	b, err := base64.RawURLEncoding.Strict().DecodeString(segment)
+	if err != nil || len(b) < aes.BlockSize {
+		return "", false
+	}
+	block, err := aes.NewCipher(nameSubkey(key, "siv-enc"))
+	if err != nil {
+		panic(err)
+	}
+	iv := b[:aes.BlockSize]
+	name := make([]byte, len(b)-aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(name, b[aes.BlockSize:])
+	if !hmac.Equal(iv, nameIV(key, name)) {
+		return "", false
+	}
+	return string(name), true
+}
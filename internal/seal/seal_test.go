@@ -0,0 +1,28 @@
+package seal
+
+import "testing"
+
+// FuzzUnname checks names round trip through Name, and that arbitrary
+// segments, including ones sealed with another key, are rejected rather than
+// decrypted to garbage.
+func FuzzUnname(f *testing.F) {
+	key, other := []byte("name-key"), []byte("other-key")
+
+	f.Add(Name(key, "wildcard_.example.com"))
+	f.Add(Name(other, "example.com"))
+	f.Add("example.com")
+	f.Add("0123456789abcdef0123456789abcdef")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, segment string) {
+		if name, ok := Unname(key, Name(key, segment)); !ok || name != segment {
+			t.Fatalf("Expected %q to round trip, got %q", segment, name)
+		}
+		if Name(key, segment) != Name(key, segment) {
+			t.Fatalf("Expected the same segment for %q", segment)
+		}
+		if name, ok := Unname(key, segment); ok && Name(key, name) != segment {
+			t.Fatalf("Unsealed %q from a segment it doesn't seal to", name)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// SiteInfo describes a certificate stored through CertMagicStorage and the
+// state of the lock CertMagic takes while issuing it. Issuer is the CertMagic
+// issuer it was obtained from, IssuerName the CA named in the certificate.
+type SiteInfo struct {
+	Domain string `json:"domain"`
+	Issuer string `json:"issuer"`
+	CertDetails
+	Locked      bool              `json:"locked"`
+	LockOwner   string            `json:"lock_owner,omitempty"`
+	LockExpires time.Time         `json:"lock_expires,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// certMagicDomain reverses the wildcard escaping CertMagic applies to
+// domains in keys.
+func certMagicDomain(safe string) string {
+	if strings.HasPrefix(safe, wildcardLabel) {
+		return "*" + strings.TrimPrefix(safe, wildcardLabel)
+	}
+	return safe
+}
+
+// Sites lists the certificates CertMagic has stored, for each issuer, with
+// their expiry and whether an instance holds the lock to issue them.
+func (s *CertMagicStorage) Sites(ctx context.Context) ([]SiteInfo, error) {
+	keys, err := s.cds.kvList(ctx, "certificates", true)
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []SiteInfo
+	for _, key := range keys {
+		// certificates/<issuer>/<domain>/<domain>.crt
+		parts := strings.Split(key, "/")
+		if len(parts) != 4 || parts[3] != parts[2]+".crt" {
+			continue
+		}
+
+		site := SiteInfo{Domain: certMagicDomain(parts[2]), Issuer: parts[1]}
+		bundle, err := s.cds.kvLoad(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if details, err := parseCertDetails(bundle); err == nil {
+			site.CertDetails = details
+		}
+
+		l := new(cdsLockRecord)
+		err = s.cds.cloudDsClient.Get(ctx, s.cds.certMagicLockKey("issue_cert_"+site.Domain), l)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, fmt.Errorf("Unable to obtain lock for %v: %w", site.Domain, err)
+		}
+		if err == nil && s.cds.lockLive(l.Expires) {
+			site.Locked, site.LockOwner, site.LockExpires = true, l.Owner, l.Expires
+		}
+		if site.Labels, err = s.cds.SiteLabels(ctx, site.Domain); err != nil {
+			return nil, err
+		}
+		if site.Annotations, err = s.cds.SiteAnnotations(ctx, site.Domain); err != nil {
+			return nil, err
+		}
+
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
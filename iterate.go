@@ -0,0 +1,116 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"cloud.google.com/go/datastore"
+	"github.com/caddyserver/caddy/caddytls"
+	"google.golang.org/api/iterator"
+)
+
+// IteratePageSize is the number of sites IterateSites reads per query.
+const IteratePageSize = 100
+
+// IterateSites calls fn with each site of this CA, in every project it uses,
+// reading IteratePageSize records at a time with query cursors so only a page
+// is held in memory, eg to export or audit hundreds of thousands of sites.
+// Iteration stops at the first error fn returns, which is returned. Sites
+// are read like LoadSite, so each private key returned is recorded with
+// EnvNameAccessAudit.
+func (cds *CloudDsStorage) IterateSites(ctx context.Context, fn func(domain string, site *caddytls.SiteData) error) error {
+	for _, client := range cds.clients() {
+		if err := cds.iterateSites(ctx, client, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cds *CloudDsStorage) iterateSites(ctx context.Context, client dsClient, fn func(string, *caddytls.SiteData) error) error {
+	// `0` sorts directly after `/`
+	base := cds.dsKey(SITE_RECORD, "sites").Name
+	start := datastore.NameKey(SITE_RECORD, base+"/", nil)
+	start.Namespace = cds.namespace
+	end := datastore.NameKey(SITE_RECORD, base+"0", nil)
+	end.Namespace = cds.namespace
+	q := datastore.NewQuery(SITE_RECORD).
+		Namespace(cds.namespace).
+		FilterField("__key__", ">=", start).
+		FilterField("__key__", "<", end).
+		Order("__key__").
+		Limit(IteratePageSize)
+
+	for {
+		it := client.Run(ctx, q)
+		n := 0
+		for {
+			r := new(cdsEncryptedRecordWithLock)
+			k, err := it.Next(r)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("Unable to list sites: %w", err)
+			}
+			n++
+			if err := cds.yieldSite(ctx, client, k, r, fn); err != nil {
+				return err
+			}
+		}
+		if n < IteratePageSize {
+			return nil
+		}
+
+		cursor, err := it.Cursor()
+		if err != nil {
+			return fmt.Errorf("Unable to list sites: %w", err)
+		}
+		q = q.Start(cursor)
+	}
+}
+
+// yieldSite calls fn with the site r stored at k, unless it's a copy LoadSite
+// wouldn't read, eg under the domain's plain name once it's hashed or in a
+// project it's no longer routed to.
+func (cds *CloudDsStorage) yieldSite(ctx context.Context, client dsClient, k *datastore.Key, r *cdsEncryptedRecordWithLock, fn func(string, *caddytls.SiteData) error) error {
+	domain, err := cds.recordDomain(k, &r.cdsEncryptedRecord)
+	if err != nil {
+		return err
+	}
+	if cds.siteClient(domain) != client {
+		return nil
+	}
+	if current := cds.siteKey(domain); current.Name != k.Name {
+		var props datastore.PropertyList
+		if err := client.Get(ctx, current, &props); err == nil {
+			return nil
+		}
+	}
+
+	if err := cds.verify(&r.cdsEncryptedRecord, SITE_RECORD, domain, r.Cert); err != nil {
+		return err
+	}
+	site, err := cds.decodeSite(r)
+	if err != nil {
+		return fmt.Errorf("Unable to decode site data for %v: %w", domain, err)
+	}
+	cds.recordKeyAccess(ctx, domain)
+	return fn(domain, site)
+}
+
+// recordDomain is siteDomainOf for a record that's already been read.
+func (cds *CloudDsStorage) recordDomain(k *datastore.Key, r *cdsEncryptedRecord) (string, error) {
+	if domain, ok := cds.openName(path.Base(k.Name)); ok {
+		return unescapeWildcard(domain), nil
+	}
+	if cds.hashKey != nil && len(r.KeyName) > 0 {
+		name, err := cds.rawFromBytes(r.KeyName)
+		if err != nil {
+			return "", fmt.Errorf("Unable to decode key name of %v: %w", k.Name, err)
+		}
+		return string(name), nil
+	}
+	return unescapeWildcard(unescapeSegment(path.Base(k.Name))), nil
+}
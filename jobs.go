@@ -0,0 +1,193 @@
+package tlsclouddatastore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJobWorkers is the default number of items bulk jobs process at once.
+const DefaultJobWorkers = 8
+
+// JobOptions configures bulk jobs over many items, eg ReconcileWithOptions.
+type JobOptions struct {
+	// Workers is the number of items processed at once, defaults to DefaultJobWorkers
+	Workers int
+
+	// Rate limits the items started per second across all workers, unlimited if 0
+	Rate float64
+
+	// Checkpoint, if set, records each item once it's done so a job that's
+	// interrupted skips them when run again
+	Checkpoint Checkpoint
+}
+
+// JobError is the failure of a single item of a bulk job, which doesn't stop
+// the others.
+type JobError struct {
+	Item string
+	Err  error
+}
+
+func (e JobError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Item, e.Err)
+}
+
+func (e JobError) Unwrap() error {
+	return e.Err
+}
+
+// Checkpoint records the items of a bulk job that are done. It must be safe
+// for concurrent use.
+type Checkpoint interface {
+	Done(item string) bool
+	Mark(item string) error
+}
+
+// FileCheckpoint is a Checkpoint kept in a file, one item per line, so a job
+// resumes where it stopped after a restart.
+type FileCheckpoint struct {
+	mu   sync.Mutex
+	done map[string]bool
+	f    *os.File
+}
+
+// OpenFileCheckpoint opens the checkpoint in path, creating it if it doesn't
+// exist. Delete the file to start a job from scratch.
+func OpenFileCheckpoint(path string) (*FileCheckpoint, error) {
+	c := &FileCheckpoint{done: make(map[string]bool)}
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Unable to open checkpoint: %w", err)
+	}
+	if err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			c.done[s.Text()] = true
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("Unable to read checkpoint: %w", err)
+		}
+	}
+
+	if c.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, fmt.Errorf("Unable to open checkpoint: %w", err)
+	}
+	return c, nil
+}
+
+// Done reports whether item was marked done.
+func (c *FileCheckpoint) Done(item string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[item]
+}
+
+// Mark records item as done.
+func (c *FileCheckpoint) Mark(item string) error {
+	if strings.ContainsAny(item, "\r\n") {
+		return fmt.Errorf("Unable to checkpoint %q, it contains a line break", item)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.WriteString(item + "\n"); err != nil {
+		return fmt.Errorf("Unable to write checkpoint: %w", err)
+	}
+	c.done[item] = true
+	return nil
+}
+
+// Close closes the checkpoint's file.
+func (c *FileCheckpoint) Close() error {
+	return c.f.Close()
+}
+
+// runJob calls fn with each item from items, on opts.Workers goroutines at
+// most opts.Rate a second, until items is closed or ctx is done. Items the
+// checkpoint has are skipped. The errors of failed items are returned, the
+// job carries on without them; only ctx ending stops it early, with its
+// error.
+func runJob(ctx context.Context, items <-chan string, opts JobOptions, fn func(ctx context.Context, item string) error) ([]JobError, error) {
+	ctx = withOpCategory(ctx, OpCategoryMaintenance)
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultJobWorkers
+	}
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	var mu sync.Mutex
+	var failed []JobError
+	fail := func(item string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, JobError{Item: item, Err: err})
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				if err := fn(ctx, item); err != nil {
+					fail(item, err)
+					continue
+				}
+				if opts.Checkpoint != nil {
+					if err := opts.Checkpoint.Mark(item); err != nil {
+						fail(item, err)
+					}
+				}
+			}
+		}()
+	}
+
+	err := dispatch(ctx, items, work, tick, opts.Checkpoint)
+	close(work)
+	wg.Wait()
+	return failed, err
+}
+
+// dispatch sends each item not yet done to work, waiting for tick if set.
+func dispatch(ctx context.Context, items <-chan string, work chan<- string, tick <-chan time.Time, checkpoint Checkpoint) error {
+	for {
+		var item string
+		select {
+		case i, ok := <-items:
+			if !ok {
+				return ctx.Err()
+			}
+			item = i
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if checkpoint != nil && checkpoint.Done(item) {
+			continue
+		}
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case work <- item:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
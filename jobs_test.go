@@ -0,0 +1,74 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func jobItems(n int) <-chan string {
+	items := make(chan string)
+	go func() {
+		defer close(items)
+		for i := 0; i < n; i++ {
+			items <- strconv.Itoa(i)
+		}
+	}()
+	return items
+}
+
+func TestRunJob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	checkpoint, err := OpenFileCheckpoint(path)
+	if err != nil {
+		t.Fatalf("Error opening checkpoint: %v", err)
+	}
+
+	var mu sync.Mutex
+	var done []string
+	process := func(ctx context.Context, item string) error {
+		if item == "3" {
+			return errors.New("failed")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		done = append(done, item)
+		return nil
+	}
+
+	failed, err := runJob(context.Background(), jobItems(10), JobOptions{Workers: 4, Checkpoint: checkpoint}, process)
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	if len(failed) != 1 || failed[0].Item != "3" || len(done) != 9 {
+		t.Fatalf("Expected only item 3 failed, got %v with %d done", failed, len(done))
+	}
+	checkpoint.Close()
+
+	// resumed, only the failed item is processed again
+	if checkpoint, err = OpenFileCheckpoint(path); err != nil {
+		t.Fatalf("Error opening checkpoint: %v", err)
+	}
+	defer checkpoint.Close()
+	done = nil
+	failed, err = runJob(context.Background(), jobItems(10), JobOptions{Rate: 100, Checkpoint: checkpoint}, process)
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	if len(failed) != 1 || len(done) != 0 {
+		t.Fatalf("Expected checkpointed items skipped, got %v failed and %v done", failed, done)
+	}
+}
+
+func TestRunJobCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	items := make(chan string)
+	go func() { items <- "never" }()
+	if _, err := runJob(ctx, items, JobOptions{}, func(context.Context, string) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the job stopped with the context, got %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/seal"
+)
+
+// caNamespace returns the part of the key namespace that identifies a CA, the
+// lower-cased host followed by the cleaned directory path, so two CA endpoints
+// on the same host (eg ACME v1 and v2 directories) don't share records. It's
+// empty for an empty URL, as used for CertMagic whose keys include the issuer.
+func caNamespace(caURL *url.URL) string {
+	host := strings.ToLower(caURL.Host)
+	if caURL.Scheme == "https" && caURL.Port() == "443" {
+		host = strings.ToLower(caURL.Hostname())
+	}
+	p := strings.Trim(path.Clean("/"+caURL.Path), "/")
+	return path.Join(host, p)
+}
+
+// caDatastoreNamespace returns the Datastore namespace used for a CA when
+// EnvNameNamespacePerCA is set, prefix includes any EnvNameNamespace. Namespaces are limited to 100 of
+// `[0-9A-Za-z._-]` and can't start with `__`.
+func caDatastoreNamespace(prefix, caNs string) string {
+	ns := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/':
+			return '.'
+		case r >= '0' && r <= '9', r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, prefix+"/"+caNs)
+	ns = strings.TrimRight(strings.TrimLeft(ns, "_"), ".")
+	if len(ns) > 100 {
+		sum := sha256.Sum256([]byte(ns))
+		ns = ns[:91] + "-" + hex.EncodeToString(sum[:4])
+	}
+	return ns
+}
+
+func (cds *CloudDsStorage) key(suffix string) string {
+	if cds.perCA {
+		// the namespace already identifies the CA
+		return path.Join(cds.prefix, suffix)
+	}
+	return path.Join(cds.prefix, cds.caNamespace, suffix)
+}
+
+// dsKey returns the key a record is written under.
+func (cds *CloudDsStorage) dsKey(kind, suffix string) *datastore.Key {
+	k := datastore.NameKey(kind, cds.key(suffix), nil)
+	k.Namespace = cds.namespace
+	return k
+}
+
+// dsKeys returns all keys a record may be stored under, the current layout
+// first followed by older layouts that are still read for compatibility.
+func (cds *CloudDsStorage) dsKeys(kind, suffix string) []*datastore.Key {
+	keys := []*datastore.Key{cds.dsKey(kind, suffix)}
+	pathLayout := path.Join(cds.prefix, cds.caNamespace, suffix)
+	if cds.perCA {
+		// records stored before namespace per CA was enabled
+		keys = append(keys, cds.baseKey(kind, pathLayout))
+	}
+	if legacy := path.Join(cds.prefix, cds.caHost, suffix); legacy != pathLayout {
+		keys = append(keys, cds.baseKey(kind, legacy))
+	}
+	return keys
+}
+
+// baseKey returns a key in the namespace set by EnvNameNamespace, which
+// records not kept per CA are stored in.
+func (cds *CloudDsStorage) baseKey(kind, name string) *datastore.Key {
+	k := datastore.NameKey(kind, name, nil)
+	k.Namespace = cds.baseNamespace
+	return k
+}
+
+// siteSuffix returns the key suffix of a site record, which includes the
+// domain's shard when sharding is enabled.
+func (cds *CloudDsStorage) siteSuffix(domain string) string {
+	return cds.siteSuffixWith(domain, cds.nameSegment(escapeWildcard(domain)))
+}
+
+// siteSuffixWith is siteSuffix with the domain's key segment.
+func (cds *CloudDsStorage) siteSuffixWith(domain, segment string) string {
+	if cds.shards > 0 {
+		return path.Join("sites", cds.shardName(shardOf(domain, cds.shards)), segment)
+	}
+	return path.Join("sites", segment)
+}
+
+func (cds *CloudDsStorage) siteKey(domain string) *datastore.Key {
+	return cds.dsKey(SITE_RECORD, cds.siteSuffix(domain))
+}
+
+func (cds *CloudDsStorage) siteKeys(domain string) []*datastore.Key {
+	var keys []*datastore.Key
+	for _, segment := range cds.nameSegments(escapeWildcard(domain)) {
+		keys = append(keys, cds.dsKeys(SITE_RECORD, cds.siteSuffixWith(domain, segment))...)
+		if cds.shards > 0 {
+			// records stored before sharding was enabled
+			keys = append(keys, cds.dsKeys(SITE_RECORD, path.Join("sites", segment))...)
+		}
+	}
+	if raw := escapeSegment(domain); raw != escapeSegment(escapeWildcard(domain)) {
+		// wildcard sites stored before `*` was escaped, which was before
+		// names could be hashed or sharded
+		keys = append(keys, cds.dsKeys(SITE_RECORD, path.Join("sites", raw))...)
+	}
+	return keys
+}
+
+func (cds *CloudDsStorage) userKey(email string) *datastore.Key {
+	return cds.dsKey(USER_RECORD, path.Join("users", cds.nameSegment(email)))
+}
+
+func (cds *CloudDsStorage) userKeys(email string) []*datastore.Key {
+	var keys []*datastore.Key
+	for _, segment := range cds.nameSegments(email) {
+		keys = append(keys, cds.dsKeys(USER_RECORD, path.Join("users", segment))...)
+	}
+	return keys
+}
+
+func (cds *CloudDsStorage) mostRecentUserKey() *datastore.Key {
+	return cds.dsKey(MOST_RECENT_USER_RECORD, "most-recent-user")
+}
+
+func (cds *CloudDsStorage) mostRecentUserKeys() []*datastore.Key {
+	return cds.dsKeys(MOST_RECENT_USER_RECORD, "most-recent-user")
+}
+
+func (cds *CloudDsStorage) emailFromKey(key *datastore.Key) string {
+	_, email := path.Split(key.Name)
+	return unescapeSegment(email)
+}
+
+// userEmailOf returns the email of the user record at k.
+func (cds *CloudDsStorage) userEmailOf(ctx context.Context, k *datastore.Key) (string, error) {
+	if email, ok := cds.openName(cds.emailFromKey(k)); ok {
+		return email, nil
+	}
+	email, err := cds.storedName(ctx, cds.cloudDsClient, k)
+	if err != nil || email != "" {
+		return email, err
+	}
+	return cds.emailFromKey(k), nil
+}
+
+// siteDomainOf returns the domain of the site record at k.
+func (cds *CloudDsStorage) siteDomainOf(ctx context.Context, client dsClient, k *datastore.Key) (string, error) {
+	if domain, ok := cds.openName(path.Base(k.Name)); ok {
+		return unescapeWildcard(domain), nil
+	}
+	domain, err := cds.storedName(ctx, client, k)
+	if err != nil || domain != "" {
+		return domain, err
+	}
+	return unescapeWildcard(unescapeSegment(path.Base(k.Name))), nil
+}
+
+// nameSegment returns the key segment of a domain, email or other name,
+// encrypted with EnvNameNameKey or an HMAC of it with EnvNameHashKey so key
+// names don't reveal it.
+func (cds *CloudDsStorage) nameSegment(name string) string {
+	if cds.nameKey != nil {
+		return seal.Name(cds.nameKey, name)
+	}
+	return cds.hashedSegment(name)
+}
+
+// hashedSegment returns the HMAC of name with EnvNameHashKey, name itself,
+// escaped, if it isn't set.
+func (cds *CloudDsStorage) hashedSegment(name string) string {
+	if cds.hashKey == nil {
+		return escapeSegment(name)
+	}
+	m := hmac.New(sha256.New, cds.hashKey)
+	m.Write([]byte(name))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// nameSegments returns the key segments a name may be stored under, the
+// current one first followed by older ones, hashed if names were hashed
+// before being encrypted and the name itself, for records stored before
+// either was enabled or names were escaped. The name itself is only read if
+// it can't leave the segment.
+func (cds *CloudDsStorage) nameSegments(name string) []string {
+	segments := []string{cds.nameSegment(name)}
+	if cds.nameKey != nil && cds.hashKey != nil {
+		segments = append(segments, cds.hashedSegment(name))
+	}
+	if escaped := escapeSegment(name); segments[len(segments)-1] != escaped {
+		segments = append(segments, escaped)
+	}
+	if segments[len(segments)-1] != name && !strings.Contains(name, "/") && name != "." && name != ".." {
+		segments = append(segments, name)
+	}
+	return segments
+}
+
+var (
+	segmentEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	segmentUnescaper = strings.NewReplacer("%25", "%", "%2F", "/", "%2E", ".")
+)
+
+// escapeSegment returns name as a single segment of a key name, `%` and `/`
+// percent-encoded, and `.` and `..` too, so path.Join can't take a crafted
+// domain or email out of its part of the key namespace. Other names, every
+// valid domain and email, are unchanged so their keys are too.
+func escapeSegment(name string) string {
+	switch name {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	return segmentEscaper.Replace(name)
+}
+
+// unescapeSegment reverses escapeSegment.
+func unescapeSegment(segment string) string {
+	if !strings.Contains(segment, "%") {
+		return segment
+	}
+	return segmentUnescaper.Replace(segment)
+}
+
+// openName returns the name a key segment was encrypted from with
+// EnvNameNameKey, false if it wasn't.
+func (cds *CloudDsStorage) openName(segment string) (string, bool) {
+	if cds.nameKey == nil {
+		return "", false
+	}
+	return seal.Unname(cds.nameKey, segment)
+}
+
+// stampName keeps name, encrypted, in a record whose key name is hashed, so
+// listings can recover it. Encrypted key names don't need it.
+func (cds *CloudDsStorage) stampName(r *cdsEncryptedRecord, name string) error {
+	if cds.hashKey == nil || cds.nameKey != nil {
+		return nil
+	}
+	var err error
+	if r.KeyName, err = cds.rawToBytes([]byte(name)); err != nil {
+		return fmt.Errorf("Unable to encode key name: %w", err)
+	}
+	return nil
+}
+
+// storedName returns the name kept in the record at k by stampName, empty if
+// its key name isn't hashed.
+func (cds *CloudDsStorage) storedName(ctx context.Context, client dsClient, k *datastore.Key) (string, error) {
+	if cds.hashKey == nil {
+		return "", nil
+	}
+	var props datastore.PropertyList
+	if err := client.Get(ctx, k, &props); err != nil {
+		return "", fmt.Errorf("Unable to obtain %v: %w", k.Name, notExist(err))
+	}
+	for _, p := range props {
+		if b, ok := p.Value.([]byte); ok && p.Name == "KeyName" && len(b) > 0 {
+			name, err := cds.rawFromBytes(b)
+			if err != nil {
+				return "", fmt.Errorf("Unable to decode key name of %v: %w", k.Name, err)
+			}
+			return string(name), nil
+		}
+	}
+	return "", nil
+}
+
+// namesUnder returns the keys of every record of kind under dir, in the
+// current layout.
+func (cds *CloudDsStorage) namesUnder(ctx context.Context, client dsClient, kind, dir string) ([]*datastore.Key, error) {
+	// `0` sorts directly after `/`
+	base := cds.dsKey(kind, dir).Name
+	keys, err := client.KeysInRange(ctx, kind, cds.namespace, base+"/", base+"0")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %v: %w", dir, err)
+	}
+	return keys, nil
+}
+
+// getFirst loads the first of keys that exists into dst, or returns
+// datastore.ErrNoSuchEntity if none of them do.
+func (cds *CloudDsStorage) getFirst(ctx context.Context, client dsClient, keys []*datastore.Key, dst interface{}) error {
+	for _, k := range keys {
+		if err := client.Get(ctx, k, dst); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	return datastore.ErrNoSuchEntity
+}
+
+// projectFirst is getFirst returning only props of the record, or nothing
+// if there are none, so its value isn't read for metadata or existence.
+func (cds *CloudDsStorage) projectFirst(ctx context.Context, client dsClient, keys []*datastore.Key, props ...string) (datastore.PropertyList, error) {
+	for _, k := range keys {
+		list, err := client.GetProjection(ctx, k, props...)
+		if err != datastore.ErrNoSuchEntity {
+			return list, err
+		}
+	}
+	return nil, datastore.ErrNoSuchEntity
+}
@@ -0,0 +1,280 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// cdsKVRecord is a value stored under an arbitrary key, encrypted in Value or,
+// for a certificate with EnvNameFieldEncryption, in plaintext siteFields.
+type cdsKVRecord struct {
+	cdsEncryptedRecord
+	Size    int64 // of the unencrypted value
+	Chunked bool  `datastore:",noindex,omitempty"` // Value is encrypted in chunks, see chunkWriter
+	siteFields
+}
+
+// KeyInfo describes a key stored with the generic key/value methods.
+type KeyInfo struct {
+	Key        string
+	Modified   time.Time
+	Size       int64
+	IsTerminal bool // false for a "directory", a prefix of other keys
+}
+
+// Store puts value at key, a slash separated path under the storage's prefix
+// and CA, encrypted like sites. It's the key/value store CertMagicStorage is
+// built on, so sibling plugins can keep their own data in the storage without
+// a record type of their own.
+func (cds *CloudDsStorage) Store(ctx context.Context, key string, value []byte) error {
+	return cds.kvStore(ctx, key, value)
+}
+
+// Load returns the value at key, the error is ErrNotExist if there's none.
+func (cds *CloudDsStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return cds.kvLoad(ctx, key)
+}
+
+// Delete deletes key and, if it's a directory, everything under it.
+func (cds *CloudDsStorage) Delete(ctx context.Context, key string) error {
+	return cds.kvDelete(ctx, key)
+}
+
+// List returns the keys under dir, all of them if recursive, otherwise only
+// its immediate children.
+func (cds *CloudDsStorage) List(ctx context.Context, dir string, recursive bool) ([]string, error) {
+	return cds.kvList(ctx, dir, recursive)
+}
+
+// Stat describes key, the error is ErrNotExist if it's neither a value nor a
+// directory.
+func (cds *CloudDsStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	return cds.kvStat(ctx, key)
+}
+
+// cleanKVKey normalises a key to a slash separated path without leading or
+// trailing slashes.
+func cleanKVKey(key string) string {
+	return strings.Trim(path.Clean("/"+key), "/")
+}
+
+func (cds *CloudDsStorage) kvKey(key string) *datastore.Key {
+	return cds.dsKey(KV_RECORD, cds.kvName(cleanKVKey(key)))
+}
+
+// kvName returns the key name of a cleaned key, each segment encrypted with
+// EnvNameNameKey or hashed with EnvNameHashKey so listing a directory is still
+// a key range.
+func (cds *CloudDsStorage) kvName(key string) string {
+	if (cds.hashKey == nil && cds.nameKey == nil) || key == "" {
+		return key
+	}
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = cds.nameSegment(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// kvKeyOf returns the cleaned key a record was stored under.
+func (cds *CloudDsStorage) kvKeyOf(ctx context.Context, k *datastore.Key) (string, error) {
+	rel := strings.TrimPrefix(k.Name, cds.kvKey("").Name+"/")
+	if cds.nameKey != nil {
+		segments := strings.Split(rel, "/")
+		for i, s := range segments {
+			var ok bool
+			if segments[i], ok = cds.openName(s); !ok {
+				return "", fmt.Errorf("Unable to decode key name of %v: %w", k.Name, ErrDecryption)
+			}
+		}
+		return strings.Join(segments, "/"), nil
+	}
+	name, err := cds.storedName(ctx, cds.cloudDsClient, k)
+	if err != nil || name != "" {
+		return name, err
+	}
+	return rel, nil
+}
+
+// isAccountKVKey reports whether key is under a CertMagic user directory,
+// `acme/<issuer>/users/`, which holds ACME account private keys.
+func isAccountKVKey(key string) bool {
+	segments := strings.SplitN(cleanKVKey(key), "/", 4)
+	return len(segments) == 4 && segments[0] == "acme" && segments[2] == "users"
+}
+
+// kvAESKey returns the AES key the value of key is encrypted with.
+func (cds *CloudDsStorage) kvAESKey(key string) []byte {
+	if isAccountKVKey(key) {
+		return cds.accountKey()
+	}
+	return cds.aesKey
+}
+
+func (cds *CloudDsStorage) kvStore(ctx context.Context, key string, value []byte) error {
+	r := &cdsKVRecord{Size: int64(len(value))}
+	var err error
+	switch {
+	case cds.fieldEnc && isCertKey(key):
+		// nothing secret, kept in plaintext so it can be queried
+		r.siteFields = certFields(value)
+	case len(value) > chunkThreshold && len(cds.kvAESKey(key)) > 0:
+		r.Chunked = true
+		r.Value, err = cds.chunkedToBytes(cds.kvAESKey(key), value)
+	default:
+		r.Value, err = cds.rawToBytesWith(cds.kvAESKey(key), value)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to encode %v: %w", key, err)
+	}
+	return cds.kvPut(ctx, key, r)
+}
+
+// kvPut signs and stores r, the encoded value of key.
+func (cds *CloudDsStorage) kvPut(ctx context.Context, key string, r *cdsKVRecord) error {
+	cds.stamp(&r.cdsEncryptedRecord)
+	cds.sign(&r.cdsEncryptedRecord, KV_RECORD, cleanKVKey(key), r.Cert)
+	if err := cds.stampName(&r.cdsEncryptedRecord, cleanKVKey(key)); err != nil {
+		return fmt.Errorf("Unable to encode %v: %w", key, err)
+	}
+
+	if _, err := cds.cloudDsClient.Put(ctx, cds.kvKey(key), r); err != nil {
+		return fmt.Errorf("Unable to store %v: %w", key, err)
+	}
+	return nil
+}
+
+func (cds *CloudDsStorage) kvLoad(ctx context.Context, key string) ([]byte, error) {
+	r, err := cds.kvGet(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return cds.kvDecode(ctx, key, r)
+}
+
+// kvGet returns the record of key, once its signature is verified.
+func (cds *CloudDsStorage) kvGet(ctx context.Context, key string) (*cdsKVRecord, error) {
+	r := new(cdsKVRecord)
+	if err := cds.cloudDsClient.Get(ctx, cds.kvKey(key), r); err != nil {
+		return nil, fmt.Errorf("Unable to obtain %v: %w", key, notExist(err))
+	}
+	if err := cds.verify(&r.cdsEncryptedRecord, KV_RECORD, cleanKVKey(key), r.Cert); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// kvDecode returns the value of key from its record r.
+func (cds *CloudDsStorage) kvDecode(ctx context.Context, key string, r *cdsKVRecord) ([]byte, error) {
+	value, err := cds.kvValue(key, r)
+	if err != nil {
+		return nil, cds.decryptFailed(key, err)
+	}
+	if isPrivateKeyKey(key) {
+		cds.recordKeyAccess(ctx, certMagicDomain(strings.Split(cleanKVKey(key), "/")[2]))
+	}
+	return value, nil
+}
+
+// kvValue is kvDecode without notifying decryption failures or recording
+// the access of private keys.
+func (cds *CloudDsStorage) kvValue(key string, r *cdsKVRecord) ([]byte, error) {
+	if r.Cert != nil {
+		return r.Cert, nil
+	}
+	decode := cds.rawFromBytes
+	if isAccountKVKey(key) {
+		decode = cds.rawAccountFromBytes
+	}
+	if r.Chunked {
+		decode = func(b []byte) ([]byte, error) {
+			return io.ReadAll(newChunkReader(cds.kvAESKey(key), bytes.NewReader(b)))
+		}
+	}
+	value, err := decode(r.Value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode %v: %w", key, err)
+	}
+	return value, nil
+}
+
+// kvDelete deletes key and everything stored under it.
+func (cds *CloudDsStorage) kvDelete(ctx context.Context, key string) error {
+	keys, err := cds.kvKeysUnder(ctx, key)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, cds.kvKey(key))
+	if err := deleteMulti(ctx, cds.cloudDsClient, keys); err != nil {
+		return fmt.Errorf("Unable to delete %v: %w", key, err)
+	}
+	return nil
+}
+
+// kvKeysUnder returns the keys of everything stored under dir.
+func (cds *CloudDsStorage) kvKeysUnder(ctx context.Context, dir string) ([]*datastore.Key, error) {
+	return cds.namesUnder(ctx, cds.cloudDsClient, KV_RECORD, cds.kvName(cleanKVKey(dir)))
+}
+
+// kvList returns the keys under dir, all of them if recursive, otherwise only
+// its immediate children (which may themselves be directories).
+func (cds *CloudDsStorage) kvList(ctx context.Context, dir string, recursive bool) ([]string, error) {
+	keys, err := cds.kvKeysUnder(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	dir = cleanKVKey(dir)
+	var list []string
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		key, err := cds.kvKeyOf(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		rel := key
+		if dir != "" {
+			rel = strings.TrimPrefix(key, dir+"/")
+		}
+		if !recursive {
+			rel = strings.SplitN(rel, "/", 2)[0]
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			list = append(list, path.Join(dir, rel))
+		}
+	}
+	return list, nil
+}
+
+func (cds *CloudDsStorage) kvStat(ctx context.Context, key string) (KeyInfo, error) {
+	props, err := cds.cloudDsClient.GetProjection(ctx, cds.kvKey(key), "Modified", "Size")
+	if err == nil {
+		return KeyInfo{
+			Key:        cleanKVKey(key),
+			Modified:   propTime(props, "Modified"),
+			Size:       propInt(props, "Size"),
+			IsTerminal: true,
+		}, nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return KeyInfo{}, fmt.Errorf("Unable to obtain %v: %w", key, err)
+	}
+
+	// not a value, but it may be a directory
+	children, err := cds.kvKeysUnder(ctx, key)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	if len(children) == 0 {
+		return KeyInfo{}, fmt.Errorf("Unable to obtain %v: %w", key, ErrNotExist)
+	}
+	return KeyInfo{Key: cleanKVKey(key), IsTerminal: false}, nil
+}
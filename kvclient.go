@@ -0,0 +1,434 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/kv"
+)
+
+// kvTransactionAttempts is how many times kvClient runs a transaction that
+// conflicts, like the Cloud Datastore client.
+const kvTransactionAttempts = 3
+
+// kvClient is a dsClient on a kv.Backend, so records are encrypted, laid out
+// and locked the same way on every backend. Queries other than listing keys
+// (eg SiteAudit) fail with ErrQueryUnsupported, and checkKVConfig refuses
+// project routes and CMEK checks, which are of Cloud Datastore databases.
+type kvClient struct {
+	backend kv.Backend
+}
+
+func newKVClient(backend kv.Backend) *kvClient {
+	return &kvClient{backend: backend}
+}
+
+// checkKVConfig returns an error if cfg uses a project that isn't allowed,
+// or asks for what backend, a key/value backend, can't honor: project routes
+// and CMEK checks are of Cloud Datastore databases.
+func checkKVConfig(cfg *Config, backend string) error {
+	if err := checkAllowedProjects(cfg); err != nil {
+		return err
+	}
+	if len(cfg.ProjectRoutes) > 0 {
+		return fmt.Errorf("Unable to route projects on %s, %s only applies to Cloud Datastore", backend, EnvNameProjectRoutes)
+	}
+	if cfg.KMSKeyName != "" {
+		return fmt.Errorf("Unable to check CMEK of %s, %s only applies to Cloud Datastore", backend, EnvNameKMSKey)
+	}
+	return nil
+}
+
+// kvKeyOf returns the key of the entity at k in the backend,
+// <namespace>/<kind>/<name>, which sorts like k's name within its kind.
+// Entities with numeric IDs, eg audit records, are named @<id>.
+func kvKeyOf(k *datastore.Key) string {
+	name := k.Name
+	if name == "" {
+		name = "@" + strconv.FormatInt(k.ID, 10)
+	}
+	return k.Namespace + "/" + k.Kind + "/" + name
+}
+
+// dsKeyOf reverses kvKeyOf.
+func dsKeyOf(key string) (*datastore.Key, error) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid key %q", key)
+	}
+	var k *datastore.Key
+	if id, err := strconv.ParseInt(strings.TrimPrefix(parts[2], "@"), 10, 64); err == nil && strings.HasPrefix(parts[2], "@") {
+		k = datastore.IDKey(parts[1], id, nil)
+	} else {
+		k = datastore.NameKey(parts[1], parts[2], nil)
+	}
+	k.Namespace = parts[0]
+	return k, nil
+}
+
+// completeKey returns key with a random ID if it's incomplete.
+func completeKey(key *datastore.Key) *datastore.Key {
+	if !key.Incomplete() {
+		return key
+	}
+	k := datastore.IDKey(key.Kind, mathrand.Int63()+1, key.Parent)
+	k.Namespace = key.Namespace
+	return k
+}
+
+// saveProps returns the properties Cloud Datastore would store of src.
+func saveProps(src interface{}) ([]datastore.Property, error) {
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(src)
+}
+
+// loadProps loads props into dst, like Cloud Datastore.
+func loadProps(dst interface{}, props []datastore.Property) error {
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(append([]datastore.Property(nil), props...))
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+// Types of kvValue.
+const (
+	kvNull = iota
+	kvInt
+	kvBool
+	kvString
+	kvFloat
+	kvTime
+	kvBytes
+	kvArray
+)
+
+// kvProperty is a datastore.Property as a kv.Backend stores it.
+type kvProperty struct {
+	Name    string
+	NoIndex bool
+	Value   kvValue
+}
+
+type kvValue struct {
+	Type   uint8
+	Int    int64
+	Bool   bool
+	String string
+	Float  float64
+	Time   time.Time
+	Bytes  []byte
+	Array  []kvValue
+}
+
+// encodeEntity encodes the properties of src.
+func encodeEntity(src interface{}) ([]byte, error) {
+	props, err := saveProps(src)
+	if err != nil {
+		return nil, err
+	}
+	stored := make([]kvProperty, len(props))
+	for i, p := range props {
+		v, err := toKVValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode property %s: %w", p.Name, err)
+		}
+		stored[i] = kvProperty{Name: p.Name, NoIndex: p.NoIndex, Value: v}
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(stored); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodeEntity decodes value, from encodeEntity, into dst.
+func decodeEntity(value []byte, dst interface{}) error {
+	var stored []kvProperty
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&stored); err != nil {
+		return fmt.Errorf("Unable to decode entity: %w", err)
+	}
+	props := make([]datastore.Property, len(stored))
+	for i, p := range stored {
+		props[i] = datastore.Property{Name: p.Name, NoIndex: p.NoIndex, Value: p.Value.value()}
+	}
+	return loadProps(dst, props)
+}
+
+func toKVValue(v interface{}) (kvValue, error) {
+	switch v := v.(type) {
+	case nil:
+		return kvValue{Type: kvNull}, nil
+	case int64:
+		return kvValue{Type: kvInt, Int: v}, nil
+	case bool:
+		return kvValue{Type: kvBool, Bool: v}, nil
+	case string:
+		return kvValue{Type: kvString, String: v}, nil
+	case float64:
+		return kvValue{Type: kvFloat, Float: v}, nil
+	case time.Time:
+		return kvValue{Type: kvTime, Time: v}, nil
+	case []byte:
+		return kvValue{Type: kvBytes, Bytes: v}, nil
+	case []interface{}:
+		array := make([]kvValue, len(v))
+		for i, e := range v {
+			var err error
+			if array[i], err = toKVValue(e); err != nil {
+				return kvValue{}, err
+			}
+		}
+		return kvValue{Type: kvArray, Array: array}, nil
+	}
+	return kvValue{}, fmt.Errorf("unsupported type %T", v)
+}
+
+func (v kvValue) value() interface{} {
+	switch v.Type {
+	case kvInt:
+		return v.Int
+	case kvBool:
+		return v.Bool
+	case kvString:
+		return v.String
+	case kvFloat:
+		return v.Float
+	case kvTime:
+		return v.Time
+	case kvBytes:
+		if v.Bytes == nil {
+			return []byte{}
+		}
+		return v.Bytes
+	case kvArray:
+		array := make([]interface{}, len(v.Array))
+		for i, e := range v.Array {
+			array[i] = e.value()
+		}
+		return array
+	}
+	return nil
+}
+
+func (c *kvClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	value, _, err := c.backend.Get(ctx, kvKeyOf(key))
+	if err != nil {
+		return err
+	}
+	return decodeEntity(value, dst)
+}
+
+func (c *kvClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	key = completeKey(key)
+	value, err := encodeEntity(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.backend.Set(ctx, kvKeyOf(key), value, kv.AnyVersion); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (c *kvClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, errors.New("datastore: keys and src slices have different length")
+	}
+	var ret []*datastore.Key
+	for i, k := range keys {
+		k, err := c.Put(ctx, k, v.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+func (c *kvClient) Delete(ctx context.Context, key *datastore.Key) error {
+	return c.backend.Delete(ctx, kvKeyOf(key), kv.AnyVersion)
+}
+
+func (c *kvClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	for _, k := range keys {
+		if err := c.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run returns no results, queries aren't supported.
+func (c *kvClient) Run(ctx context.Context, q *datastore.Query) dsIterator {
+	return errIterator{ErrQueryUnsupported}
+}
+
+func (c *kvClient) KeysInRange(ctx context.Context, kind, namespace, start, end string) ([]*datastore.Key, error) {
+	prefix := namespace + "/" + kind + "/"
+	names, err := c.backend.Keys(ctx, prefix+start, prefix+end)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, 0, len(names))
+	for _, name := range names {
+		k, err := dsKeyOf(name)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// GetProjection returns the properties of key named in props, like
+// memClient's, the whole entity is read.
+func (c *kvClient) GetProjection(ctx context.Context, key *datastore.Key, props ...string) (datastore.PropertyList, error) {
+	var all datastore.PropertyList
+	if err := c.Get(ctx, key, &all); err != nil {
+		return nil, err
+	}
+	return projectProps(all, props)
+}
+
+// projectProps returns the properties of all named in props, nil if there
+// are none, datastore.ErrNoSuchEntity if all doesn't have every one of them
+// like a projection query.
+func projectProps(all datastore.PropertyList, props []string) (datastore.PropertyList, error) {
+	if len(props) == 0 {
+		return nil, nil
+	}
+	var list datastore.PropertyList
+	for _, p := range all {
+		for _, name := range props {
+			if p.Name == name {
+				list = append(list, p)
+			}
+		}
+	}
+	if len(list) < len(props) {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return list, nil
+}
+
+// RunInTransaction runs f optimistically: its writes are applied only if
+// the keys they write are still at the versions f read, otherwise it's run
+// again, up to kvTransactionAttempts times before failing with
+// datastore.ErrConcurrentTransaction. Unless the backend is a kv.Batcher,
+// like Spanner, writes of different keys are applied one by one in the order
+// they were made, so a transaction writing several keys is partly applied if
+// a later write conflicts or fails. On Bigtable and Cloud Storage that
+// loses the atomicity of:
+//   - StoreUserContext, the user can be stored without becoming the most
+//     recent user
+//   - putSiteEntityUnlessLocked, the site can be stored with the lock record
+//     of a new site left behind, until it expires
+//   - countIssued and takeIssuance, retried after the domain's record
+//     conflicts they count or take from the account's record again, so
+//     issuance is over-counted rather than under
+//
+// Transactions writing a single key are atomic everywhere.
+func (c *kvClient) RunInTransaction(ctx context.Context, f func(tx dsTransaction) error) error {
+	for i := 0; i < kvTransactionAttempts; i++ {
+		tx := &kvTransaction{ctx: ctx, c: c, versions: make(map[string]int64), writes: make(map[string][]byte)}
+		if err := f(tx); err != nil {
+			return err
+		}
+		err := tx.commit()
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return datastore.ErrConcurrentTransaction
+}
+
+func (c *kvClient) Close() error {
+	return c.backend.Close()
+}
+
+// kvTransaction is a transaction of kvClient. Like Cloud Datastore it
+// doesn't see its own writes.
+type kvTransaction struct {
+	ctx      context.Context
+	c        *kvClient
+	versions map[string]int64  // of the keys read
+	writes   map[string][]byte // nil values are deletes
+	order    []string          // keys written, in order
+}
+
+func (tx *kvTransaction) Get(key *datastore.Key, dst interface{}) error {
+	k := kvKeyOf(key)
+	value, version, err := tx.c.backend.Get(tx.ctx, k)
+	if err == datastore.ErrNoSuchEntity {
+		tx.versions[k] = 0
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	tx.versions[k] = version
+	return decodeEntity(value, dst)
+}
+
+func (tx *kvTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	value, err := encodeEntity(src)
+	if err != nil {
+		return nil, err
+	}
+	tx.write(kvKeyOf(completeKey(key)), value)
+	return nil, nil
+}
+
+func (tx *kvTransaction) Delete(key *datastore.Key) error {
+	tx.write(kvKeyOf(key), nil)
+	return nil
+}
+
+func (tx *kvTransaction) write(k string, value []byte) {
+	if _, ok := tx.writes[k]; !ok {
+		tx.order = append(tx.order, k)
+	}
+	tx.writes[k] = value
+}
+
+// commit applies the writes, conditional on the versions read.
+func (tx *kvTransaction) commit() error {
+	writes := make([]kv.Write, 0, len(tx.order))
+	for _, k := range tx.order {
+		version, ok := tx.versions[k]
+		if !ok {
+			version = kv.AnyVersion
+		}
+		writes = append(writes, kv.Write{Key: k, Value: tx.writes[k], Version: version})
+	}
+	if b, ok := tx.c.backend.(kv.Batcher); ok {
+		if len(writes) == 0 {
+			return nil
+		}
+		return b.Commit(tx.ctx, writes)
+	}
+	for _, w := range writes {
+		var err error
+		if w.Value == nil {
+			err = tx.c.backend.Delete(tx.ctx, w.Key, w.Version)
+		} else {
+			err = tx.c.backend.Set(tx.ctx, w.Key, w.Value, w.Version)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
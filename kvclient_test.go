@@ -0,0 +1,222 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/caddyserver/caddy/caddytls"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/kv"
+)
+
+// mapBackend is a kv.Backend in a map, versions counting writes.
+type mapBackend struct {
+	mu       sync.Mutex
+	values   map[string][]byte
+	versions map[string]int64
+	next     int64
+}
+
+func newMapBackend() *mapBackend {
+	return &mapBackend{values: make(map[string][]byte), versions: make(map[string]int64)}
+}
+
+func (b *mapBackend) Get(ctx context.Context, key string) ([]byte, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	value, ok := b.values[key]
+	if !ok {
+		return nil, 0, datastore.ErrNoSuchEntity
+	}
+	return value, b.versions[key], nil
+}
+
+func (b *mapBackend) Set(ctx context.Context, key string, value []byte, version int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if version != kv.AnyVersion && b.versions[key] != version {
+		return ErrConflict
+	}
+	b.next++
+	b.values[key], b.versions[key] = value, b.next
+	return nil
+}
+
+func (b *mapBackend) Delete(ctx context.Context, key string, version int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if version != kv.AnyVersion && b.versions[key] != version {
+		return ErrConflict
+	}
+	delete(b.values, key)
+	delete(b.versions, key)
+	return nil
+}
+
+func (b *mapBackend) Keys(ctx context.Context, start, end string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for k := range b.values {
+		if k >= start && k < end {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *mapBackend) Close() error {
+	return nil
+}
+
+func TestKVClient(t *testing.T) {
+	cds := newTestStorage(t, &Config{InstanceID: "a"}, newKVClient(newMapBackend()))
+	ctx := context.Background()
+
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte("meta")}
+	if _, err := cds.TryLockContext(ctx, "example.com"); err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	if err := cds.StoreSiteContext(ctx, "example.com", site); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	loaded, err := cds.LoadSiteContext(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Error loading site: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, site) {
+		t.Errorf("Expected %+v, got %+v", site, loaded)
+	}
+	if err := cds.kvStore(ctx, "certificates/acme/a.com/a.com.crt", []byte("a")); err != nil {
+		t.Fatalf("Error storing key: %v", err)
+	}
+	keys, err := cds.kvList(ctx, "certificates", true)
+	if err != nil || len(keys) != 1 || keys[0] != "certificates/acme/a.com/a.com.crt" {
+		t.Errorf("Expected the key listed, got %v, %v", keys, err)
+	}
+	if _, err := cds.SiteAudit(ctx, "example.com"); !errors.Is(err, ErrQueryUnsupported) {
+		t.Errorf("Expected ErrQueryUnsupported, got %v", err)
+	}
+	if err := cds.Healthy(ctx); err != nil {
+		t.Errorf("Expected healthy without queries, got %v", err)
+	}
+
+	// a transaction loses to a write of a key it read
+	client := newKVClient(newMapBackend())
+	k := datastore.NameKey(RENEWAL_RECORD, "renewal", nil)
+	attempts := 0
+	err = client.RunInTransaction(ctx, func(tx dsTransaction) error {
+		attempts++
+		r := new(cdsRenewalRecord)
+		if err := tx.Get(k, r); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if attempts == 1 {
+			if _, err := client.Put(ctx, k, &cdsRenewalRecord{Failures: 10}); err != nil {
+				return err
+			}
+		}
+		r.Failures++
+		_, err := tx.Put(k, r)
+		return err
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("Expected the transaction retried once, got %d attempts, %v", attempts, err)
+	}
+	r := new(cdsRenewalRecord)
+	if err := client.Get(ctx, k, r); err != nil || r.Failures != 11 {
+		t.Errorf("Expected the retry to see the write, got %+v, %v", r, err)
+	}
+
+	id, err := client.Put(ctx, datastore.IncompleteKey(AUDIT_RECORD, nil), &cdsRenewalRecord{Failures: 1})
+	if err != nil || id.Incomplete() {
+		t.Fatalf("Expected an ID allocated, got %v, %v", id, err)
+	}
+	if err := client.Get(ctx, id, r); err != nil || r.Failures != 1 {
+		t.Errorf("Expected the entity with an ID loaded, got %+v, %v", r, err)
+	}
+}
+
+func TestCheckKVConfig(t *testing.T) {
+	if err := checkKVConfig(&Config{ProjectID: "prod"}, "Cloud Bigtable"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	for _, cfg := range []*Config{
+		{ProjectID: "prod", AllowedProjects: []string{"staging"}},
+		{ProjectID: "prod", ProjectRoutes: []ProjectRoute{{Pattern: "*.example.org", Project: "other"}}},
+		{ProjectID: "prod", KMSKeyName: "projects/kms/locations/eu/keyRings/r/cryptoKeys/tls"},
+	} {
+		if err := checkKVConfig(cfg, "Cloud Bigtable"); err == nil {
+			t.Errorf("Expected error for %+v", cfg)
+		}
+	}
+}
+
+// batchMapBackend is a mapBackend committing transactions atomically.
+type batchMapBackend struct {
+	*mapBackend
+	commits int
+}
+
+func (b *batchMapBackend) Commit(ctx context.Context, writes []kv.Write) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commits++
+	for _, w := range writes {
+		if w.Version != kv.AnyVersion && b.versions[w.Key] != w.Version {
+			return ErrConflict
+		}
+	}
+	for _, w := range writes {
+		if w.Value == nil {
+			delete(b.values, w.Key)
+			delete(b.versions, w.Key)
+			continue
+		}
+		b.next++
+		b.values[w.Key], b.versions[w.Key] = w.Value, b.next
+	}
+	return nil
+}
+
+func TestKVClientBatch(t *testing.T) {
+	backend := &batchMapBackend{mapBackend: newMapBackend()}
+	client := newKVClient(backend)
+	ctx := context.Background()
+	a, b := datastore.NameKey(CONTROL_RECORD, "a", nil), datastore.NameKey(CONTROL_RECORD, "b", nil)
+
+	err := client.RunInTransaction(ctx, func(tx dsTransaction) error {
+		for _, k := range []*datastore.Key{a, b} {
+			if err := tx.Get(k, &cdsPauseRecord{}); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if _, err := tx.Put(k, &cdsPauseRecord{Reason: k.Name}); err != nil {
+				return err
+			}
+		}
+		if backend.commits == 0 {
+			// b is written meanwhile, the first attempt conflicts
+			if _, err := client.Put(ctx, b, &cdsPauseRecord{Reason: "other"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error running transaction: %v", err)
+	}
+	if backend.commits != 2 {
+		t.Errorf("Expected the transaction committed in 2 attempts, got %d", backend.commits)
+	}
+	for _, k := range []*datastore.Key{a, b} {
+		r := new(cdsPauseRecord)
+		if err := client.Get(ctx, k, r); err != nil || r.Reason != k.Name {
+			t.Errorf("Expected %v written by the transaction, got %q, %v", k.Name, r.Reason, err)
+		}
+	}
+}
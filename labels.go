@@ -0,0 +1,49 @@
+package tlsclouddatastore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseLabels parses a comma separated list of `key=value` labels.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		k := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || k == "" {
+			return nil, fmt.Errorf("Invalid label %q, expected key=value", l)
+		}
+		if _, ok := labels[k]; ok {
+			return nil, fmt.Errorf("Duplicate label %q", k)
+		}
+		labels[k] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// labelStrings returns labels sorted in the `key=value` form they're stored in.
+func labelStrings(labels map[string]string) []string {
+	var l []string
+	for k, v := range labels {
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Labels returns the `key=value` labels attached to every stored entity.
+func (cds *CloudDsStorage) Labels() []string {
+	return append([]string(nil), cds.labels...)
+}
+
+// stamp sets the properties every written record carries.
+func (cds *CloudDsStorage) stamp(r *cdsEncryptedRecord) {
+	r.Modified = cds.clock.Now()
+	r.Labels = cds.labels
+}
@@ -0,0 +1,130 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// cdsLockRecord is a lock held by a single instance until Expires.
+type cdsLockRecord struct {
+	Owner    string
+	Expires  time.Time
+	Modified time.Time
+	Labels   []string
+}
+
+// Leadership is held by a single instance of a cluster until its TTL passes
+// without renewal or it's released.
+type Leadership struct {
+	cds     *CloudDsStorage
+	name    string
+	owner   string
+	key     *datastore.Key
+	ttl     time.Duration
+	expires time.Time
+}
+
+func (cds *CloudDsStorage) leaderKey(name string) *datastore.Key {
+	return cds.dsKey(LOCK_RECORD, path.Join("leaders", name))
+}
+
+// AcquireLeadership attempts to make this instance the leader for name, eg
+// a maintenance job that only one instance of a cluster should run. If
+// another instance holds an unexpired leadership ErrConflict is returned.
+// Acquiring a leadership this instance already holds extends it.
+func (cds *CloudDsStorage) AcquireLeadership(ctx context.Context, name string, ttl time.Duration) (*Leadership, error) {
+	return cds.acquireLock(ctx, cds.leaderKey(name), name, cds.instanceID, ttl)
+}
+
+// acquireLock takes the lock record at key for owner, unless another owner
+// holds it.
+func (cds *CloudDsStorage) acquireLock(ctx context.Context, key *datastore.Key, name, owner string, ttl time.Duration) (*Leadership, error) {
+	l := &Leadership{cds: cds, name: name, owner: owner, key: key, ttl: ttl}
+	if err := l.extend(ctx, true); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// extend sets the lock record's expiry to ttl from now if it's free (when
+// acquire is set) or held by this instance.
+func (l *Leadership) extend(ctx context.Context, acquire bool) error {
+	expires := l.cds.clock.Now().Add(l.ttl)
+	var expired string // owner of the expired lock taken over
+	err := l.cds.cloudDsClient.RunInTransaction(ctx, func(tx dsTransaction) error {
+		r := new(cdsLockRecord)
+		err := tx.Get(l.key, r)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		held := err == nil && r.Owner != "" && l.cds.lockLive(r.Expires)
+		if held && r.Owner != l.owner {
+			return fmt.Errorf("held by %s: %w", r.Owner, ErrConflict)
+		}
+		if !held && !acquire {
+			return fmt.Errorf("expired: %w", ErrConflict)
+		}
+		// released locks are deleted, an expired one's holder didn't finish
+		expired = ""
+		if !held && r.Owner != "" && r.Owner != l.owner {
+			expired = r.Owner
+		}
+
+		r.Owner = l.owner
+		r.Expires = lockTime(expires)
+		r.Modified = l.cds.clock.Now()
+		r.Labels = l.cds.labels
+		_, err = tx.Put(l.key, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to obtain lock %s: %w", l.name, err)
+	}
+	if expired != "" {
+		l.cds.lockTakenOver(l.name, expired)
+	}
+	l.expires = expires
+	return nil
+}
+
+// Name returns the name the leadership was acquired for.
+func (l *Leadership) Name() string {
+	return l.name
+}
+
+// Expires returns when the leadership lapses unless renewed.
+func (l *Leadership) Expires() time.Time {
+	return l.expires
+}
+
+// Renew extends the leadership by its TTL. If it has already expired, or been
+// taken over by another instance, ErrConflict is returned.
+func (l *Leadership) Renew(ctx context.Context) error {
+	return l.extend(ctx, false)
+}
+
+// Release gives up the leadership so another instance can acquire it straight
+// away. Releasing a leadership that's been taken over is a no-op.
+func (l *Leadership) Release(ctx context.Context) error {
+	err := l.cds.cloudDsClient.RunInTransaction(ctx, func(tx dsTransaction) error {
+		r := new(cdsLockRecord)
+		if err := tx.Get(l.key, r); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if r.Owner != l.owner {
+			return nil
+		}
+		return tx.Delete(l.key)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to release lock %s: %w", l.name, err)
+	}
+	return nil
+}
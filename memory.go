@@ -0,0 +1,219 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// NewMemoryStorage returns a storage for caURL that keeps records in memory
+// instead of Cloud Datastore, with the same encryption and semantics, for
+// tests of programs using the storage and as a reference to check the real
+// backend against. cfg may be nil, its project settings and routes are
+// ignored, and records are encrypted with a random key unless it sets one.
+// Queries other than listing keys (eg SiteAudit) fail with
+// ErrQueryUnsupported.
+func NewMemoryStorage(caURL *url.URL, cfg *Config) (*CloudDsStorage, error) {
+	c := Config{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.AESKeyB64 == "" && !c.AllowPlaintext {
+		// records don't outlive the storage, so any key will do
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, fmt.Errorf("Unable to generate AES key: %v", err)
+		}
+		c.AESKeyB64 = base64.StdEncoding.EncodeToString(key)
+	}
+	return newCloudDsStorage(caURL, &c, newMemClient())
+}
+
+// NewMemoryCertMagicStorage is NewCertMagicStorage keeping records in memory,
+// see NewMemoryStorage.
+func NewMemoryCertMagicStorage(cfg *Config) (*CertMagicStorage, error) {
+	cds, err := NewMemoryStorage(&url.URL{}, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &CertMagicStorage{cds: cds, locks: make(map[string]*certMagicLock)}, nil
+}
+
+type memKey struct {
+	namespace string
+	kind      string
+	name      string
+	id        int64
+}
+
+func memKeyOf(k *datastore.Key) memKey {
+	return memKey{namespace: k.Namespace, kind: k.Kind, name: k.Name, id: k.ID}
+}
+
+// memClient is an in-memory dsClient. Entities are stored as the properties
+// Cloud Datastore would store, so they load the same way.
+type memClient struct {
+	mu       sync.Mutex
+	entities map[memKey][]datastore.Property
+	nextID   int64
+}
+
+func newMemClient() *memClient {
+	return &memClient{entities: make(map[memKey][]datastore.Property)}
+}
+
+func (c *memClient) get(key *datastore.Key, dst interface{}) error {
+	props, ok := c.entities[memKeyOf(key)]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return loadProps(dst, props)
+}
+
+// save returns the properties of src and the complete key it's stored under.
+func (c *memClient) save(key *datastore.Key, src interface{}) (*datastore.Key, []datastore.Property, error) {
+	props, err := saveProps(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.Incomplete() {
+		c.nextID++
+		id := datastore.IDKey(key.Kind, c.nextID, key.Parent)
+		id.Namespace = key.Namespace
+		key = id
+	}
+	return key, props, nil
+}
+
+func (c *memClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key, dst)
+}
+
+func (c *memClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, props, err := c.save(key, src)
+	if err != nil {
+		return nil, err
+	}
+	c.entities[memKeyOf(key)] = props
+	return key, nil
+}
+
+func (c *memClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, errors.New("datastore: keys and src slices have different length")
+	}
+	var ret []*datastore.Key
+	for i, k := range keys {
+		k, err := c.Put(ctx, k, v.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+func (c *memClient) Delete(ctx context.Context, key *datastore.Key) error {
+	return c.DeleteMulti(ctx, []*datastore.Key{key})
+}
+
+func (c *memClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		delete(c.entities, memKeyOf(k))
+	}
+	return nil
+}
+
+// Run fails with ErrQueryUnsupported, queries aren't supported.
+func (c *memClient) Run(ctx context.Context, q *datastore.Query) dsIterator {
+	return errIterator{ErrQueryUnsupported}
+}
+
+func (c *memClient) KeysInRange(ctx context.Context, kind, namespace, start, end string) ([]*datastore.Key, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []*datastore.Key
+	for mk := range c.entities {
+		if mk.kind == kind && mk.namespace == namespace && mk.name >= start && mk.name < end {
+			k := datastore.NameKey(kind, mk.name, nil)
+			k.Namespace = namespace
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+// GetProjection returns the properties of key named in props, all of them if
+// there are none.
+func (c *memClient) GetProjection(ctx context.Context, key *datastore.Key, props ...string) (datastore.PropertyList, error) {
+	var all datastore.PropertyList
+	if err := c.Get(ctx, key, &all); err != nil {
+		return nil, err
+	}
+	return projectProps(all, props)
+}
+
+// RunInTransaction runs f holding the client's lock, so transactions are
+// serialized rather than retried. Writes are applied if f succeeds.
+func (c *memClient) RunInTransaction(ctx context.Context, f func(tx dsTransaction) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx := &memTransaction{c: c, writes: make(map[memKey][]datastore.Property)}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for k, props := range tx.writes {
+		if props == nil {
+			delete(c.entities, k)
+		} else {
+			c.entities[k] = props
+		}
+	}
+	return nil
+}
+
+func (c *memClient) Close() error {
+	return nil
+}
+
+// memTransaction reads committed entities, like Cloud Datastore it doesn't
+// see its own writes.
+type memTransaction struct {
+	c      *memClient
+	writes map[memKey][]datastore.Property // nil properties are deletes
+}
+
+func (tx *memTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return tx.c.get(key, dst)
+}
+
+func (tx *memTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	key, props, err := tx.c.save(key, src)
+	if err != nil {
+		return nil, err
+	}
+	tx.writes[memKeyOf(key)] = props
+	return nil, nil
+}
+
+func (tx *memTransaction) Delete(key *datastore.Key) error {
+	tx.writes[memKeyOf(key)] = nil
+	return nil
+}
@@ -0,0 +1,50 @@
+package tlsclouddatastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// metadataAttribute returns the custom metadata attribute name of the
+// instance, or of its project if the instance doesn't set it. Replaced in
+// tests.
+var metadataAttribute = func(name string) (string, bool, error) {
+	for _, get := range []func(string) (string, error){metadata.InstanceAttributeValue, metadata.ProjectAttributeValue} {
+		v, err := get(name)
+		var notDefined metadata.NotDefinedError
+		if errors.As(err, &notDefined) {
+			continue
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("Unable to read metadata attribute %s: %w", name, err)
+		}
+		return v, true, nil
+	}
+	return "", false, nil
+}
+
+// metadataProjectID returns the project of the instance. Replaced in tests.
+var metadataProjectID = metadata.ProjectID
+
+// attributeName returns the metadata attribute an env var is read from, eg
+// `caddy-clouddatastoretls-prefix` for CADDY_CLOUDDATASTORETLS_PREFIX.
+func attributeName(envName string) string {
+	return strings.ToLower(strings.ReplaceAll(envName, "_", "-"))
+}
+
+// secretEnvNames are the vars never read from metadata, which anything
+// running on the instance can read: keys, and URLs that may carry
+// credentials.
+var secretEnvNames = map[string]bool{
+	EnvNameAESKey:         true,
+	EnvNameUserAESKey:     true,
+	EnvNameHashKey:        true,
+	EnvNameNameKey:        true,
+	EnvNameSigningKeys:    true,
+	EnvNameRedisURL:       true,
+	EnvNameRenewalWebhook: true,
+	EnvNameNotifyWebhook:  true,
+}
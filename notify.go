@@ -0,0 +1,196 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the events operators are notified of, besides
+// EventStorageDegraded.
+const (
+	EventDecryptionFailed = "decryption_failed"
+	EventLockTakeover     = "lock_takeover"
+	EventCertsExpiring    = "certs_expiring"
+	EventRenewalFailed    = "renewal_failed"
+	EventIntegrityFailed  = "integrity_failed"
+)
+
+// notifyEvents are the events notifiers may be sent, all of them unless
+// EnvNameNotifyEvents picks some.
+var notifyEvents = []string{EventStorageDegraded, EventDecryptionFailed, EventLockTakeover, EventCertsExpiring, EventRenewalFailed, EventIntegrityFailed}
+
+// notifyInterval is the least time between notifications of the same event,
+// so a failing project doesn't flood a channel. Repeats are still logged.
+const notifyInterval = time.Minute
+
+// notifyTimeout bounds a single notification.
+const notifyTimeout = 10 * time.Second
+
+// Notification is an event operators should hear about rather than only
+// find in the logs.
+type Notification struct {
+	Event    string                 `json:"event"`
+	Message  string                 `json:"message"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	Instance string                 `json:"instance"`
+	Time     time.Time              `json:"time"`
+}
+
+// Notifier delivers notifications, eg to a webhook or chat. Notify is called
+// in its own goroutine, an error is logged.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// WebhookNotifier posts notifications as JSON to URL.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// Notify posts n to the webhook.
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, w.Client, w.URL, n)
+}
+
+// SlackNotifier posts notifications to a Slack incoming webhook.
+type SlackNotifier struct {
+	WebhookURL string
+	Client     *http.Client // http.DefaultClient if nil
+}
+
+// Notify posts n to Slack as a message.
+func (s *SlackNotifier) Notify(ctx context.Context, n Notification) error {
+	text := fmt.Sprintf("*%s* on `%s`: %s", n.Event, n.Instance, n.Message)
+	return postJSON(ctx, s.Client, s.WebhookURL, map[string]string{"text": text})
+}
+
+// postJSON posts v as JSON to url, an error unless it's accepted.
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Unable to encode notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to create notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to send notification: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Notification rejected: %s", resp.Status)
+	}
+	return nil
+}
+
+// notifiers are the notifiers of a storage and the events they're sent.
+type notifiers struct {
+	list   []Notifier
+	events map[string]bool
+	mu     sync.Mutex
+	last   map[string]time.Time // when each event was last sent
+}
+
+// newNotifiers returns the notifiers cfg configures, nil if there are none.
+func newNotifiers(cfg *Config) (*notifiers, error) {
+	n := &notifiers{list: append([]Notifier(nil), cfg.Notifiers...), events: make(map[string]bool), last: make(map[string]time.Time)}
+	if cfg.NotifyWebhook != "" {
+		n.list = append(n.list, &WebhookNotifier{URL: cfg.NotifyWebhook})
+	}
+	if cfg.NotifySlack != "" {
+		n.list = append(n.list, &SlackNotifier{WebhookURL: cfg.NotifySlack})
+	}
+	if len(n.list) == 0 {
+		return nil, nil
+	}
+
+	events := cfg.NotifyEvents
+	if len(events) == 0 {
+		events = notifyEvents
+	}
+next:
+	for _, e := range events {
+		for _, known := range notifyEvents {
+			if e == known {
+				n.events[e] = true
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("Unknown event %q from %s, expected one of %s", e, EnvNameNotifyEvents, strings.Join(notifyEvents, ","))
+	}
+	return n, nil
+}
+
+// AddNotifier adds a notifier sent every event EnvNameNotifyEvents picks, it
+// must be added before the storage is used.
+func (cds *CloudDsStorage) AddNotifier(n Notifier) {
+	if cds.notifiers == nil {
+		cds.notifiers = &notifiers{events: make(map[string]bool), last: make(map[string]time.Time)}
+		for _, e := range notifyEvents {
+			cds.notifiers.events[e] = true
+		}
+	}
+	cds.notifiers.list = append(cds.notifiers.list, n)
+	if cds.renewing == nil {
+		cds.renewing = make(map[string]bool)
+	}
+}
+
+// notify sends event to the notifiers, unless it isn't picked or was sent
+// within notifyInterval.
+func (cds *CloudDsStorage) notify(event, message string, data map[string]interface{}) {
+	n := cds.notifiers
+	if n == nil || !n.events[event] {
+		return
+	}
+	now := cds.clock.Now()
+	n.mu.Lock()
+	if last, ok := n.last[event]; ok && now.Sub(last) < notifyInterval {
+		n.mu.Unlock()
+		return
+	}
+	n.last[event] = now
+	n.mu.Unlock()
+
+	note := Notification{Event: event, Message: message, Data: data, Instance: cds.instanceID, Time: now}
+	for _, notifier := range n.list {
+		go func(notifier Notifier) {
+			ctx, cancel := context.WithTimeout(cds.ctx, notifyTimeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, note); err != nil && cds.ctx.Err() == nil {
+				log.Printf("[ERROR] Unable to notify %s: %v", event, err)
+			}
+		}(notifier)
+	}
+}
+
+// decryptFailed notifies EventDecryptionFailed if err is ErrDecryption, and
+// returns err.
+func (cds *CloudDsStorage) decryptFailed(name string, err error) error {
+	if errors.Is(err, ErrDecryption) {
+		cds.notify(EventDecryptionFailed, fmt.Sprintf("Unable to decrypt %s, is the AES key right? %v", name, err), map[string]interface{}{"name": name})
+	}
+	return err
+}
+
+// lockTakenOver notifies EventLockTakeover of the expired lock name of owner
+// being taken over, its holder likely died mid-operation.
+func (cds *CloudDsStorage) lockTakenOver(name, owner string) {
+	log.Printf("[WARNING] Took over the expired lock %s of %s", name, owner)
+	cds.notify(EventLockTakeover, fmt.Sprintf("Took over the expired lock %s of %s", name, owner), map[string]interface{}{"name": name, "owner": owner})
+}
@@ -0,0 +1,63 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// cdsOCSPRecord is a stapled OCSP response. OCSP responses are public and
+// signed by the CA so, unlike other records, they aren't encrypted.
+type cdsOCSPRecord struct {
+	Staple     []byte `datastore:",noindex"`
+	NextUpdate time.Time
+	Modified   time.Time
+	Labels     []string
+}
+
+// ocspKey is per certificate rather than per domain, so a staple for a
+// certificate that's since been renewed is never returned for the new one.
+func (cds *CloudDsStorage) ocspKey(domain string, serial *big.Int) *datastore.Key {
+	return cds.dsKey(OCSP_RECORD, path.Join("ocsp", cds.nameSegment(escapeWildcard(domain))+"-"+serial.Text(16)))
+}
+
+// StoreOCSP stores the OCSP response for the certificate of domain with
+// serial, so every instance can staple it without querying the responder.
+func (cds *CloudDsStorage) StoreOCSP(ctx context.Context, domain string, serial *big.Int, staple []byte, nextUpdate time.Time) error {
+	r := &cdsOCSPRecord{
+		Staple:     staple,
+		NextUpdate: nextUpdate,
+		Modified:   cds.clock.Now(),
+		Labels:     cds.labels,
+	}
+	if _, err := cds.siteClient(domain).Put(ctx, cds.ocspKey(domain, serial), r); err != nil {
+		return fmt.Errorf("Unable to store OCSP response for %v: %w", domain, err)
+	}
+	return nil
+}
+
+// LoadOCSP returns the OCSP response stored for the certificate of domain
+// with serial and when it should be updated. ErrNotExist is returned if
+// there's no response or it's past its next update.
+func (cds *CloudDsStorage) LoadOCSP(ctx context.Context, domain string, serial *big.Int) ([]byte, time.Time, error) {
+	r := new(cdsOCSPRecord)
+	if err := cds.siteClient(domain).Get(ctx, cds.ocspKey(domain, serial), r); err != nil {
+		return nil, time.Time{}, fmt.Errorf("Unable to obtain OCSP response for %v: %w", domain, notExist(err))
+	}
+	if !r.NextUpdate.IsZero() && cds.clock.Now().After(r.NextUpdate) {
+		return nil, time.Time{}, fmt.Errorf("OCSP response for %v is stale: %w", domain, ErrNotExist)
+	}
+	return r.Staple, r.NextUpdate, nil
+}
+
+// DeleteOCSP deletes the OCSP response for the certificate of domain with serial.
+func (cds *CloudDsStorage) DeleteOCSP(ctx context.Context, domain string, serial *big.Int) error {
+	if err := cds.siteClient(domain).Delete(ctx, cds.ocspKey(domain, serial)); err != nil {
+		return fmt.Errorf("Unable to delete OCSP response for %v: %w", domain, err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Categories of the Cloud Datastore operations OpStats counts.
+const (
+	// OpCategoryHandshake operations load certificates and keys, which
+	// CertMagic does during the handshakes of on-demand TLS
+	OpCategoryHandshake = "handshake"
+	// OpCategoryLockPolling operations check on locks held by other instances
+	OpCategoryLockPolling = "lock_polling"
+	// OpCategoryMaintenance operations are made by scans, monitors, health
+	// checks and bulk jobs
+	OpCategoryMaintenance = "maintenance"
+	// OpCategoryOther operations are the rest, eg storing certificates
+	OpCategoryOther = "other"
+)
+
+// opStatsDays is how many days of operations are kept.
+const opStatsDays = 31
+
+// opKindUnknown is the kind of queries that returned no entities, which
+// don't say what they were of.
+const opKindUnknown = "unknown"
+
+// opsVars are the operations of each storage by kind and category, keyed by
+// storage, published by expvar at /debug/vars.
+var opsVars = expvar.NewMap("caddy_clouddatastoretls_ops")
+
+// OpCounts are the entity reads, writes and deletes of Cloud Datastore
+// operations, which it bills for. A query reads each entity it returns, at
+// least one.
+type OpCounts struct {
+	Reads   int64 `json:"reads"`
+	Writes  int64 `json:"writes"`
+	Deletes int64 `json:"deletes"`
+}
+
+func (c *OpCounts) add(o OpCounts) {
+	c.Reads += o.Reads
+	c.Writes += o.Writes
+	c.Deletes += o.Deletes
+}
+
+// DayOps are the operations of a UTC day.
+type DayOps struct {
+	Day        string              `json:"day"` // eg `2020-01-31`
+	Categories map[string]OpCounts `json:"categories"`
+	Total      OpCounts            `json:"total"`
+}
+
+// OpStats returns the operations the storage made each day, in every project
+// it uses, by OpCategory, oldest first, for up to the last 31 days. They're
+// only counted since the storage was created, so estimate the bill of a
+// cluster from the stats of each instance.
+func (cds *CloudDsStorage) OpStats() []DayOps {
+	return cds.ops.stats()
+}
+
+// OpStatsByKind returns the operations the storage made since it was created
+// by entity kind, eg LOCK_RECORD, and then OpCategory, to tell which records
+// the reads, writes and deletes are of.
+func (cds *CloudDsStorage) OpStatsByKind() map[string]map[string]OpCounts {
+	return cds.ops.byKind()
+}
+
+// publishOps publishes OpStatsByKind in opsVars until the storage is closed.
+func (cds *CloudDsStorage) publishOps() {
+	name := cds.expiryVarName()
+	opsVars.Set(name, expvar.Func(func() interface{} {
+		return cds.OpStatsByKind()
+	}))
+	go func() {
+		<-cds.ctx.Done()
+		opsVars.Delete(name)
+	}()
+}
+
+type opCategoryKey struct{}
+
+// withOpCategory returns ctx with the operations made with it counted under
+// category.
+func withOpCategory(ctx context.Context, category string) context.Context {
+	return context.WithValue(ctx, opCategoryKey{}, category)
+}
+
+// opCategory returns the category of the operations made with ctx.
+func opCategory(ctx context.Context) string {
+	if category, ok := ctx.Value(opCategoryKey{}).(string); ok {
+		return category
+	}
+	return OpCategoryOther
+}
+
+// opCounter counts operations by day and category, and by kind and
+// category.
+type opCounter struct {
+	clock Clock
+	mu    sync.Mutex
+	days  map[string]map[string]*OpCounts
+	kinds map[string]map[string]*OpCounts
+}
+
+func newOpCounter(clock Clock) *opCounter {
+	return &opCounter{clock: clock, days: make(map[string]map[string]*OpCounts), kinds: make(map[string]map[string]*OpCounts)}
+}
+
+// count adds o, operations on records of kind, to the operations of
+// category today.
+func (c *opCounter) count(category, kind string, o OpCounts) {
+	day := c.clock.Now().UTC().Format("2006-01-02")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.days[day]; !ok {
+		c.days[day] = make(map[string]*OpCounts)
+		c.prune()
+	}
+	addCounts(c.days[day], category, o)
+	if _, ok := c.kinds[kind]; !ok {
+		c.kinds[kind] = make(map[string]*OpCounts)
+	}
+	addCounts(c.kinds[kind], category, o)
+}
+
+// addCounts adds o to the counts of category in m.
+func addCounts(m map[string]*OpCounts, category string, o OpCounts) {
+	counts, ok := m[category]
+	if !ok {
+		counts = new(OpCounts)
+		m[category] = counts
+	}
+	counts.add(o)
+}
+
+// prune drops the oldest days past opStatsDays.
+func (c *opCounter) prune() {
+	if len(c.days) <= opStatsDays {
+		return
+	}
+	days := make([]string, 0, len(c.days))
+	for day := range c.days {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days[:len(days)-opStatsDays] {
+		delete(c.days, day)
+	}
+}
+
+func (c *opCounter) stats() []DayOps {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make([]DayOps, 0, len(c.days))
+	for day, categories := range c.days {
+		d := DayOps{Day: day, Categories: make(map[string]OpCounts)}
+		for category, counts := range categories {
+			d.Categories[category] = *counts
+			d.Total.add(*counts)
+		}
+		stats = append(stats, d)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Day < stats[j].Day })
+	return stats
+}
+
+func (c *opCounter) byKind() map[string]map[string]OpCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kinds := make(map[string]map[string]OpCounts, len(c.kinds))
+	for kind, categories := range c.kinds {
+		kinds[kind] = make(map[string]OpCounts, len(categories))
+		for category, counts := range categories {
+			kinds[kind][category] = *counts
+		}
+	}
+	return kinds
+}
+
+// countKeys counts o for each of keys, by their kind.
+func (c *opCounter) countKeys(category string, keys []*datastore.Key, o OpCounts) {
+	for _, k := range keys {
+		c.count(category, k.Kind, o)
+	}
+}
+
+// wrap returns client with its operations counted.
+func (c *opCounter) wrap(client dsClient) dsClient {
+	return &countingClient{dsClient: client, ops: c}
+}
+
+// countingClient is a dsClient counting its operations.
+type countingClient struct {
+	dsClient
+	ops *opCounter
+}
+
+func (c *countingClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	c.ops.count(opCategory(ctx), key.Kind, OpCounts{Reads: 1})
+	return c.dsClient.Get(ctx, key, dst)
+}
+
+func (c *countingClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	c.ops.count(opCategory(ctx), key.Kind, OpCounts{Writes: 1})
+	return c.dsClient.Put(ctx, key, src)
+}
+
+func (c *countingClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	c.ops.countKeys(opCategory(ctx), keys, OpCounts{Writes: 1})
+	return c.dsClient.PutMulti(ctx, keys, src)
+}
+
+func (c *countingClient) Delete(ctx context.Context, key *datastore.Key) error {
+	c.ops.count(opCategory(ctx), key.Kind, OpCounts{Deletes: 1})
+	return c.dsClient.Delete(ctx, key)
+}
+
+func (c *countingClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	c.ops.countKeys(opCategory(ctx), keys, OpCounts{Deletes: 1})
+	return c.dsClient.DeleteMulti(ctx, keys)
+}
+
+func (c *countingClient) Run(ctx context.Context, q *datastore.Query) dsIterator {
+	return &countingIterator{dsIterator: c.dsClient.Run(ctx, q), ops: c.ops, category: opCategory(ctx)}
+}
+
+func (c *countingClient) KeysInRange(ctx context.Context, kind, namespace, start, end string) ([]*datastore.Key, error) {
+	// keys-only queries are billed a single read
+	c.ops.count(opCategory(ctx), kind, OpCounts{Reads: 1})
+	return c.dsClient.KeysInRange(ctx, kind, namespace, start, end)
+}
+
+func (c *countingClient) GetProjection(ctx context.Context, key *datastore.Key, props ...string) (datastore.PropertyList, error) {
+	c.ops.count(opCategory(ctx), key.Kind, OpCounts{Reads: 1})
+	return c.dsClient.GetProjection(ctx, key, props...)
+}
+
+func (c *countingClient) RunInTransaction(ctx context.Context, f func(tx dsTransaction) error) error {
+	category := opCategory(ctx)
+	return c.dsClient.RunInTransaction(ctx, func(tx dsTransaction) error {
+		return f(&countingTransaction{dsTransaction: tx, ops: c.ops, category: category})
+	})
+}
+
+// countingIterator counts the entities a query returns.
+type countingIterator struct {
+	dsIterator
+	ops      *opCounter
+	category string
+	n        int
+}
+
+func (it *countingIterator) Next(dst interface{}) (*datastore.Key, error) {
+	k, err := it.dsIterator.Next(dst)
+	switch {
+	case err == nil:
+		it.ops.count(it.category, k.Kind, OpCounts{Reads: 1})
+		it.n++
+	case err == iterator.Done && it.n == 0:
+		it.ops.count(it.category, opKindUnknown, OpCounts{Reads: 1})
+	}
+	return k, err
+}
+
+// countingTransaction counts the operations of a transaction, each attempt
+// if it's retried.
+type countingTransaction struct {
+	dsTransaction
+	ops      *opCounter
+	category string
+}
+
+func (tx *countingTransaction) Get(key *datastore.Key, dst interface{}) error {
+	tx.ops.count(tx.category, key.Kind, OpCounts{Reads: 1})
+	return tx.dsTransaction.Get(key, dst)
+}
+
+func (tx *countingTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	tx.ops.count(tx.category, key.Kind, OpCounts{Writes: 1})
+	return tx.dsTransaction.Put(key, src)
+}
+
+func (tx *countingTransaction) Delete(key *datastore.Key) error {
+	tx.ops.count(tx.category, key.Kind, OpCounts{Deletes: 1})
+	return tx.dsTransaction.Delete(key)
+}
@@ -0,0 +1,116 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// pauseName is the name of the control record pausing issuance, under the
+// storage's prefix rather than its CA so it pauses the whole cluster.
+const pauseName = "control/pause"
+
+// pauseCheckInterval is how long an instance goes by the pause record it
+// last read, so issuance doesn't read it on every lock.
+const pauseCheckInterval = 30 * time.Second
+
+// cdsPauseRecord pauses issuance and renewal across the cluster while it
+// exists.
+type cdsPauseRecord struct {
+	Reason   string `datastore:",noindex"`
+	Instance string `datastore:",noindex"` // instance that paused
+	Modified time.Time
+	Labels   []string
+}
+
+// PauseState is a pause of issuance set with Pause.
+type PauseState struct {
+	Reason   string    `json:"reason"`
+	Instance string    `json:"instance"`
+	Since    time.Time `json:"since"`
+}
+
+// pauseCache is the pause record as last read by this instance.
+type pauseCache struct {
+	state   *PauseState // nil if not paused
+	checked time.Time
+}
+
+func (cds *CloudDsStorage) pauseKey() *datastore.Key {
+	return cds.baseKey(CONTROL_RECORD, path.Join(cds.prefix, pauseName))
+}
+
+// Pause stops every instance of the cluster from obtaining or renewing
+// certificates, eg during an incident or a CA outage, until Resume. Locks to
+// issue fail with ErrPaused, loading certificates and everything else carry
+// on. Other instances notice within pauseCheckInterval.
+func (cds *CloudDsStorage) Pause(ctx context.Context, reason string) error {
+	r := &cdsPauseRecord{Reason: reason, Instance: cds.instanceID, Modified: cds.clock.Now(), Labels: cds.labels}
+	if _, err := cds.cloudDsClient.Put(ctx, cds.pauseKey(), r); err != nil {
+		return fmt.Errorf("Unable to pause issuance: %w", err)
+	}
+	cds.setPause(r.state())
+	log.Printf("[WARNING] Issuance paused across the cluster: %s", reason)
+	return nil
+}
+
+// Resume lets the cluster obtain and renew certificates again after Pause.
+func (cds *CloudDsStorage) Resume(ctx context.Context) error {
+	if err := cds.cloudDsClient.Delete(ctx, cds.pauseKey()); err != nil {
+		return fmt.Errorf("Unable to resume issuance: %w", err)
+	}
+	cds.setPause(nil)
+	log.Printf("[INFO] Issuance resumed across the cluster")
+	return nil
+}
+
+// PauseState returns the pause of issuance, nil if it isn't paused.
+func (cds *CloudDsStorage) PauseState(ctx context.Context) (*PauseState, error) {
+	r := new(cdsPauseRecord)
+	err := cds.cloudDsClient.Get(ctx, cds.pauseKey(), r)
+	if err == datastore.ErrNoSuchEntity {
+		cds.setPause(nil)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read pause: %w", err)
+	}
+	cds.setPause(r.state())
+	return r.state(), nil
+}
+
+func (r *cdsPauseRecord) state() *PauseState {
+	return &PauseState{Reason: r.Reason, Instance: r.Instance, Since: r.Modified}
+}
+
+func (cds *CloudDsStorage) setPause(state *PauseState) {
+	cds.pauseMu.Lock()
+	defer cds.pauseMu.Unlock()
+	cds.pause = pauseCache{state: state, checked: cds.clock.Now()}
+}
+
+// checkPaused returns ErrPaused if issuance is paused, reading the pause
+// record at most every pauseCheckInterval. Issuance carries on if it can't
+// be read, the lock would most likely fail as well.
+func (cds *CloudDsStorage) checkPaused(ctx context.Context) error {
+	cds.pauseMu.Lock()
+	cached := cds.pause
+	cds.pauseMu.Unlock()
+
+	state := cached.state
+	if cached.checked.IsZero() || cds.clock.Now().Sub(cached.checked) >= pauseCheckInterval {
+		var err error
+		if state, err = cds.PauseState(ctx); err != nil {
+			log.Printf("[WARNING] %v", err)
+			return nil
+		}
+	}
+	if state != nil {
+		return fmt.Errorf("Issuance paused by %s since %s: %s: %w", state.Instance, state.Since.UTC().Format(time.RFC3339), state.Reason, ErrPaused)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package tlsclouddatastore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// proxyDialer returns a gRPC dialer that tunnels connections through the
+// HTTP(S) proxy at proxyURL with CONNECT. tlsCfg is used to connect to an https
+// proxy, nil for the defaults.
+func proxyDialer(proxyURL *url.URL, tlsCfg *tls.Config) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to proxy %s: %w", proxyURL.Host, err)
+		}
+		if proxyURL.Scheme == "https" {
+			c := new(tls.Config)
+			if tlsCfg != nil {
+				c = tlsCfg.Clone()
+			}
+			c.ServerName = proxyURL.Hostname()
+			tlsConn := tls.Client(conn, c)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("Unable to connect to proxy %s: %w", proxyURL.Host, err)
+			}
+			conn = tlsConn
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u := proxyURL.User; u != nil {
+			password, _ := u.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to send CONNECT to proxy %s: %w", proxyURL.Host, err)
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to read CONNECT response from proxy %s: %w", proxyURL.Host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("Proxy %s refused CONNECT to %s: %s", proxyURL.Host, addr, resp.Status)
+		}
+		if br.Buffered() > 0 {
+			// the server spoke first and the reader already has some of it
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+		return conn, nil
+	}
+}
+
+// proxyAddr returns the host:port of proxyURL, with the scheme's default port
+// if it doesn't have one.
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	if proxyURL.Scheme == "https" {
+		return net.JoinHostPort(proxyURL.Hostname(), "443")
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), "80")
+}
+
+// parseProxyURL parses a proxy URL, accepting `host:port` for an HTTP proxy.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		// no scheme, eg `proxy.corp:3128`
+		u, err = url.Parse("http://" + s)
+	}
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL %q", s)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid proxy URL %q, only http and https proxies are supported", s)
+	}
+	return u, nil
+}
+
+// bufferedConn is a net.Conn whose reads start with data already buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
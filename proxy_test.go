@@ -0,0 +1,93 @@
+package tlsclouddatastore
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// connectProxy accepts one CONNECT request, checks its credentials and
+// echoes whatever is sent through the tunnel.
+func connectProxy(t *testing.T, l net.Listener, wantAuth string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Errorf("Error reading CONNECT: %v", err)
+		return
+	}
+	if req.Method != http.MethodConnect || req.Host != "datastore.googleapis.com:443" {
+		t.Errorf("Unexpected request %s %s", req.Method, req.Host)
+	}
+	if req.Header.Get("Proxy-Authorization") != wantAuth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	io.Copy(conn, br)
+}
+
+func TestProxyDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go connectProxy(t, l, "Basic dXNlcjpwYXNz") // user:pass
+
+	proxyURL, err := parseProxyURL("http://user:pass@" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error parsing proxy URL: %v", err)
+	}
+	conn, err := proxyDialer(proxyURL, nil)(context.Background(), "datastore.googleapis.com:443")
+	if err != nil {
+		t.Fatalf("Error dialing through proxy: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("Error writing through tunnel: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("Expected ping echoed through the tunnel, got %q: %v", b, err)
+	}
+}
+
+func TestProxyDialerRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go connectProxy(t, l, "Basic dXNlcjpwYXNz")
+
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	if _, err := proxyDialer(proxyURL, nil)(context.Background(), "datastore.googleapis.com:443"); err == nil {
+		t.Fatal("Expected error when the proxy refuses CONNECT")
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	for in, want := range map[string]string{
+		"proxy.corp:3128":             "http://proxy.corp:3128",
+		"https://proxy.corp":          "https://proxy.corp",
+		"http://u:p@proxy.corp:3128/": "http://u:p@proxy.corp:3128/",
+	} {
+		u, err := parseProxyURL(in)
+		if err != nil || u.String() != want {
+			t.Errorf("Expected %s parsing %s, got %v: %v", want, in, u, err)
+		}
+	}
+	if _, err := parseProxyURL("socks5://proxy.corp:1080"); err == nil {
+		t.Error("Expected error for a socks proxy")
+	}
+}
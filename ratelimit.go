@@ -0,0 +1,237 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DefaultRateLimitBackoff is how long the cluster backs off after the CA
+// rate limits it without saying until when.
+const DefaultRateLimitBackoff = time.Hour
+
+// rateLimitHistory is how long issuances are counted for, the longest
+// window of Let's Encrypt's limits.
+const rateLimitHistory = 168 * time.Hour
+
+// Scopes of the rate limits RecordRateLimit records.
+const (
+	// RateLimitAccount limits every issuance of the CA's account
+	RateLimitAccount = "account"
+	// RateLimitDomain limits the issuances of a registered domain
+	RateLimitDomain = "domain"
+)
+
+// retryAfterPattern matches the time Let's Encrypt says to retry after in
+// the detail of a rate limit error, eg `retry after 2020-01-01 00:00:00 UTC`.
+var retryAfterPattern = regexp.MustCompile(`retry after (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) UTC`)
+
+// cdsRateLimitRecord is the rate limit state of the CA's account or of a
+// registered domain, shared by the cluster.
+type cdsRateLimitRecord struct {
+	Until    time.Time   // issuance backs off until then
+	Detail   string      `datastore:",noindex"` // of the rate limit error
+	Instance string      `datastore:",noindex"` // that was rate limited
+	Hours    []time.Time `datastore:",noindex"` // hours certificates were issued in, oldest first
+	Counts   []int       `datastore:",noindex"` // certificates issued in each of Hours
+	Modified time.Time
+	Labels   []string
+}
+
+// RateLimitState is the rate limit state the cluster shares for the CA's
+// account or a registered domain.
+type RateLimitState struct {
+	Scope    string    `json:"scope"`            // RateLimitAccount or RateLimitDomain
+	Domain   string    `json:"domain,omitempty"` // registered domain of RateLimitDomain
+	Until    time.Time `json:"until,omitempty"`  // issuance backs off until then, zero if it doesn't
+	Detail   string    `json:"detail,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Issued1h int       `json:"issued_1h"` // certificates issued in the last hour
+	Issued3h int       `json:"issued_3h"`
+	Issued7d int       `json:"issued_7d"`
+}
+
+func (cds *CloudDsStorage) rateLimitKey(scope, domain string) *datastore.Key {
+	if scope == RateLimitAccount {
+		return cds.dsKey(RATE_LIMIT_RECORD, "ratelimits/account")
+	}
+	return cds.dsKey(RATE_LIMIT_RECORD, path.Join("ratelimits/domains", cds.nameSegment(registeredDomain(domain))))
+}
+
+// RecordRateLimit records that the CA rate limited an issuance of domain
+// until retryAfter, so every instance of the cluster with an issuance rate
+// set backs off issuing for scope until then instead of each being limited
+// in turn, as this one does. Locks to issue fail with ErrRateLimited in the
+// meantime.
+func (cds *CloudDsStorage) RecordRateLimit(ctx context.Context, scope, domain string, retryAfter time.Time, detail string) error {
+	if scope != RateLimitAccount && scope != RateLimitDomain {
+		return fmt.Errorf("Invalid rate limit scope %q", scope)
+	}
+	k := cds.rateLimitKey(scope, domain)
+	err := cds.cloudDsClient.RunInTransaction(ctx, func(tx dsTransaction) error {
+		r := new(cdsRateLimitRecord)
+		if err := tx.Get(k, r); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if r.Until.After(retryAfter) {
+			// already backing off for longer
+			return nil
+		}
+		r.Until, r.Detail, r.Instance = retryAfter, detail, cds.instanceID
+		r.Modified, r.Labels = cds.clock.Now(), cds.labels
+		_, err := tx.Put(k, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to record rate limit of %v: %w", domain, err)
+	}
+	cds.rateLimitSeen.Store(true)
+	log.Printf("[WARNING] Rate limited issuing %v, the cluster backs off until %s: %s", domain, retryAfter.UTC().Format(time.RFC3339), detail)
+	return nil
+}
+
+// RecordCAError records err, an error of the CA obtaining or renewing the
+// certificate of domain, with RecordRateLimit if it's a rate limit error.
+// The scope and the time to retry after are taken from Let's Encrypt's
+// detail if it has them, otherwise the account backs off for
+// DefaultRateLimitBackoff. It returns whether err was a rate limit.
+func (cds *CloudDsStorage) RecordCAError(ctx context.Context, domain string, err error) (bool, error) {
+	if err == nil {
+		return false, nil
+	}
+	detail := err.Error()
+	if !strings.Contains(detail, "rateLimited") && !strings.Contains(detail, "HTTP 429") {
+		return false, nil
+	}
+	scope := RateLimitAccount
+	if strings.Contains(detail, "registered domain") || strings.Contains(detail, "exact set of") {
+		scope = RateLimitDomain
+	}
+	retryAfter := cds.clock.Now().Add(DefaultRateLimitBackoff)
+	if m := retryAfterPattern.FindStringSubmatch(detail); m != nil {
+		if t, err := time.Parse("2006-01-02 15:04:05", m[1]); err == nil {
+			retryAfter = t
+		}
+	}
+	return true, cds.RecordRateLimit(ctx, scope, domain, retryAfter, detail)
+}
+
+// RateLimits returns the rate limit state of the CA's account and of the
+// registered domain of domain.
+func (cds *CloudDsStorage) RateLimits(ctx context.Context, domain string) ([]RateLimitState, error) {
+	var states []RateLimitState
+	for _, scope := range []string{RateLimitAccount, RateLimitDomain} {
+		r := new(cdsRateLimitRecord)
+		err := cds.cloudDsClient.Get(ctx, cds.rateLimitKey(scope, domain), r)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, fmt.Errorf("Unable to read rate limits of %v: %w", domain, err)
+		}
+		states = append(states, r.state(scope, domain, cds.clock.Now()))
+	}
+	return states, nil
+}
+
+func (r *cdsRateLimitRecord) state(scope, domain string, now time.Time) RateLimitState {
+	s := RateLimitState{Scope: scope, Detail: r.Detail, Instance: r.Instance}
+	if scope == RateLimitDomain {
+		s.Domain = registeredDomain(domain)
+	}
+	if r.Until.After(now) {
+		s.Until = r.Until
+	}
+	for i, hour := range r.Hours {
+		if i >= len(r.Counts) {
+			break
+		}
+		age := now.Sub(hour)
+		if age < time.Hour {
+			s.Issued1h += r.Counts[i]
+		}
+		if age < 3*time.Hour {
+			s.Issued3h += r.Counts[i]
+		}
+		if age < rateLimitHistory {
+			s.Issued7d += r.Counts[i]
+		}
+	}
+	return s
+}
+
+// tracksRateLimits reports whether issuances are counted and locks to issue
+// check the rate limit state: with an issuance rate configured, or once this
+// instance has recorded a rate limit. Otherwise nothing is read or written
+// for each issuance.
+func (cds *CloudDsStorage) tracksRateLimits() bool {
+	return cds.issuanceRate.Limit > 0 || cds.domainRate.Limit > 0 || cds.rateLimitSeen.Load()
+}
+
+// checkRateLimited returns ErrRateLimited if the cluster is backing off
+// issuing domain after a rate limit. Issuance carries on if the state can't
+// be read, the lock would most likely fail as well.
+func (cds *CloudDsStorage) checkRateLimited(ctx context.Context, domain string) error {
+	if !cds.tracksRateLimits() {
+		return nil
+	}
+	states, err := cds.RateLimits(ctx, domain)
+	if err != nil {
+		log.Printf("[WARNING] %v", err)
+		return nil
+	}
+	for _, s := range states {
+		if !s.Until.IsZero() {
+			return fmt.Errorf("Rate limited issuing %v until %s: %s: %w", domain, s.Until.UTC().Format(time.RFC3339), s.Detail, ErrRateLimited)
+		}
+	}
+	return nil
+}
+
+// countIssued counts a certificate issued for domain in the hour, for the
+// account and its registered domain, if rate limits are tracked.
+func (cds *CloudDsStorage) countIssued(ctx context.Context, domain string) {
+	if !cds.tracksRateLimits() {
+		return
+	}
+	now := cds.clock.Now()
+	hour := now.Truncate(time.Hour)
+	keys := []*datastore.Key{cds.rateLimitKey(RateLimitAccount, domain), cds.rateLimitKey(RateLimitDomain, domain)}
+	err := cds.cloudDsClient.RunInTransaction(ctx, func(tx dsTransaction) error {
+		for _, k := range keys {
+			r := new(cdsRateLimitRecord)
+			if err := tx.Get(k, r); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			r.count(hour, now)
+			r.Modified, r.Labels = now, cds.labels
+			if _, err := tx.Put(k, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Unable to count issuance of %v: %v", domain, err)
+	}
+}
+
+// count adds an issuance in hour, dropping the hours past rateLimitHistory.
+func (r *cdsRateLimitRecord) count(hour, now time.Time) {
+	var hours []time.Time
+	var counts []int
+	for i, h := range r.Hours {
+		if i < len(r.Counts) && now.Sub(h) < rateLimitHistory {
+			hours, counts = append(hours, h), append(counts, r.Counts[i])
+		}
+	}
+	if n := len(hours); n > 0 && hours[n-1].Equal(hour) {
+		counts[n-1]++
+	} else {
+		hours, counts = append(hours, hour), append(counts, 1)
+	}
+	r.Hours, r.Counts = hours, counts
+}
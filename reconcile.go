@@ -0,0 +1,149 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// reconcilePrefixes are the CertMagic key prefixes holding certificates
+// (per domain) and ACME accounts (per user).
+var reconcilePrefixes = []string{"certificates", "acme"}
+
+// ReconcileConflict is a key that's newer in the destination than the source
+// but has a different value, so it's left for an operator to resolve.
+type ReconcileConflict struct {
+	Key         string
+	SrcModified time.Time
+	DstModified time.Time
+}
+
+// ReconcileReport lists the differences Reconcile found.
+type ReconcileReport struct {
+	// Missing keys were in the source but not the destination
+	Missing []string
+
+	// Newer keys were modified more recently in the source than the destination
+	Newer []string
+
+	Conflicts []ReconcileConflict
+
+	// Failed keys couldn't be compared or copied
+	Failed []JobError
+
+	mu sync.Mutex
+}
+
+// Reconcile compares the certificates and accounts of two CertMagic
+// storages, eg a file storage and Cloud Datastore or two projects, and
+// copies keys missing from dst or newer in src. Keys with different values
+// that are newer in dst are reported as conflicts and not copied. If dryRun
+// is set nothing is copied, for drift detection. Keys are reconciled one at a
+// time and the first key that fails is returned as an error, once the others
+// are done.
+func Reconcile(ctx context.Context, src, dst certmagic.Storage, dryRun bool) (*ReconcileReport, error) {
+	report, err := ReconcileWithOptions(ctx, src, dst, dryRun, JobOptions{Workers: 1})
+	if err == nil && len(report.Failed) > 0 {
+		err = report.Failed[0].Err
+	}
+	return report, err
+}
+
+// ReconcileWithOptions is Reconcile with keys reconciled by a pool of
+// workers, optionally rate limited and checkpointed, for large storages.
+// Keys that fail are listed in the report's Failed rather than stopping the
+// others; an error is only returned if the keys can't be listed or ctx ends.
+func ReconcileWithOptions(ctx context.Context, src, dst certmagic.Storage, dryRun bool, opts JobOptions) (*ReconcileReport, error) {
+	report := new(ReconcileReport)
+	ctx = WithAccessReason(ctx, "reconcile")
+	var keys []string
+	for _, prefix := range reconcilePrefixes {
+		prefixKeys, err := src.List(ctx, prefix, true)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return report, fmt.Errorf("Unable to list %v: %w", prefix, err)
+		}
+		keys = append(keys, prefixKeys...)
+	}
+
+	items := make(chan string)
+	go func() {
+		defer close(items)
+		for _, key := range keys {
+			select {
+			case items <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	failed, err := runJob(ctx, items, opts, func(ctx context.Context, key string) error {
+		return reconcileKey(ctx, src, dst, key, dryRun, report)
+	})
+	report.Failed = failed
+	return report, err
+}
+
+func reconcileKey(ctx context.Context, src, dst certmagic.Storage, key string, dryRun bool, report *ReconcileReport) error {
+	srcInfo, err := src.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Unable to obtain %v from source: %w", key, err)
+	}
+	if !srcInfo.IsTerminal {
+		return nil
+	}
+
+	dstInfo, err := dst.Stat(ctx, key)
+	missing := errors.Is(err, fs.ErrNotExist)
+	if err != nil && !missing {
+		return fmt.Errorf("Unable to obtain %v from destination: %w", key, err)
+	}
+
+	value, err := src.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Unable to load %v from source: %w", key, err)
+	}
+
+	if !missing {
+		existing, err := dst.Load(ctx, key)
+		if err != nil {
+			return fmt.Errorf("Unable to load %v from destination: %w", key, err)
+		}
+		if bytes.Equal(value, existing) {
+			return nil
+		}
+		if !srcInfo.Modified.After(dstInfo.Modified) {
+			report.mu.Lock()
+			report.Conflicts = append(report.Conflicts, ReconcileConflict{
+				Key:         key,
+				SrcModified: srcInfo.Modified,
+				DstModified: dstInfo.Modified,
+			})
+			report.mu.Unlock()
+			return nil
+		}
+	}
+
+	report.mu.Lock()
+	if missing {
+		report.Missing = append(report.Missing, key)
+	} else {
+		report.Newer = append(report.Newer, key)
+	}
+	report.mu.Unlock()
+	if dryRun {
+		return nil
+	}
+	if err := dst.Store(ctx, key, value); err != nil {
+		return fmt.Errorf("Unable to store %v in destination: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DefaultRenewalFailures is how many renewals of a domain in a row may fail
+// before the renewal webhook is called.
+const DefaultRenewalFailures = 3
+
+// certMagicIssueLock is the prefix of the locks CertMagic takes to obtain or
+// renew the certificate of a domain.
+const certMagicIssueLock = "issue_cert_"
+
+// renewalClient posts to the renewal webhook.
+var renewalClient = &http.Client{Timeout: 10 * time.Second}
+
+// cdsRenewalRecord counts the failed renewals of a domain since its
+// certificate was last stored, by any instance.
+type cdsRenewalRecord struct {
+	Failures    int       `datastore:",noindex"`
+	LastFailure time.Time `datastore:",noindex"`
+	Stored      time.Time `datastore:",noindex"` // certificate last stored, with EnvNameRenewalJitter
+	NextAttempt time.Time `datastore:",noindex"` // renewals are deferred until then, with EnvNameRenewalJitter
+	Modified    time.Time
+	Labels      []string
+}
+
+// RenewalFailure is posted as JSON to the renewal webhook when a domain has
+// failed to renew repeatedly.
+type RenewalFailure struct {
+	Domain      string    `json:"domain"`
+	Failures    int       `json:"failures"` // in a row, since the certificate was last stored
+	LastFailure time.Time `json:"last_failure"`
+	Instance    string    `json:"instance"`
+}
+
+func (cds *CloudDsStorage) renewalKey(domain string) *datastore.Key {
+	return cds.dsKey(RENEWAL_RECORD, path.Join("renewals", cds.nameSegment(escapeWildcard(domain))))
+}
+
+// renewalStarted notes this instance took the lock to renew domain, a
+// failure unless its certificate is stored before the lock is released.
+func (cds *CloudDsStorage) renewalStarted(domain string) {
+	if cds.renewing == nil {
+		return
+	}
+	cds.renewingMu.Lock()
+	defer cds.renewingMu.Unlock()
+	cds.renewing[strings.ToLower(domain)] = true
+}
+
+// renewalStored resets the failures and renewal schedule of domain, its
+// certificate was stored. With EnvNameRenewalJitter the record is kept to
+// tell its next lock is a renewal.
+func (cds *CloudDsStorage) renewalStored(ctx context.Context, domain string) {
+	if cds.renewing == nil && cds.renewalJitter <= 0 {
+		return
+	}
+	cds.renewingMu.Lock()
+	delete(cds.renewing, strings.ToLower(domain))
+	cds.renewingMu.Unlock()
+
+	var err error
+	if cds.renewalJitter > 0 {
+		now := cds.clock.Now()
+		_, err = cds.siteClient(domain).Put(ctx, cds.renewalKey(domain), &cdsRenewalRecord{Stored: now, Modified: now, Labels: cds.labels})
+	} else {
+		err = cds.siteClient(domain).Delete(ctx, cds.renewalKey(domain))
+	}
+	if err != nil {
+		log.Printf("[ERROR] Unable to reset renewal failures of %v: %v", domain, err)
+	}
+}
+
+// renewalDue staggers the renewals of domain across the cluster with
+// EnvNameRenewalJitter, returning ErrRenewalDeferred until its next attempt.
+// The first attempt once the certificate is due is deferred by a random part
+// of the jitter, so certificates obtained together don't all renew at once,
+// and each attempt defers the next by the jitter and a random part of it, so
+// instances don't race to retry. renewal is whether domain is known to have
+// a certificate, otherwise it's only deferred if it has a renewal record.
+func (cds *CloudDsStorage) renewalDue(ctx context.Context, domain string, renewal bool) error {
+	if cds.renewalJitter <= 0 {
+		return nil
+	}
+	k := cds.renewalKey(domain)
+	var next time.Time
+	err := cds.siteClient(domain).RunInTransaction(ctx, func(tx dsTransaction) error {
+		next = time.Time{}
+		r := new(cdsRenewalRecord)
+		err := tx.Get(k, r)
+		if err == datastore.ErrNoSuchEntity && !renewal {
+			// first issuance
+			return nil
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := cds.clock.Now()
+		switch {
+		case r.NextAttempt.IsZero():
+			r.NextAttempt = now.Add(cds.jitter())
+			next = r.NextAttempt
+		case now.Before(r.NextAttempt):
+			next = r.NextAttempt
+			return nil
+		default:
+			r.NextAttempt = now.Add(cds.renewalJitter + cds.jitter())
+		}
+		r.Modified, r.Labels = now, cds.labels
+		_, err = tx.Put(k, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to schedule renewal of %v: %w", domain, err)
+	}
+	if next.After(cds.clock.Now()) {
+		return fmt.Errorf("Renewal of %v deferred until %s: %w", domain, next.UTC().Format(time.RFC3339), ErrRenewalDeferred)
+	}
+	return nil
+}
+
+// jitter returns a random duration up to EnvNameRenewalJitter.
+func (cds *CloudDsStorage) jitter() time.Duration {
+	return time.Duration(mathrand.Int63n(int64(cds.renewalJitter)))
+}
+
+// renewalEnded counts a failure of domain if this instance released its lock
+// without storing its certificate, calling the webhook and notifying
+// EventRenewalFailed every cds.renewalLimit failures in a row.
+func (cds *CloudDsStorage) renewalEnded(ctx context.Context, domain string) {
+	if cds.renewing == nil {
+		return
+	}
+	cds.renewingMu.Lock()
+	failed := cds.renewing[strings.ToLower(domain)]
+	delete(cds.renewing, strings.ToLower(domain))
+	cds.renewingMu.Unlock()
+	if !failed {
+		return
+	}
+
+	k := cds.renewalKey(domain)
+	r := new(cdsRenewalRecord)
+	err := cds.siteClient(domain).RunInTransaction(ctx, func(tx dsTransaction) error {
+		if err := tx.Get(k, r); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := cds.clock.Now()
+		r.Failures++
+		r.LastFailure, r.Modified, r.Labels = now, now, cds.labels
+		_, err := tx.Put(k, r)
+		return err
+	})
+	if err != nil {
+		log.Printf("[ERROR] Unable to record renewal failure of %v: %v", domain, err)
+		return
+	}
+	log.Printf("[WARNING] Renewal of %v failed, %d in a row", domain, r.Failures)
+	if r.Failures%cds.renewalLimit == 0 {
+		if cds.renewalHook != "" {
+			f := RenewalFailure{Domain: domain, Failures: r.Failures, LastFailure: r.LastFailure, Instance: cds.instanceID}
+			go cds.notifyRenewalFailure(f)
+		}
+		cds.notify(EventRenewalFailed, fmt.Sprintf("Renewal of %v failed %d times in a row", domain, r.Failures), map[string]interface{}{"domain": domain, "failures": r.Failures})
+	}
+}
+
+// notifyRenewalFailure posts f to the renewal webhook.
+func (cds *CloudDsStorage) notifyRenewalFailure(f RenewalFailure) {
+	body, err := json.Marshal(f)
+	if err != nil {
+		log.Printf("[ERROR] Unable to encode renewal failure of %v: %v", f.Domain, err)
+		return
+	}
+	req, err := http.NewRequestWithContext(cds.ctx, http.MethodPost, cds.renewalHook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[ERROR] Unable to call renewal webhook: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := renewalClient.Do(req)
+	if err != nil {
+		log.Printf("[ERROR] Unable to call renewal webhook for %v: %v", f.Domain, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[ERROR] Renewal webhook for %v responded %s", f.Domain, resp.Status)
+	}
+}
+
+// issueLockDomain returns the domain of a CertMagic lock taken to obtain or
+// renew its certificate, false for other locks.
+func issueLockDomain(name string) (string, bool) {
+	if !strings.HasPrefix(name, certMagicIssueLock) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, certMagicIssueLock), true
+}
+
+// certKeyDomain returns the domain of a certificate key CertMagic stores.
+func certKeyDomain(key string) string {
+	return unescapeWildcard(strings.Split(cleanKVKey(key), "/")[2])
+}
+
+// validWebhook checks the webhook from env is an http(s) URL.
+func validWebhook(hook, env string) error {
+	if !strings.HasPrefix(hook, "https://") && !strings.HasPrefix(hook, "http://") {
+		return fmt.Errorf("Invalid webhook %q from %s, expected an http(s) URL", hook, env)
+	}
+	return nil
+}
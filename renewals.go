@@ -0,0 +1,194 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// DefaultRenewalPoll is how often SubscribeRenewals looks for renewals by
+	// default.
+	DefaultRenewalPoll = 30 * time.Second
+
+	// renewalSkew is how far back each poll looks before the last renewal
+	// seen, for renewals stamped by instances whose clocks are behind.
+	renewalSkew = time.Minute
+)
+
+// RenewalEvent is a certificate stored by any instance, seen by
+// SubscribeRenewals.
+type RenewalEvent struct {
+	Domain   string
+	Issuer   string    // the CertMagic issuer, empty for Caddy v1 sites
+	Instance string    // that stored it, only for Caddy v1 sites
+	NotAfter time.Time // expiry of the new certificate, only for Caddy v1 sites
+	Stored   time.Time
+}
+
+// SubscribeRenewals sends an event each time any instance stores a
+// certificate for the storage's CA, Caddy v1 sites and CertMagic
+// certificates alike, so instances can reload renewed certificates rather
+// than wait for their cache to expire. Cloud Datastore has no change
+// listeners, so stored records are queried every interval, DefaultRenewalPoll
+// if it's 0. Only renewals after subscribing are sent. Caddy v1 sites are
+// found from their audit entries, so their domains are as stored, ie hashed
+// with EnvNameHashKey, and aren't seen with EnvNameSiteAuditHistory off. The channel is closed once ctx is done or the storage
+// is closed.
+func (cds *CloudDsStorage) SubscribeRenewals(ctx context.Context, interval time.Duration) (<-chan RenewalEvent, error) {
+	if interval <= 0 {
+		interval = DefaultRenewalPoll
+	}
+	p := &renewalPoller{cds: cds, since: cds.clock.Now(), seen: make(map[string]time.Time)}
+	// anything already stored in the skew window isn't a new renewal
+	if _, err := p.poll(ctx); err != nil {
+		return nil, err
+	}
+
+	events := make(chan RenewalEvent)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-cds.ctx.Done():
+				return
+			case <-cds.clock.After(interval):
+			}
+
+			renewals, err := p.poll(ctx)
+			if err != nil {
+				log.Printf("[WARNING] Unable to look for renewals: %v", err)
+			}
+			for _, e := range renewals {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				case <-cds.ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// renewalPoller finds the renewals since the last poll.
+type renewalPoller struct {
+	cds   *CloudDsStorage
+	since time.Time            // the latest renewal seen
+	seen  map[string]time.Time // renewals in the skew window already sent, by key
+}
+
+// poll returns the renewals not seen before, oldest first.
+func (p *renewalPoller) poll(ctx context.Context) ([]RenewalEvent, error) {
+	from := p.since.Add(-renewalSkew)
+	var renewals []RenewalEvent
+	add := func(id string, e RenewalEvent) {
+		if _, ok := p.seen[id]; ok {
+			return
+		}
+		p.seen[id] = e.Stored
+		renewals = append(renewals, e)
+	}
+
+	for _, client := range p.cds.clients() {
+		if err := p.cds.siteRenewals(ctx, client, from, add); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.cds.certRenewals(ctx, from, add); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(renewals, func(i, j int) bool {
+		return renewals[i].Stored.Before(renewals[j].Stored)
+	})
+	for _, e := range renewals {
+		if e.Stored.After(p.since) {
+			p.since = e.Stored
+		}
+	}
+	for id, stored := range p.seen {
+		if stored.Before(p.since.Add(-renewalSkew)) {
+			delete(p.seen, id)
+		}
+	}
+	return renewals, nil
+}
+
+// siteRenewals calls add with the Caddy v1 sites stored in client since
+// from, from their audit entries.
+func (cds *CloudDsStorage) siteRenewals(ctx context.Context, client dsClient, from time.Time, add func(string, RenewalEvent)) error {
+	// filtered by CA here so no composite index is needed
+	q := datastore.NewQuery(AUDIT_RECORD).
+		Namespace(cds.namespace).
+		FilterField("Created", ">", from)
+	for it := client.Run(ctx, q); ; {
+		var e AuditEntry
+		k, err := it.Next(&e)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to query audit entries: %w", err)
+		}
+		if e.CA != cds.caNamespace {
+			continue
+		}
+		domain := unescapeSegment(e.Domain)
+		if name, ok := cds.openName(e.Domain); ok {
+			domain = name
+		}
+		add(k.String(), RenewalEvent{
+			Domain:   unescapeWildcard(domain),
+			Instance: e.Instance,
+			NotAfter: e.NotAfter,
+			Stored:   e.Created,
+		})
+	}
+}
+
+// certRenewals calls add with the CertMagic certificates stored since from.
+func (cds *CloudDsStorage) certRenewals(ctx context.Context, from time.Time, add func(string, RenewalEvent)) error {
+	base := cds.kvKey("certificates").Name + "/"
+	q := datastore.NewQuery(KV_RECORD).
+		Namespace(cds.namespace).
+		FilterField("Modified", ">", from).
+		Project("Modified")
+	for it := cds.cloudDsClient.Run(ctx, q); ; {
+		var props datastore.PropertyList
+		k, err := it.Next(&props)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to query certificates: %w", err)
+		}
+		if !strings.HasPrefix(k.Name, base) {
+			continue
+		}
+		key, err := cds.kvKeyOf(ctx, k)
+		if err != nil {
+			return err
+		}
+		if !isCertKey(key) {
+			continue
+		}
+		stored := propTime(props, "Modified")
+		parts := strings.Split(key, "/")
+		add(fmt.Sprintf("%s@%d", k.String(), stored.UnixNano()), RenewalEvent{
+			Domain: certMagicDomain(parts[2]),
+			Issuer: parts[1],
+			Stored: stored,
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+)
+
+// projectRoute sends site records for domains matching pattern to another
+// GCP project (or database), eg a customer's own project.
+type projectRoute struct {
+	pattern string
+	client  dsClient
+}
+
+// ProjectRoute keeps site records for domains matching Pattern, a domain or
+// `*.domain` for any subdomain, in another GCP project and optionally database.
+type ProjectRoute struct {
+	Pattern  string
+	Project  string
+	Database string
+}
+
+// parseProjectRoutes parses a comma separated list of `pattern=project` or
+// `pattern=project/database` entries.
+func parseProjectRoutes(s string) ([]ProjectRoute, error) {
+	var specs []ProjectRoute
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid project route %q, expected pattern=project[/database]", entry)
+		}
+		spec := ProjectRoute{Pattern: parts[0], Project: parts[1]}
+		if i := strings.Index(spec.Project, "/"); i >= 0 {
+			spec.Project, spec.Database = spec.Project[:i], spec.Project[i+1:]
+		}
+		if spec.Project == "" {
+			return nil, fmt.Errorf("Invalid project route %q, missing project", entry)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// matchDomain reports whether domain matches pattern, either exactly or, for
+// a pattern like `*.example.com`, as any subdomain of example.com.
+func matchDomain(pattern, domain string) bool {
+	domain = strings.ToLower(domain)
+	if pattern == domain {
+		return true
+	}
+	return isWildcard(pattern) && strings.HasSuffix(domain, pattern[1:])
+}
+
+// newClient creates a client for projectID, using the default database unless
+// databaseID is set.
+func newClient(ctx context.Context, projectID, databaseID string, o []option.ClientOption) (dsClient, error) {
+	var client *datastore.Client
+	var err error
+	if databaseID == "" {
+		client, err = datastore.NewClient(ctx, projectID, o...)
+	} else {
+		client, err = datastore.NewClientWithDatabase(ctx, projectID, databaseID, o...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cloudClient{client}, nil
+}
+
+// addProjectRoutes creates a client for each distinct project in specs.
+func (cds *CloudDsStorage) addProjectRoutes(specs []ProjectRoute, o []option.ClientOption) error {
+	clients := make(map[string]dsClient)
+	for _, spec := range specs {
+		if spec.Pattern == "" || spec.Project == "" {
+			return fmt.Errorf("Invalid project route %+v, pattern and project are required", spec)
+		}
+		id := spec.Project + "/" + spec.Database
+		client, ok := clients[id]
+		if !ok {
+			var err error
+			if client, err = newClient(cds.ctx, spec.Project, spec.Database, o); err != nil {
+				return fmt.Errorf("Unable to create Cloud Datastore client for project %s: %w", spec.Project, err)
+			}
+			client = cds.ops.wrap(client)
+			clients[id] = client
+		}
+		cds.routes = append(cds.routes, projectRoute{pattern: strings.ToLower(spec.Pattern), client: client})
+	}
+	return nil
+}
+
+// siteClient returns the client for the project a domain's records are kept
+// in, the first matching route or the default project.
+func (cds *CloudDsStorage) siteClient(domain string) dsClient {
+	for _, r := range cds.routes {
+		if matchDomain(r.pattern, domain) {
+			return r.client
+		}
+	}
+	return cds.cloudDsClient
+}
+
+// clients returns each distinct client, the default project's first.
+func (cds *CloudDsStorage) clients() []dsClient {
+	clients := []dsClient{cds.cloudDsClient}
+	seen := map[dsClient]bool{cds.cloudDsClient: true}
+	for _, r := range cds.routes {
+		if !seen[r.client] {
+			seen[r.client] = true
+			clients = append(clients, r.client)
+		}
+	}
+	return clients
+}
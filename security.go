@@ -0,0 +1,267 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// FindingHigh findings leave private keys readable to anyone with access to the dataset
+	FindingHigh = "high"
+	// FindingMedium findings weaken protections that are enabled
+	FindingMedium = "medium"
+	// FindingLow findings are worth reviewing but expected during migrations
+	FindingLow = "low"
+)
+
+// SecurityFinding is a weakness SecurityAudit found in the configuration or
+// the stored records.
+type SecurityFinding struct {
+	Severity string   `json:"severity"`
+	Check    string   `json:"check"`
+	Detail   string   `json:"detail"`
+	Keys     []string `json:"keys,omitempty"` // key names of the affected records
+}
+
+// auditedKinds are the kinds holding encrypted values SecurityAudit checks.
+var auditedKinds = []string{SITE_RECORD, USER_RECORD, MOST_RECENT_USER_RECORD, KV_RECORD}
+
+// SecurityAudit inspects the settings the storage runs with and the records
+// of its CA, in every project it uses, and returns the findings, the most
+// severe first. Records are only decrypted to tell which key they're under,
+// nothing is modified.
+func (cds *CloudDsStorage) SecurityAudit(ctx context.Context) ([]SecurityFinding, error) {
+	ctx = withOpCategory(ctx, OpCategoryMaintenance)
+	findings := cds.configFindings()
+
+	a := &recordAudit{cds: cds, sigKeys: make(map[string][]string)}
+	for _, client := range cds.clients() {
+		for _, kind := range auditedKinds {
+			if err := a.scanKind(ctx, client, kind); err != nil {
+				return nil, err
+			}
+		}
+		if err := a.scanLocks(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+	findings = append(findings, a.findings()...)
+
+	rank := map[string]int{FindingHigh: 0, FindingMedium: 1, FindingLow: 2}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return rank[findings[i].Severity] < rank[findings[j].Severity]
+	})
+	return findings, nil
+}
+
+// configFindings returns the findings about the settings, without reading
+// any records.
+func (cds *CloudDsStorage) configFindings() []SecurityFinding {
+	var findings []SecurityFinding
+	add := func(severity, check, detail string) {
+		findings = append(findings, SecurityFinding{Severity: severity, Check: check, Detail: detail})
+	}
+
+	if cds.defaultKeySet {
+		add(FindingHigh, "default_key", fmt.Sprintf("The published default key is configured, it's only used to read records stored under it, generate a key for %s", EnvNameAESKey))
+	}
+	if len(cds.aesKey) == 0 {
+		add(FindingHigh, "no_key", "Records are stored unencrypted, there's no AES key")
+	}
+	if n := cds.defaultReads.Load(); n > 0 {
+		add(FindingHigh, "default_key_reads", fmt.Sprintf("%d records were read with the published default key since starting, store them again to encrypt them with the AES key", n))
+	}
+	if len(cds.signingKeys) == 0 {
+		add(FindingLow, "unsigned", fmt.Sprintf("Records aren't signed, set %s so they can't be substituted by someone with the AES key", EnvNameSigningKeys))
+	} else if cds.unsignedOK {
+		add(FindingMedium, "accept_unsigned", fmt.Sprintf("Unsigned records are accepted, unset %s once every record is signed", EnvNameAcceptUnsigned))
+	}
+	if cds.hashKey == nil && cds.nameKey == nil && !cds.fieldEnc {
+		add(FindingLow, "key_names", fmt.Sprintf("Domains and emails are readable in key names, set %s to encrypt them", EnvNameNameKey))
+	}
+	return findings
+}
+
+// isDefaultKey reports whether key is DefaultAESKeyB64.
+func isDefaultKey(key []byte) bool {
+	return len(key) > 0 && base64.StdEncoding.EncodeToString(key) == DefaultAESKeyB64
+}
+
+// recordAudit collects the records SecurityAudit found in each state.
+type recordAudit struct {
+	cds        *CloudDsStorage
+	plaintext  []string
+	defaultKey []string
+	unknownKey []string
+	siteKey    []string            // user records still under the AES key with EnvNameUserAESKey
+	sigKeys    map[string][]string // records by signing key ID, empty for unsigned
+	ownerless  []string
+}
+
+// scanKind checks the value and signature of every record of kind under the
+// storage's prefix and CA.
+func (a *recordAudit) scanKind(ctx context.Context, client dsClient, kind string) error {
+	base := a.cds.dsKey(kind, "").Name + "/"
+	q := datastore.NewQuery(kind).Namespace(a.cds.namespace)
+	for it := client.Run(ctx, q); ; {
+		var props datastore.PropertyList
+		k, err := it.Next(&props)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to scan %v: %w", kind, err)
+		}
+		if !strings.HasPrefix(k.Name, base) {
+			continue
+		}
+
+		var value []byte
+		var sigKeyID string
+		var chunked bool
+		for _, p := range props {
+			switch p.Name {
+			case "Value":
+				value, _ = p.Value.([]byte)
+			case "SigKeyID":
+				sigKeyID, _ = p.Value.(string)
+			case "Chunked":
+				chunked, _ = p.Value.(bool)
+			}
+		}
+		a.checkValue(kind, strings.TrimPrefix(k.Name, base), k.Name, value, chunked)
+		if len(a.cds.signingKeys) > 0 {
+			a.sigKeys[sigKeyID] = append(a.sigKeys[sigKeyID], k.Name)
+		}
+		if kind == SITE_RECORD {
+			a.checkLock(k.Name, props, "Lock", "LockOwner")
+		}
+	}
+}
+
+// scanLocks checks the owners of the lock records under the storage's prefix
+// and CA.
+func (a *recordAudit) scanLocks(ctx context.Context, client dsClient) error {
+	base := a.cds.dsKey(LOCK_RECORD, "").Name + "/"
+	q := datastore.NewQuery(LOCK_RECORD).Namespace(a.cds.namespace)
+	for it := client.Run(ctx, q); ; {
+		var props datastore.PropertyList
+		k, err := it.Next(&props)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to scan %v: %w", LOCK_RECORD, err)
+		}
+		if strings.HasPrefix(k.Name, base) {
+			a.checkLock(k.Name, props, "Expires", "Owner")
+		}
+	}
+}
+
+// checkLock records name if it's locked, its expiry property is in the
+// future, without an owner property, as only older versions lock records.
+func (a *recordAudit) checkLock(name string, props datastore.PropertyList, expiresProp, ownerProp string) {
+	var expires time.Time
+	var owner string
+	for _, p := range props {
+		switch p.Name {
+		case expiresProp:
+			expires, _ = p.Value.(time.Time)
+		case ownerProp:
+			owner, _ = p.Value.(string)
+		}
+	}
+	if owner == "" && expires.After(a.cds.clock.Now()) {
+		a.ownerless = append(a.ownerless, name)
+	}
+}
+
+// checkValue records which key value is encrypted with when it isn't the one
+// the record would be stored with now. key is the record's key name relative
+// to the storage's prefix and CA, name its full key name.
+func (a *recordAudit) checkValue(kind, key, name string, value []byte, chunked bool) {
+	if len(value) == 0 {
+		// certificates kept in plaintext with EnvNameFieldEncryption
+		return
+	}
+	if bytes.HasPrefix(value, []byte(valuePrefix)) || bytes.HasPrefix(value, []byte(compressedPrefix)) {
+		a.plaintext = append(a.plaintext, name)
+		return
+	}
+	open := decryptWith
+	if chunked {
+		open = func(key, value []byte) ([]byte, error) {
+			return io.ReadAll(newChunkReader(key, bytes.NewReader(value)))
+		}
+	}
+
+	if a.cds.userAESKey != nil {
+		if _, err := open(a.cds.userAESKey, value); err == nil {
+			return
+		}
+	}
+	if len(a.cds.aesKey) > 0 {
+		if _, err := open(a.cds.aesKey, value); err == nil {
+			account := kind == USER_RECORD || (kind == KV_RECORD && isAccountKVKey(key))
+			if account && a.cds.userAESKey != nil {
+				a.siteKey = append(a.siteKey, name)
+			}
+			return
+		}
+	}
+	if _, err := open(defaultAESKey, value); err == nil {
+		a.defaultKey = append(a.defaultKey, name)
+		return
+	}
+	if len(a.cds.aesKey) > 0 {
+		a.unknownKey = append(a.unknownKey, name)
+	}
+}
+
+// findings returns the findings about the scanned records.
+func (a *recordAudit) findings() []SecurityFinding {
+	var findings []SecurityFinding
+	add := func(severity, check, detail string, keys []string) {
+		if len(keys) > 0 {
+			findings = append(findings, SecurityFinding{Severity: severity, Check: check, Detail: fmt.Sprintf(detail, len(keys)), Keys: keys})
+		}
+	}
+
+	add(FindingHigh, "plaintext_records", "%d records are stored unencrypted", a.plaintext)
+	add(FindingHigh, "default_key_records", "%d records are encrypted with the published default key", a.defaultKey)
+	add(FindingMedium, "unknown_key_records", "%d records can't be decrypted with the configured keys, they may be under a previous key", a.unknownKey)
+	add(FindingLow, "site_key_user_records", "%d user records are still encrypted with the site AES key, store them again to use "+EnvNameUserAESKey, a.siteKey)
+	add(FindingLow, "ownerless_locks", "%d locks are held without an owner, by an older version", a.ownerless)
+
+	if len(a.cds.signingKeys) > 0 {
+		add(FindingMedium, "unsigned_records", "%d records aren't signed", a.sigKeys[""])
+		var old, ids []string
+		for id, names := range a.sigKeys {
+			if id != "" && id != a.cds.signingKeys[0].id {
+				old = append(old, names...)
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		sort.Strings(old)
+		if len(old) > 0 {
+			findings = append(findings, SecurityFinding{
+				Severity: FindingLow,
+				Check:    "old_signing_key_records",
+				Detail:   fmt.Sprintf("%d records are signed with previous keys %s, store them again before removing them", len(old), strings.Join(ids, ", ")),
+				Keys:     old,
+			})
+		}
+	}
+	return findings
+}
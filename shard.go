@@ -0,0 +1,69 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// shardOf returns the shard of domain when site keys are split across n shards.
+func shardOf(domain string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(domain)))
+	return int(h.Sum32() % uint32(n))
+}
+
+// shardName returns the zero padded key segment of a shard, so shards sort
+// in order in the Datastore console.
+func (cds *CloudDsStorage) shardName(shard int) string {
+	return fmt.Sprintf("%0*d", len(strconv.Itoa(cds.shards-1)), shard)
+}
+
+// Shards returns the number of shards site keys are split across, 0 if
+// sharding isn't enabled.
+func (cds *CloudDsStorage) Shards() int {
+	return cds.shards
+}
+
+// ShardOf returns the shard a domain's site record is stored in.
+func (cds *CloudDsStorage) ShardOf(domain string) (int, error) {
+	if cds.shards == 0 {
+		return 0, fmt.Errorf("Sharding isn't enabled, set %s", EnvNameShards)
+	}
+	return shardOf(domain, cds.shards), nil
+}
+
+// SiteDomainsInShard returns the domains with a site record in shard, across
+// the default and any routed projects. Each shard is a separate key range so
+// jobs over large fleets can work on shards in parallel.
+func (cds *CloudDsStorage) SiteDomainsInShard(ctx context.Context, shard int) ([]string, error) {
+	if cds.shards == 0 {
+		return nil, fmt.Errorf("Sharding isn't enabled, set %s", EnvNameShards)
+	}
+	if shard < 0 || shard >= cds.shards {
+		return nil, fmt.Errorf("Invalid shard %d, must be less than %d", shard, cds.shards)
+	}
+
+	var domains []string
+	seen := make(map[string]bool) // a site may also be under its plain or hashed name
+	for _, client := range cds.clients() {
+		keys, err := cds.namesUnder(ctx, client, SITE_RECORD, path.Join("sites", cds.shardName(shard)))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to query shard %d: %w", shard, err)
+		}
+		for _, k := range keys {
+			domain, err := cds.siteDomainOf(ctx, client, k)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return domains, nil
+}
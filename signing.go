@@ -0,0 +1,115 @@
+package tlsclouddatastore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// SigningKey is an HMAC key records are signed with, see EnvNameSigningKeys.
+// ID is stored with each signature so the key can be rotated.
+type SigningKey struct {
+	ID     string
+	KeyB64 string
+}
+
+type signingKey struct {
+	id  string
+	key []byte
+}
+
+// parseSigningKeys parses a comma separated list of `id=base64 key` entries.
+func parseSigningKeys(s string) ([]SigningKey, error) {
+	var keys []SigningKey
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			// the entry isn't quoted as it may be a key
+			return nil, fmt.Errorf("Invalid signing key in %s, expected id=key", EnvNameSigningKeys)
+		}
+		keys = append(keys, SigningKey{ID: parts[0], KeyB64: parts[1]})
+	}
+	return keys, nil
+}
+
+// decodeSigningKeys decodes keys, the first of which new records are signed
+// with.
+func decodeSigningKeys(keys []SigningKey) ([]signingKey, error) {
+	var decoded []signingKey
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if seen[k.ID] {
+			return nil, fmt.Errorf("Duplicate signing key %q", k.ID)
+		}
+		seen[k.ID] = true
+		b, err := base64.StdEncoding.DecodeString(k.KeyB64)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("Unable to decode signing key %q from %s", k.ID, EnvNameSigningKeys)
+		}
+		decoded = append(decoded, signingKey{id: k.ID, key: b})
+	}
+	return decoded, nil
+}
+
+// recordMAC returns the signature of a record of kind for name, over its
+// encrypted value and any plaintext field, so it can't be moved to another
+// name or kind.
+func recordMAC(key []byte, kind, name string, value, plain []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	for _, part := range [][]byte{[]byte(kind), []byte(name), value, plain} {
+		writeLenPrefixed(m, part)
+	}
+	return m.Sum(nil)
+}
+
+func writeLenPrefixed(h hash.Hash, b []byte) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+	h.Write(n[:])
+	h.Write(b)
+}
+
+// sign signs r, a record of kind for name, with the current signing key, if
+// EnvNameSigningKeys is set. plain is any plaintext field kept next to Value.
+func (cds *CloudDsStorage) sign(r *cdsEncryptedRecord, kind, name string, plain []byte) {
+	if len(cds.signingKeys) == 0 {
+		return
+	}
+	k := cds.signingKeys[0]
+	r.Sig = recordMAC(k.key, kind, name, r.Value, plain)
+	r.SigKeyID = k.id
+}
+
+// verify returns ErrSignature unless r, a record of kind for name, is signed
+// with one of the signing keys, when EnvNameSigningKeys is set. Unsigned
+// records are accepted with EnvNameAcceptUnsigned, while existing records are
+// being signed.
+func (cds *CloudDsStorage) verify(r *cdsEncryptedRecord, kind, name string, plain []byte) error {
+	if len(cds.signingKeys) == 0 {
+		return nil
+	}
+	if len(r.Sig) == 0 {
+		if cds.unsignedOK {
+			return nil
+		}
+		return fmt.Errorf("%w: %v is unsigned", ErrSignature, name)
+	}
+	for _, k := range cds.signingKeys {
+		if k.id != r.SigKeyID {
+			continue
+		}
+		if !hmac.Equal(r.Sig, recordMAC(k.key, kind, name, r.Value, plain)) {
+			return fmt.Errorf("%w: %v doesn't match its signature", ErrSignature, name)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %v is signed with unknown key %q", ErrSignature, name, r.SigKeyID)
+}
@@ -0,0 +1,181 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// cdsSiteLabelRecord is the labels of a site. Unlike EnvNameLabels, which
+// every record carries, they're set per site and indexed so sites can be
+// listed by them.
+type cdsSiteLabelRecord struct {
+	cdsEncryptedRecord
+	SiteLabels []string // `key=value`
+}
+
+// siteLabelKey is separate from the site's key so labels outlive the site
+// record being replaced on renewal.
+func (cds *CloudDsStorage) siteLabelKey(domain string) *datastore.Key {
+	return cds.dsKey(SITE_LABEL_RECORD, path.Join("labels", cds.nameSegment(escapeWildcard(domain))))
+}
+
+// SetSiteLabels replaces the labels of domain, eg `team=payments` or
+// `env=prod`, which SitesWithLabel lists sites by, removing them if labels
+// is empty. They're kept in plaintext to be queried, so they shouldn't hold
+// anything sensitive; SetSiteAnnotation is for metadata that may.
+func (cds *CloudDsStorage) SetSiteLabels(ctx context.Context, domain string, labels map[string]string) error {
+	if err := validDomain(domain); err != nil {
+		return err
+	}
+	k := cds.siteLabelKey(domain)
+	if len(labels) == 0 {
+		if err := cds.siteClient(domain).Delete(ctx, k); err != nil {
+			return fmt.Errorf("Unable to delete labels of %v: %w", domain, err)
+		}
+		return nil
+	}
+	for key := range labels {
+		if err := validLabelKey(key); err != nil {
+			return err
+		}
+	}
+
+	r := &cdsSiteLabelRecord{SiteLabels: labelStrings(labels)}
+	cds.stamp(&r.cdsEncryptedRecord)
+	if err := cds.stampName(&r.cdsEncryptedRecord, domain); err != nil {
+		return fmt.Errorf("Unable to store labels of %v: %w", domain, err)
+	}
+	if _, err := cds.siteClient(domain).Put(ctx, k, r); err != nil {
+		return fmt.Errorf("Unable to store labels of %v: %w", domain, err)
+	}
+	return nil
+}
+
+// SiteLabels returns the labels of domain set with SetSiteLabels, none if it
+// has none.
+func (cds *CloudDsStorage) SiteLabels(ctx context.Context, domain string) (map[string]string, error) {
+	if err := validDomain(domain); err != nil {
+		return nil, err
+	}
+	r := new(cdsSiteLabelRecord)
+	err := cds.siteClient(domain).Get(ctx, cds.siteLabelKey(domain), r)
+	if err == datastore.ErrNoSuchEntity {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to obtain labels of %v: %w", domain, err)
+	}
+	return r.labels(), nil
+}
+
+// validLabelKey checks key can be set with SetSiteLabels and listed by.
+func validLabelKey(key string) error {
+	if key == "" || strings.Contains(key, "=") {
+		return fmt.Errorf("Invalid label %q, keys must be set and can't contain =", key)
+	}
+	return nil
+}
+
+func (r *cdsSiteLabelRecord) labels() map[string]string {
+	labels := make(map[string]string, len(r.SiteLabels))
+	for _, l := range r.SiteLabels {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+	return labels
+}
+
+// SitesWithLabel returns the domains labelled key=value with SetSiteLabels,
+// in every project the storage uses, Caddy v1 sites and CertMagic
+// certificates alike.
+func (cds *CloudDsStorage) SitesWithLabel(ctx context.Context, key, value string) ([]string, error) {
+	if err := validLabelKey(key); err != nil {
+		return nil, err
+	}
+	// an equality filter is served by the built-in index, the key prefix
+	// limits the results to this storage's records
+	base := cds.dsKey(SITE_LABEL_RECORD, "labels").Name + "/"
+	q := datastore.NewQuery(SITE_LABEL_RECORD).
+		Namespace(cds.namespace).
+		FilterField("SiteLabels", "=", key+"="+value).
+		KeysOnly()
+
+	var domains []string
+	for _, client := range cds.clients() {
+		for it := client.Run(ctx, q); ; {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to query sites labelled %v=%v: %w", key, value, err)
+			}
+			if !strings.HasPrefix(k.Name, base) {
+				continue
+			}
+			domain, err := cds.siteDomainOf(ctx, client, k)
+			if err != nil {
+				return nil, err
+			}
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+// LabelledSite is a site listed by ListSitesByLabel.
+type LabelledSite struct {
+	Domain   string            `json:"domain"`
+	Labels   map[string]string `json:"labels"`
+	Modified time.Time         `json:"modified"` // when its labels were last set
+}
+
+// ListSitesByLabel returns the sites labelled key=value with all their
+// labels, most recently labelled first, in every project the storage uses.
+func (cds *CloudDsStorage) ListSitesByLabel(ctx context.Context, key, value string) ([]LabelledSite, error) {
+	if err := validLabelKey(key); err != nil {
+		return nil, err
+	}
+	// like SitesWithLabel only filtered, so the built-in index serves it,
+	// and sorted once read rather than needing a composite index
+	base := cds.dsKey(SITE_LABEL_RECORD, "labels").Name + "/"
+	q := datastore.NewQuery(SITE_LABEL_RECORD).
+		Namespace(cds.namespace).
+		FilterField("SiteLabels", "=", key+"="+value)
+
+	var sites []LabelledSite
+	for _, client := range cds.clients() {
+		for it := client.Run(ctx, q); ; {
+			r := new(cdsSiteLabelRecord)
+			k, err := it.Next(r)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to query sites labelled %v=%v: %w", key, value, err)
+			}
+			if !strings.HasPrefix(k.Name, base) {
+				continue
+			}
+			domain, err := cds.siteDomainOf(ctx, client, k)
+			if err != nil {
+				return nil, err
+			}
+			sites = append(sites, LabelledSite{Domain: domain, Labels: r.labels(), Modified: r.Modified})
+		}
+	}
+	// most recent first, merged across projects
+	sort.SliceStable(sites, func(i, j int) bool {
+		return sites[i].Modified.After(sites[j].Modified)
+	})
+	return sites, nil
+}
@@ -0,0 +1,176 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// siteLockTTL is how long a site lock lasts, time to obtain a certificate
+// before another instance may try.
+const siteLockTTL = 30 * time.Second
+
+// siteLockKey is where the lock of a site that hasn't been stored yet is
+// kept, so locking a new domain doesn't write a site record without a
+// certificate that SiteExists and LoadSite would have to tell apart.
+func (cds *CloudDsStorage) siteLockKey(domain string) *datastore.Key {
+	return cds.dsKey(LOCK_RECORD, path.Join("sites", cds.nameSegment(escapeWildcard(domain))))
+}
+
+// hasSite returns whether r holds a site rather than only the lock older
+// versions wrote when locking a new domain.
+func (r *cdsEncryptedRecordWithLock) hasSite() bool {
+	return len(r.Value) > 0 || len(r.Cert) > 0
+}
+
+// lockNewSite takes the lock record of domain, which has no site yet,
+// returning its expiry if it's already held, zero once it's taken.
+func (cds *CloudDsStorage) lockNewSite(ctx context.Context, domain string) (time.Time, error) {
+	k := cds.siteLockKey(domain)
+	var held time.Time
+	var expired string // owner of the expired lock taken over
+	err := cds.siteClient(domain).RunInTransaction(ctx, func(tx dsTransaction) error {
+		l := new(cdsLockRecord)
+		err := tx.Get(k, l)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && cds.lockLive(l.Expires) {
+			held = l.Expires
+			return nil
+		}
+		expired = ""
+		if err == nil && l.Owner != cds.instanceID {
+			expired = l.Owner
+		}
+		now := cds.clock.Now()
+		l = &cdsLockRecord{Owner: cds.instanceID, Expires: lockTime(now.Add(siteLockTTL)), Modified: now, Labels: cds.labels}
+		_, err = tx.Put(k, l)
+		return err
+	})
+	if err == nil && held.IsZero() && expired != "" {
+		cds.lockTakenOver(domain, expired)
+	}
+	return held, err
+}
+
+// unlockNewSite deletes the lock record of domain if this instance holds it.
+func (cds *CloudDsStorage) unlockNewSite(ctx context.Context, domain string) error {
+	k := cds.siteLockKey(domain)
+	return cds.siteClient(domain).RunInTransaction(ctx, func(tx dsTransaction) error {
+		l := new(cdsLockRecord)
+		err := tx.Get(k, l)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if l.Owner != cds.instanceID {
+			// expired and taken over, left to the new holder
+			return nil
+		}
+		return tx.Delete(k)
+	})
+}
+
+// lockSite takes the lock of the stored site of domain, returning its expiry
+// if it's already held, zero once it's taken. The site is read and written
+// back in one transaction, so two instances can't both take an expired lock
+// or write back a site stored meanwhile.
+func (cds *CloudDsStorage) lockSite(ctx context.Context, domain string) (time.Time, error) {
+	k := cds.siteKey(domain)
+	var held time.Time
+	var expired string // owner of the expired lock taken over
+	err := cds.siteClient(domain).RunInTransaction(ctx, func(tx dsTransaction) error {
+		r, err := getFirstTx(tx, cds.siteKeys(domain))
+		if err != nil {
+			return err
+		}
+		if cds.lockLive(r.Lock) {
+			held = r.Lock
+			return nil
+		}
+		expired = ""
+		if r.LockOwner != cds.instanceID {
+			expired = r.LockOwner
+		}
+		// the owner is kept until the lock is released or the site stored
+		r.Lock = lockTime(cds.clock.Now().Add(siteLockTTL))
+		r.LockOwner = cds.instanceID
+		cds.stamp(&r.cdsEncryptedRecord)
+		if err := cds.stampName(&r.cdsEncryptedRecord, domain); err != nil {
+			return err
+		}
+		_, err = tx.Put(k, r)
+		return err
+	})
+	if err == nil && held.IsZero() && expired != "" {
+		cds.lockTakenOver(domain, expired)
+	}
+	return held, err
+}
+
+// unlockSite clears the lock of the stored site of domain if this instance
+// holds it.
+func (cds *CloudDsStorage) unlockSite(ctx context.Context, domain string) error {
+	k := cds.siteKey(domain)
+	return cds.siteClient(domain).RunInTransaction(ctx, func(tx dsTransaction) error {
+		r, err := getFirstTx(tx, cds.siteKeys(domain))
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !cds.lockLive(r.Lock) || cds.lockedByOther(r) {
+			// expired or taken over, left to the new holder
+			return nil
+		}
+		r.Lock = time.Time{}
+		r.LockOwner = ""
+		cds.stamp(&r.cdsEncryptedRecord)
+		if err := cds.stampName(&r.cdsEncryptedRecord, domain); err != nil {
+			return err
+		}
+		_, err = tx.Put(k, r)
+		return err
+	})
+}
+
+// getFirstTx is getFirst within tx.
+func getFirstTx(tx dsTransaction, keys []*datastore.Key) (*cdsEncryptedRecordWithLock, error) {
+	for _, k := range keys {
+		r := new(cdsEncryptedRecordWithLock)
+		if err := tx.Get(k, r); err != datastore.ErrNoSuchEntity {
+			return r, err
+		}
+	}
+	return nil, datastore.ErrNoSuchEntity
+}
+
+// siteLocked returns whether domain is locked, by its site record or, if it
+// hasn't been stored yet, its lock record.
+func (cds *CloudDsStorage) siteLocked(ctx context.Context, domain string) (bool, error) {
+	// only the lock is read, not the site
+	props, err := cds.projectFirst(ctx, cds.siteClient(domain), cds.siteKeys(domain), "Lock")
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	if err == nil && cds.lockLive(propTime(props, "Lock")) {
+		return true, nil
+	}
+
+	l := new(cdsLockRecord)
+	err = cds.siteClient(domain).Get(ctx, cds.siteLockKey(domain), l)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to obtain lock for %v: %w", domain, err)
+	}
+	return cds.lockLive(l.Expires), nil
+}
@@ -0,0 +1,54 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/internal/kv"
+)
+
+// DefaultSpannerTable is the Cloud Spanner table records are stored in.
+const DefaultSpannerTable = "caddytls"
+
+// NewSpannerStorage returns a storage for caURL keeping records in the Cloud
+// Spanner database cfg.SpannerDatabase of cfg.ProjectID rather than Cloud
+// Datastore, for multi-region synchronous replication with locks and
+// transactions that are strongly consistent across regions, see kvClient.
+func NewSpannerStorage(caURL *url.URL, cfg *Config) (*CloudDsStorage, error) {
+	if cfg.ProjectID == "" {
+		return nil, fmt.Errorf("Unable read project id from env var: %s", EnvNameProjectId)
+	}
+	instance, database, ok := strings.Cut(cfg.SpannerDatabase, "/")
+	if !ok || instance == "" || database == "" {
+		return nil, fmt.Errorf("Invalid Spanner database %q from %s, expected <instance>/<database>", cfg.SpannerDatabase, EnvNameSpannerDatabase)
+	}
+	if err := checkKVConfig(cfg, "Cloud Spanner"); err != nil {
+		return nil, err
+	}
+
+	o, err := backendClientOptions(cfg, "SPANNER_EMULATOR_HOST")
+	if err != nil {
+		return nil, err
+	}
+	db := fmt.Sprintf("projects/%s/instances/%s/databases/%s", cfg.ProjectID, instance, database)
+	client, err := spanner.NewClient(context.Background(), db, o...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create Cloud Spanner client: %w", err)
+	}
+	table := cfg.SpannerTable
+	if table == "" {
+		table = DefaultSpannerTable
+	}
+
+	cs, err := newCloudDsStorage(caURL, cfg, newKVClient(kv.NewSpanner(client, table)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.start(cfg, "Cloud Spanner "+cfg.SpannerDatabase+"/"+table); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
@@ -0,0 +1,169 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// DefaultSTEKRotationInterval is how often session ticket keys are rotated by default
+	DefaultSTEKRotationInterval = 10 * time.Hour
+
+	// MinSTEKRotationInterval is the shortest interval ShareSTEKs accepts, it checks for
+	// another instance's rotation every tenth of the interval
+	MinSTEKRotationInterval = time.Minute
+
+	// DefaultSTEKCount is how many session ticket keys are kept by default, the newest is used to
+	// encrypt new tickets and the rest to decrypt older ones
+	DefaultSTEKCount = 4
+)
+
+// cdsSTEKRecord holds the cluster's session ticket keys, encrypted in Value.
+type cdsSTEKRecord struct {
+	cdsEncryptedRecord
+	Version int64
+	Rotated time.Time
+}
+
+// stekState is the encrypted part of a cdsSTEKRecord.
+type stekState struct {
+	Keys [][32]byte // newest first
+}
+
+// stekName is the name of the session ticket keys record.
+const stekName = "session-ticket-keys"
+
+// stekKey is shared by all CAs, session tickets aren't specific to a CA.
+func (cds *CloudDsStorage) stekKey() *datastore.Key {
+	return cds.baseKey(STEK_RECORD, path.Join(cds.prefix, stekName))
+}
+
+// LoadSTEKs returns the cluster's TLS session ticket keys, newest first, and
+// their version which increases with each rotation. ErrNotExist is returned
+// if they've never been rotated.
+func (cds *CloudDsStorage) LoadSTEKs(ctx context.Context) ([][32]byte, int64, error) {
+	r := new(cdsSTEKRecord)
+	if err := cds.cloudDsClient.Get(ctx, cds.stekKey(), r); err != nil {
+		return nil, 0, fmt.Errorf("Unable to obtain session ticket keys: %w", notExist(err))
+	}
+	if err := cds.verify(&r.cdsEncryptedRecord, STEK_RECORD, stekName, nil); err != nil {
+		return nil, 0, err
+	}
+	state := new(stekState)
+	if err := cds.fromBytes(r.Value, state); err != nil {
+		return nil, 0, fmt.Errorf("Unable to decode session ticket keys: %w", err)
+	}
+	return state.Keys, r.Version, nil
+}
+
+// RotateSTEKs adds a new session ticket key if the newest is older than
+// interval, keeping at most count keys, and returns the current keys and
+// their version. It's safe to call from every instance, the rotation is
+// transactional so only one of them adds a key.
+func (cds *CloudDsStorage) RotateSTEKs(ctx context.Context, interval time.Duration, count int) ([][32]byte, int64, error) {
+	if count < 1 {
+		return nil, 0, fmt.Errorf("Invalid session ticket key count %d", count)
+	}
+
+	var keys [][32]byte
+	var version int64
+	err := cds.cloudDsClient.RunInTransaction(ctx, func(tx dsTransaction) error {
+		r := new(cdsSTEKRecord)
+		state := new(stekState)
+		err := tx.Get(cds.stekKey(), r)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+		case err != nil:
+			return err
+		default:
+			if err := cds.verify(&r.cdsEncryptedRecord, STEK_RECORD, stekName, nil); err != nil {
+				return err
+			}
+			if err := cds.fromBytes(r.Value, state); err != nil {
+				return fmt.Errorf("Unable to decode session ticket keys: %w", err)
+			}
+		}
+
+		keys, version = state.Keys, r.Version
+		if len(state.Keys) > 0 && cds.clock.Now().Sub(r.Rotated) < interval {
+			return nil
+		}
+
+		var k [32]byte
+		if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+			return fmt.Errorf("Unable to generate session ticket key: %w", err)
+		}
+		state.Keys = append([][32]byte{k}, state.Keys...)
+		if len(state.Keys) > count {
+			state.Keys = state.Keys[:count]
+		}
+
+		if r.Value, err = cds.toBytes(state); err != nil {
+			return fmt.Errorf("Unable to encode session ticket keys: %w", err)
+		}
+		cds.stamp(&r.cdsEncryptedRecord)
+		cds.sign(&r.cdsEncryptedRecord, STEK_RECORD, stekName, nil)
+		r.Version++
+		r.Rotated = r.Modified
+		if _, err := tx.Put(cds.stekKey(), r); err != nil {
+			return err
+		}
+		keys, version = state.Keys, r.Version
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to rotate session ticket keys: %w", err)
+	}
+	return keys, version, nil
+}
+
+// ShareSTEKs keeps config's session ticket keys in sync with the cluster's,
+// rotating them every interval, at least MinSTEKRotationInterval, until ctx
+// is done. Instances running it behind the same load balancer can resume
+// each others' TLS sessions.
+func (cds *CloudDsStorage) ShareSTEKs(ctx context.Context, config *tls.Config, interval time.Duration, count int) error {
+	if interval < MinSTEKRotationInterval {
+		return fmt.Errorf("Invalid session ticket key rotation interval %v, must be at least %v", interval, MinSTEKRotationInterval)
+	}
+
+	var current int64 = -1
+	update := func() error {
+		keys, version, err := cds.RotateSTEKs(ctx, interval, count)
+		if err != nil {
+			return err
+		}
+		if version != current {
+			config.SetSessionTicketKeys(keys)
+			current = version
+		}
+		return nil
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	go func() {
+		// check more often than the interval so instances pick up another's rotation promptly
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-cds.ctx.Done():
+				return
+			case <-cds.clock.After(interval / 10):
+				if err := update(); err != nil {
+					log.Printf("[WARNING] Unable to sync session ticket keys: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
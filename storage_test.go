@@ -1,32 +1,53 @@
 package tlsclouddatastore_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
 
 	"reflect"
+	"sort"
 
 	"context"
 
-	"os"
-
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/firestore"
 	"github.com/hashicorp/consul/api"
 	"github.com/j0hnsmith/caddy-tlsclouddatastore"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/dstest"
 	"github.com/caddyserver/caddy/caddytls"
-	"google.golang.org/api/iterator"
+	"google.golang.org/grpc"
 )
 
 var consulClient *api.Client
 
 const TestCaUrl = "https://acme-staging.api.letsencrypt.org/directory"
 
-// these tests need a Cloud Datastore emulator `gcloud beta emulators datastore start`
+// these tests run against the Cloud Datastore emulator, started unless DATASTORE_EMULATOR_HOST is set
 // https://cloud.google.com/datastore/docs/tools/datastore-emulator
+// or against a real project in a disposable namespace with `-dstest.project`
+func TestMain(m *testing.M) {
+	dstest.Main(m)
+}
+
 func setupStorage(t *testing.T) caddytls.Storage {
-	truncateDs(t)
+	dstest.Truncate(t)
 
 	caurl, _ := url.Parse(TestCaUrl)
 	cs, err := tlsclouddatastore.NewCloudDatastoreStorage(caurl)
@@ -38,36 +59,6 @@ func setupStorage(t *testing.T) caddytls.Storage {
 	return cs
 }
 
-func truncateDs(t *testing.T) {
-	projectID := os.Getenv(tlsclouddatastore.EnvNameProjectId)
-	if projectID == "" {
-		t.Fatalf("Unable read project id from env var: %s", tlsclouddatastore.EnvNameProjectId)
-	}
-
-	cloudDsClient, err := datastore.NewClient(context.TODO(), projectID)
-	if err != nil {
-		t.Fatalf("Unable to create Cloud Datastore client: %v", err)
-	}
-
-	recordTypes := []string{tlsclouddatastore.USER_RECORD, tlsclouddatastore.SITE_RECORD, tlsclouddatastore.MOST_RECENT_USER_RECORD}
-	for _, rt := range recordTypes {
-		q := datastore.NewQuery(rt).KeysOnly()
-		for it := cloudDsClient.Run(context.TODO(), q); ; {
-			key, err := it.Next(nil)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			if err := cloudDsClient.Delete(context.TODO(), key); err != nil {
-				t.Fatal(err)
-			}
-		}
-	}
-}
-
 func getUser() *caddytls.UserData {
 	return &caddytls.UserData{
 		Reg: []byte("registration"),
@@ -83,6 +74,36 @@ func getSite() *caddytls.SiteData {
 	}
 }
 
+// getSiteWithCert returns site data with a self signed certificate for domain
+// expiring at notAfter.
+func getSiteWithCert(t *testing.T, domain string, notAfter time.Time) *caddytls.SiteData {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(notAfter.Unix()),
+		Subject:      pkix.Name{CommonName: domain},
+		Issuer:       pkix.Name{CommonName: "Test CA"},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-time.Hour * 24 * 90),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+	return &caddytls.SiteData{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		Meta: []byte("meta"),
+	}
+}
+
 func TestMostRecentUserEmail(t *testing.T) {
 	gds := setupStorage(t)
 
@@ -288,3 +309,865 @@ func TestDistributedLockUnlock(t *testing.T) {
 		t.Fatalf("Error when unlocking: %v", err)
 	}
 }
+
+func TestWildcardSite(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+
+	defaultSite := getSite()
+	err := gds.StoreSite("*.test.com", defaultSite)
+	if err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	site, err := gds.LoadSite("*.test.com")
+	if err != nil {
+		t.Fatalf("Error loading site: %v", err)
+	}
+	if !reflect.DeepEqual(site, defaultSite) {
+		t.Fatalf("Loaded site is not the same like the saved one")
+	}
+
+	wildcard, ok, err := gds.CoveringWildcard("tls.test.com")
+	if err != nil {
+		t.Fatalf("Error finding covering wildcard: %v", err)
+	}
+	if !ok || wildcard != "*.test.com" {
+		t.Fatalf("Expected *.test.com to cover tls.test.com, got '%s'", wildcard)
+	}
+
+	// wildcards only cover a single label
+	_, ok, err = gds.CoveringWildcard("a.tls.test.com")
+	if err != nil {
+		t.Fatalf("Error finding covering wildcard: %v", err)
+	}
+	if ok {
+		t.Fatal("*.test.com shouldn't cover a.tls.test.com")
+	}
+}
+
+func newStorageForCA(t *testing.T, ca string) caddytls.Storage {
+	caurl, _ := url.Parse(ca)
+	cs, err := tlsclouddatastore.NewCloudDatastoreStorage(caurl)
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	return cs
+}
+
+func TestCAPathNamespace(t *testing.T) {
+	dstest.Truncate(t)
+	v1 := newStorageForCA(t, "https://acme.example.com/directory")
+	v2 := newStorageForCA(t, "https://acme.example.com/v2/directory")
+	domain := "tls.test.com"
+
+	if err := v1.StoreSite(domain, getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	exists, err := v2.SiteExists(domain)
+	if err != nil {
+		t.Fatalf("Error checking if site exists: %v", err)
+	}
+	if exists {
+		t.Fatal("Site stored for one CA path shouldn't exist for another")
+	}
+}
+
+func TestCAPathNamespaceReadsHostOnlyRecords(t *testing.T) {
+	dstest.Truncate(t)
+	// a CA URL without a path stores under the host only, the same as older versions
+	legacy := newStorageForCA(t, "https://acme.example.com")
+	current := newStorageForCA(t, "https://acme.example.com/directory")
+	domain := "tls.test.com"
+
+	defaultSite := getSite()
+	if err := legacy.StoreSite(domain, defaultSite); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := legacy.StoreUser("test@test.com", getUser()); err != nil {
+		t.Fatalf("Error storing user: %v", err)
+	}
+
+	site, err := current.LoadSite(domain)
+	if err != nil {
+		t.Fatalf("Error loading site: %v", err)
+	}
+	if !reflect.DeepEqual(site, defaultSite) {
+		t.Fatalf("Loaded site is not the same like the saved one")
+	}
+	if email := current.MostRecentUserEmail(); email != "test@test.com" {
+		t.Fatalf("'%s' doesn't match 'test@test.com'", email)
+	}
+}
+
+func TestLoadNotExist(t *testing.T) {
+	gds := setupStorage(t)
+
+	_, err := gds.LoadSite("tls.test.com")
+	if !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist loading missing site, got: %v", err)
+	}
+
+	_, err = gds.LoadUser("test@test.com")
+	if !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist loading missing user, got: %v", err)
+	}
+}
+
+func TestLoadSiteWrongKey(t *testing.T) {
+	gds := setupStorage(t)
+	if err := gds.StoreSite("tls.test.com", getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	t.Setenv(tlsclouddatastore.EnvNameAESKey, "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	other := newStorageForCA(t, TestCaUrl)
+
+	_, err := other.LoadSite("tls.test.com")
+	if !errors.Is(err, tlsclouddatastore.ErrDecryption) {
+		t.Fatalf("Expected ErrDecryption loading site with the wrong key, got: %v", err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	defer gds.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := gds.LoadSiteContext(ctx, "tls.test.com"); err == nil {
+		t.Fatal("Expected an error loading site with a cancelled context")
+	}
+	if err := gds.StoreSiteContext(ctx, "tls.test.com", getSite()); err == nil {
+		t.Fatal("Expected an error storing site with a cancelled context")
+	}
+}
+
+func TestProjectRoutes(t *testing.T) {
+	if dstest.Real() {
+		t.Skip("Needs a second project")
+	}
+	unrouted := setupStorage(t)
+	t.Setenv(tlsclouddatastore.EnvNameProjectRoutes, "*.customer.com=customer-project")
+	routed := newStorageForCA(t, TestCaUrl)
+	domain := "www.customer.com"
+
+	if err := routed.StoreSite(domain, getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	defer routed.DeleteSite(domain)
+
+	exists, err := routed.SiteExists(domain)
+	if err != nil {
+		t.Fatalf("Error checking if site exists: %v", err)
+	}
+	if !exists {
+		t.Fatalf("Site should exist but doesn't: %s", domain)
+	}
+
+	exists, err = unrouted.SiteExists(domain)
+	if err != nil {
+		t.Fatalf("Error checking if site exists: %v", err)
+	}
+	if exists {
+		t.Fatal("Routed site shouldn't be stored in the default project")
+	}
+}
+
+func TestShards(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameShards, "4")
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+
+	domains := []string{"a.test.com", "b.test.com", "c.test.com", "d.test.com", "*.test.com"}
+	for _, d := range domains {
+		if err := gds.StoreSite(d, getSite()); err != nil {
+			t.Fatalf("Error storing site: %v", err)
+		}
+	}
+
+	var found []string
+	for shard := 0; shard < gds.Shards(); shard++ {
+		inShard, err := gds.SiteDomainsInShard(context.Background(), shard)
+		if err != nil {
+			t.Fatalf("Error listing shard %d: %v", shard, err)
+		}
+		for _, d := range inShard {
+			if s, _ := gds.ShardOf(d); s != shard {
+				t.Fatalf("%s listed in shard %d but belongs in %d", d, shard, s)
+			}
+		}
+		found = append(found, inShard...)
+	}
+
+	sort.Strings(domains)
+	sort.Strings(found)
+	if !reflect.DeepEqual(domains, found) {
+		t.Fatalf("Expected %v across all shards, found %v", domains, found)
+	}
+}
+
+func TestNamespacePerCA(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameNamespacePerCA, "true")
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	other := newStorageForCA(t, "https://acme.example.com/directory")
+	domain := "tls.test.com"
+
+	if gds.Namespace() == "" || gds.Namespace() == other.(*tlsclouddatastore.CloudDsStorage).Namespace() {
+		t.Fatalf("Expected a distinct namespace per CA, got '%s'", gds.Namespace())
+	}
+
+	if err := gds.StoreSite(domain, getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	defer gds.DeleteSite(domain)
+
+	exists, err := other.SiteExists(domain)
+	if err != nil {
+		t.Fatalf("Error checking if site exists: %v", err)
+	}
+	if exists {
+		t.Fatal("Site stored for one CA shouldn't exist for another")
+	}
+
+	cloudDsClient, err := dstest.NewClient(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloudDsClient.Close()
+	q := datastore.NewQuery(tlsclouddatastore.SITE_RECORD).Namespace(gds.Namespace()).KeysOnly()
+	keys, err := cloudDsClient.GetAll(context.TODO(), q, nil)
+	if err != nil {
+		t.Fatalf("Error querying namespace: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("Expected 1 site in namespace %s, found %d", gds.Namespace(), len(keys))
+	}
+}
+
+func TestLabels(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameLabels, "team=platform, environment=test")
+	gds := newStorageForCA(t, TestCaUrl)
+
+	if err := gds.StoreSite("tls.test.com", getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := gds.StoreUser("test@test.com", getUser()); err != nil {
+		t.Fatalf("Error storing user: %v", err)
+	}
+
+	cloudDsClient, err := dstest.NewClient(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloudDsClient.Close()
+	recordTypes := []string{tlsclouddatastore.USER_RECORD, tlsclouddatastore.SITE_RECORD, tlsclouddatastore.MOST_RECENT_USER_RECORD}
+	for _, rt := range recordTypes {
+		q := datastore.NewQuery(rt).Namespace(gds.(*tlsclouddatastore.CloudDsStorage).Namespace()).FilterField("Labels", "=", "team=platform").KeysOnly()
+		keys, err := cloudDsClient.GetAll(context.TODO(), q, nil)
+		if err != nil {
+			t.Fatalf("Error querying by label: %v", err)
+		}
+		if len(keys) != 1 {
+			t.Fatalf("Expected 1 %s labelled team=platform, found %d", rt, len(keys))
+		}
+	}
+}
+
+func TestUnaryInterceptors(t *testing.T) {
+	dstest.Truncate(t)
+	cfg, err := tlsclouddatastore.ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	var mu sync.Mutex
+	var methods []string
+	cfg.UnaryInterceptors = []grpc.UnaryClientInterceptor{
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			mu.Lock()
+			methods = append(methods, method)
+			mu.Unlock()
+			return invoker(ctx, method, req, reply, cc, opts...)
+		},
+	}
+	caurl, _ := url.Parse(TestCaUrl)
+	gds, err := tlsclouddatastore.NewCloudDatastoreStorageWithConfig(caurl, cfg)
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	defer gds.Close()
+
+	if err := gds.StoreSite("tls.test.com", getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range methods {
+		if strings.HasSuffix(m, "/Commit") {
+			return
+		}
+	}
+	t.Fatalf("Expected the commit storing the site intercepted, got %v", methods)
+}
+
+func TestLeadership(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameInstanceID, "instance-1")
+	gds1 := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	t.Setenv(tlsclouddatastore.EnvNameInstanceID, "instance-2")
+	gds2 := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+
+	l1, err := gds1.AcquireLeadership(ctx, "maintenance", time.Second*2)
+	if err != nil {
+		t.Fatalf("Error acquiring leadership: %v", err)
+	}
+
+	if _, err := gds2.AcquireLeadership(ctx, "maintenance", time.Second*2); !errors.Is(err, tlsclouddatastore.ErrConflict) {
+		t.Fatalf("Expected ErrConflict acquiring leadership held by another instance, got: %v", err)
+	}
+
+	if err := l1.Renew(ctx); err != nil {
+		t.Fatalf("Error renewing leadership: %v", err)
+	}
+
+	if err := l1.Release(ctx); err != nil {
+		t.Fatalf("Error releasing leadership: %v", err)
+	}
+
+	l2, err := gds2.AcquireLeadership(ctx, "maintenance", time.Millisecond*100)
+	if err != nil {
+		t.Fatalf("Error acquiring released leadership: %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	if err := l2.Renew(ctx); !errors.Is(err, tlsclouddatastore.ErrConflict) {
+		t.Fatalf("Expected ErrConflict renewing expired leadership, got: %v", err)
+	}
+	if _, err := gds1.AcquireLeadership(ctx, "maintenance", time.Second*2); err != nil {
+		t.Fatalf("Error acquiring expired leadership: %v", err)
+	}
+}
+
+func TestSiteAudit(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	domain := "tls.test.com"
+	first := time.Now().Add(time.Hour * 24 * 30).Truncate(time.Second).UTC()
+	second := first.Add(time.Hour * 24 * 60)
+
+	if err := gds.StoreSite(domain, getSiteWithCert(t, domain, first)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := gds.StoreSite(domain, getSiteWithCert(t, domain, second)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	entries, err := gds.SiteAudit(context.Background(), domain)
+	if err != nil {
+		t.Fatalf("Error loading audit entries: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, found %d", len(entries))
+	}
+	if entries[0].Instance != gds.InstanceID() {
+		t.Fatalf("Expected instance %s, found %s", gds.InstanceID(), entries[0].Instance)
+	}
+	if !entries[0].PreviousNotAfter.IsZero() || !entries[0].NotAfter.Equal(first) {
+		t.Fatalf("Unexpected expiry in first entry: %v -> %v", entries[0].PreviousNotAfter, entries[0].NotAfter)
+	}
+	if !entries[1].PreviousNotAfter.Equal(first) || !entries[1].NotAfter.Equal(second) {
+		t.Fatalf("Unexpected expiry in renewal entry: %v -> %v", entries[1].PreviousNotAfter, entries[1].NotAfter)
+	}
+}
+
+func TestRotateSTEKs(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+
+	if _, _, err := gds.LoadSTEKs(ctx); !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist before first rotation, got: %v", err)
+	}
+
+	keys, version, err := gds.RotateSTEKs(ctx, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("Error rotating session ticket keys: %v", err)
+	}
+	if len(keys) != 1 || version != 1 {
+		t.Fatalf("Expected 1 key at version 1, got %d at version %d", len(keys), version)
+	}
+
+	// not due yet
+	again, version, err := gds.RotateSTEKs(ctx, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("Error rotating session ticket keys: %v", err)
+	}
+	if version != 1 || !reflect.DeepEqual(keys, again) {
+		t.Fatal("Session ticket keys shouldn't be rotated before the interval")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := gds.RotateSTEKs(ctx, 0, 2); err != nil {
+			t.Fatalf("Error rotating session ticket keys: %v", err)
+		}
+	}
+	loaded, version, err := gds.LoadSTEKs(ctx)
+	if err != nil {
+		t.Fatalf("Error loading session ticket keys: %v", err)
+	}
+	if len(loaded) != 2 || version != 3 {
+		t.Fatalf("Expected 2 keys at version 3, got %d at version %d", len(loaded), version)
+	}
+	if loaded[1] == keys[0] {
+		t.Fatal("Oldest key should have been dropped")
+	}
+}
+
+func TestStoreAndLoadOCSP(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+	domain := "tls.test.com"
+	serial := big.NewInt(1234)
+	nextUpdate := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	if err := gds.StoreOCSP(ctx, domain, serial, []byte("staple"), nextUpdate); err != nil {
+		t.Fatalf("Error storing OCSP response: %v", err)
+	}
+
+	staple, next, err := gds.LoadOCSP(ctx, domain, serial)
+	if err != nil {
+		t.Fatalf("Error loading OCSP response: %v", err)
+	}
+	if string(staple) != "staple" || !next.Equal(nextUpdate) {
+		t.Fatalf("Loaded OCSP response is not the same like the saved one")
+	}
+
+	// a renewed certificate has a different serial
+	if _, _, err := gds.LoadOCSP(ctx, domain, big.NewInt(5678)); !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist for another certificate, got: %v", err)
+	}
+
+	if err := gds.StoreOCSP(ctx, domain, serial, []byte("staple"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("Error storing OCSP response: %v", err)
+	}
+	if _, _, err := gds.LoadOCSP(ctx, domain, serial); !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist for a stale response, got: %v", err)
+	}
+}
+
+func TestDNSChallenge(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+	domain := "tls.test.com"
+
+	if err := gds.StoreDNSChallenge(ctx, domain, "token", "keyauth", time.Minute); err != nil {
+		t.Fatalf("Error storing challenge: %v", err)
+	}
+	c, err := gds.LoadDNSChallenge(ctx, domain)
+	if err != nil {
+		t.Fatalf("Error loading challenge: %v", err)
+	}
+	if c.Token != "token" || c.KeyAuth != "keyauth" {
+		t.Fatalf("Loaded challenge is not the same like the saved one")
+	}
+
+	if err := gds.StoreDNSChallenge(ctx, "expired.test.com", "token", "keyauth", -time.Minute); err != nil {
+		t.Fatalf("Error storing challenge: %v", err)
+	}
+	if _, err := gds.LoadDNSChallenge(ctx, "expired.test.com"); !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist for an expired challenge, got: %v", err)
+	}
+
+	n, err := gds.PruneChallenges(ctx)
+	if err != nil {
+		t.Fatalf("Error pruning challenges: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 expired challenge pruned, got %d", n)
+	}
+
+	if err := gds.DeleteDNSChallenge(ctx, domain); err != nil {
+		t.Fatalf("Error deleting challenge: %v", err)
+	}
+	if _, err := gds.LoadDNSChallenge(ctx, domain); !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist for a deleted challenge, got: %v", err)
+	}
+}
+
+func TestHTTPChallengeHandler(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	domain := "tls.test.com"
+
+	err := gds.StoreChallenge(context.Background(), &tlsclouddatastore.Challenge{
+		Type:    tlsclouddatastore.ChallengeHTTP01,
+		Domain:  domain,
+		Token:   "token",
+		KeyAuth: "token.keyauth",
+		Expires: time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("Error storing challenge: %v", err)
+	}
+
+	h := gds.HTTPChallengeHandler(http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://tls.test.com/.well-known/acme-challenge/token", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "token.keyauth" {
+		t.Fatalf("Expected key authorization, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://tls.test.com/.well-known/acme-challenge/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected unknown token to be passed on, got %d", w.Code)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+
+	if err := gds.Healthy(context.Background()); err != nil {
+		t.Fatalf("Expected storage healthy, got: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	gds.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := gds.Healthy(ctx); err == nil {
+		t.Fatal("Expected error checking health with a cancelled context")
+	}
+}
+
+func TestSitesExpiringBefore(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameFieldEncryption, "true")
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	soon := time.Now().Add(time.Hour * 24 * 10).Truncate(time.Second)
+	later := soon.Add(time.Hour * 24 * 60)
+
+	if err := gds.StoreSite("soon.test.com", getSiteWithCert(t, "soon.test.com", soon)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := gds.StoreSite("later.test.com", getSiteWithCert(t, "later.test.com", later)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	domains, err := gds.SitesExpiringBefore(context.Background(), soon.Add(time.Hour*24*30))
+	if err != nil {
+		t.Fatalf("Error querying expiring sites: %v", err)
+	}
+	if len(domains) != 1 || domains[0] != "soon.test.com" {
+		t.Fatalf("Expected only soon.test.com, found %v", domains)
+	}
+
+	site, err := gds.LoadSite("soon.test.com")
+	if err != nil {
+		t.Fatalf("Error loading site: %v", err)
+	}
+	if cert, _ := pem.Decode(site.Cert); cert == nil || string(site.Meta) != "meta" {
+		t.Fatalf("Expected the certificate and encrypted fields, got %+v", site)
+	}
+}
+
+func TestExpiryStats(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameFieldEncryption, "true")
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	soon := time.Now().Add(time.Hour * 24 * 10).Truncate(time.Second)
+	later := soon.Add(time.Hour * 24 * 60)
+
+	if err := gds.StoreSite("soon.test.com", getSiteWithCert(t, "soon.test.com", soon)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := gds.StoreSite("later.test.com", getSiteWithCert(t, "later.test.com", later)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	st, err := gds.ExpiryStats(context.Background())
+	if err != nil {
+		t.Fatalf("Error scanning expiry: %v", err)
+	}
+	if !st.Soonest.Equal(soon) || st.Within7d != 0 || st.Within14d != 1 || st.Within30d != 1 {
+		t.Fatalf("Expected only soon.test.com expiring within 14 days, got %+v", st)
+	}
+}
+
+func TestSiteKeyAccesses(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameAccessAudit, tlsclouddatastore.AccessAuditDatastore)
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+	domain := "tls.test.com"
+
+	if err := gds.StoreSite(domain, getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if _, err := gds.LoadSite(domain); err != nil {
+		t.Fatalf("Error loading site: %v", err)
+	}
+	if _, err := gds.LoadSiteContext(tlsclouddatastore.WithAccessReason(ctx, "export"), domain); err != nil {
+		t.Fatalf("Error loading site: %v", err)
+	}
+
+	entries, err := gds.SiteKeyAccesses(ctx, domain)
+	if err != nil {
+		t.Fatalf("Error loading key access entries: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 key access entries, found %d", len(entries))
+	}
+	if entries[0].Reason != tlsclouddatastore.AccessReasonLoad || entries[1].Reason != "export" {
+		t.Fatalf("Unexpected reasons %q and %q", entries[0].Reason, entries[1].Reason)
+	}
+	if entries[0].Instance != gds.InstanceID() {
+		t.Fatalf("Expected instance %s, found %s", gds.InstanceID(), entries[0].Instance)
+	}
+}
+
+func TestSecurityAudit(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameSigningKeys, "k1=c2lnbmluZy1rZXktMQ==")
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	if err := gds.StoreSite("tls.test.com", getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	t.Setenv(tlsclouddatastore.EnvNameSigningKeys, "k2=c2lnbmluZy1rZXktMg==,k1=c2lnbmluZy1rZXktMQ==")
+	gds = newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	findings, err := gds.SecurityAudit(context.Background())
+	if err != nil {
+		t.Fatalf("Error auditing: %v", err)
+	}
+
+	checks := make(map[string]tlsclouddatastore.SecurityFinding)
+	for _, f := range findings {
+		checks[f.Check] = f
+	}
+	if f, ok := checks["old_signing_key_records"]; !ok || len(f.Keys) != 1 {
+		t.Errorf("Expected the site signed with k1 reported, got %+v", findings)
+	}
+	if _, ok := checks["unknown_key_records"]; ok {
+		t.Errorf("Expected every record decrypted, got %+v", findings)
+	}
+}
+
+func TestIterateSites(t *testing.T) {
+	dstest.Truncate(t)
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	// one more than a page so the second page is read from the cursor
+	want := make(map[string]bool)
+	for i := 0; i <= tlsclouddatastore.IteratePageSize; i++ {
+		domain := fmt.Sprintf("site%d.test.com", i)
+		if err := gds.StoreSite(domain, getSite()); err != nil {
+			t.Fatalf("Error storing site: %v", err)
+		}
+		want[domain] = true
+	}
+
+	seen := make(map[string]bool)
+	err := gds.IterateSites(context.Background(), func(domain string, site *caddytls.SiteData) error {
+		if seen[domain] {
+			t.Errorf("%s returned twice", domain)
+		}
+		seen[domain] = true
+		if string(site.Key) != "key" {
+			t.Errorf("Unexpected key for %s: %s", domain, site.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error iterating sites: %v", err)
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("Expected %d sites, found %d", len(want), len(seen))
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = gds.IterateSites(context.Background(), func(string, *caddytls.SiteData) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Fatalf("Expected iteration stopped by the first error, got %v after %d sites", err, n)
+	}
+}
+
+func TestLoadSiteMeta(t *testing.T) {
+	dstest.Truncate(t)
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	for _, fieldEnc := range []string{"false", "true"} {
+		t.Setenv(tlsclouddatastore.EnvNameFieldEncryption, fieldEnc)
+		gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+		domain := "meta-" + fieldEnc + ".test.com"
+		ctx := context.Background()
+
+		if err := gds.StoreSiteContext(ctx, domain, getSiteWithCert(t, domain, notAfter)); err != nil {
+			t.Fatalf("Error storing site: %v", err)
+		}
+		meta, err := gds.LoadSiteMeta(ctx, domain)
+		if err != nil {
+			t.Fatalf("Error loading site meta: %v", err)
+		}
+		if !meta.NotAfter.Equal(notAfter) || meta.IssuerName != domain || meta.KeyType != "ECDSA P-256" || len(meta.SANs) != 1 || meta.SANs[0] != domain || meta.Modified.IsZero() {
+			t.Fatalf("Unexpected site meta with field encryption %s: %+v", fieldEnc, meta)
+		}
+
+		if _, err := gds.LoadSiteMeta(ctx, "missing.test.com"); !errors.Is(err, tlsclouddatastore.ErrNotExist) {
+			t.Fatalf("Expected ErrNotExist, got %v", err)
+		}
+	}
+}
+
+func TestSitesWithLabel(t *testing.T) {
+	dstest.Truncate(t)
+	t.Setenv(tlsclouddatastore.EnvNameHashKey, "aGFzaC1rZXk=")
+	gds := newStorageForCA(t, TestCaUrl).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+
+	labels := map[string]map[string]string{
+		"a.test.com": {"team": "payments", "env": "prod"},
+		"b.test.com": {"team": "payments", "env": "staging"},
+		"c.test.com": {"team": "search", "env": "prod"},
+	}
+	for domain, l := range labels {
+		if err := gds.SetSiteLabels(ctx, domain, l); err != nil {
+			t.Fatalf("Error setting labels of %v: %v", domain, err)
+		}
+	}
+
+	domains, err := gds.SitesWithLabel(ctx, "team", "payments")
+	if err != nil {
+		t.Fatalf("Error listing sites by label: %v", err)
+	}
+	sort.Strings(domains)
+	if !reflect.DeepEqual(domains, []string{"a.test.com", "b.test.com"}) {
+		t.Fatalf("Expected the payments sites, got %v", domains)
+	}
+
+	if err := gds.SetSiteLabels(ctx, "c.test.com", nil); err != nil {
+		t.Fatalf("Error removing labels: %v", err)
+	}
+	if domains, err = gds.SitesWithLabel(ctx, "env", "prod"); err != nil || !reflect.DeepEqual(domains, []string{"a.test.com"}) {
+		t.Fatalf("Expected only a.test.com in prod, got %v %v", domains, err)
+	}
+	if l, err := gds.SiteLabels(ctx, "b.test.com"); err != nil || l["env"] != "staging" {
+		t.Fatalf("Expected b.test.com labels, got %v %v", l, err)
+	}
+
+	// relabelled last, b.test.com is listed first
+	if err := gds.SetSiteLabels(ctx, "b.test.com", map[string]string{"team": "payments", "env": "prod"}); err != nil {
+		t.Fatalf("Error setting labels: %v", err)
+	}
+	sites, err := gds.ListSitesByLabel(ctx, "team", "payments")
+	if err != nil {
+		t.Fatalf("Error listing sites by label: %v", err)
+	}
+	if len(sites) != 2 || sites[0].Domain != "b.test.com" || sites[1].Domain != "a.test.com" || sites[0].Labels["env"] != "prod" {
+		t.Fatalf("Expected b.test.com then a.test.com, got %+v", sites)
+	}
+	if !sites[0].Modified.After(sites[1].Modified) {
+		t.Fatalf("Expected the most recently labelled first, got %+v", sites)
+	}
+}
+
+func TestIntegrityScan(t *testing.T) {
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	expires := time.Now().Add(time.Hour * 24 * 60)
+	if err := gds.StoreSite("ok.test.com", getSiteWithCert(t, "ok.test.com", expires)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	mismatched := getSiteWithCert(t, "mismatch.test.com", expires)
+	mismatched.Key = getSiteWithCert(t, "other.test.com", expires).Key
+	if err := gds.StoreSite("mismatch.test.com", mismatched); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := gds.StoreSite("garbage.test.com", getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := gds.StoreUser("test@test.com", getUser()); err != nil {
+		t.Fatalf("Error storing user: %v", err)
+	}
+
+	t.Setenv(tlsclouddatastore.EnvNameAESKey, "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	other := newStorageForCA(t, TestCaUrl)
+	if err := other.StoreSite("wrong.test.com", getSiteWithCert(t, "wrong.test.com", expires)); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+
+	report, err := gds.IntegrityScan(context.Background())
+	if err != nil {
+		t.Fatalf("Error scanning: %v", err)
+	}
+	if report.Scanned < 6 {
+		t.Errorf("Expected every record scanned, got %d", report.Scanned)
+	}
+	problems := make(map[string]string)
+	for _, issue := range report.Issues {
+		problems[path.Base(issue.Key)] = issue.Problem
+	}
+	expected := map[string]string{
+		"mismatch.test.com": tlsclouddatastore.IntegrityKeyMismatch,
+		"garbage.test.com":  tlsclouddatastore.IntegrityCertificate,
+		"wrong.test.com":    tlsclouddatastore.IntegrityDecryption,
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected issues %v, got %v", expected, problems)
+	}
+}
+
+func TestMigrateToFirestore(t *testing.T) {
+	if dstest.Real() || os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Needs the Datastore and Firestore emulators, set FIRESTORE_EMULATOR_HOST")
+	}
+	gds := setupStorage(t).(*tlsclouddatastore.CloudDsStorage)
+	ctx := context.Background()
+	if err := gds.StoreSite("tls.test.com", getSite()); err != nil {
+		t.Fatalf("Error storing site: %v", err)
+	}
+	if err := gds.StoreUser("test@test.com", getUser()); err != nil {
+		t.Fatalf("Error storing user: %v", err)
+	}
+
+	fs, err := firestore.NewClient(ctx, "dstest")
+	if err != nil {
+		t.Fatalf("Error creating Firestore client: %v", err)
+	}
+	defer fs.Close()
+	progress := make(map[string]int)
+	opts := tlsclouddatastore.FirestoreMigrationOptions{BatchSize: 1, Progress: func(kind string, copied int) {
+		progress[kind] = copied
+	}}
+	copied, err := gds.MigrateToFirestore(ctx, fs, opts)
+	if err != nil {
+		t.Fatalf("Error migrating to Firestore: %v", err)
+	}
+	if copied < 3 || progress[tlsclouddatastore.SITE_RECORD] != 1 || progress[tlsclouddatastore.USER_RECORD] != 1 {
+		t.Fatalf("Expected at least the site and user records copied one per batch, got %d: %v", copied, progress)
+	}
+
+	cloudDsClient, err := dstest.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cloudDsClient.Close()
+	keys, err := cloudDsClient.GetAll(ctx, datastore.NewQuery(tlsclouddatastore.SITE_RECORD).KeysOnly(), nil)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Expected 1 site record, got %v: %v", keys, err)
+	}
+	doc, err := fs.Collection(tlsclouddatastore.SITE_RECORD).Doc(url.PathEscape(keys[0].Name)).Get(ctx)
+	if err != nil {
+		t.Fatalf("Error loading the site's document: %v", err)
+	}
+	if _, ok := doc.Data()["Value"]; !ok {
+		t.Errorf("Expected the site's properties copied, got %v", doc.Data())
+	}
+}
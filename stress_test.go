@@ -0,0 +1,124 @@
+package tlsclouddatastore_test
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddytls"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore"
+	"github.com/j0hnsmith/caddy-tlsclouddatastore/dstest"
+)
+
+// stress tests take minutes, run them with `go test -race -run Stress -stress`
+var stress = flag.Bool("stress", false, "run lock stress tests")
+
+const (
+	stressInstances  = 4
+	stressGoroutines = 8 // per instance
+	stressDomains    = 3
+	stressRounds     = 5 // per goroutine
+)
+
+// TestStressLocking hammers TryLock/StoreSite/Unlock on a few domains from
+// many goroutines of several instances. Each lock holder increments a counter
+// kept in the site's Meta, so two holders at once show up as a double acquire
+// and lost increments as lost updates.
+func TestStressLocking(t *testing.T) {
+	if !*stress {
+		t.Skip("run with -stress")
+	}
+	dstest.Truncate(t)
+
+	caURL, _ := url.Parse(TestCaUrl)
+	var instances []caddytls.Storage
+	for i := 0; i < stressInstances; i++ {
+		cs, err := tlsclouddatastore.NewCloudDatastoreStorage(caURL)
+		if err != nil {
+			t.Fatalf("Error creating storage: %v", err)
+		}
+		defer cs.(*tlsclouddatastore.CloudDsStorage).Close()
+		instances = append(instances, cs)
+	}
+
+	holders := make([]int32, stressDomains)
+	var doubleAcquires, errs int32
+	var wg sync.WaitGroup
+	for _, cs := range instances {
+		for g := 0; g < stressGoroutines; g++ {
+			wg.Add(1)
+			go func(cs caddytls.Storage) {
+				defer wg.Done()
+				for r := 0; r < stressRounds; r++ {
+					for d := 0; d < stressDomains; d++ {
+						if err := stressRound(cs, d, holders, &doubleAcquires); err != nil {
+							atomic.AddInt32(&errs, 1)
+							t.Log(err)
+						}
+					}
+				}
+			}(cs)
+		}
+	}
+	wg.Wait()
+
+	if errs > 0 {
+		t.Errorf("%d rounds failed", errs)
+	}
+	if doubleAcquires > 0 {
+		t.Errorf("Lock held by more than one goroutine at once %d times", doubleAcquires)
+	}
+	expected := stressInstances * stressGoroutines * stressRounds
+	for d := 0; d < stressDomains; d++ {
+		site, err := instances[0].LoadSite(stressDomain(d))
+		if err != nil {
+			t.Fatalf("Error loading site: %v", err)
+		}
+		if n, _ := strconv.Atoi(string(site.Meta)); n != expected {
+			t.Errorf("Expected %s counter %d, got %d (%d lost updates)", stressDomain(d), expected, n, expected-n)
+		}
+	}
+}
+
+func stressDomain(d int) string {
+	return fmt.Sprintf("stress%d.test.com", d)
+}
+
+// stressRound takes the lock of domain d, increments its counter and
+// releases the lock.
+func stressRound(cs caddytls.Storage, d int, holders []int32, doubleAcquires *int32) error {
+	domain := stressDomain(d)
+	for {
+		waiter, err := cs.TryLock(domain)
+		if err != nil {
+			return fmt.Errorf("Error locking %s: %v", domain, err)
+		}
+		if waiter == nil {
+			break
+		}
+		waiter.Wait()
+	}
+
+	if atomic.AddInt32(&holders[d], 1) > 1 {
+		atomic.AddInt32(doubleAcquires, 1)
+	}
+	n := 0
+	if site, err := cs.LoadSite(domain); err == nil {
+		n, _ = strconv.Atoi(string(site.Meta))
+	}
+	site := &caddytls.SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte(strconv.Itoa(n + 1))}
+	err := cs.StoreSite(domain, site)
+	// released before unlocking, so the next holder isn't counted as a double acquire
+	atomic.AddInt32(&holders[d], -1)
+	if unlockErr := cs.Unlock(domain); unlockErr != nil && err == nil {
+		return fmt.Errorf("Error unlocking %s: %v", domain, unlockErr)
+	}
+	if err != nil {
+		return fmt.Errorf("Error storing %s: %v", domain, err)
+	}
+	return nil
+}
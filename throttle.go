@@ -0,0 +1,147 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Rate is a number of issuances allowed per window, eg 300 per 3h.
+type Rate struct {
+	Limit  int
+	Window time.Duration
+}
+
+// ParseRate parses a rate of the form `<limit>/<window>`, eg `300/3h`.
+func ParseRate(s string) (Rate, error) {
+	limit, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("Invalid rate %q, expected <limit>/<window>", s)
+	}
+	var r Rate
+	var err error
+	if r.Limit, err = strconv.Atoi(limit); err != nil || r.Limit <= 0 {
+		return Rate{}, fmt.Errorf("Invalid rate limit %q", limit)
+	}
+	if r.Window, err = time.ParseDuration(window); err != nil || r.Window <= 0 {
+		return Rate{}, fmt.Errorf("Invalid rate window %q", window)
+	}
+	return r, nil
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Limit, r.Window)
+}
+
+// refill returns tokens topped up for elapsed, up to the limit.
+func (r Rate) refill(tokens float64, elapsed time.Duration) float64 {
+	if elapsed > 0 {
+		tokens += float64(r.Limit) * float64(elapsed) / float64(r.Window)
+	}
+	if tokens > float64(r.Limit) {
+		tokens = float64(r.Limit)
+	}
+	return tokens
+}
+
+// wait returns how long until tokens reach a whole one.
+func (r Rate) wait(tokens float64) time.Duration {
+	return time.Duration((1 - tokens) * float64(r.Window) / float64(r.Limit))
+}
+
+// cdsThrottleRecord is a token bucket shared by the cluster, issuing a
+// certificate takes a token.
+type cdsThrottleRecord struct {
+	Tokens   float64 `datastore:",noindex"`
+	Modified time.Time
+	Labels   []string
+}
+
+// throttleBucket is a bucket an issuance takes a token from.
+type throttleBucket struct {
+	key  *datastore.Key
+	rate Rate
+}
+
+// registeredDomain returns the domain under a public suffix domain belongs
+// to, which CAs rate limit by, or domain itself if it has none, eg an IP.
+func registeredDomain(domain string) string {
+	domain = strings.TrimPrefix(strings.ToLower(domain), "*.")
+	if registered, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return registered
+	}
+	return domain
+}
+
+// throttleBuckets returns the buckets an issuance of domain takes a token
+// from, none if issuance isn't throttled.
+func (cds *CloudDsStorage) throttleBuckets(domain string) []throttleBucket {
+	var buckets []throttleBucket
+	if cds.issuanceRate.Limit > 0 {
+		buckets = append(buckets, throttleBucket{key: cds.dsKey(THROTTLE_RECORD, "throttle/account"), rate: cds.issuanceRate})
+	}
+	if cds.domainRate.Limit > 0 {
+		k := cds.dsKey(THROTTLE_RECORD, path.Join("throttle/domains", cds.nameSegment(registeredDomain(domain))))
+		buckets = append(buckets, throttleBucket{key: k, rate: cds.domainRate})
+	}
+	return buckets
+}
+
+// takeIssuance takes a token to obtain or renew the certificate of domain
+// from every bucket of EnvNameIssuanceRate and EnvNameDomainIssuanceRate,
+// returning ErrThrottled without taking any if one of them is empty, so the
+// cluster as a whole keeps to the CA's rate limits.
+func (cds *CloudDsStorage) takeIssuance(ctx context.Context, domain string) error {
+	buckets := cds.throttleBuckets(domain)
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	var wait time.Duration
+	err := cds.cloudDsClient.RunInTransaction(ctx, func(tx dsTransaction) error {
+		wait = 0
+		now := cds.clock.Now()
+		records := make([]*cdsThrottleRecord, len(buckets))
+		for i, b := range buckets {
+			r := new(cdsThrottleRecord)
+			err := tx.Get(b.key, r)
+			if err == datastore.ErrNoSuchEntity {
+				r.Tokens, r.Modified = float64(b.rate.Limit), now
+			} else if err != nil {
+				return err
+			}
+			r.Tokens = b.rate.refill(r.Tokens, now.Sub(r.Modified))
+			if r.Tokens < 1 {
+				if w := b.rate.wait(r.Tokens); w > wait {
+					wait = w
+				}
+			}
+			records[i] = r
+		}
+		if wait > 0 {
+			return nil
+		}
+		for i, b := range buckets {
+			r := records[i]
+			r.Tokens--
+			r.Modified, r.Labels = now, cds.labels
+			if _, err := tx.Put(b.key, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to throttle issuance of %v: %w", domain, err)
+	}
+	if wait > 0 {
+		return fmt.Errorf("Issuance of %v throttled, retry in %v: %w", domain, wait.Round(time.Second), ErrThrottled)
+	}
+	return nil
+}
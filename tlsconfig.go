@@ -0,0 +1,35 @@
+package tlsclouddatastore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// clientTLSConfig returns the TLS settings of Cloud Datastore connections, nil
+// for the defaults. A CA file is trusted as well as the system roots.
+func clientTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.CAFile == "" {
+		return cfg.TLSConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA file %s: %w", cfg.CAFile, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Unable to read CA file %s: no PEM certificates found", cfg.CAFile)
+	}
+
+	t := new(tls.Config)
+	if cfg.TLSConfig != nil {
+		t = cfg.TLSConfig.Clone()
+	}
+	t.RootCAs = pool
+	return t, nil
+}
@@ -0,0 +1,59 @@
+package tlsclouddatastore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientTLSConfig(t *testing.T) {
+	if c, err := clientTLSConfig(&Config{}); err != nil || c != nil {
+		t.Fatalf("Expected the default TLS settings, got %v: %v", c, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Corp Root"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error writing CA file: %v", err)
+	}
+
+	c, err := clientTLSConfig(&Config{CAFile: caFile, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS13}})
+	if err != nil {
+		t.Fatalf("Error reading CA file: %v", err)
+	}
+	if c.MinVersion != tls.VersionTLS13 {
+		t.Error("Expected other TLS settings kept")
+	}
+	cert, _ := x509.ParseCertificate(der)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: c.RootCAs}); err != nil {
+		t.Errorf("Expected the CA file trusted: %v", err)
+	}
+
+	if _, err := clientTLSConfig(&Config{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("Expected error for a missing CA file")
+	}
+}
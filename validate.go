@@ -0,0 +1,63 @@
+package tlsclouddatastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDomainLength is the longest domain name DNS allows.
+const maxDomainLength = 253
+
+// ValidationError is returned when a domain or email can't be used in a key
+// name, before anything is read or written. It matches ErrInvalidName with
+// errors.Is.
+type ValidationError struct {
+	Field  string // "domain" or "email"
+	Value  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// Is matches ErrInvalidName.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidName
+}
+
+// validDomain checks domain can be stored, so garbage hostnames, eg from
+// on-demand TLS probes, can't build malformed key names or ones that collide
+// with another record's.
+func validDomain(domain string) error {
+	if len(domain) > maxDomainLength {
+		return &ValidationError{Field: "domain", Value: domain, Reason: fmt.Sprintf("longer than %d bytes", maxDomainLength)}
+	}
+	return validName("domain", domain)
+}
+
+// validEmail checks email can be stored, like validDomain.
+func validEmail(email string) error {
+	return validName("email", email)
+}
+
+func validName(field, name string) error {
+	invalid := func(reason string) error {
+		return &ValidationError{Field: field, Value: name, Reason: reason}
+	}
+	switch {
+	case name == "":
+		return invalid("empty")
+	case strings.ContainsAny(name, `/\`):
+		// key names are paths, a slash would move the record
+		return invalid("contains a slash")
+	case strings.HasPrefix(name, ".") || strings.HasSuffix(name, "."):
+		return invalid("starts or ends with a dot")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return invalid("contains a control character")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package tlsclouddatastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// SiteWatchInterval is how often WatchSite reads a site to look for changes.
+const SiteWatchInterval = 10 * time.Second
+
+// SiteEvent is a change to a site seen by WatchSite.
+type SiteEvent struct {
+	Domain   string
+	Deleted  bool      // otherwise the site was stored
+	Modified time.Time // when the site was stored, zero if it was deleted
+}
+
+// WatchSite sends an event each time the site of domain is stored or
+// deleted, by this or another instance, eg to keep in-memory caches across a
+// cluster coherent. The site is read every SiteWatchInterval, so several
+// changes within one are seen as one, and only changes to the site itself are
+// reported, not its lock being taken or released. The channel is closed once
+// ctx is done or the storage is closed; it isn't buffered, so the next change
+// is only looked for once an event is received.
+func (cds *CloudDsStorage) WatchSite(ctx context.Context, domain string) (<-chan SiteEvent, error) {
+	version, _, err := cds.siteVersion(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan SiteEvent)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-cds.ctx.Done():
+				return
+			case <-cds.clock.After(SiteWatchInterval):
+			}
+
+			v, modified, err := cds.siteVersion(ctx, domain)
+			if err != nil {
+				log.Printf("[WARNING] Unable to watch site %v: %v", domain, err)
+				continue
+			}
+			if bytes.Equal(v, version) {
+				continue
+			}
+			version = v
+
+			e := SiteEvent{Domain: domain, Deleted: v == nil, Modified: modified}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			case <-cds.ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// siteVersion returns a digest of the site of domain that changes whenever
+// it's stored, but not when only its lock is, with when it was stored. Both
+// are nil and zero if there's no site.
+func (cds *CloudDsStorage) siteVersion(ctx context.Context, domain string) ([]byte, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, cds.timeout)
+	defer cancel()
+	r, err := cds.getSiteEntity(ctx, domain)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("Unable to obtain site data for %v: %w", domain, err)
+	}
+	if len(r.Value) == 0 && len(r.Cert) == 0 {
+		// only locked, before its first certificate is stored
+		return nil, time.Time{}, nil
+	}
+	// values are encrypted with a new nonce each time they're stored
+	h := sha256.New()
+	h.Write(r.Value)
+	h.Write(r.Cert)
+	return h.Sum(nil), r.Modified, nil
+}
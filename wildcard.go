@@ -0,0 +1,67 @@
+package tlsclouddatastore
+
+import (
+	"context"
+	"strings"
+)
+
+// wildcardLabel replaces `*` in key names. `*` isn't valid in a hostname so
+// the escaped form can't collide with a real domain, and it's the same
+// convention CertMagic uses for its storage keys.
+const wildcardLabel = "wildcard_"
+
+// escapeWildcard returns domain with any `*` replaced, so `*.example.com` is
+// stored under `wildcard_.example.com`.
+func escapeWildcard(domain string) string {
+	return strings.Replace(domain, "*", wildcardLabel, -1)
+}
+
+// unescapeWildcard reverses escapeWildcard.
+func unescapeWildcard(name string) string {
+	return strings.Replace(name, wildcardLabel, "*", -1)
+}
+
+// isWildcard reports whether domain is a wildcard name like `*.example.com`.
+func isWildcard(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
+
+// wildcardFor returns the wildcard name that would cover domain, e.g.
+// `*.example.com` for `www.example.com`. A wildcard only matches a single
+// label so there is at most one candidate, and none for a bare TLD.
+func wildcardFor(domain string) (string, bool) {
+	if isWildcard(domain) {
+		return "", false
+	}
+	i := strings.Index(domain, ".")
+	if i <= 0 || i == len(domain)-1 || !strings.Contains(domain[i+1:], ".") {
+		return "", false
+	}
+	return "*" + domain[i:], true
+}
+
+// CoveringWildcard returns the name of a stored wildcard site that covers
+// domain, eg `*.example.com` for `www.example.com`. The bool is false if no
+// such record exists.
+func (cds *CloudDsStorage) CoveringWildcard(domain string) (string, bool, error) {
+	ctx, cancel := cds.opContext()
+	defer cancel()
+	return cds.CoveringWildcardContext(ctx, domain)
+}
+
+// CoveringWildcardContext is CoveringWildcard with a caller supplied context.
+func (cds *CloudDsStorage) CoveringWildcardContext(ctx context.Context, domain string) (string, bool, error) {
+	wildcard, ok := wildcardFor(domain)
+	if !ok {
+		return "", false, nil
+	}
+
+	exists, err := cds.SiteExistsContext(ctx, wildcard)
+	if err != nil {
+		return "", false, err
+	}
+	if !exists {
+		return "", false, nil
+	}
+	return wildcard, true, nil
+}